@@ -0,0 +1,293 @@
+package market
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// Controller handles the market data endpoints. They're served from the in
+// memory stores, without making binance requests.
+type Controller struct {
+	tickers store.TickerSource
+	symbols store.SymbolListSource
+	klines  store.KlineSource
+	funding store.FundingSource
+}
+
+const (
+	// defaultKlinesLimit is how many klines are returned without a limit
+	// query parameter
+	defaultKlinesLimit = 100
+
+	// defaultFundingHistoryLimit is how many funding rates are returned
+	// without a limit query parameter
+	defaultFundingHistoryLimit = 100
+)
+
+// NewController returns a controller serving the tickers, symbols, klines and
+// funding rates from the stores.
+func NewController(
+	tickers store.TickerSource,
+	symbols store.SymbolListSource,
+	klines store.KlineSource,
+	funding store.FundingSource,
+) *Controller {
+	return &Controller{tickers: tickers, symbols: symbols, klines: klines, funding: funding}
+}
+
+// Symbol is a futures symbol's exchange info.
+type Symbol struct {
+	Symbol             string                    `json:"symbol"`
+	Pair               string                    `json:"pair"`
+	ContractType       futures.ContractType      `json:"contractType"`
+	Status             string                    `json:"status"`
+	BaseAsset          string                    `json:"baseAsset"`
+	QuoteAsset         string                    `json:"quoteAsset"`
+	MarginAsset        string                    `json:"marginAsset"`
+	PricePrecision     int                       `json:"pricePrecision"`
+	QuantityPrecision  int                       `json:"quantityPrecision"`
+	BaseAssetPrecision int                       `json:"baseAssetPrecision"`
+	QuotePrecision     int                       `json:"quotePrecision"`
+	OrderTypes         []futures.OrderType       `json:"orderTypes"`
+	TimeInForce        []futures.TimeInForceType `json:"timeInForce"`
+	Filters            []map[string]interface{}  `json:"filters"`
+}
+
+// tickerSorts are the values of the tickers sort query parameter, and the
+// ticker field each one sorts by.
+var tickerSorts = map[string]func(store.Ticker) string{
+	"changePercent": func(t store.Ticker) string { return t.PriceChangePercent },
+	"volume":        func(t store.Ticker) string { return t.Volume },
+	"quoteVolume":   func(t store.Ticker) string { return t.QuoteVolume },
+}
+
+// GetSymbols returns the exchange info of every symbol, including its
+// filters, precisions and status. The status query parameter only returns
+// the symbols with the status, e.g. TRADING.
+func (ctl *Controller) GetSymbols(c *gin.Context) {
+	status := c.Query("status")
+
+	symbols := make([]Symbol, 0)
+	for _, name := range ctl.symbols.GetSymbols() {
+		s, ok := ctl.symbols.GetSymbol(name)
+		if !ok || status != "" && s.Status != status {
+			continue
+		}
+		symbols = append(symbols, Symbol{
+			Symbol:             s.Symbol,
+			Pair:               s.Pair,
+			ContractType:       s.ContractType,
+			Status:             s.Status,
+			BaseAsset:          s.BaseAsset,
+			QuoteAsset:         s.QuoteAsset,
+			MarginAsset:        s.MarginAsset,
+			PricePrecision:     s.PricePrecision,
+			QuantityPrecision:  s.QuantityPrecision,
+			BaseAssetPrecision: s.BaseAssetPrecision,
+			QuotePrecision:     s.QuotePrecision,
+			OrderTypes:         s.OrderType,
+			TimeInForce:        s.TimeInForce,
+			Filters:            s.Filters,
+		})
+	}
+
+	c.JSON(http.StatusOK, symbols)
+}
+
+// GetTicker returns the symbol's 24hr ticker.
+func (ctl *Controller) GetTicker(c *gin.Context) {
+	symbol := c.Param("symbol")
+
+	ticker, ok := ctl.tickers.GetTicker(symbol)
+	if !ok {
+		middleware.Error(c, errors.NewSymbolNotFound(symbol))
+		return
+	}
+
+	c.JSON(http.StatusOK, ticker)
+}
+
+// GetTickers returns every symbol's 24hr ticker, sorted by symbol. The sort
+// query parameter sorts them by changePercent, volume or quoteVolume instead,
+// in descending order unless order is asc, and limit only returns the first
+// tickers.
+func (ctl *Controller) GetTickers(c *gin.Context) {
+	tickers := ctl.tickers.GetTickers()
+
+	if by := c.Query("sort"); by != "" {
+		field, ok := tickerSorts[by]
+		if !ok {
+			middleware.Error(c, errors.NewInvalidQuery("sort", "must be one of changePercent, volume, quoteVolume"))
+			return
+		}
+
+		order := c.DefaultQuery("order", "desc")
+		if order != "asc" && order != "desc" {
+			middleware.Error(c, errors.NewInvalidQuery("order", "must be either asc or desc"))
+			return
+		}
+
+		sort.SliceStable(tickers, func(i, j int) bool {
+			a, b := parse(field(tickers[i])), parse(field(tickers[j]))
+			if order == "asc" {
+				return a < b
+			}
+			return a > b
+		})
+	}
+
+	if param, ok := c.GetQuery("limit"); ok {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit < 1 {
+			middleware.Error(c, errors.NewInvalidQuery("limit", "must be a positive integer"))
+			return
+		}
+		if limit < len(tickers) {
+			tickers = tickers[:limit]
+		}
+	}
+
+	c.JSON(http.StatusOK, tickers)
+}
+
+// GetKlines returns the symbol's last klines of the interval, ordered by open
+// time, the last one being the current kline. The limit query parameter is
+// how many klines are returned, 100 by default and at most 500.
+func (ctl *Controller) GetKlines(c *gin.Context) {
+	symbol := c.Query("symbol")
+	if symbol == "" {
+		middleware.Error(c, errors.NewSymbolRequired())
+		return
+	}
+	if _, ok := ctl.symbols.GetSymbol(symbol); !ok {
+		middleware.Error(c, errors.NewSymbolNotFound(symbol))
+		return
+	}
+
+	interval := c.Query("interval")
+	if interval == "" {
+		middleware.Error(c, errors.NewInvalidQuery("interval", "query parameter is required"))
+		return
+	}
+
+	limit := defaultKlinesLimit
+	if param, ok := c.GetQuery("limit"); ok {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil {
+			middleware.Error(c, errors.NewInvalidQuery("limit", "must be an integer"))
+			return
+		}
+	}
+
+	klines, err := ctl.klines.GetKlines(c.Request.Context(), symbol, interval, limit)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, klines)
+}
+
+// GetFunding returns every symbol's mark price and current funding rate,
+// ranked by funding rate in descending order unless the order query
+// parameter is asc. limit only returns the first symbols.
+func (ctl *Controller) GetFunding(c *gin.Context) {
+	prices := ctl.funding.GetMarkPrices()
+
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		middleware.Error(c, errors.NewInvalidQuery("order", "must be either asc or desc"))
+		return
+	}
+
+	sort.SliceStable(prices, func(i, j int) bool {
+		a, b := parse(prices[i].FundingRate), parse(prices[j].FundingRate)
+		if order == "asc" {
+			return a < b
+		}
+		return a > b
+	})
+
+	if param, ok := c.GetQuery("limit"); ok {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit < 1 {
+			middleware.Error(c, errors.NewInvalidQuery("limit", "must be a positive integer"))
+			return
+		}
+		if limit < len(prices) {
+			prices = prices[:limit]
+		}
+	}
+
+	c.JSON(http.StatusOK, prices)
+}
+
+// GetFundingHistory returns the symbol's settled funding rates, oldest first.
+// The startTime and endTime query parameters bound their funding time in ms,
+// and limit is how many are returned, 100 by default and at most 1000.
+// Without a startTime the last funding rates are returned.
+func (ctl *Controller) GetFundingHistory(c *gin.Context) {
+	symbol := c.Query("symbol")
+	if symbol == "" {
+		middleware.Error(c, errors.NewSymbolRequired())
+		return
+	}
+	if _, ok := ctl.symbols.GetSymbol(symbol); !ok {
+		middleware.Error(c, errors.NewSymbolNotFound(symbol))
+		return
+	}
+
+	var startTime, endTime time.Time
+	for _, param := range []struct {
+		name string
+		time *time.Time
+	}{
+		{name: "startTime", time: &startTime},
+		{name: "endTime", time: &endTime},
+	} {
+		value, ok := c.GetQuery(param.name)
+		if !ok {
+			continue
+		}
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 {
+			middleware.Error(c, errors.NewInvalidQuery(param.name, "must be a timestamp in ms"))
+			return
+		}
+		*param.time = time.UnixMilli(ms)
+	}
+
+	limit := defaultFundingHistoryLimit
+	if param, ok := c.GetQuery("limit"); ok {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil {
+			middleware.Error(c, errors.NewInvalidQuery("limit", "must be an integer"))
+			return
+		}
+	}
+
+	history, err := ctl.funding.GetFundingHistory(c.Request.Context(), symbol, startTime, endTime, limit)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+// parse returns the float value of s, or 0 if it isn't a number, so tickers
+// without stats yet are sorted as 0.
+func parse(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
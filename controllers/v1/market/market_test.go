@@ -0,0 +1,351 @@
+package market
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTickers is a ticker source with fixed tickers by symbol.
+type fakeTickers map[string]store.Ticker
+
+func (t fakeTickers) GetTicker(symbol string) (store.Ticker, bool) {
+	ticker, ok := t[symbol]
+	return ticker, ok
+}
+
+func (t fakeTickers) GetTickers() []store.Ticker {
+	tickers := make([]store.Ticker, 0, len(t))
+	for _, ticker := range t {
+		tickers = append(tickers, ticker)
+	}
+	sort.Slice(tickers, func(i, j int) bool {
+		return tickers[i].Symbol < tickers[j].Symbol
+	})
+	return tickers
+}
+
+// fakeSymbols is a symbol list source with fixed exchange info by symbol.
+type fakeSymbols map[string]futures.Symbol
+
+func (s fakeSymbols) GetSymbol(symbol string) (futures.Symbol, bool) {
+	info, ok := s[symbol]
+	return info, ok
+}
+
+func (s fakeSymbols) GetSymbols() []string {
+	symbols := make([]string, 0, len(s))
+	for symbol := range s {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// fakeKlines is a kline source with a minute kline per minute since the
+// epoch, closing at the minute's number.
+type fakeKlines struct{}
+
+func (fakeKlines) GetKlines(ctx context.Context, symbol, interval string, limit int) ([]store.Kline, error) {
+	if interval != "1m" {
+		return nil, errors.NewValidationError("interval", "must be 1m")
+	}
+	if limit < 1 || limit > 500 {
+		return nil, errors.NewValidationError("limit", "must be between 1 and 500")
+	}
+	klines := make([]store.Kline, 0, limit)
+	for i := 0; i < limit; i++ {
+		klines = append(klines, store.Kline{
+			Symbol:   symbol,
+			Interval: interval,
+			OpenTime: time.UnixMilli(0).Add(time.Duration(i) * time.Minute),
+			Close:    strconv.Itoa(i),
+		})
+	}
+	return klines, nil
+}
+
+// fakeFunding is a funding source with fixed mark prices, whose history is a
+// funding rate every 8 hours since the epoch at the symbol's current rate.
+type fakeFunding []store.MarkPrice
+
+func (f fakeFunding) GetMarkPrices() []store.MarkPrice {
+	return append([]store.MarkPrice{}, f...)
+}
+
+func (f fakeFunding) GetFundingHistory(
+	ctx context.Context,
+	symbol string,
+	startTime time.Time,
+	endTime time.Time,
+	limit int,
+) ([]store.FundingRate, error) {
+	if limit < 1 || limit > 1000 {
+		return nil, errors.NewValidationError("limit", "must be between 1 and 1000")
+	}
+	var rate string
+	for _, price := range f {
+		if price.Symbol == symbol {
+			rate = price.FundingRate
+		}
+	}
+	history := make([]store.FundingRate, 0, limit)
+	for fundingTime := time.UnixMilli(0); len(history) < limit; fundingTime = fundingTime.Add(8 * time.Hour) {
+		if fundingTime.Before(startTime) {
+			continue
+		}
+		if !endTime.IsZero() && fundingTime.After(endTime) {
+			break
+		}
+		history = append(history, store.FundingRate{Symbol: symbol, FundingRate: rate, FundingTime: fundingTime})
+	}
+	return history, nil
+}
+
+// newTestRouter returns a router with the market routes served from fake
+// stores.
+func newTestRouter() *gin.Engine {
+	tickers := fakeTickers{
+		"BTCUSDT": {Symbol: "BTCUSDT", LastPrice: "60000", PriceChangePercent: "2.5", Volume: "100", QuoteVolume: "6000000"},
+		"ETHUSDT": {Symbol: "ETHUSDT", LastPrice: "4000", PriceChangePercent: "-1.2", Volume: "2000", QuoteVolume: "8000000"},
+		"TRXUSDT": {Symbol: "TRXUSDT", LastPrice: "0.1", PriceChangePercent: "7", Volume: "1000000", QuoteVolume: "100000"},
+	}
+	symbols := fakeSymbols{
+		"BTCUSDT": {Symbol: "BTCUSDT", Status: "TRADING", PricePrecision: 2, QuantityPrecision: 3},
+		"ETHUSDT": {Symbol: "ETHUSDT", Status: "TRADING", PricePrecision: 2, QuantityPrecision: 3},
+		"DOTUSDT": {Symbol: "DOTUSDT", Status: "SETTLING", PricePrecision: 3, QuantityPrecision: 1},
+	}
+	funding := fakeFunding{
+		{Symbol: "BTCUSDT", MarkPrice: "60010", FundingRate: "0.00010000"},
+		{Symbol: "ETHUSDT", MarkPrice: "4001", FundingRate: "0.00050000"},
+		{Symbol: "DOTUSDT", MarkPrice: "30", FundingRate: "-0.00020000"},
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.Errors())
+	m := NewController(tickers, symbols, fakeKlines{}, funding)
+	r.GET("/v1/market/symbols", m.GetSymbols)
+	r.GET("/v1/market/ticker/:symbol", m.GetTicker)
+	r.GET("/v1/market/tickers", m.GetTickers)
+	r.GET("/v1/market/klines", m.GetKlines)
+	r.GET("/v1/market/funding", m.GetFunding)
+	r.GET("/v1/market/funding/history", m.GetFundingHistory)
+	return r
+}
+
+// get returns the router's response to the GET request, decoding its body
+// into res.
+func get(t *testing.T, r *gin.Engine, url string, res interface{}) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	err := json.Unmarshal(w.Body.Bytes(), res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestGetSymbols(t *testing.T) {
+	r := newTestRouter()
+
+	var symbols []Symbol
+	w := get(t, r, "/v1/market/symbols", &symbols)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, symbols, 3)
+	assert.Equal(t, "BTCUSDT", symbols[0].Symbol, "sorted by symbol")
+	assert.Equal(t, 3, symbols[0].QuantityPrecision)
+
+	w = get(t, r, "/v1/market/symbols?status=SETTLING", &symbols)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []Symbol{{Symbol: "DOTUSDT", Status: "SETTLING", PricePrecision: 3, QuantityPrecision: 1}}, symbols)
+}
+
+func TestGetTicker(t *testing.T) {
+	r := newTestRouter()
+
+	var ticker store.Ticker
+	w := get(t, r, "/v1/market/ticker/BTCUSDT", &ticker)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "60000", ticker.LastPrice)
+
+	var res middleware.ErrorResponse
+	w = get(t, r, "/v1/market/ticker/FOOUSDT", &res)
+	assert.Equal(t, http.StatusNotFound, w.Code, "unknown symbol")
+	assert.Equal(t, errors.CodeNotFound, res.Code)
+}
+
+func TestGetTickers(t *testing.T) {
+	r := newTestRouter()
+
+	tests := []struct {
+		name            string
+		url             string
+		expectedSymbols []string
+	}{
+		{
+			name:            "sorted by symbol",
+			url:             "/v1/market/tickers",
+			expectedSymbols: []string{"BTCUSDT", "ETHUSDT", "TRXUSDT"},
+		},
+		{
+			name:            "top gainers",
+			url:             "/v1/market/tickers?sort=changePercent&limit=2",
+			expectedSymbols: []string{"TRXUSDT", "BTCUSDT"},
+		},
+		{
+			name:            "top losers",
+			url:             "/v1/market/tickers?sort=changePercent&order=asc&limit=1",
+			expectedSymbols: []string{"ETHUSDT"},
+		},
+		{
+			name:            "by quote volume",
+			url:             "/v1/market/tickers?sort=quoteVolume",
+			expectedSymbols: []string{"ETHUSDT", "BTCUSDT", "TRXUSDT"},
+		},
+		{
+			name:            "limit above the number of tickers",
+			url:             "/v1/market/tickers?sort=volume&limit=10",
+			expectedSymbols: []string{"TRXUSDT", "ETHUSDT", "BTCUSDT"},
+		},
+	}
+
+	for _, tc := range tests {
+		var tickers []store.Ticker
+		w := get(t, r, tc.url, &tickers)
+		assert.Equal(t, http.StatusOK, w.Code, tc.name)
+		symbols := make([]string, 0, len(tickers))
+		for _, ticker := range tickers {
+			symbols = append(symbols, ticker.Symbol)
+		}
+		assert.Equal(t, tc.expectedSymbols, symbols, tc.name)
+	}
+
+	for _, url := range []string{
+		"/v1/market/tickers?sort=price",
+		"/v1/market/tickers?sort=volume&order=up",
+		"/v1/market/tickers?limit=0",
+	} {
+		var res middleware.ErrorResponse
+		w := get(t, r, url, &res)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+		assert.Equal(t, errors.CodeValidation, res.Code, url)
+	}
+}
+
+func TestGetKlines(t *testing.T) {
+	r := newTestRouter()
+
+	var klines []store.Kline
+	w := get(t, r, "/v1/market/klines?symbol=BTCUSDT&interval=1m", &klines)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, klines, defaultKlinesLimit)
+
+	w = get(t, r, "/v1/market/klines?symbol=BTCUSDT&interval=1m&limit=3", &klines)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.Len(t, klines, 3) {
+		assert.Equal(t, "BTCUSDT", klines[0].Symbol)
+		assert.Equal(t, "2", klines[2].Close)
+	}
+
+	var res middleware.ErrorResponse
+	w = get(t, r, "/v1/market/klines?symbol=FOOUSDT&interval=1m", &res)
+	assert.Equal(t, http.StatusNotFound, w.Code, "unknown symbol")
+	assert.Equal(t, errors.CodeNotFound, res.Code)
+
+	for _, url := range []string{
+		"/v1/market/klines?interval=1m",
+		"/v1/market/klines?symbol=BTCUSDT",
+		"/v1/market/klines?symbol=BTCUSDT&interval=2m",
+		"/v1/market/klines?symbol=BTCUSDT&interval=1m&limit=ten",
+		"/v1/market/klines?symbol=BTCUSDT&interval=1m&limit=501",
+	} {
+		var res middleware.ErrorResponse
+		w := get(t, r, url, &res)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+		assert.Equal(t, errors.CodeValidation, res.Code, url)
+	}
+}
+
+func TestGetFunding(t *testing.T) {
+	r := newTestRouter()
+
+	symbols := func(prices []store.MarkPrice) []string {
+		var symbols []string
+		for _, price := range prices {
+			symbols = append(symbols, price.Symbol)
+		}
+		return symbols
+	}
+
+	var prices []store.MarkPrice
+	w := get(t, r, "/v1/market/funding", &prices)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"ETHUSDT", "BTCUSDT", "DOTUSDT"}, symbols(prices), "highest funding rate first")
+	assert.Equal(t, "4001", prices[0].MarkPrice)
+
+	w = get(t, r, "/v1/market/funding?order=asc&limit=2", &prices)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"DOTUSDT", "BTCUSDT"}, symbols(prices), "lowest funding rate first")
+
+	for _, url := range []string{
+		"/v1/market/funding?order=up",
+		"/v1/market/funding?limit=0",
+	} {
+		var res middleware.ErrorResponse
+		w := get(t, r, url, &res)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+		assert.Equal(t, errors.CodeValidation, res.Code, url)
+	}
+}
+
+func TestGetFundingHistory(t *testing.T) {
+	r := newTestRouter()
+
+	var history []store.FundingRate
+	w := get(t, r, "/v1/market/funding/history?symbol=ETHUSDT", &history)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.Len(t, history, defaultFundingHistoryLimit) {
+		assert.Equal(t, "0.00050000", history[0].FundingRate)
+	}
+
+	start := time.UnixMilli(0).Add(16 * time.Hour).UnixMilli()
+	end := time.UnixMilli(0).Add(40 * time.Hour).UnixMilli()
+	w = get(t, r, "/v1/market/funding/history?symbol=ETHUSDT&startTime="+strconv.FormatInt(start, 10)+"&endTime="+strconv.FormatInt(end, 10), &history)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.Len(t, history, 4) {
+		assert.Equal(t, start, history[0].FundingTime.UnixMilli())
+		assert.Equal(t, end, history[3].FundingTime.UnixMilli())
+	}
+
+	var res middleware.ErrorResponse
+	w = get(t, r, "/v1/market/funding/history?symbol=FOOUSDT", &res)
+	assert.Equal(t, http.StatusNotFound, w.Code, "unknown symbol")
+	assert.Equal(t, errors.CodeNotFound, res.Code)
+
+	for _, url := range []string{
+		"/v1/market/funding/history",
+		"/v1/market/funding/history?symbol=ETHUSDT&startTime=yesterday",
+		"/v1/market/funding/history?symbol=ETHUSDT&endTime=-1",
+		"/v1/market/funding/history?symbol=ETHUSDT&limit=ten",
+		"/v1/market/funding/history?symbol=ETHUSDT&limit=1001",
+	} {
+		var res middleware.ErrorResponse
+		w := get(t, r, url, &res)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+		assert.Equal(t, errors.CodeValidation, res.Code, url)
+	}
+}
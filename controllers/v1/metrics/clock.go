@@ -0,0 +1,13 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetClock returns the current offset from the binance server time and when
+// it was last measured.
+func (ctl *Controller) GetClock(c *gin.Context) {
+	c.JSON(http.StatusOK, ctl.clock.Status())
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/gin-gonic/gin"
+)
+
+// Ready returns the health of each store, with a service unavailable if one
+// of them isn't healthy, so the service isn't sent requests while its market
+// data is stale.
+func (ctl *Controller) Ready(c *gin.Context) {
+	ready := true
+	stores := make(map[string]store.Health, len(ctl.stores))
+	for name, source := range ctl.stores {
+		health := source.Health()
+		stores[name] = health
+		ready = ready && health.Healthy
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": ready, "stores": stores})
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/gin-gonic/gin"
+)
+
+// Controller handles the metrics endpoints.
+type Controller struct {
+	limiter *ratelimit.Limiter
+	clock   *clock.Clock
+	stores  map[string]store.HealthSource
+}
+
+// NewController returns a controller reporting the limiter's usage, the
+// clock's offset and the stores' health by name.
+func NewController(
+	limiter *ratelimit.Limiter,
+	clock *clock.Clock,
+	stores map[string]store.HealthSource,
+) *Controller {
+	return &Controller{limiter: limiter, clock: clock, stores: stores}
+}
+
+// GetRateLimits returns the current usage of the binance request weight and
+// order rate limits, and how many requests were delayed or rejected.
+func (ctl *Controller) GetRateLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, ctl.limiter.Usage())
+}
@@ -0,0 +1,327 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// upgrader accepts websocket connections from any origin, since the
+	// clients are authenticated by their token instead of cookies
+	upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	// writeTimeout is how long a client has to receive a message before it's
+	// disconnected
+	writeTimeout = 10 * time.Second
+
+	// pingInterval is how often a websocket client is pinged, or an event
+	// stream sent a keepalive comment
+	pingInterval = 30 * time.Second
+
+	// pongTimeout is how long a websocket client can go without answering a
+	// ping before it's disconnected
+	pongTimeout = 60 * time.Second
+
+	// maxRequestSize is the largest websocket request a client can send
+	maxRequestSize int64 = 64 * 1024
+)
+
+// Methods of the websocket requests.
+const (
+	MethodSubscribe         = "SUBSCRIBE"
+	MethodUnsubscribe       = "UNSUBSCRIBE"
+	MethodListSubscriptions = "LIST_SUBSCRIPTIONS"
+)
+
+// Controller handles the market data streams.
+type Controller struct {
+	hub     *marketstream.Hub
+	symbols store.SymbolInfoSource
+}
+
+// NewController returns a controller streaming the hub's events for the
+// symbols in the exchange info.
+func NewController(hub *marketstream.Hub, symbols store.SymbolInfoSource) *Controller {
+	return &Controller{hub: hub, symbols: symbols}
+}
+
+// Request is a websocket client's request to change or list its
+// subscriptions.
+type Request struct {
+	ID       int64    `json:"id"`
+	Method   string   `json:"method"`
+	Channels []string `json:"channels"`
+	Symbols  []string `json:"symbols"`
+}
+
+// Response is the response to a websocket client's request, with the
+// client's subscribed symbols of each channel or the error.
+type Response struct {
+	ID     int64                             `json:"id"`
+	Result map[marketstream.Channel][]string `json:"result"`
+	Error  *middleware.ErrorResponse         `json:"error,omitempty"`
+}
+
+// StreamTickers streams the market data events of the channels' symbols,
+// over a websocket if the request is a websocket upgrade, otherwise as
+// server-sent events. The channels and symbols query parameters are comma
+// separated lists of the initial subscriptions. Websocket clients can change
+// their subscriptions with requests, the server-sent events subscriptions
+// are fixed.
+func (ctl *Controller) StreamTickers(c *gin.Context) {
+	isWebSocket := websocket.IsWebSocketUpgrade(c.Request)
+	channels := split(c.Query("channels"))
+	symbols := split(c.Query("symbols"))
+	if !isWebSocket && len(channels) == 0 {
+		middleware.Error(c, errors.NewValidationError("channels", "query parameter is required"))
+		return
+	}
+
+	sub := ctl.hub.NewSubscription()
+	defer sub.Close()
+
+	if len(channels) > 0 || len(symbols) > 0 {
+		err := ctl.subscribe(sub, channels, symbols)
+		if err != nil {
+			middleware.Error(c, err)
+			return
+		}
+	}
+
+	if isWebSocket {
+		ctl.serveWebSocket(c, sub)
+		return
+	}
+	ctl.serveEvents(c, sub)
+}
+
+// serveEvents streams the subscription's events as server-sent events named
+// after their channel, until the client disconnects.
+func (ctl *Controller) serveEvents(c *gin.Context, sub *marketstream.Subscription) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Proxies shouldn't buffer the events
+	c.Header("X-Accel-Buffering", "no")
+	// The client is connected before the first event
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(pingInterval)
+	defer keepalive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepalive.C:
+			_, err := io.WriteString(w, ": keepalive\n\n")
+			return err == nil
+		case <-sub.Ready():
+			for _, event := range sub.Events() {
+				c.SSEvent(string(event.Channel), event)
+			}
+			return true
+		}
+	})
+
+	log.WithFields(log.Fields{
+		"RequestID": middleware.RequestID(c),
+		"Skipped":   sub.Skipped(),
+	}).Info("Event stream closed")
+}
+
+// serveWebSocket streams the subscription's events over a websocket and
+// handles the client's requests, until either side disconnects.
+func (ctl *Controller) serveWebSocket(c *gin.Context, sub *marketstream.Subscription) {
+	requestID := middleware.RequestID(c)
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, http.Header{"X-Request-ID": {requestID}})
+	if err != nil {
+		// The upgrader already responded with the error
+		log.WithField("RequestID", requestID).Warn(err)
+		return
+	}
+
+	responses := make(chan Response)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctl.read(conn, sub, requestID, responses, closed)
+	}()
+
+	err = ctl.write(conn, sub, responses, done)
+	close(closed)
+	conn.Close()
+	// The subscription is closed once the reader can't change it anymore
+	<-done
+
+	log.WithFields(log.Fields{
+		"RequestID": requestID,
+		"Skipped":   sub.Skipped(),
+	}).WithError(err).Info("Websocket stream closed")
+}
+
+// read handles the client's requests until the connection is closed,
+// sending their responses to the writer.
+func (ctl *Controller) read(
+	conn *websocket.Conn,
+	sub *marketstream.Subscription,
+	requestID string,
+	responses chan<- Response,
+	closed <-chan struct{},
+) {
+	conn.SetReadLimit(maxRequestSize)
+	_ = conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req Request
+		err = json.Unmarshal(message, &req)
+		res := Response{ID: req.ID}
+		if err == nil {
+			err = ctl.handle(sub, &req)
+		} else {
+			err = errors.NewInvalidBody(err)
+		}
+		if err != nil {
+			errRes := middleware.NewErrorResponse(err, requestID)
+			res.Error = &errRes
+		} else {
+			res.Result = sub.Topics()
+		}
+
+		select {
+		case responses <- res:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// handle changes the subscription as requested.
+func (ctl *Controller) handle(sub *marketstream.Subscription, req *Request) error {
+	switch req.Method {
+	case MethodSubscribe:
+		return ctl.subscribe(sub, req.Channels, req.Symbols)
+	case MethodUnsubscribe:
+		channels, err := parseChannels(req.Channels)
+		if err != nil {
+			return err
+		}
+		sub.Unsubscribe(channels, req.Symbols)
+		return nil
+	case MethodListSubscriptions:
+		return nil
+	}
+	return errors.NewValidationError("method", fmt.Sprintf(
+		"%q must be one of %s, %s, %s", req.Method, MethodSubscribe, MethodUnsubscribe, MethodListSubscriptions))
+}
+
+// write sends the subscription's events and the responses to the client,
+// and pings it, until the reader is done or a write fails.
+func (ctl *Controller) write(
+	conn *websocket.Conn,
+	sub *marketstream.Subscription,
+	responses <-chan Response,
+	done <-chan struct{},
+) error {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-done:
+			return nil
+		case res := <-responses:
+			err = writeJSON(conn, res)
+		case <-sub.Ready():
+			for _, event := range sub.Events() {
+				err = writeJSON(conn, event)
+				if err != nil {
+					break
+				}
+			}
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeJSON sends the message as json, failing if the client doesn't receive
+// it within the writeTimeout.
+func writeJSON(conn *websocket.Conn, message interface{}) error {
+	err := conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(message)
+}
+
+// subscribe subscribes to the channels' symbols, which have to be known.
+func (ctl *Controller) subscribe(sub *marketstream.Subscription, names []string, symbols []string) error {
+	channels, err := parseChannels(names)
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return errors.NewValidationError("channels", "at least one channel is required")
+	}
+	if len(symbols) == 0 {
+		return errors.NewValidationError("symbols", "at least one symbol is required")
+	}
+	for _, symbol := range symbols {
+		if _, ok := ctl.symbols.GetSymbol(symbol); !ok {
+			return errors.NewValidationError("symbols", fmt.Sprintf("unknown symbol %q", symbol))
+		}
+	}
+	return sub.Subscribe(channels, symbols)
+}
+
+// parseChannels returns the named channels.
+func parseChannels(names []string) ([]marketstream.Channel, error) {
+	channels := make([]marketstream.Channel, 0, len(names))
+	for _, name := range names {
+		channel, err := marketstream.ParseChannel(name)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// split returns the values of the comma separated list.
+func split(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,177 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSymbols is a symbol info source with only BTCUSDT and ETHUSDT.
+type fakeSymbols struct{}
+
+func (fakeSymbols) GetSymbol(symbol string) (futures.Symbol, bool) {
+	return futures.Symbol{Symbol: symbol}, symbol == "BTCUSDT" || symbol == "ETHUSDT"
+}
+
+// fakeStreams records the handlers of the connected upstream streams by
+// channel, so the tests can publish their events.
+type fakeStreams struct {
+	m        sync.Mutex
+	handlers map[marketstream.Channel]func(marketstream.Event)
+}
+
+func (f *fakeStreams) serve(
+	channel marketstream.Channel,
+	symbols []string,
+	handler func(marketstream.Event),
+	errHandler futures.ErrHandler,
+) (doneC, stopC chan struct{}, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.handlers[channel] = handler
+	return make(chan struct{}), make(chan struct{}), nil
+}
+
+// publish publishes the ticker once the ticker stream is connected.
+func (f *fakeStreams) publish(t *testing.T, symbol, price string) {
+	var handler func(marketstream.Event)
+	assert.Eventually(t, func() bool {
+		f.m.Lock()
+		defer f.m.Unlock()
+		handler = f.handlers[marketstream.ChannelTicker]
+		return handler != nil
+	}, time.Second, 10*time.Millisecond)
+	handler(marketstream.Event{
+		Channel: marketstream.ChannelTicker,
+		Symbol:  symbol,
+		Data:    store.Ticker{Symbol: symbol, LastPrice: price},
+	})
+}
+
+// newTestServer returns a server with the stream route and the fake
+// streams of its hub.
+func newTestServer(t *testing.T) (*httptest.Server, *fakeStreams) {
+	streams := &fakeStreams{handlers: make(map[marketstream.Channel]func(marketstream.Event))}
+	s := NewController(marketstream.NewHub(streams.serve), fakeSymbols{})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.Errors())
+	r.GET("/v1/stream/tickers", s.StreamTickers)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv, streams
+}
+
+// event is a streamed ticker event.
+type event struct {
+	Channel marketstream.Channel `json:"channel"`
+	Symbol  string               `json:"symbol"`
+	Data    store.Ticker         `json:"data"`
+}
+
+func TestEventStream(t *testing.T) {
+	srv, streams := newTestServer(t)
+
+	res, err := http.Get(srv.URL + "/v1/stream/tickers?channels=ticker&symbols=BTCUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	streams.publish(t, "ETHUSDT", "4000")
+	streams.publish(t, "BTCUSDT", "60000")
+
+	lines := bufio.NewScanner(res.Body)
+	lines.Scan()
+	assert.Equal(t, "event:ticker", lines.Text())
+	lines.Scan()
+	var e event
+	err = json.Unmarshal([]byte(strings.TrimPrefix(lines.Text(), "data:")), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "BTCUSDT", e.Symbol, "only the subscribed symbols")
+	assert.Equal(t, "60000", e.Data.LastPrice)
+
+	for _, url := range []string{
+		"/v1/stream/tickers?symbols=BTCUSDT",
+		"/v1/stream/tickers?channels=trades&symbols=BTCUSDT",
+		"/v1/stream/tickers?channels=ticker&symbols=FOOUSDT",
+	} {
+		res, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var errRes middleware.ErrorResponse
+		_ = json.NewDecoder(res.Body).Decode(&errRes)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, url)
+		assert.Equal(t, errors.CodeValidation, errRes.Code, url)
+	}
+}
+
+func TestWebSocketStream(t *testing.T) {
+	srv, streams := newTestServer(t)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/stream/tickers"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var res Response
+	err = conn.WriteJSON(Request{ID: 1, Method: MethodSubscribe, Channels: []string{"ticker"}, Symbols: []string{"BTCUSDT", "ETHUSDT"}})
+	assert.NoError(t, err)
+	err = conn.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, Response{ID: 1, Result: map[marketstream.Channel][]string{"ticker": {"BTCUSDT", "ETHUSDT"}}}, res)
+
+	streams.publish(t, "ETHUSDT", "4000")
+	var e event
+	err = conn.ReadJSON(&e)
+	assert.NoError(t, err)
+	assert.Equal(t, "ETHUSDT", e.Symbol)
+	assert.Equal(t, "4000", e.Data.LastPrice)
+
+	err = conn.WriteJSON(Request{ID: 2, Method: MethodUnsubscribe, Channels: []string{"ticker"}, Symbols: []string{"ETHUSDT"}})
+	assert.NoError(t, err)
+	res = Response{}
+	err = conn.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, map[marketstream.Channel][]string{"ticker": {"BTCUSDT"}}, res.Result)
+
+	err = conn.WriteJSON(Request{ID: 3, Method: MethodSubscribe, Channels: []string{"kline_2m"}, Symbols: []string{"BTCUSDT"}})
+	assert.NoError(t, err)
+	res = Response{}
+	err = conn.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), res.ID)
+	if assert.NotNil(t, res.Error, "invalid channel") {
+		assert.Equal(t, errors.CodeValidation, res.Error.Code)
+	}
+
+	err = conn.WriteJSON(Request{ID: 4, Method: "PING"})
+	assert.NoError(t, err)
+	res = Response{}
+	err = conn.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.NotNil(t, res.Error, "unknown method")
+}
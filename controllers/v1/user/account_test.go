@@ -41,7 +41,7 @@ func TestGetAccount(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	GetAccount(c)
+	newBinanceController().GetAccount(c)
 
 	assert.Equal(t, http.StatusOK, w.Code)
 
@@ -41,7 +41,7 @@ func TestGetBalance(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	GetBalance(c)
+	newBinanceController().GetBalance(c)
 
 	assert.Equal(t, http.StatusOK, w.Code)
 
@@ -0,0 +1,58 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// CreateBracketOrder creates a LIMIT or MARKET entry order for the user with
+// reduce only take profit and stop loss exit orders that are placed once the
+// entry order is filled. The response is successful once the entry order is
+// created, even if the exit orders are still being retried.
+func (ctl *Controller) CreateBracketOrder(c *gin.Context) {
+	var bot models.BracketBot
+
+	err := bindUser(c, &bot, &bot.User)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Side":  bot.Order.Side,
+		"Order": fmt.Sprintf("%#v\n", bot.Order),
+	}).Info("New bracket order")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&bot.User)
+	defer cancel()
+
+	res, err := client.CreateBracketOrder(ctx, &bot.Order)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"ID":            res.ID,
+		"Symbol":        res.Entry.Symbol,
+		"ClientOrderID": res.Entry.ClientOrderID,
+		"OrigQuantity":  res.Entry.OrigQuantity,
+	}).Info("Created bracket order")
+
+	if res.ExitError != "" {
+		log.WithFields(log.Fields{
+			"ID":        res.ID,
+			"ExitError": res.ExitError,
+		}).Warn("Bracket exit orders not placed yet, retrying")
+	}
+
+	c.JSON(http.StatusOK, res)
+}
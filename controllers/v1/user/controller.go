@@ -0,0 +1,40 @@
+package user
+
+import (
+	"github.com/bosdhill/golang-binance-service/core/models"
+	binance "github.com/bosdhill/golang-binance-service/libs/binancewrapper"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// Controller handles the user endpoints, making the requests to the user's
+// Exchange.
+type Controller struct {
+	exchange binance.ExchangeFactory
+}
+
+// NewController returns a controller that gets the user's Exchange from
+// exchange.
+func NewController(exchange binance.ExchangeFactory) *Controller {
+	return &Controller{exchange: exchange}
+}
+
+// bindUser binds the request body to obj and sets user to the user making the
+// request. That's the stored user if the request is authenticated with a
+// bearer token, in which case the body is optional, otherwise it's the user's
+// credentials in the body.
+func bindUser(c *gin.Context, obj interface{}, user *models.User) error {
+	_, stored, ok := middleware.StoredUser(c)
+	if !ok {
+		return c.BindJSON(obj)
+	}
+
+	if c.Request.ContentLength != 0 {
+		err := c.BindJSON(obj)
+		if err != nil {
+			return err
+		}
+	}
+	*user = *stored
+	return nil
+}
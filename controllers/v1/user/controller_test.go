@@ -0,0 +1,268 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	binance "github.com/bosdhill/golang-binance-service/libs/binancewrapper"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
+	"github.com/bosdhill/golang-binance-service/libs/store/info"
+	"github.com/bosdhill/golang-binance-service/libs/store/markprice"
+	"github.com/bosdhill/golang-binance-service/libs/store/orderbook"
+	"github.com/bosdhill/golang-binance-service/libs/store/stats"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newBinanceController returns a controller making the requests to binance.
+func newBinanceController() *Controller {
+	return NewController(binance.NewExchangeFactory(stats.NewStore(), info.NewStore(), orderbook.NewStore(), markprice.NewStore(), clock.NewClock()))
+}
+
+// fakeExchange is a fake binance.Exchange that records the orders it's sent.
+// Calling an unimplemented method panics.
+type fakeExchange struct {
+	binance.Exchange
+
+	user   *models.User
+	orders []*models.Order
+	err    error
+}
+
+// factory returns an ExchangeFactory that always returns the fake exchange.
+func (f *fakeExchange) factory() binance.ExchangeFactory {
+	return func(user *models.User) binance.Exchange {
+		f.user = user
+		return f
+	}
+}
+
+func (f *fakeExchange) CreateOrder(
+	ctx context.Context,
+	order *models.Order,
+) (*binance.OrderResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.orders = append(f.orders, order)
+	return &binance.OrderResponse{CreateOrderResponse: &futures.CreateOrderResponse{
+		Symbol:        order.Symbol,
+		Side:          order.Side,
+		Type:          order.Type,
+		ClientOrderID: order.NewClientOrderID,
+		OrigQuantity:  "0.1",
+		Status:        futures.OrderStatusTypeNew,
+	}}, nil
+}
+
+func (f *fakeExchange) GetOrder(
+	ctx context.Context,
+	symbol string,
+	orderID int64,
+	clientOrderID string,
+) (*futures.Order, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &futures.Order{Symbol: symbol, OrderID: orderID, ClientOrderID: clientOrderID}, nil
+}
+
+// serve returns the response of the handler for the route to a request with
+// the body as json. The errors are rendered by middleware.Errors.
+func serve(
+	t *testing.T,
+	route string,
+	handler gin.HandlerFunc,
+	method, url string,
+	body interface{},
+) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.Errors())
+	r.Handle(method, route, handler)
+
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateOrderWithFakeExchange(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int
+		expectedErr  errors.Code
+	}{
+		{
+			name:         "order created",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "validation error",
+			err:          errors.NewValidationError("leverage", "must be between 1 and 125"),
+			expectedCode: http.StatusBadRequest,
+			expectedErr:  errors.CodeValidation,
+		},
+		{
+			name:         "insufficient margin",
+			err:          &common.APIError{Code: -2019, Message: "Margin is insufficient."},
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedErr:  errors.CodeInsufficientBalance,
+		},
+		{
+			name:         "timeout",
+			err:          fmt.Errorf("create order: %w", context.DeadlineExceeded),
+			expectedCode: http.StatusGatewayTimeout,
+			expectedErr:  errors.CodeUpstreamTimeout,
+		},
+	}
+
+	for _, tc := range tests {
+		exchange := &fakeExchange{err: tc.err}
+		bot := models.Bot{
+			User: models.User{APIKey: "key", APISecret: "secret"},
+			Order: models.Order{
+				Type:       futures.OrderTypeMarket,
+				Symbol:     "BTCUSDT",
+				Side:       futures.SideTypeBuy,
+				Percentage: 0.1,
+			},
+		}
+		w := serve(t, "/v1/user/order", NewController(exchange.factory()).CreateOrder, "POST", "/v1/user/order", bot)
+
+		assert.Equal(t, tc.expectedCode, w.Code, tc.name)
+		assert.Equal(t, "key", exchange.user.APIKey, tc.name)
+		if tc.err == nil {
+			assert.Len(t, exchange.orders, 1, tc.name)
+			assert.Equal(t, bot.Order.Symbol, exchange.orders[0].Symbol, tc.name)
+			continue
+		}
+
+		var res middleware.ErrorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.expectedErr, res.Code, tc.name)
+		assert.NotEmpty(t, res.RequestID, tc.name)
+	}
+}
+
+func TestGetOrderWithFakeExchange(t *testing.T) {
+	tests := []struct {
+		name                  string
+		url                   string
+		expectedCode          int
+		expectedOrderID       int64
+		expectedClientOrderID string
+	}{
+		{
+			name:            "get order by orderId",
+			url:             "/v1/user/order/42?symbol=BTCUSDT",
+			expectedCode:    http.StatusOK,
+			expectedOrderID: 42,
+		},
+		{
+			name:                  "get order by clientOrderId",
+			url:                   "/v1/user/order/bkt01-e?symbol=BTCUSDT&idType=clientOrderId",
+			expectedCode:          http.StatusOK,
+			expectedClientOrderID: "bkt01-e",
+		},
+		{
+			name:                  "get order by numeric clientOrderId",
+			url:                   "/v1/user/order/12345?symbol=BTCUSDT&idType=clientOrderId",
+			expectedCode:          http.StatusOK,
+			expectedClientOrderID: "12345",
+		},
+		{
+			name:         "clientOrderId without idType",
+			url:          "/v1/user/order/bkt01-e?symbol=BTCUSDT",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "invalid idType",
+			url:          "/v1/user/order/42?symbol=BTCUSDT&idType=id",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "symbol required",
+			url:          "/v1/user/order/42",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		exchange := &fakeExchange{}
+		w := serve(t, "/v1/user/order/:id", NewController(exchange.factory()).GetOrder, "GET", tc.url,
+			models.User{APIKey: "key", APISecret: "secret"})
+
+		assert.Equal(t, tc.expectedCode, w.Code, tc.name)
+		if tc.expectedCode != http.StatusOK {
+			continue
+		}
+
+		var got futures.Order
+		err := json.Unmarshal(w.Body.Bytes(), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.expectedOrderID, got.OrderID, tc.name)
+		assert.Equal(t, tc.expectedClientOrderID, got.ClientOrderID, tc.name)
+	}
+}
+
+func TestGetOrderWithStoredUser(t *testing.T) {
+	v, err := vault.New(filepath.Join(t.TempDir(), "vault.json"), []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := v.Register(&models.User{APIKey: "storedkey", APISecret: "storedsecret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := &fakeExchange{}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.Errors())
+	r.GET("/v1/user/order/:id", middleware.Credentials(v), NewController(exchange.factory()).GetOrder)
+
+	// The request doesn't have a body with the user's credentials
+	req, err := http.NewRequest("GET", "/v1/user/order/42?symbol=BTCUSDT", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+reg.Token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "storedkey", exchange.user.APIKey)
+	assert.Equal(t, "storedsecret", exchange.user.APISecret)
+
+	req.Header.Set("Authorization", "Bearer "+reg.ID+".wrong")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "invalid token")
+}
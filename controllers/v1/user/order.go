@@ -4,32 +4,27 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
 	"github.com/bosdhill/golang-binance-service/core/errors"
 	"github.com/bosdhill/golang-binance-service/core/models"
-	binance "github.com/bosdhill/golang-binance-service/libs/binancewrapper"
+	"github.com/bosdhill/golang-binance-service/middleware"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
 var timeout = 1 * time.Minute
 
-// CancelAllOrders closes all futures orders for the user
-func CancelAllOrders(c *gin.Context) {
-	// TODO
-}
-
 // CreateOrder creates the futures order for the user. The order types are:
 // MARKET, LIMIT, and STOP_MARKET
-func CreateOrder(c *gin.Context) {
+func (ctl *Controller) CreateOrder(c *gin.Context) {
 	var bot models.Bot
 
-	err := c.BindJSON(&bot)
+	err := bindUser(c, &bot, &bot.User)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, err)
-		log.Error(err)
+		middleware.Error(c, errors.NewInvalidBody(err))
 		return
 	}
 
@@ -39,19 +34,12 @@ func CreateOrder(c *gin.Context) {
 	}).Info("New order")
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	client := binance.NewClient(&bot.User)
+	client := ctl.exchange(&bot.User)
 	defer cancel()
 
 	orderResp, err := client.CreateOrder(ctx, &bot.Order)
 	if err != nil {
-		if common.IsAPIError(err) {
-			apiErr := errors.NewAPIError(err)
-			c.JSON(int(apiErr.Code), errors.NewAPIError(err))
-		} else {
-			c.JSON(http.StatusInternalServerError, err)
-		}
-
-		log.Error(err)
+		middleware.Error(c, err)
 		return
 	}
 
@@ -64,3 +52,206 @@ func CreateOrder(c *gin.Context) {
 
 	c.JSON(http.StatusOK, orderResp)
 }
+
+// ListOrders returns the user's futures orders. The status query parameter is
+// either "open" (default) for open orders, optionally filtered by symbol, or
+// "all" for the order history of a symbol, limited by the limit query
+// parameter.
+func (ctl *Controller) ListOrders(c *gin.Context) {
+	var user models.User
+
+	err := bindUser(c, &user, &user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	symbol := c.Query("symbol")
+	status := c.DefaultQuery("status", "open")
+	if status != "open" && status != "all" {
+		middleware.Error(c, errors.NewInvalidOrderStatus(status))
+		return
+	}
+
+	if status == "all" && symbol == "" {
+		middleware.Error(c, errors.NewSymbolRequired())
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidQuery("limit", "must be an integer"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&user)
+	defer cancel()
+
+	var res []*futures.Order
+	if status == "open" {
+		res, err = client.ListOpenOrders(ctx, symbol)
+	} else {
+		res, err = client.ListOrders(ctx, symbol, limit)
+	}
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Symbol": symbol,
+		"Status": status,
+		"Orders": len(res),
+	}).Info("Listed orders")
+
+	c.JSON(http.StatusOK, res)
+}
+
+// GetOrder returns the user's futures order for the symbol query parameter.
+// The id path parameter is the orderId, or the clientOrderId if the idType
+// query parameter is clientOrderId.
+func (ctl *Controller) GetOrder(c *gin.Context) {
+	var user models.User
+
+	err := bindUser(c, &user, &user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	symbol := c.Query("symbol")
+	if symbol == "" {
+		middleware.Error(c, errors.NewSymbolRequired())
+		return
+	}
+
+	orderID, clientOrderID, err := parseOrderID(c)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&user)
+	defer cancel()
+
+	res, err := client.GetOrder(ctx, symbol, orderID, clientOrderID)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Symbol":        res.Symbol,
+		"OrderID":       res.OrderID,
+		"ClientOrderID": res.ClientOrderID,
+		"Status":        res.Status,
+	}).Info("Got order")
+
+	c.JSON(http.StatusOK, res)
+}
+
+// CancelOrder cancels the user's open futures order for the symbol query
+// parameter. The id path parameter is the orderId, or the clientOrderId if the
+// idType query parameter is clientOrderId.
+func (ctl *Controller) CancelOrder(c *gin.Context) {
+	var user models.User
+
+	err := bindUser(c, &user, &user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	symbol := c.Query("symbol")
+	if symbol == "" {
+		middleware.Error(c, errors.NewSymbolRequired())
+		return
+	}
+
+	orderID, clientOrderID, err := parseOrderID(c)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&user)
+	defer cancel()
+
+	res, err := client.CancelOrder(ctx, symbol, orderID, clientOrderID)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// CancelOrders cancels the user's open futures orders for the symbol query
+// parameter. If the request body lists orderIds or clientOrderIds only those
+// orders are cancelled, otherwise all open orders for the symbol are cancelled.
+func (ctl *Controller) CancelOrders(c *gin.Context) {
+	var cancellation models.OrderCancellation
+
+	err := bindUser(c, &cancellation, &cancellation.User)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	symbol := c.Query("symbol")
+	if symbol == "" {
+		middleware.Error(c, errors.NewSymbolRequired())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&cancellation.User)
+	defer cancel()
+
+	if len(cancellation.OrderIDs) == 0 && len(cancellation.ClientOrderIDs) == 0 {
+		err = client.CancelAllOrders(ctx, symbol)
+		if err != nil {
+			middleware.Error(c, err)
+			return
+		}
+
+		log.WithField("Symbol", symbol).Info("Cancelled all orders")
+
+		c.JSON(http.StatusOK, gin.H{"symbol": symbol})
+		return
+	}
+
+	res, err := client.CancelMultipleOrders(
+		ctx,
+		symbol,
+		cancellation.OrderIDs,
+		cancellation.ClientOrderIDs,
+	)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// parseOrderID returns the orderId or the clientOrderId of the id path
+// parameter, depending on the idType query parameter. The id is the orderId by
+// default, since a clientOrderId can be numeric too.
+func parseOrderID(c *gin.Context) (int64, string, error) {
+	id := c.Param("id")
+	switch c.DefaultQuery("idType", "orderId") {
+	case "orderId":
+		orderID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return 0, "", errors.NewValidationError("id", "must be an integer orderId, or set idType=clientOrderId")
+		}
+		return orderID, "", nil
+	case "clientOrderId":
+		return 0, id, nil
+	}
+	return 0, "", errors.NewInvalidQuery("idType", "must be either orderId or clientOrderId")
+}
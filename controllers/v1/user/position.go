@@ -0,0 +1,142 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetPositionMode returns the user's position mode, either hedge mode
+// (dualSidePosition=true) or one-way mode (dualSidePosition=false)
+func (ctl *Controller) GetPositionMode(c *gin.Context) {
+	var user models.User
+
+	err := bindUser(c, &user, &user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&user)
+	defer cancel()
+
+	res, err := client.GetPositionMode(ctx)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithField("DualSidePosition", res.DualSidePosition).Info("Got Position Mode")
+
+	c.JSON(http.StatusOK, res)
+}
+
+// ChangePositionMode changes the user's position mode to hedge mode if
+// dualSidePosition is true, otherwise to one-way mode
+func (ctl *Controller) ChangePositionMode(c *gin.Context) {
+	var mode models.PositionMode
+
+	err := bindUser(c, &mode, &mode.User)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&mode.User)
+	defer cancel()
+
+	err = client.ChangePositionMode(ctx, mode.DualSidePosition)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dualSidePosition": mode.DualSidePosition})
+}
+
+// ListPositions returns the user's non-zero positions with their risk metrics.
+// The symbol query parameter only returns the symbol's positions and the
+// minNotional query parameter leaves out positions with a smaller notional.
+func (ctl *Controller) ListPositions(c *gin.Context) {
+	var user models.User
+
+	err := bindUser(c, &user, &user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	symbol := c.Query("symbol")
+	minNotional, err := strconv.ParseFloat(c.DefaultQuery("minNotional", "0"), 64)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidQuery("minNotional", "must be a number"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&user)
+	defer cancel()
+
+	res, err := client.ListPositions(ctx, symbol, minNotional)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"Symbol":      symbol,
+		"MinNotional": minNotional,
+		"Positions":   len(res),
+	}).Info("Listed positions")
+
+	c.JSON(http.StatusOK, res)
+}
+
+// ClosePositions closes the user's positions for the symbol query parameter,
+// or every open position if it isn't set. Each symbol's open orders are
+// cancelled and its positions closed with MARKET orders. Responds with the
+// result of each symbol, with a multi-status if a symbol isn't flat.
+func (ctl *Controller) ClosePositions(c *gin.Context) {
+	var user models.User
+
+	err := bindUser(c, &user, &user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	symbol := c.Query("symbol")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	client := ctl.exchange(&user)
+	defer cancel()
+
+	res, err := client.ClosePositions(ctx, symbol)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	for _, result := range res {
+		if !result.Flat {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"Symbol":  symbol,
+		"Symbols": len(res),
+		"Status":  status,
+	}).Info("Closed positions")
+
+	c.JSON(status, res)
+}
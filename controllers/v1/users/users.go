@@ -0,0 +1,117 @@
+package users
+
+import (
+	"net/http"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Controller handles the registration of users whose credentials are stored
+// in the vault.
+type Controller struct {
+	vault *vault.Vault
+}
+
+// NewController returns a controller storing the users in the vault.
+func NewController(vault *vault.Vault) *Controller {
+	return &Controller{vault: vault}
+}
+
+// Register stores the user's api key and secret, and responds with the
+// user's ID and the bearer token authenticating the user's requests. The
+// token isn't stored, so it can't be returned again.
+func (ctl *Controller) Register(c *gin.Context) {
+	var user models.User
+
+	err := c.BindJSON(&user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	if user.APIKey == "" || user.APISecret == "" {
+		middleware.Error(c, errors.NewValidationError("api_key", "api_key and api_secret are required"))
+		return
+	}
+
+	res, err := ctl.vault.Register(&user)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithField("ID", res.ID).Info("Registered user")
+
+	c.JSON(http.StatusCreated, res)
+}
+
+// RotateKeys replaces the stored api key and secret of the user the request
+// is authenticated as. The bearer token stays valid.
+func (ctl *Controller) RotateKeys(c *gin.Context) {
+	id, err := authorize(c)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	var user models.User
+
+	err = c.BindJSON(&user)
+	if err != nil {
+		middleware.Error(c, errors.NewInvalidBody(err))
+		return
+	}
+
+	if user.APIKey == "" || user.APISecret == "" {
+		middleware.Error(c, errors.NewValidationError("api_key", "api_key and api_secret are required"))
+		return
+	}
+
+	err = ctl.vault.Rotate(id, user.APIKey, user.APISecret)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithField("ID", id).Info("Rotated user keys")
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// DeleteUser deletes the stored credentials of the user the request is
+// authenticated as, revoking the bearer token.
+func (ctl *Controller) DeleteUser(c *gin.Context) {
+	id, err := authorize(c)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	err = ctl.vault.Delete(id)
+	if err != nil {
+		middleware.Error(c, err)
+		return
+	}
+
+	log.WithField("ID", id).Info("Deleted user")
+
+	c.Status(http.StatusNoContent)
+}
+
+// authorize returns the id path parameter if the request is authenticated as
+// that user.
+func authorize(c *gin.Context) (string, error) {
+	id, _, err := middleware.RequireStoredUser(c)
+	if err != nil {
+		return "", err
+	}
+	if id != c.Param("id") {
+		return "", errors.NewForbiddenUser(c.Param("id"))
+	}
+	return id, nil
+}
@@ -0,0 +1,95 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRouter returns a router with the users routes storing the users in a
+// temporary vault.
+func newTestRouter(t *testing.T) (*gin.Engine, *vault.Vault) {
+	v, err := vault.New(filepath.Join(t.TempDir(), "vault.json"), []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.Errors())
+	u := NewController(v)
+	credentials := middleware.Credentials(v)
+	r.POST("/v1/users", u.Register)
+	r.PUT("/v1/users/:id/keys", credentials, u.RotateKeys)
+	r.DELETE("/v1/users/:id", credentials, u.DeleteUser)
+	return r, v
+}
+
+// serve returns the router's response to the request with the body as json
+// and the bearer token, if it's set.
+func serve(t *testing.T, r *gin.Engine, method, url, token string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUserLifecycle(t *testing.T) {
+	r, v := newTestRouter(t)
+
+	w := serve(t, r, "POST", "/v1/users", "", models.User{APIKey: "apikey", APISecret: "apisecret"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var reg vault.Registration
+	err := json.Unmarshal(w.Body.Bytes(), &reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(t, r, "PUT", "/v1/users/"+reg.ID+"/keys", "", models.User{APIKey: "newkey", APISecret: "newsecret"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "token required")
+
+	w = serve(t, r, "PUT", "/v1/users/other/keys", reg.Token, models.User{APIKey: "newkey", APISecret: "newsecret"})
+	assert.Equal(t, http.StatusForbidden, w.Code, "other user")
+
+	w = serve(t, r, "PUT", "/v1/users/"+reg.ID+"/keys", reg.Token, models.User{APIKey: "newkey", APISecret: "newsecret"})
+	assert.Equal(t, http.StatusOK, w.Code, "keys rotated")
+	user, err := v.Get(reg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "newkey", user.APIKey)
+
+	w = serve(t, r, "DELETE", "/v1/users/"+reg.ID, reg.Token, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code, "user deleted")
+
+	w = serve(t, r, "DELETE", "/v1/users/"+reg.ID, reg.Token, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "token revoked")
+}
+
+func TestRegisterRequiresCredentials(t *testing.T) {
+	r, _ := newTestRouter(t)
+	w := serve(t, r, "POST", "/v1/users", "", models.User{APIKey: "apikey"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,95 @@
+package errors
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/adshao/go-binance/v2/common"
+)
+
+// binanceError is the HTTP status and code a binance error code is
+// responded with.
+type binanceError struct {
+	status int
+	code   Code
+}
+
+// binanceErrors maps the binance error codes to the service's responses.
+// Codes that aren't listed are mapped by their range, see NewExchangeError.
+// See https://binance-docs.github.io/apidocs/futures/en/#error-codes
+var binanceErrors = map[int64]binanceError{
+	// The response wasn't an api error, e.g. a 5xx from the gateway
+	0: {http.StatusBadGateway, CodeUpstreamError},
+
+	-1000: {http.StatusBadGateway, CodeUpstreamError},                // UNKNOWN
+	-1001: {http.StatusBadGateway, CodeUpstreamError},                // DISCONNECTED
+	-1002: {http.StatusUnauthorized, CodeExchangeUnauthorized},       // UNAUTHORIZED
+	-1003: {http.StatusTooManyRequests, CodeRateLimited},             // TOO_MANY_REQUESTS
+	-1006: {http.StatusBadGateway, CodeUpstreamError},                // UNEXPECTED_RESP
+	-1007: {http.StatusGatewayTimeout, CodeUpstreamTimeout},          // TIMEOUT
+	-1008: {http.StatusServiceUnavailable, CodeUpstreamError},        // SERVER_BUSY
+	-1015: {http.StatusTooManyRequests, CodeRateLimited},             // TOO_MANY_ORDERS
+	-1016: {http.StatusServiceUnavailable, CodeUpstreamError},        // SERVICE_SHUTTING_DOWN
+	-1021: {http.StatusBadGateway, CodeUpstreamError},                // INVALID_TIMESTAMP
+	-1022: {http.StatusUnauthorized, CodeExchangeUnauthorized},       // INVALID_SIGNATURE
+	-1121: {http.StatusBadRequest, CodeExchangeRejected},             // BAD_SYMBOL
+	-2010: {http.StatusUnprocessableEntity, CodeExchangeRejected},    // NEW_ORDER_REJECTED
+	-2011: {http.StatusUnprocessableEntity, CodeExchangeRejected},    // CANCEL_REJECTED
+	-2013: {http.StatusNotFound, CodeNotFound},                       // NO_SUCH_ORDER
+	-2014: {http.StatusUnauthorized, CodeExchangeUnauthorized},       // BAD_API_KEY_FMT
+	-2015: {http.StatusUnauthorized, CodeExchangeUnauthorized},       // REJECTED_MBX_KEY
+	-2018: {http.StatusUnprocessableEntity, CodeInsufficientBalance}, // BALANCE_NOT_SUFFICIENT
+	-2019: {http.StatusUnprocessableEntity, CodeInsufficientBalance}, // MARGIN_NOT_SUFFICIEN
+	-2021: {http.StatusUnprocessableEntity, CodeExchangeRejected},    // ORDER_WOULD_IMMEDIATELY_TRIGGER
+	-2022: {http.StatusUnprocessableEntity, CodeExchangeRejected},    // REDUCE_ONLY_REJECT
+	-4046: {http.StatusConflict, CodeExchangeRejected},               // NO_NEED_TO_CHANGE_MARGIN_TYPE
+	-4059: {http.StatusConflict, CodeExchangeRejected},               // NO_NEED_TO_CHANGE_POSITION_SIDE
+	-4164: {http.StatusUnprocessableEntity, CodeExchangeRejected},    // MIN_NOTIONAL
+}
+
+// ExchangeError is returned when binance responds with an api error.
+type ExchangeError struct {
+	// Code and Message are binance's error code and message
+	Code    int64  `json:"code"`
+	Message string `json:"msg"`
+
+	apiErr *common.APIError
+	status int
+	code   Code
+}
+
+func (e *ExchangeError) Error() string {
+	return fmt.Sprintf("binance error %d: %s", e.Code, e.Message)
+}
+
+func (e *ExchangeError) Unwrap() error {
+	return e.apiErr
+}
+
+func (e *ExchangeError) Status() int {
+	return e.status
+}
+
+func (e *ExchangeError) ErrorCode() Code {
+	return e.code
+}
+
+// NewExchangeError returns the binance api error with its HTTP status and
+// code. Unlisted codes in the -1100 range are bad parameters, other unlisted
+// codes below -2000 are rejections of the request, and the rest are upstream
+// errors.
+func NewExchangeError(apiErr *common.APIError) *ExchangeError {
+	e := &ExchangeError{Code: apiErr.Code, Message: apiErr.Message, apiErr: apiErr}
+	mapped, ok := binanceErrors[apiErr.Code]
+	switch {
+	case ok:
+	case apiErr.Code <= -1100 && apiErr.Code > -1200:
+		mapped = binanceError{http.StatusBadRequest, CodeExchangeRejected}
+	case apiErr.Code <= -2000:
+		mapped = binanceError{http.StatusUnprocessableEntity, CodeExchangeRejected}
+	default:
+		mapped = binanceError{http.StatusBadGateway, CodeUpstreamError}
+	}
+	e.status, e.code = mapped.status, mapped.code
+	return e
+}
@@ -1,11 +1,70 @@
 package errors
 
 import (
+	"context"
 	err "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/adshao/go-binance/v2/common"
 )
 
+// Code is the stable code of a kind of error, which clients can match on
+// instead of the error message.
+type Code string
+
+const (
+	CodeValidation           Code = "VALIDATION_FAILED"
+	CodeFilter               Code = "FILTER_FAILED"
+	CodeInsufficientBalance  Code = "INSUFFICIENT_BALANCE"
+	CodeExchangeRejected     Code = "EXCHANGE_REJECTED"
+	CodeExchangeUnauthorized Code = "EXCHANGE_UNAUTHORIZED"
+	CodeRateLimited          Code = "RATE_LIMITED"
+	CodeUpstreamTimeout      Code = "UPSTREAM_TIMEOUT"
+	CodeUpstreamError        Code = "UPSTREAM_ERROR"
+	CodeStaleData            Code = "STALE_DATA"
+	CodeSlippageExceeded     Code = "SLIPPAGE_EXCEEDED"
+	CodeNotFound             Code = "NOT_FOUND"
+	CodeUnauthorized         Code = "UNAUTHORIZED"
+	CodeForbidden            Code = "FORBIDDEN"
+	CodeInternal             Code = "INTERNAL"
+)
+
+// ServiceError is an error the service responds with. Every error type in
+// this package is one, other errors are internal errors, see AsServiceError.
+type ServiceError interface {
+	error
+
+	// Status is the HTTP status of the response
+	Status() int
+
+	// ErrorCode is the stable code of the kind of error
+	ErrorCode() Code
+}
+
+// AsServiceError returns the ServiceError in e's chain. Binance api errors are
+// mapped by their code, see NewExchangeError, and timeouts are upstream
+// timeouts. Any other error is an internal error, so its message isn't
+// exposed.
+func AsServiceError(e error) ServiceError {
+	var serviceErr ServiceError
+	if err.As(e, &serviceErr) {
+		return serviceErr
+	}
+	var apiErr *common.APIError
+	if err.As(e, &apiErr) {
+		return NewExchangeError(apiErr)
+	}
+	var netErr net.Error
+	if err.Is(e, context.DeadlineExceeded) || err.As(e, &netErr) && netErr.Timeout() {
+		return &TimeoutError{err: e}
+	}
+	return &InternalError{err: e}
+}
+
 func NewAPIError(e error) *common.APIError {
 	if common.IsAPIError(e) {
 		apiArror, _ := e.(*common.APIError)
@@ -14,10 +73,385 @@ func NewAPIError(e error) *common.APIError {
 	return nil
 }
 
+// InsufficientBalanceError is returned when the user's balance or margin
+// isn't enough for the order.
+type InsufficientBalanceError struct {
+	Reason string `json:"reason"`
+}
+
+func (e *InsufficientBalanceError) Error() string {
+	return e.Reason
+}
+
+func (e *InsufficientBalanceError) Status() int {
+	return http.StatusUnprocessableEntity
+}
+
+func (e *InsufficientBalanceError) ErrorCode() Code {
+	return CodeInsufficientBalance
+}
+
 func NewNoUSDTBalance() error {
-	return err.New("no USDT balance")
+	return &InsufficientBalanceError{Reason: "no USDT balance"}
 }
 
 func NewPositionSizeInvalid() error {
-	return err.New("position size invalid, either 0.0 or exceeded max size")
+	return &ValidationError{Field: "percentage", Reason: "position size is either 0 or exceeds the max size"}
+}
+
+func NewSymbolRequired() error {
+	return &ValidationError{Field: "symbol", Reason: "query parameter is required"}
+}
+
+func NewInvalidOrderStatus(status string) error {
+	return &ValidationError{Field: "status", Reason: fmt.Sprintf("%q must be either open or all", status)}
+}
+
+func NewInvalidBracketOrder() error {
+	return &ValidationError{
+		Field:  "order",
+		Reason: "bracket order entry must be LIMIT or MARKET with takeProfitPrice and stopLossPrice",
+	}
+}
+
+// NewInvalidBody returns a validation error for a request body that couldn't
+// be decoded.
+func NewInvalidBody(e error) error {
+	return &ValidationError{Field: "body", Reason: e.Error()}
+}
+
+// NewInvalidQuery returns a validation error for a query parameter that
+// couldn't be parsed.
+func NewInvalidQuery(param, reason string) error {
+	return &ValidationError{Field: param, Reason: reason}
+}
+
+// FilterError is returned when an order is rejected before being sent to
+// binance because it doesn't pass one of the symbol's filters.
+type FilterError struct {
+	Symbol string `json:"symbol"`
+	Filter string `json:"filter,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (e *FilterError) Error() string {
+	if e.Filter == "" {
+		return fmt.Sprintf("%s: %s", e.Symbol, e.Reason)
+	}
+	return fmt.Sprintf("%s %s filter failed: %s", e.Symbol, e.Filter, e.Reason)
+}
+
+func (e *FilterError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *FilterError) ErrorCode() Code {
+	return CodeFilter
+}
+
+func NewFilterError(symbol, filter, reason string) error {
+	return &FilterError{Symbol: symbol, Filter: filter, Reason: reason}
+}
+
+// AsFilterError returns the FilterError in e's chain, if there is one.
+func AsFilterError(e error) (*FilterError, bool) {
+	var filterErr *FilterError
+	ok := err.As(e, &filterErr)
+	return filterErr, ok
+}
+
+func NewUnknownSymbol(symbol string) error {
+	return &FilterError{Symbol: symbol, Reason: "unknown symbol"}
+}
+
+// NewSymbolNotTrading returns a filter error for an order on a symbol that
+// isn't trading, e.g. one that's SETTLING or in a BREAK.
+func NewSymbolNotTrading(symbol, status string) error {
+	return &FilterError{Symbol: symbol, Reason: fmt.Sprintf("symbol is %s, not TRADING", status)}
+}
+
+// ValidationError is returned when a request field is invalid.
+type ValidationError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+func (e *ValidationError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *ValidationError) ErrorCode() Code {
+	return CodeValidation
+}
+
+func NewValidationError(field, reason string) error {
+	return &ValidationError{Field: field, Reason: reason}
+}
+
+// AsValidationError returns the ValidationError in e's chain, if there is one.
+func AsValidationError(e error) (*ValidationError, bool) {
+	var validationErr *ValidationError
+	ok := err.As(e, &validationErr)
+	return validationErr, ok
+}
+
+// ValidationErrors is returned when several request fields are invalid.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		fields = append(fields, fieldErr.Field)
+	}
+	return fmt.Sprintf("invalid request: %s", strings.Join(fields, ", "))
+}
+
+func (e ValidationErrors) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e ValidationErrors) ErrorCode() Code {
+	return CodeValidation
+}
+
+// RateLimitError is returned when a request is held back because it would
+// exceed one of the binance rate limits before its context is done.
+type RateLimitError struct {
+	Limit      string        `json:"limit"`
+	RetryAfter time.Duration `json:"retryAfter"`
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit reached, retry after %v", e.Limit, e.RetryAfter)
+}
+
+func (e *RateLimitError) Status() int {
+	return http.StatusTooManyRequests
+}
+
+func (e *RateLimitError) ErrorCode() Code {
+	return CodeRateLimited
+}
+
+func NewRateLimitError(limit string, retryAfter time.Duration) error {
+	return &RateLimitError{Limit: limit, RetryAfter: retryAfter}
+}
+
+// AsRateLimitError returns the RateLimitError in e's chain, if there is one.
+func AsRateLimitError(e error) (*RateLimitError, bool) {
+	var rateLimitErr *RateLimitError
+	ok := err.As(e, &rateLimitErr)
+	return rateLimitErr, ok
+}
+
+// AuthError is returned when a request isn't authenticated, or is
+// authenticated but isn't allowed to make the request, e.g. it references a
+// different stored user.
+type AuthError struct {
+	Reason string `json:"reason"`
+
+	// Forbidden is true if the request is authenticated but the user isn't
+	// allowed to make it
+	Forbidden bool `json:"-"`
+}
+
+func (e *AuthError) Error() string {
+	return e.Reason
+}
+
+func (e *AuthError) Status() int {
+	if e.Forbidden {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+func (e *AuthError) ErrorCode() Code {
+	if e.Forbidden {
+		return CodeForbidden
+	}
+	return CodeUnauthorized
+}
+
+func NewInvalidToken() error {
+	return &AuthError{Reason: "invalid bearer token"}
+}
+
+func NewTokenRequired() error {
+	return &AuthError{Reason: "bearer token is required"}
+}
+
+func NewForbiddenUser(id string) error {
+	return &AuthError{Reason: fmt.Sprintf("not authenticated as user %s", id), Forbidden: true}
+}
+
+// AsAuthError returns the AuthError in e's chain, if there is one.
+func AsAuthError(e error) (*AuthError, bool) {
+	var authErr *AuthError
+	ok := err.As(e, &authErr)
+	return authErr, ok
+}
+
+// NotFoundError is returned when a stored resource doesn't exist.
+type NotFoundError struct {
+	Resource string `json:"resource"`
+	ID       string `json:"id"`
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Resource, e.ID)
+}
+
+func (e *NotFoundError) Status() int {
+	return http.StatusNotFound
+}
+
+func (e *NotFoundError) ErrorCode() Code {
+	return CodeNotFound
+}
+
+func NewUnknownUser(id string) error {
+	return &NotFoundError{Resource: "user", ID: id}
+}
+
+func NewSymbolNotFound(symbol string) error {
+	return &NotFoundError{Resource: "symbol", ID: symbol}
+}
+
+func NewUnknownRoute(path string) error {
+	return &NotFoundError{Resource: "route", ID: path}
+}
+
+// AsNotFoundError returns the NotFoundError in e's chain, if there is one.
+func AsNotFoundError(e error) (*NotFoundError, bool) {
+	var notFoundErr *NotFoundError
+	ok := err.As(e, &notFoundErr)
+	return notFoundErr, ok
+}
+
+// TimeoutError is returned when binance didn't respond before the request's
+// context was done.
+type TimeoutError struct {
+	err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "binance did not respond in time"
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *TimeoutError) Status() int {
+	return http.StatusGatewayTimeout
+}
+
+func (e *TimeoutError) ErrorCode() Code {
+	return CodeUpstreamTimeout
+}
+
+// UpstreamError is returned when binance responds with a 5xx without an api
+// error, e.g. from its gateway, so whether the request was executed is
+// unknown.
+type UpstreamError struct {
+	StatusCode int `json:"status"`
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("binance responded with status %d", e.StatusCode)
+}
+
+func (e *UpstreamError) Status() int {
+	return http.StatusBadGateway
+}
+
+func (e *UpstreamError) ErrorCode() Code {
+	return CodeUpstreamError
+}
+
+func NewUpstreamError(status int) error {
+	return &UpstreamError{StatusCode: status}
+}
+
+// AsUpstreamError returns the UpstreamError in e's chain, if there is one.
+func AsUpstreamError(e error) (*UpstreamError, bool) {
+	var upstreamErr *UpstreamError
+	ok := err.As(e, &upstreamErr)
+	return upstreamErr, ok
+}
+
+// StaleDataError is returned when a symbol's market data is older than
+// allowed, e.g. its last price while the price stream is disconnected.
+type StaleDataError struct {
+	Symbol string        `json:"symbol"`
+	Age    time.Duration `json:"age"`
+}
+
+func (e *StaleDataError) Error() string {
+	return fmt.Sprintf("%s market data is stale, last updated %v ago", e.Symbol, e.Age.Round(time.Millisecond))
+}
+
+func (e *StaleDataError) Status() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e *StaleDataError) ErrorCode() Code {
+	return CodeStaleData
+}
+
+func NewStaleData(symbol string, age time.Duration) error {
+	return &StaleDataError{Symbol: symbol, Age: age}
+}
+
+// SlippageError is returned when a MARKET order is rejected before being sent
+// to binance because its fill estimated from the order book slips more than
+// the order's maxSlippageBps from the best price.
+type SlippageError struct {
+	Symbol              string  `json:"symbol"`
+	MaxSlippageBps      int     `json:"maxSlippageBps"`
+	ExpectedSlippageBps float64 `json:"expectedSlippageBps"`
+	ReferencePrice      string  `json:"referencePrice"`
+	ExpectedAvgPrice    string  `json:"expectedAvgPrice,omitempty"`
+}
+
+func (e *SlippageError) Error() string {
+	if e.ExpectedAvgPrice == "" {
+		return fmt.Sprintf("%s order book isn't deep enough to fill the order within %d bps", e.Symbol, e.MaxSlippageBps)
+	}
+	return fmt.Sprintf("%s expected slippage of %.2f bps exceeds the max of %d bps", e.Symbol, e.ExpectedSlippageBps, e.MaxSlippageBps)
+}
+
+func (e *SlippageError) Status() int {
+	return http.StatusUnprocessableEntity
+}
+
+func (e *SlippageError) ErrorCode() Code {
+	return CodeSlippageExceeded
+}
+
+// InternalError is any other error. Its message isn't exposed since it could
+// include internal details, e.g. file paths.
+type InternalError struct {
+	err error
+}
+
+func (e *InternalError) Error() string {
+	return "internal server error"
+}
+
+func (e *InternalError) Unwrap() error {
+	return e.err
+}
+
+func (e *InternalError) Status() int {
+	return http.StatusInternalServerError
+}
+
+func (e *InternalError) ErrorCode() Code {
+	return CodeInternal
 }
@@ -6,10 +6,18 @@ import "github.com/adshao/go-binance/v2/futures"
 // futures api credentials
 type User struct {
 	// APIKey is the user's futures api key
-	APIKey string `json:"api_key"`
+	APIKey string `json:"api_key" validate:"required"`
 
 	// APISecret is the user's futures api secret
-	APISecret string `json:"api_secret"`
+	APISecret string `json:"api_secret" validate:"required"`
+
+	// Leverage is the user's default leverage, used by orders that don't set
+	// one. Defaults to 10x.
+	Leverage int `json:"leverage,omitempty" validate:"omitempty,min=1,max=125"`
+
+	// MarginType is the user's default margin type (ISOLATED or CROSSED), used
+	// by orders that don't set one. Defaults to CROSSED.
+	MarginType futures.MarginType `json:"marginType,omitempty" validate:"omitempty,oneof=ISOLATED CROSSED"`
 }
 
 // Order represents the Limit/Take Profit, Market, or Stop Loss orders
@@ -19,17 +27,17 @@ type Order struct {
 	// 	MARKET requires percentage
 	//	LIMIT
 	//	STOP_LOSS (SL) (or in the Binance API STOP_MARKET)
-	Type futures.OrderType `json:"type"`
+	Type futures.OrderType `json:"type" validate:"required,oneof=MARKET LIMIT STOP_MARKET"`
 
 	// Symbol of the asset
-	Symbol string `json:"symbol"`
+	Symbol string `json:"symbol" validate:"required,symbol"`
 
 	// Side or either buy or sell
-	Side futures.SideType `json:"side"`
+	Side futures.SideType `json:"side" validate:"required,side"`
 
 	// Used by LIMIT and MARKET
 	// Percentage of futures balance to trade. Used by LIMIT and MARKET orders.
-	Percentage float64 `json:"percentage"`
+	Percentage float64 `json:"percentage" validate:"omitempty,percentage"`
 
 	// Used by LIMIT
 	// Price to buy underlying asset. Used by LIMIT orders.
@@ -40,17 +48,129 @@ type Order struct {
 	// 	IOC - Immediate or Cancel
 	// 	FOK - Fill or Kill
 	// 	GTX - Good Till Crossing (Post Only)
-	TimeInForce futures.TimeInForceType `json:"timeInForce"`
+	TimeInForce futures.TimeInForceType `json:"timeInForce" validate:"omitempty,oneof=GTC IOC FOK GTX"`
 
 	// Used by STOP_MARKET
 	// StopPrice closes the position at the market price
 	StopPrice string `json:"stopPrice"`
+
+	// PositionSide of the order:
+	//	BOTH (default in one-way mode)
+	//	LONG or SHORT (hedge mode). Defaults to LONG for BUY and SHORT for SELL.
+	PositionSide futures.PositionSideType `json:"positionSide" validate:"omitempty,oneof=BOTH LONG SHORT"`
+
+	// ReduceOnly orders can only reduce the position. One-way mode only.
+	ReduceOnly bool `json:"reduceOnly"`
+
+	// Used by STOP_MARKET
+	// ClosePosition closes the entire position when the stop price is met,
+	// the quantity (and percentage) is ignored.
+	ClosePosition bool `json:"closePosition"`
+
+	// Leverage of the symbol, between 1 and 125. Optional, defaults to the
+	// user's leverage.
+	Leverage int `json:"leverage" validate:"omitempty,min=1,max=125"`
+
+	// MarginType of the symbol, either ISOLATED or CROSSED. Optional, defaults
+	// to the user's margin type.
+	MarginType futures.MarginType `json:"marginType" validate:"omitempty,oneof=ISOLATED CROSSED"`
+
+	// NewClientOrderID is an optional unique id for the order. Generated by
+	// binance if empty.
+	NewClientOrderID string `json:"newClientOrderId" validate:"omitempty,max=36"`
+
+	// Used by MARKET
+	// MaxSlippageBps is how far the average fill price estimated from the
+	// order book can be from the best price, in basis points. Optional, the
+	// slippage isn't checked without it.
+	MaxSlippageBps int `json:"maxSlippageBps" validate:"omitempty,min=1,max=1000"`
+
+	// Used by MARKET with MaxSlippageBps
+	// SlippageAction is what's done with an order whose estimated slippage
+	// exceeds MaxSlippageBps:
+	//	REJECT (default) rejects the order
+	//	LIMIT_IOC sends it as a LIMIT IOC order at the slippage bound instead
+	SlippageAction SlippageAction `json:"slippageAction" validate:"omitempty,oneof=REJECT LIMIT_IOC"`
+
+	// Used by MARKET
+	// SizingPrice is the price the position size is converted to the order's
+	// quantity at:
+	//	LAST (default) the symbol's last price
+	//	MARK the symbol's mark price, which binance uses for the margin and
+	//	liquidation of the position
+	SizingPrice SizingPrice `json:"sizingPrice" validate:"omitempty,oneof=LAST MARK"`
+}
+
+// SlippageAction is what's done with a MARKET order whose estimated slippage
+// exceeds its MaxSlippageBps.
+type SlippageAction string
+
+const (
+	SlippageActionReject   SlippageAction = "REJECT"
+	SlippageActionLimitIOC SlippageAction = "LIMIT_IOC"
+)
+
+// SizingPrice is the price a MARKET order's position size is converted to its
+// quantity at.
+type SizingPrice string
+
+const (
+	SizingPriceLast SizingPrice = "LAST"
+	SizingPriceMark SizingPrice = "MARK"
+)
+
+// BracketOrder represents a LIMIT or MARKET entry order with reduce only
+// TAKE_PROFIT_MARKET and STOP_MARKET exit orders. The exit orders are placed
+// for the filled quantity once the entry order is filled, and when one of them
+// is filled the other is cancelled.
+type BracketOrder struct {
+	// Entry order, either LIMIT or MARKET
+	Order
+
+	// TakeProfitPrice is the stop price of the TAKE_PROFIT_MARKET exit order
+	TakeProfitPrice string `json:"takeProfitPrice" validate:"required"`
+
+	// StopLossPrice is the stop price of the STOP_MARKET exit order
+	StopLossPrice string `json:"stopLossPrice" validate:"required"`
 }
 
 // Bot represents a bot order
 type Bot struct {
 	// User's api key and secret
-	User User
+	User User `json:"user"`
+
 	// User's Order
-	Order Order
+	Order Order `json:"order"`
+}
+
+// BracketBot represents a bot bracket order
+type BracketBot struct {
+	// User's api key and secret
+	User User `json:"user"`
+
+	// User's BracketOrder
+	Order BracketOrder `json:"order"`
+}
+
+// OrderCancellation represents a batch of open orders to cancel for a symbol.
+// If both OrderIDs and ClientOrderIDs are empty, every open order for the
+// symbol is cancelled.
+type OrderCancellation struct {
+	// User's api key and secret
+	User User `json:"user"`
+
+	// OrderIDs of the orders to cancel (max 10)
+	OrderIDs []int64 `json:"orderIds" validate:"max=10"`
+
+	// ClientOrderIDs of the orders to cancel (max 10)
+	ClientOrderIDs []string `json:"clientOrderIds" validate:"max=10"`
+}
+
+// PositionMode represents the user's position mode
+type PositionMode struct {
+	// User's api key and secret
+	User User `json:"user"`
+
+	// DualSidePosition is true for hedge mode and false for one-way mode
+	DualSidePosition bool `json:"dualSidePosition"`
 }
@@ -3,51 +3,69 @@ package binancewrapper
 
 import (
 	"context"
-	"sync"
 
 	"github.com/adshao/go-binance/v2/futures"
 	"github.com/bosdhill/golang-binance-service/core/errors"
 	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
 	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
-	log "github.com/sirupsen/logrus"
+	"github.com/bosdhill/golang-binance-service/libs/store"
 )
 
-var binanceOnce sync.Once
-
 // binanceClient is a wrapper for the binance api.
 type binanceClient struct {
 	c *futures.Client
+
+	// leverage and marginType are the user's defaults for orders
+	leverage   int
+	marginType futures.MarginType
+
+	// prices and symbols are the stores used for the quantity calculations
+	// and filter checks
+	prices  store.PriceSource
+	symbols store.SymbolInfoSource
+
+	// books is the order book store used to estimate the fill of MARKET
+	// orders with a max slippage
+	books store.OrderBookSource
+
+	// markPrices is the mark price store used to size MARKET orders at the
+	// mark price
+	markPrices store.MarkPriceSource
 }
 
-// NewClient returns a new binance client.
-func NewClient(user *models.User) *binanceClient {
-	client := futures.NewClient(user.APIKey, user.APISecret)
-	b := binanceClient{client}
-	binanceOnce.Do(func() {
-		// Should store timeoffset somewhere for future use when new clients are
-		// created since this function can be called concurrently
-		err := retry.ServerTimeSync()
-		if err != nil {
-			log.Fatal(err, "could not get binance server time and set time offset")
-		}
-	})
+// newClient returns a new binance client using the prices, symbols, books and
+// markPrices stores, with its time offset set by timeSource.
+func newClient(
+	user *models.User,
+	prices store.PriceSource,
+	symbols store.SymbolInfoSource,
+	books store.OrderBookSource,
+	markPrices store.MarkPriceSource,
+	timeSource TimeSource,
+) *binanceClient {
+	client := ratelimit.NewClient(user.APIKey, user.APISecret)
+	timeSource.Apply(client)
+	b := binanceClient{
+		c:          client,
+		leverage:   user.Leverage,
+		marginType: user.MarginType,
+		prices:     prices,
+		symbols:    symbols,
+		books:      books,
+		markPrices: markPrices,
+	}
 	return &b
 }
 
 // GetAccount returns the User's USD-(s)M Futures Account.
 func (b *binanceClient) GetAccount(ctx context.Context) (*futures.Account, error) {
 	svc := b.c.NewGetAccountService()
-	var res *futures.Account
-	res, err := svc.Do(ctx)
+	res, err := retry.Do(ctx, b.c, "GetAccount", func(opts ...futures.RequestOption) (*futures.Account, error) {
+		return svc.Do(ctx, opts...)
+	})
 	if err != nil {
-		retryRes, err := retry.Do(err, func(opts ...futures.RequestOption) (interface{}, error) {
-			log.WithField("recvWindow", opts).Info("Retrying GetAccount request")
-			return svc.Do(ctx, opts...)
-		})
-		if err != nil {
-			return nil, err
-		}
-		res = retryRes.(*futures.Account)
+		return nil, err
 	}
 	return res, nil
 }
@@ -55,17 +73,11 @@ func (b *binanceClient) GetAccount(ctx context.Context) (*futures.Account, error
 // getBalances returns the User's USD-(s)M Futures Balances.
 func (b *binanceClient) getBalances(ctx context.Context) ([]*futures.Balance, error) {
 	svc := b.c.NewGetBalanceService()
-	var res []*futures.Balance
-	res, err := svc.Do(ctx)
+	res, err := retry.Do(ctx, b.c, "GetBalance", func(opts ...futures.RequestOption) ([]*futures.Balance, error) {
+		return svc.Do(ctx, opts...)
+	})
 	if err != nil {
-		retryRes, err := retry.Do(err, func(opts ...futures.RequestOption) (interface{}, error) {
-			log.WithField("recvWindow", opts).Info("Retrying GetBalance request")
-			return svc.Do(ctx, opts...)
-		})
-		if err != nil {
-			return nil, err
-		}
-		res = retryRes.([]*futures.Balance)
+		return nil, err
 	}
 	return res, nil
 }
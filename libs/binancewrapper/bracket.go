@@ -0,0 +1,1067 @@
+// Package binancewrapper wraps the binance api client
+package binancewrapper
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/filters"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
+	"github.com/bosdhill/golang-binance-service/libs/userstream"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	tracker     *bracketTracker
+	trackerOnce sync.Once
+
+	// streamTimeout is the timeout of the requests made from the user data
+	// stream handlers.
+	streamTimeout = 1 * time.Minute
+
+	// exitRetries is how many times the exit orders that couldn't be placed
+	// are retried in the background
+	exitRetries = 5
+
+	// exitRetryBackoff is how long to wait before the nth retry of the exit
+	// orders, starting at 0
+	exitRetryBackoff = retry.ExponentialBackoff(1*time.Second, 30*time.Second)
+
+	// bracketHistory is how many of a symbol's most recent orders are
+	// searched for the brackets' orders when they're restored
+	bracketHistory = 1000
+)
+
+// BracketOrderResponse is the response of a bracket order. TakeProfit and
+// StopLoss are nil until the entry order is filled, at which point they are
+// placed in the background.
+//
+// ExitError is set if the entry order was filled but its exit orders couldn't
+// all be placed. The placed ones are returned, and the missing ones are
+// retried in the background.
+type BracketOrderResponse struct {
+	ID         string                       `json:"id"`
+	Entry      *OrderResponse               `json:"entry"`
+	TakeProfit *futures.CreateOrderResponse `json:"takeProfit"`
+	StopLoss   *futures.CreateOrderResponse `json:"stopLoss"`
+	ExitError  string                       `json:"exitError,omitempty"`
+}
+
+// The clientOrderId of each order in a bracket is the bracket's id followed
+// by the order's role, and for the exit orders replacing resized ones by a
+// sequence number, e.g. bkt5f0c2a9e1b7d-di40-cje0-sl2.
+const (
+	bracketPrefix  = "bkt"
+	entryRole      = "e"
+	takeProfitRole = "tp"
+	stopLossRole   = "sl"
+)
+
+// bracket is an entry order and its take profit and stop loss exit orders,
+// each identified by their clientOrderId.
+type bracket struct {
+	m          sync.Mutex
+	order      models.BracketOrder
+	id         string
+	entryID    string
+	takeProfit *exitOrder
+	stopLoss   *exitOrder
+
+	// sequence is the sequence number of the last exit order replacing a
+	// resized one
+	sequence int
+
+	// entryClosed is set once the entry order is filled, cancelled or expired
+	entryClosed bool
+
+	// exitQuantity is the entry's filled quantity the exit orders are placed
+	// for, it's empty until the entry is partially filled
+	exitQuantity string
+	retrying     bool
+
+	// closed are the clientOrderIds of the exit orders that were cancelled
+	// or expired
+	closed map[string]bool
+}
+
+// exitOrder is one of a bracket's exit orders. Resizing the exit order
+// replaces it with a new one, so id is the clientOrderId of the current one.
+type exitOrder struct {
+	role      string
+	orderType futures.OrderType
+	stopPrice string
+	id        string
+	res       *futures.CreateOrderResponse
+}
+
+// newBracket returns a bracket for the order with a random id. The take
+// profit and stop loss prices are encoded in the id as their number of the
+// symbol's ticks, so the bracket can be restored from its orders.
+func newBracket(symbol *futures.Symbol, order *models.BracketOrder) (*bracket, error) {
+	buf := make([]byte, 6)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	takeProfit, err := encodePrice(symbol, order.TakeProfitPrice)
+	if err != nil {
+		return nil, err
+	}
+	stopLoss, err := encodePrice(symbol, order.StopLossPrice)
+	if err != nil {
+		return nil, err
+	}
+	id := bracketPrefix + hex.EncodeToString(buf) + "-" + takeProfit + "-" + stopLoss
+	return bracketWithID(id, order), nil
+}
+
+// parseBracket returns the bracket with the id, with its take profit and
+// stop loss prices decoded from the id. The bracket's side and position
+// side are left for the caller to set from its orders.
+func parseBracket(symbol *futures.Symbol, id string) (*bracket, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid bracket id %s", id)
+	}
+	takeProfit, err := decodePrice(symbol, parts[1])
+	if err != nil {
+		return nil, err
+	}
+	stopLoss, err := decodePrice(symbol, parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return bracketWithID(id, &models.BracketOrder{
+		Order:           models.Order{Symbol: symbol.Symbol},
+		TakeProfitPrice: takeProfit,
+		StopLossPrice:   stopLoss,
+	}), nil
+}
+
+// bracketWithID returns a bracket for the order with the id.
+func bracketWithID(id string, order *models.BracketOrder) *bracket {
+	return &bracket{
+		order:   *order,
+		id:      id,
+		entryID: id + "-" + entryRole,
+		takeProfit: &exitOrder{
+			role:      takeProfitRole,
+			orderType: futures.OrderTypeTakeProfitMarket,
+			stopPrice: order.TakeProfitPrice,
+			id:        id + "-" + takeProfitRole,
+		},
+		stopLoss: &exitOrder{
+			role:      stopLossRole,
+			orderType: futures.OrderTypeStopMarket,
+			stopPrice: order.StopLossPrice,
+			id:        id + "-" + stopLossRole,
+		},
+		closed: make(map[string]bool),
+	}
+}
+
+// parseClientOrderID returns the bracket id, role and sequence number of a
+// bracket order's clientOrderId, or false if it isn't a bracket order.
+func parseClientOrderID(clientOrderID string) (string, string, int, bool) {
+	i := strings.LastIndex(clientOrderID, "-")
+	if !strings.HasPrefix(clientOrderID, bracketPrefix) || i < 0 {
+		return "", "", 0, false
+	}
+	suffix := clientOrderID[i+1:]
+	role := strings.TrimRight(suffix, "0123456789")
+	switch role {
+	case entryRole, takeProfitRole, stopLossRole:
+	default:
+		return "", "", 0, false
+	}
+	sequence, _ := strconv.Atoi(suffix[len(role):])
+	return clientOrderID[:i], role, sequence, true
+}
+
+// encodePrice returns the price as its number of the symbol's ticks in base
+// 36.
+func encodePrice(symbol *futures.Symbol, price string) (string, error) {
+	tick, err := tickSize(symbol)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(int64(math.Round(p/tick)), 36), nil
+}
+
+// decodePrice returns the price of the symbol's number of ticks in base 36.
+func decodePrice(symbol *futures.Symbol, ticks string) (string, error) {
+	tick, err := tickSize(symbol)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseInt(ticks, 36, 64)
+	if err != nil {
+		return "", err
+	}
+	return filters.Price(symbol, strconv.FormatFloat(float64(n)*tick, 'f', -1, 64))
+}
+
+// tickSize returns the symbol's tick size.
+func tickSize(symbol *futures.Symbol) (float64, error) {
+	if f := symbol.PriceFilter(); f != nil {
+		if tick, _ := strconv.ParseFloat(f.TickSize, 64); tick > 0 {
+			return tick, nil
+		}
+	}
+	return 0, fmt.Errorf("%s has no tick size", symbol.Symbol)
+}
+
+// exits returns the bracket's exit orders, the stop loss first since it's
+// the one protecting the position.
+func (br *bracket) exits() []*exitOrder {
+	return []*exitOrder{br.stopLoss, br.takeProfit}
+}
+
+// exit returns the bracket's exit order with the role.
+func (br *bracket) exit(role string) *exitOrder {
+	if role == takeProfitRole {
+		return br.takeProfit
+	}
+	return br.stopLoss
+}
+
+// closeEntry records that the entry order is filled, cancelled or expired.
+func (br *bracket) closeEntry() {
+	br.m.Lock()
+	defer br.m.Unlock()
+	br.entryClosed = true
+}
+
+// pending returns whether an exit order still has to be created or resized
+// for the exit quantity. Must be called with br.m held.
+func (br *bracket) pending() bool {
+	if br.exitQuantity == "" {
+		return false
+	}
+	for _, exit := range br.exits() {
+		if br.closed[exit.id] {
+			continue
+		}
+		if exit.res == nil || greater(br.exitQuantity, exit.res.OrigQuantity) {
+			return true
+		}
+	}
+	return false
+}
+
+// greater returns whether the quantity a is greater than b, an empty
+// quantity being 0.
+func greater(a, b string) bool {
+	x, _ := strconv.ParseFloat(a, 64)
+	y, _ := strconv.ParseFloat(b, 64)
+	return x > y
+}
+
+// orderOpen returns whether an order with the status can still be filled.
+func orderOpen(status futures.OrderStatusType) bool {
+	return status == futures.OrderStatusTypeNew || status == futures.OrderStatusTypePartiallyFilled
+}
+
+// CreateBracketOrder creates a LIMIT or MARKET entry order. As the entry
+// order is filled, TAKE_PROFIT_MARKET and STOP_MARKET orders reducing the
+// entry's position side are placed for the filled quantity, and replaced by
+// larger ones on each partial fill, so the take profit can't be triggered
+// before the entry is filled. When one of the exit orders is filled the other
+// one and the rest of the entry are cancelled. Order updates are received
+// through the user's data stream, and the bracket is reconciled with its
+// orders whenever the stream reconnects.
+//
+// Once the entry order is created the bracket order doesn't fail, since the
+// position has to be protected: the exit orders that couldn't be placed are
+// retried in the background, see BracketOrderResponse.ExitError.
+func (b *binanceClient) CreateBracketOrder(
+	ctx context.Context,
+	order *models.BracketOrder,
+) (*BracketOrderResponse, error) {
+	if order.Type != futures.OrderTypeMarket && order.Type != futures.OrderTypeLimit ||
+		order.TakeProfitPrice == "" || order.StopLossPrice == "" {
+		return nil, errors.NewInvalidBracketOrder()
+	}
+
+	symbol, err := b.tradingSymbol(order.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	rounded := *order
+	rounded.TakeProfitPrice, err = filters.Price(&symbol, order.TakeProfitPrice)
+	if err != nil {
+		return nil, err
+	}
+	rounded.StopLossPrice, err = filters.Price(&symbol, order.StopLossPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	// The exit orders are placed for the entry's position side, so it's
+	// resolved before the bracket is tracked.
+	rounded.PositionSide, err = b.getPositionSide(ctx, &order.Order)
+	if err != nil {
+		return nil, err
+	}
+
+	br, err := newBracket(&symbol, &rounded)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bracket must be tracked before the entry order is created, otherwise
+	// its fill could be missed.
+	stream, err := getBracketTracker().track(b, br)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := rounded.Order
+	entry.NewClientOrderID = br.entryID
+	res, err := b.CreateOrder(ctx, &entry)
+	if err != nil {
+		stream.untrack(br)
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"ID":              br.id,
+		"Symbol":          order.Symbol,
+		"Side":            order.Side,
+		"TakeProfitPrice": order.TakeProfitPrice,
+		"StopLossPrice":   order.StopLossPrice,
+	}).Info("New Bracket Order")
+
+	bracketRes := &BracketOrderResponse{ID: br.id, Entry: res}
+
+	// MARKET orders are usually filled by the time they're queried, so the
+	// exit orders can be returned in the response.
+	if order.Type == futures.OrderTypeMarket {
+		filled, err := b.GetOrder(ctx, order.Symbol, res.OrderID, "")
+		if err != nil {
+			log.Error(err)
+			return bracketRes, nil
+		}
+
+		if filled.Status == futures.OrderStatusTypeFilled {
+			br.closeEntry()
+			bracketRes.TakeProfit, bracketRes.StopLoss, err = b.createExitOrders(
+				ctx,
+				br,
+				filled.ExecutedQuantity,
+			)
+			if err != nil {
+				log.WithField("ID", br.id).Error(err)
+				bracketRes.ExitError = err.Error()
+				stream.retryExits(br)
+			}
+		}
+	}
+	return bracketRes, nil
+}
+
+// createExitOrders creates the bracket's take profit and stop loss orders for
+// quantity, or replaces them if they were placed for a smaller quantity.
+// Calls with a smaller or empty quantity place the missing exit orders for
+// the largest quantity so far. The current exit orders are returned, along
+// with why the others couldn't be created or resized.
+func (b *binanceClient) createExitOrders(
+	ctx context.Context,
+	br *bracket,
+	quantity string,
+) (*futures.CreateOrderResponse, *futures.CreateOrderResponse, error) {
+	br.m.Lock()
+	defer br.m.Unlock()
+	if greater(quantity, br.exitQuantity) {
+		br.exitQuantity = quantity
+	}
+	if br.exitQuantity == "" {
+		return nil, nil, nil
+	}
+
+	side := futures.SideTypeSell
+	if br.order.Side == futures.SideTypeSell {
+		side = futures.SideTypeBuy
+	}
+
+	for _, exit := range br.exits() {
+		err := b.placeExitOrder(ctx, br, exit, side)
+		if err != nil {
+			return br.takeProfit.res, br.stopLoss.res, err
+		}
+	}
+	return br.takeProfit.res, br.stopLoss.res, nil
+}
+
+// placeExitOrder creates the exit order for the bracket's exit quantity, or
+// replaces it if it was placed for a smaller quantity. The replaced order is
+// only cancelled once the new one is created, so the position is never left
+// without the exit order. Must be called with br.m held.
+func (b *binanceClient) placeExitOrder(
+	ctx context.Context,
+	br *bracket,
+	exit *exitOrder,
+	side futures.SideType,
+) error {
+	if br.closed[exit.id] || exit.res != nil && !greater(br.exitQuantity, exit.res.OrigQuantity) {
+		return nil
+	}
+
+	id := exit.id
+	if exit.res != nil {
+		br.sequence++
+		id = br.id + "-" + exit.role + strconv.Itoa(br.sequence)
+	}
+	res, err := b.createExitOrder(
+		ctx,
+		br.order.Symbol,
+		side,
+		br.order.PositionSide,
+		exit.orderType,
+		exit.stopPrice,
+		br.exitQuantity,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	replaced := exit.res
+	exit.id, exit.res = id, res
+	log.WithFields(log.Fields{
+		"ID":            br.id,
+		"ClientOrderID": id,
+		"Symbol":        br.order.Symbol,
+		"Quantity":      br.exitQuantity,
+	}).Info("Created bracket exit order")
+
+	if replaced != nil {
+		_, err = b.CancelOrder(ctx, br.order.Symbol, replaced.OrderID, "")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"ID":            br.id,
+				"ClientOrderID": replaced.ClientOrderID,
+			}).Error(err)
+		}
+	}
+	return nil
+}
+
+// createExitOrder creates an exit order that is triggered at stopPrice. In
+// one-way mode (positionSide BOTH) the order is reduce only, in hedge mode it
+// reduces the positionSide's position since it's in the opposite side.
+func (b *binanceClient) createExitOrder(
+	ctx context.Context,
+	symbol string,
+	side futures.SideType,
+	positionSide futures.PositionSideType,
+	orderType futures.OrderType,
+	stopPrice string,
+	quantity string,
+	clientOrderID string,
+) (*futures.CreateOrderResponse, error) {
+	svc := b.c.NewCreateOrderService().
+		Type(orderType).
+		Symbol(symbol).
+		Side(side).
+		PositionSide(positionSide).
+		StopPrice(stopPrice).
+		Quantity(quantity).
+		NewClientOrderID(clientOrderID)
+	if positionSide == futures.PositionSideTypeBoth {
+		svc.ReduceOnly(true)
+	}
+	res, err := retry.DoOnce(ctx, b.c, "CreateExitOrder", func(opts ...futures.RequestOption) (*futures.CreateOrderResponse, error) {
+		return svc.Do(ctx, opts...)
+	}, b.orderLanded(symbol, clientOrderID))
+	if err != nil {
+		b.checkPositionMode(err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// RestoreBracketOrders rebuilds the user's brackets from their orders, since
+// brackets are only tracked in memory and are lost when the service restarts.
+// The brackets are found by the clientOrderIds of the open orders, and of the
+// recent orders of the symbols with an open position, so entries filled while
+// the service was down get their exit orders. A bracket whose exit order was
+// filled has its other orders cancelled, and one whose exit orders were
+// cancelled, or whose position was closed, isn't restored.
+func (b *binanceClient) RestoreBracketOrders(ctx context.Context) error {
+	open, err := b.ListOpenOrders(ctx, "")
+	if err != nil {
+		return err
+	}
+	positions, err := b.openPositions(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	symbols := make(map[string]bool)
+	for _, o := range open {
+		if _, _, _, ok := parseClientOrderID(o.ClientOrderID); ok {
+			symbols[o.Symbol] = true
+		}
+	}
+	for _, p := range positions {
+		symbols[p.Symbol] = true
+	}
+	sorted := make([]string, 0, len(symbols))
+	for symbol := range symbols {
+		sorted = append(sorted, symbol)
+	}
+	sort.Strings(sorted)
+
+	var stream *bracketStream
+	for _, symbol := range sorted {
+		brackets, err := b.bracketOrders(ctx, symbol, open)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(brackets))
+		for id := range brackets {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			s, err := b.restoreBracket(ctx, symbol, id, brackets[id], positions)
+			if err != nil {
+				log.WithField("ID", id).Error(err)
+				continue
+			}
+			if s != nil {
+				stream = s
+			}
+		}
+	}
+
+	// The updates sent before the stream was subscribed to were missed
+	if stream != nil {
+		stream.reconcile()
+	}
+	return nil
+}
+
+// bracketOrders returns the symbol's recent and open bracket orders by their
+// bracket id.
+func (b *binanceClient) bracketOrders(
+	ctx context.Context,
+	symbol string,
+	open []*futures.Order,
+) (map[string][]*futures.Order, error) {
+	history, err := b.ListOrders(ctx, symbol, bracketHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open orders older than the history are kept
+	orders := make(map[int64]*futures.Order)
+	for _, o := range history {
+		orders[o.OrderID] = o
+	}
+	for _, o := range open {
+		if o.Symbol == symbol {
+			orders[o.OrderID] = o
+		}
+	}
+
+	brackets := make(map[string][]*futures.Order)
+	for _, o := range orders {
+		if id, _, _, ok := parseClientOrderID(o.ClientOrderID); ok {
+			brackets[id] = append(brackets[id], o)
+		}
+	}
+	return brackets, nil
+}
+
+// restoreBracket rebuilds the bracket from its orders and tracks it, placing
+// or resizing its exit orders for the entry's filled quantity. The stream it's
+// tracked on is returned, or nil if the bracket is closed or already tracked.
+func (b *binanceClient) restoreBracket(
+	ctx context.Context,
+	symbol string,
+	id string,
+	orders []*futures.Order,
+	positions []*futures.PositionRisk,
+) (*bracketStream, error) {
+	if getBracketTracker().tracks(b, id) {
+		return nil, nil
+	}
+	s, ok := b.symbols.GetSymbol(symbol)
+	if !ok {
+		return nil, errors.NewUnknownSymbol(symbol)
+	}
+	br, err := parseBracket(&s, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The latest exit orders of each role are the current ones
+	sort.Slice(orders, func(i, j int) bool {
+		_, _, x, _ := parseClientOrderID(orders[i].ClientOrderID)
+		_, _, y, _ := parseClientOrderID(orders[j].ClientOrderID)
+		return x < y || x == y && orders[i].OrderID < orders[j].OrderID
+	})
+
+	var entry *futures.Order
+	exitFilled := false
+	for _, o := range orders {
+		_, role, sequence, _ := parseClientOrderID(o.ClientOrderID)
+		if role == entryRole {
+			entry = o
+			continue
+		}
+		exitFilled = exitFilled || o.Status == futures.OrderStatusTypeFilled
+		exit := br.exit(role)
+		exit.id, exit.res = o.ClientOrderID, newCreateOrderResponse(o)
+		if sequence > br.sequence {
+			br.sequence = sequence
+		}
+	}
+
+	// The entry can be older than the history, its side is the opposite of
+	// the exit orders' and its filled quantity the largest exit order's.
+	entryOpen := entry != nil && orderOpen(entry.Status)
+	br.entryClosed = !entryOpen
+	placed := false
+	for _, exit := range br.exits() {
+		if exit.res == nil {
+			continue
+		}
+		placed = true
+		br.order.PositionSide = exit.res.PositionSide
+		br.order.Side = futures.SideTypeBuy
+		if exit.res.Side == futures.SideTypeBuy {
+			br.order.Side = futures.SideTypeSell
+		}
+		if greater(exit.res.OrigQuantity, br.exitQuantity) {
+			br.exitQuantity = exit.res.OrigQuantity
+		}
+	}
+	if entry != nil {
+		br.order.Side = entry.Side
+		br.order.PositionSide = entry.PositionSide
+		if greater(entry.ExecutedQuantity, "0") {
+			br.exitQuantity = entry.ExecutedQuantity
+		}
+	}
+
+	var live []*futures.Order
+	current := false
+	for _, o := range orders {
+		if !orderOpen(o.Status) {
+			continue
+		}
+		live = append(live, o)
+		if o == entry || o.ClientOrderID == br.takeProfit.id || o.ClientOrderID == br.stopLoss.id {
+			current = true
+		}
+	}
+	for _, exit := range br.exits() {
+		if exit.res != nil && !orderOpen(exit.res.Status) {
+			br.closed[exit.id] = true
+		}
+	}
+
+	switch {
+	case exitFilled:
+		log.WithField("ID", br.id).Info("Bracket order closed while the service was down")
+		b.cancelOrders(ctx, br, live)
+		return nil, nil
+	case !entryOpen && br.exitQuantity == "", placed && !current:
+		// the entry wasn't filled or the exit orders were cancelled
+		b.cancelOrders(ctx, br, live)
+		return nil, nil
+	case !entryOpen && !hasPosition(positions, br.order.Symbol, br.order.PositionSide):
+		log.WithField("ID", br.id).Info("Bracket position closed while the service was down")
+		b.cancelOrders(ctx, br, live)
+		return nil, nil
+	}
+
+	// Exit orders replaced by the current ones that weren't cancelled
+	var stale []*futures.Order
+	for _, o := range live {
+		if o != entry && o.ClientOrderID != br.takeProfit.id && o.ClientOrderID != br.stopLoss.id {
+			stale = append(stale, o)
+		}
+	}
+	b.cancelOrders(ctx, br, stale)
+
+	stream, err := getBracketTracker().track(b, br)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"ID":           br.id,
+		"Symbol":       br.order.Symbol,
+		"Side":         br.order.Side,
+		"ExitQuantity": br.exitQuantity,
+	}).Info("Restored bracket order")
+
+	_, _, err = b.createExitOrders(ctx, br, "")
+	if err != nil {
+		log.WithField("ID", br.id).Error(err)
+		stream.retryExits(br)
+	}
+	return stream, nil
+}
+
+// cancelOrders cancels the bracket's orders, logging the ones that couldn't
+// be cancelled.
+func (b *binanceClient) cancelOrders(ctx context.Context, br *bracket, orders []*futures.Order) {
+	for _, o := range orders {
+		_, err := b.CancelOrder(ctx, o.Symbol, o.OrderID, "")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"ID":            br.id,
+				"ClientOrderID": o.ClientOrderID,
+			}).Error(err)
+		}
+	}
+}
+
+// hasPosition returns whether one of the open positions is the symbol's
+// position side.
+func hasPosition(
+	positions []*futures.PositionRisk,
+	symbol string,
+	positionSide futures.PositionSideType,
+) bool {
+	for _, p := range positions {
+		if p.Symbol == symbol && p.PositionSide == string(positionSide) {
+			return true
+		}
+	}
+	return false
+}
+
+// bracketTracker tracks the open brackets of each user through a single user
+// data stream subscription per user.
+type bracketTracker struct {
+	m       sync.Mutex
+	streams map[string]*bracketStream
+}
+
+// getBracketTracker returns a reference to the bracket tracker.
+func getBracketTracker() *bracketTracker {
+	trackerOnce.Do(func() {
+		tracker = &bracketTracker{streams: make(map[string]*bracketStream)}
+	})
+	return tracker
+}
+
+// track starts tracking the bracket on the client user's data stream,
+// subscribing to the stream if needed.
+func (t *bracketTracker) track(b *binanceClient, br *bracket) (*bracketStream, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	s, ok := t.streams[b.c.APIKey]
+	if !ok {
+		s = &bracketStream{
+			client:   b,
+			brackets: make(map[string]*bracket),
+		}
+		user := &models.User{APIKey: b.c.APIKey, APISecret: b.c.SecretKey}
+		sub, err := userstream.Subscribe(user, userstream.Handlers{
+			OrderTradeUpdate: s.handleOrderTradeUpdate,
+			Reconnected:      s.reconcile,
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.sub = sub
+		t.streams[b.c.APIKey] = s
+	}
+	s.add(br)
+	return s, nil
+}
+
+// tracks returns whether the bracket with the id is tracked for the client
+// user.
+func (t *bracketTracker) tracks(b *binanceClient, id string) bool {
+	t.m.Lock()
+	s, ok := t.streams[b.c.APIKey]
+	t.m.Unlock()
+	if !ok {
+		return false
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok = s.brackets[id]
+	return ok
+}
+
+// release unsubscribes from the stream if it isn't tracking any brackets.
+func (t *bracketTracker) release(s *bracketStream) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.brackets) != 0 || t.streams[s.client.c.APIKey] != s {
+		return
+	}
+	s.sub.Unsubscribe()
+	delete(t.streams, s.client.c.APIKey)
+}
+
+// bracketStream manages the exit orders of the user's brackets through the
+// user's data stream.
+type bracketStream struct {
+	m        sync.Mutex
+	client   *binanceClient
+	brackets map[string]*bracket
+	sub      *userstream.Subscription
+}
+
+// add tracks the bracket by its id.
+func (s *bracketStream) add(br *bracket) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.brackets[br.id] = br
+}
+
+// tracking returns whether the bracket is tracked.
+func (s *bracketStream) tracking(br *bracket) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.brackets[br.id] == br
+}
+
+// tracked returns the tracked brackets.
+func (s *bracketStream) tracked() []*bracket {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var brackets []*bracket
+	for _, br := range s.brackets {
+		brackets = append(brackets, br)
+	}
+	return brackets
+}
+
+// untrack stops tracking the bracket.
+func (s *bracketStream) untrack(br *bracket) {
+	s.m.Lock()
+	if s.brackets[br.id] == br {
+		delete(s.brackets, br.id)
+	}
+	s.m.Unlock()
+	getBracketTracker().release(s)
+}
+
+// handleOrderTradeUpdate creates or resizes the exit orders as an entry order
+// is filled and cancels the bracket's other orders when an exit order is
+// filled.
+func (s *bracketStream) handleOrderTradeUpdate(event *userstream.OrderTradeUpdate) {
+	update := event.Order
+	id, role, _, ok := parseClientOrderID(update.ClientOrderID)
+	if !ok {
+		return
+	}
+	s.m.Lock()
+	br, ok := s.brackets[id]
+	s.m.Unlock()
+	if !ok {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"ID":            br.id,
+		"ClientOrderID": update.ClientOrderID,
+		"Status":        update.Status,
+		"FilledQty":     update.AccumulatedFilledQty,
+	}).Info("Bracket order update")
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+	defer cancel()
+
+	if role == entryRole {
+		s.handleEntryUpdate(ctx, br, update)
+	} else {
+		s.handleExitUpdate(ctx, br, update)
+	}
+}
+
+// handleEntryUpdate creates the exit orders for the filled quantity as the
+// entry order is partially filled, resizing them on each fill, until it's
+// filled or cancelled.
+func (s *bracketStream) handleEntryUpdate(
+	ctx context.Context,
+	br *bracket,
+	update futures.WsOrderTradeUpdate,
+) {
+	switch update.Status {
+	case futures.OrderStatusTypePartiallyFilled:
+	case futures.OrderStatusTypeFilled:
+		br.closeEntry()
+	case futures.OrderStatusTypeCanceled, futures.OrderStatusTypeExpired:
+		br.closeEntry()
+		filled, _ := strconv.ParseFloat(update.AccumulatedFilledQty, 64)
+		if filled == 0 {
+			s.untrack(br)
+			return
+		}
+	default:
+		return
+	}
+
+	_, _, err := s.client.createExitOrders(ctx, br, update.AccumulatedFilledQty)
+	if err != nil {
+		log.WithField("ID", br.id).Error(err)
+		s.retryExits(br)
+	}
+}
+
+// retryExits retries creating or resizing the bracket's exit orders in the
+// background with backoff, until they're placed for the exit quantity, the
+// bracket isn't tracked anymore or the retries run out.
+func (s *bracketStream) retryExits(br *bracket) {
+	br.m.Lock()
+	defer br.m.Unlock()
+	if br.retrying {
+		return
+	}
+	br.retrying = true
+
+	go func() {
+		defer func() {
+			br.m.Lock()
+			br.retrying = false
+			br.m.Unlock()
+		}()
+
+		for n := 0; n < exitRetries; n++ {
+			time.Sleep(exitRetryBackoff(n))
+			if !s.tracking(br) {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+			_, _, err := s.client.createExitOrders(ctx, br, "")
+			cancel()
+			if err == nil {
+				return
+			}
+			log.WithFields(log.Fields{
+				"ID":    br.id,
+				"Retry": n + 1,
+			}).Error(err)
+		}
+		log.WithField("ID", br.id).Error("Bracket exit orders could not be created, the position isn't protected")
+	}()
+}
+
+// reconcile reconciles the tracked brackets with their orders after the user
+// data stream reconnected, since their updates sent while it was down were
+// missed. The orders' current state is handled like an update.
+func (s *bracketStream) reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+	defer cancel()
+
+	for _, br := range s.tracked() {
+		br.m.Lock()
+		var ids []string
+		if !br.entryClosed {
+			ids = append(ids, br.entryID)
+		}
+		for _, exit := range br.exits() {
+			if exit.res != nil && !br.closed[exit.id] {
+				ids = append(ids, exit.id)
+			}
+		}
+		br.m.Unlock()
+
+		log.WithField("ID", br.id).Info("Reconciling bracket order")
+
+		for _, id := range ids {
+			order, err := s.client.GetOrder(ctx, br.order.Symbol, 0, id)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"ID":            br.id,
+					"ClientOrderID": id,
+				}).Error(err)
+				continue
+			}
+			s.handleOrderTradeUpdate(&userstream.OrderTradeUpdate{
+				Order: futures.WsOrderTradeUpdate{
+					Symbol:               order.Symbol,
+					ClientOrderID:        order.ClientOrderID,
+					Status:               order.Status,
+					AccumulatedFilledQty: order.ExecutedQuantity,
+				},
+			})
+		}
+
+		// The exit orders that couldn't be created or resized are retried
+		br.m.Lock()
+		pending := br.pending()
+		br.m.Unlock()
+		if pending && s.tracking(br) {
+			s.retryExits(br)
+		}
+	}
+}
+
+// handleExitUpdate cancels the bracket's other orders once an exit order is
+// filled, and stops tracking the bracket once its exit orders are cancelled.
+// The updates of the exit orders replaced by resized ones are ignored.
+func (s *bracketStream) handleExitUpdate(
+	ctx context.Context,
+	br *bracket,
+	update futures.WsOrderTradeUpdate,
+) {
+	switch update.Status {
+	case futures.OrderStatusTypeFilled:
+		// The rest of a partially filled entry is cancelled too
+		br.m.Lock()
+		var ids []string
+		if !br.entryClosed {
+			ids = append(ids, br.entryID)
+		}
+		for _, exit := range br.exits() {
+			if exit.res != nil && exit.id != update.ClientOrderID && !br.closed[exit.id] {
+				ids = append(ids, exit.id)
+			}
+		}
+		br.m.Unlock()
+
+		for _, id := range ids {
+			_, err := s.client.CancelOrder(ctx, br.order.Symbol, 0, id)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"ID":            br.id,
+					"ClientOrderID": id,
+				}).Error(err)
+			}
+		}
+		s.untrack(br)
+	case futures.OrderStatusTypeCanceled, futures.OrderStatusTypeExpired:
+		br.m.Lock()
+		if update.ClientOrderID == br.takeProfit.id || update.ClientOrderID == br.stopLoss.id {
+			br.closed[update.ClientOrderID] = true
+		}
+		closed := br.closed[br.takeProfit.id] && br.closed[br.stopLoss.id]
+		br.m.Unlock()
+		if closed {
+			s.untrack(br)
+		}
+	}
+}
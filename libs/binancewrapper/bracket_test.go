@@ -0,0 +1,382 @@
+package binancewrapper
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateBracketOrder(t *testing.T) {
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	ctx := context.Background()
+	client := newTestClient(t, user)
+
+	tests := []struct {
+		name        string
+		order       *models.BracketOrder
+		expectedErr error
+	}{
+		{
+			name: "create market bracket order of Size 0.01 for BTCUSDT",
+			order: &models.BracketOrder{
+				Order: models.Order{
+					Type:       futures.OrderTypeMarket,
+					Symbol:     "BTCUSDT",
+					Side:       futures.SideTypeBuy,
+					Percentage: 0.01,
+				},
+				TakeProfitPrice: lastPriceIncreased("BTCUSDT"),
+				StopLossPrice:   lastPriceDecreased("BTCUSDT"),
+			},
+		},
+		{
+			name: "reject stop market bracket order",
+			order: &models.BracketOrder{
+				Order: models.Order{
+					Type:       futures.OrderTypeStopMarket,
+					Symbol:     "BTCUSDT",
+					Side:       futures.SideTypeBuy,
+					Percentage: 0.01,
+					StopPrice:  lastPriceIncreased("BTCUSDT"),
+				},
+				TakeProfitPrice: lastPriceIncreased("BTCUSDT"),
+				StopLossPrice:   lastPriceDecreased("BTCUSDT"),
+			},
+			expectedErr: errors.NewInvalidBracketOrder(),
+		},
+	}
+
+	for _, tc := range tests {
+		res, err := client.CreateBracketOrder(ctx, tc.order)
+		if tc.expectedErr != nil {
+			assert.EqualError(t, err, tc.expectedErr.Error(), tc.name)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NotNil(t, res.TakeProfit, tc.name)
+		assert.NotNil(t, res.StopLoss, tc.name)
+		assert.True(t, res.TakeProfit.ReduceOnly, tc.name)
+		assert.True(t, res.StopLoss.ReduceOnly, tc.name)
+		assert.Equal(t, res.TakeProfit.OrigQuantity, res.StopLoss.OrigQuantity, tc.name)
+
+		// Close the position and cancel the exit orders
+		_, err = client.CreateOrder(ctx, &models.Order{
+			Type:       futures.OrderTypeMarket,
+			Symbol:     tc.order.Symbol,
+			Side:       futures.SideTypeSell,
+			Percentage: tc.order.Percentage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = client.CancelAllOrders(ctx, tc.order.Symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// openOrder returns the symbol's open order with the clientOrderId on the fake
+// server.
+func openOrder(fake *fakebinance.Server, symbol, clientOrderID string) (futures.Order, bool) {
+	for _, o := range fake.Orders(symbol) {
+		if o.ClientOrderID == clientOrderID && o.Status == futures.OrderStatusTypeNew {
+			return o, true
+		}
+	}
+	return futures.Order{}, false
+}
+
+// trackedStream returns the stream the client user's brackets are tracked
+// on.
+func trackedStream(client *binanceClient) *bracketStream {
+	tracker := getBracketTracker()
+	tracker.m.Lock()
+	defer tracker.m.Unlock()
+	return tracker.streams[client.c.APIKey]
+}
+
+// trackedBracket returns the tracked bracket with the id.
+func trackedBracket(client *binanceClient, id string) (*bracket, bool) {
+	stream := trackedStream(client)
+	if stream == nil {
+		return nil, false
+	}
+	stream.m.Lock()
+	defer stream.m.Unlock()
+	br, ok := stream.brackets[id]
+	return br, ok
+}
+
+// closeBracket closes the bracket's position and cancels its exit orders.
+func closeBracket(t *testing.T, client *binanceClient, order *models.BracketOrder) {
+	ctx := context.Background()
+	_, err := client.CreateOrder(ctx, &models.Order{
+		Type:       futures.OrderTypeMarket,
+		Symbol:     order.Symbol,
+		Side:       futures.SideTypeSell,
+		Percentage: order.Percentage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.CancelAllOrders(ctx, order.Symbol)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateBracketOrderExitFailed(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("exit order failures can only be scripted against the fake server")
+	}
+	defer func(backoff func(int) time.Duration) { exitRetryBackoff = backoff }(exitRetryBackoff)
+	exitRetryBackoff = func(int) time.Duration { return 200 * time.Millisecond }
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	client := newTestClient(t, user)
+	order := &models.BracketOrder{
+		Order: models.Order{
+			Type:       futures.OrderTypeMarket,
+			Symbol:     "ETHUSDT",
+			Side:       futures.SideTypeBuy,
+			Percentage: 0.01,
+		},
+		TakeProfitPrice: lastPriceIncreased("ETHUSDT"),
+		StopLossPrice:   lastPriceDecreased("ETHUSDT"),
+	}
+
+	// The stop loss is placed but the take profit fails, both when it's
+	// placed for the response and for the entry's fill update
+	failure := fakebinance.Failure{Code: -2021, Message: "Order would immediately trigger."}
+	fake.FailOrder(futures.OrderTypeTakeProfitMarket, failure)
+	fake.FailOrder(futures.OrderTypeTakeProfitMarket, failure)
+
+	res, err := client.CreateBracketOrder(context.Background(), order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBracket(t, client, order)
+
+	assert.Equal(t, futures.OrderStatusTypeFilled, res.Entry.Status, "position opened")
+	assert.NotNil(t, res.StopLoss, "stop loss placed")
+	assert.Nil(t, res.TakeProfit)
+	assert.NotEmpty(t, res.ExitError)
+
+	// The take profit is retried in the background
+	assert.Eventually(t, func() bool {
+		_, ok := openOrder(fake, order.Symbol, res.ID+"-tp")
+		return ok
+	}, 2*time.Second, 10*time.Millisecond, "take profit placed")
+	stopLoss, ok := openOrder(fake, order.Symbol, res.ID+"-sl")
+	assert.True(t, ok, "stop loss still open")
+	takeProfit, _ := openOrder(fake, order.Symbol, res.ID+"-tp")
+	assert.Equal(t, stopLoss.OrigQuantity, takeProfit.OrigQuantity)
+}
+
+func TestCreateBracketOrderReconcile(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("missed fills can only be scripted against the fake server")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	client := newTestClient(t, user)
+	order := &models.BracketOrder{
+		Order: models.Order{
+			Type:        futures.OrderTypeLimit,
+			Symbol:      "ETHUSDT",
+			Side:        futures.SideTypeBuy,
+			Percentage:  0.01,
+			TimeInForce: futures.TimeInForceTypeGTC,
+			Price:       lastPriceDecreased("ETHUSDT"),
+		},
+		TakeProfitPrice: lastPriceIncreased("ETHUSDT"),
+		StopLossPrice:   calcLastPrice(-2*percentage, "ETHUSDT"),
+	}
+
+	res, err := client.CreateBracketOrder(context.Background(), order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBracket(t, client, order)
+	assert.Equal(t, futures.OrderStatusTypeNew, res.Entry.Status)
+
+	// The entry is filled while the user data stream is down, so its update
+	// is missed
+	fake.DisconnectStreams()
+	assert.True(t, fake.Fill(res.Entry.OrderID))
+	_, ok := openOrder(fake, order.Symbol, res.ID+"-sl")
+	assert.False(t, ok)
+
+	stream := trackedStream(client)
+	stream.reconcile()
+
+	// The stream is still reconnecting, so the bracket is released for the
+	// next tests instead of waiting for its orders' cancellations
+	defer func() {
+		for _, br := range stream.tracked() {
+			stream.untrack(br)
+		}
+	}()
+
+	_, ok = openOrder(fake, order.Symbol, res.ID+"-sl")
+	assert.True(t, ok, "stop loss placed")
+	_, ok = openOrder(fake, order.Symbol, res.ID+"-tp")
+	assert.True(t, ok, "take profit placed")
+}
+
+func TestCreateBracketOrderPartialFill(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("partial fills can only be scripted against the fake server")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	client := newTestClient(t, user)
+	order := &models.BracketOrder{
+		Order: models.Order{
+			Type:        futures.OrderTypeLimit,
+			Symbol:      "ETHUSDT",
+			Side:        futures.SideTypeBuy,
+			Percentage:  0.01,
+			TimeInForce: futures.TimeInForceTypeGTC,
+			Price:       lastPriceDecreased("ETHUSDT"),
+		},
+		TakeProfitPrice: lastPriceIncreased("ETHUSDT"),
+		StopLossPrice:   calcLastPrice(-2*percentage, "ETHUSDT"),
+	}
+
+	res, err := client.CreateBracketOrder(context.Background(), order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBracket(t, client, order)
+	quantity, _ := strconv.ParseFloat(res.Entry.OrigQuantity, 64)
+	half := strconv.FormatFloat(math.Floor(quantity/2*1000)/1000, 'f', -1, 64)
+
+	// The exit orders are placed for the partially filled quantity
+	assert.True(t, fake.FillPartially(res.Entry.OrderID, half))
+	assert.Eventually(t, func() bool {
+		_, ok := openOrder(fake, order.Symbol, res.ID+"-tp")
+		return ok
+	}, 2*time.Second, 10*time.Millisecond, "take profit placed")
+	stopLoss, ok := openOrder(fake, order.Symbol, res.ID+"-sl")
+	assert.True(t, ok, "stop loss placed")
+	assert.Equal(t, half, stopLoss.OrigQuantity)
+
+	// and replaced by exit orders for the filled quantity once it's filled
+	assert.True(t, fake.Fill(res.Entry.OrderID))
+	assert.Eventually(t, func() bool {
+		_, ok := openOrder(fake, order.Symbol, res.ID+"-tp2")
+		return ok
+	}, 2*time.Second, 10*time.Millisecond, "take profit resized")
+	stopLoss, ok = openOrder(fake, order.Symbol, res.ID+"-sl1")
+	assert.True(t, ok, "stop loss resized")
+	takeProfit, _ := openOrder(fake, order.Symbol, res.ID+"-tp2")
+	assert.Equal(t, quantity, parseFloat(stopLoss.OrigQuantity))
+	assert.Equal(t, quantity, parseFloat(takeProfit.OrigQuantity))
+
+	assert.Eventually(t, func() bool {
+		_, tp := openOrder(fake, order.Symbol, res.ID+"-tp")
+		_, sl := openOrder(fake, order.Symbol, res.ID+"-sl")
+		return !tp && !sl
+	}, 2*time.Second, 10*time.Millisecond, "replaced exit orders cancelled")
+}
+
+func TestRestoreBracketOrders(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("restarts can only be scripted against the fake server")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	ctx := context.Background()
+	client := newTestClient(t, user)
+	order := &models.BracketOrder{
+		Order: models.Order{
+			Type:        futures.OrderTypeLimit,
+			Symbol:      "ETHUSDT",
+			Side:        futures.SideTypeBuy,
+			Percentage:  0.01,
+			TimeInForce: futures.TimeInForceTypeGTC,
+			Price:       lastPriceDecreased("ETHUSDT"),
+		},
+		TakeProfitPrice: lastPriceIncreased("ETHUSDT"),
+		StopLossPrice:   calcLastPrice(-2*percentage, "ETHUSDT"),
+	}
+
+	res, err := client.CreateBracketOrder(ctx, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBracket(t, client, order)
+
+	// The service restarts, so the bracket isn't tracked anymore
+	br, ok := trackedBracket(client, res.ID)
+	if !ok {
+		t.Fatal("bracket not tracked")
+	}
+	trackedStream(client).untrack(br)
+
+	err = client.RestoreBracketOrders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, ok := trackedBracket(client, res.ID)
+	if !ok {
+		t.Fatal("bracket not restored")
+	}
+	assert.Equal(t, br.order.Side, restored.order.Side)
+	assert.Equal(t, br.order.PositionSide, restored.order.PositionSide)
+	assert.Equal(t, br.order.TakeProfitPrice, restored.order.TakeProfitPrice)
+	assert.Equal(t, br.order.StopLossPrice, restored.order.StopLossPrice)
+
+	// The restored bracket's exit orders are placed once the entry is filled
+	assert.True(t, fake.Fill(res.Entry.OrderID))
+	assert.Eventually(t, func() bool {
+		_, ok := openOrder(fake, order.Symbol, res.ID+"-tp")
+		return ok
+	}, 2*time.Second, 10*time.Millisecond, "take profit placed")
+	stopLoss, ok := openOrder(fake, order.Symbol, res.ID+"-sl")
+	assert.True(t, ok, "stop loss placed")
+	assert.Equal(t, br.order.StopLossPrice, stopLoss.StopPrice)
+	assert.Equal(t, res.Entry.OrigQuantity, stopLoss.OrigQuantity)
+}
+
+// parseFloat returns the float value of s, or 0 if it isn't a number.
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
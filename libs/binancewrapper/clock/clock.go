@@ -0,0 +1,201 @@
+// clock keeps the offset between the local time and the binance server time,
+// so signed requests are timestamped with the server's time.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	c       *Clock
+	once    sync.Once
+	nowFunc = time.Now
+
+	// defaultRefreshInterval is how often the offset is measured again, since
+	// the local clock drifts from the server's
+	defaultRefreshInterval = 5 * time.Minute
+
+	// minSyncInterval is how long a measured offset is kept before it can be
+	// measured again, so requests failing with -1021 at the same time only
+	// sync once
+	minSyncInterval = 1 * time.Second
+
+	// samples is how many server times are requested for each sync, the one
+	// with the shortest round trip is the most accurate
+	samples = 3
+
+	// syncTimeout is how long a sync waits for the server times
+	syncTimeout = 10 * time.Second
+)
+
+// Status is the clock's current offset from the binance server time.
+type Status struct {
+	// Offset is how far the server time is ahead of the local time in ms
+	Offset int64 `json:"offset"`
+
+	// RoundTrip is the round trip time in ms of the request the offset was
+	// measured with, the offset is accurate within half of it
+	RoundTrip int64 `json:"roundTrip"`
+
+	LastSync  *time.Time `json:"lastSync,omitempty"`
+	Syncs     int64      `json:"syncs"`
+	Failures  int64      `json:"failures"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// Clock measures the offset between the local time and the binance server
+// time.
+type Clock struct {
+	// serverTime returns the binance server time in ms
+	serverTime func(ctx context.Context) (int64, error)
+
+	// syncing serializes the syncs
+	syncing sync.Mutex
+
+	m         sync.RWMutex
+	offset    time.Duration
+	roundTrip time.Duration
+	lastSync  time.Time
+	syncs     int64
+	failures  int64
+	lastErr   error
+}
+
+// NewClock returns the clock shared by the process. The first call measures
+// the offset and refreshes it every defaultRefreshInterval.
+func NewClock() *Clock {
+	once.Do(func() {
+		client := ratelimit.NewClient("", "")
+		c = newClock(func(ctx context.Context) (int64, error) {
+			return client.NewServerTimeService().Do(ctx)
+		})
+		err := c.Sync(context.Background())
+		if err != nil {
+			log.WithField("Error", err).Error("Could not sync with the binance server time")
+		}
+		go c.refresh(defaultRefreshInterval)
+	})
+	return c
+}
+
+// newClock returns a clock measuring the offset from serverTime.
+func newClock(serverTime func(ctx context.Context) (int64, error)) *Clock {
+	return &Clock{serverTime: serverTime}
+}
+
+// Apply sets the client's time offset to the clock's offset. Clients keep the
+// offset they're created with, so it's applied again when the clock is resynced
+// after a -1021 error.
+func (c *Clock) Apply(client *futures.Client) {
+	// The client subtracts its TimeOffset from the local time
+	client.TimeOffset = -c.Offset().Milliseconds()
+}
+
+// Offset returns how far the server time is ahead of the local time.
+func (c *Clock) Offset() time.Duration {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.offset
+}
+
+// Now returns the current server time.
+func (c *Clock) Now() time.Time {
+	return nowFunc().Add(c.Offset())
+}
+
+// Sync measures the offset from the server time. The server time is assumed
+// to be measured halfway through the request, so the offset is compensated
+// for the round trip time. Syncs within minSyncInterval of the last one are
+// skipped.
+func (c *Clock) Sync(ctx context.Context) error {
+	c.syncing.Lock()
+	defer c.syncing.Unlock()
+
+	c.m.RLock()
+	synced := !c.lastSync.IsZero() && nowFunc().Sub(c.lastSync) < minSyncInterval
+	c.m.RUnlock()
+	if synced {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+
+	var offset, roundTrip time.Duration
+	var err error
+	measured := false
+	for i := 0; i < samples; i++ {
+		start := nowFunc()
+		var serverTime int64
+		serverTime, err = c.serverTime(ctx)
+		if err != nil {
+			break
+		}
+		end := nowFunc()
+
+		rtt := end.Sub(start)
+		if !measured || rtt < roundTrip {
+			offset = time.UnixMilli(serverTime).Sub(start.Add(rtt / 2))
+			roundTrip = rtt
+			measured = true
+		}
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if !measured {
+		c.failures++
+		c.lastErr = err
+		return err
+	}
+
+	c.offset = offset
+	c.roundTrip = roundTrip
+	c.lastSync = nowFunc()
+	c.syncs++
+	c.lastErr = nil
+
+	log.WithFields(log.Fields{
+		"Offset":    offset,
+		"RoundTrip": roundTrip,
+	}).Info("Updated time offset")
+	return nil
+}
+
+// refresh syncs the clock every interval.
+func (c *Clock) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := c.Sync(context.Background())
+		if err != nil {
+			log.WithField("Error", err).Error("Could not sync with the binance server time")
+		}
+	}
+}
+
+// Status returns the clock's current offset and its last syncs.
+func (c *Clock) Status() *Status {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	status := &Status{
+		Offset:    c.offset.Milliseconds(),
+		RoundTrip: c.roundTrip.Milliseconds(),
+		Syncs:     c.syncs,
+		Failures:  c.failures,
+	}
+	if !c.lastSync.IsZero() {
+		lastSync := c.lastSync
+		status.LastSync = &lastSync
+	}
+	if c.lastErr != nil {
+		status.LastError = c.lastErr.Error()
+	}
+	return status
+}
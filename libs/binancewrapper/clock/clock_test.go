@@ -0,0 +1,122 @@
+package clock
+
+import (
+	"context"
+	stderrors "errors"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock replaces nowFunc, the clock is moved forward by the round trips
+// of the server time requests.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock(t *testing.T) *fakeClock {
+	clock := &fakeClock{now: time.Date(2021, 11, 12, 10, 30, 15, 0, time.UTC)}
+	nowFunc = func() time.Time { return clock.now }
+	t.Cleanup(func() {
+		nowFunc = time.Now
+	})
+	return clock
+}
+
+func TestSyncRoundTripCompensation(t *testing.T) {
+	local := newFakeClock(t)
+	serverOffset := 2 * time.Second
+
+	// The server time is measured halfway through each round trip
+	roundTrips := []time.Duration{400 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond}
+	var n int
+	c := newClock(func(ctx context.Context) (int64, error) {
+		rtt := roundTrips[n]
+		n++
+		local.now = local.now.Add(rtt / 2)
+		serverTime := local.now.Add(serverOffset).UnixMilli()
+		local.now = local.now.Add(rtt / 2)
+		return serverTime, nil
+	})
+
+	err := c.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, serverOffset, c.Offset())
+
+	status := c.Status()
+	assert.Equal(t, int64(2000), status.Offset)
+	assert.Equal(t, int64(100), status.RoundTrip, "shortest round trip")
+	assert.Equal(t, int64(1), status.Syncs)
+	assert.NotNil(t, status.LastSync)
+
+	client := futures.NewClient("", "")
+	c.Apply(client)
+	assert.Equal(t, int64(-2000), client.TimeOffset)
+}
+
+func TestSyncInterval(t *testing.T) {
+	local := newFakeClock(t)
+	var requests int
+	c := newClock(func(ctx context.Context) (int64, error) {
+		requests++
+		return local.now.UnixMilli(), nil
+	})
+
+	assert.NoError(t, c.Sync(context.Background()))
+	assert.Equal(t, samples, requests)
+
+	// Concurrent -1021 errors only sync once
+	assert.NoError(t, c.Sync(context.Background()))
+	assert.Equal(t, samples, requests)
+
+	local.now = local.now.Add(minSyncInterval)
+	assert.NoError(t, c.Sync(context.Background()))
+	assert.Equal(t, 2*samples, requests)
+}
+
+func TestSyncFailure(t *testing.T) {
+	newFakeClock(t)
+	c := newClock(func(ctx context.Context) (int64, error) {
+		return 0, stderrors.New("connection refused")
+	})
+
+	assert.Error(t, c.Sync(context.Background()))
+	status := c.Status()
+	assert.Equal(t, int64(1), status.Failures)
+	assert.Equal(t, "connection refused", status.LastError)
+	assert.Nil(t, status.LastSync)
+}
+
+func TestSignedRequestsWithOffset(t *testing.T) {
+	server := fakebinance.New()
+	defer server.Close()
+
+	// The server is behind, so the local timestamps are ahead of it
+	server.SetTimeOffset(-3 * time.Second)
+
+	client := futures.NewClient("key", "secret")
+	client.BaseURL = server.URL
+	client.HTTPClient = server.Client()
+
+	ctx := context.Background()
+	_, err := client.NewGetAccountService().Do(ctx)
+	assert.Error(t, err, "timestamp ahead of the server time")
+
+	c := newClock(func(ctx context.Context) (int64, error) {
+		return client.NewServerTimeService().Do(ctx)
+	})
+	err = c.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.InDelta(t, -3000, c.Offset().Milliseconds(), 500)
+
+	c.Apply(client)
+	_, err = client.NewGetAccountService().Do(ctx)
+	assert.NoError(t, err)
+}
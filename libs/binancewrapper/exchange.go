@@ -0,0 +1,63 @@
+// Package binancewrapper wraps the binance api client
+package binancewrapper
+
+import (
+	"context"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+)
+
+// Exchange is a user's USD-(s)M futures account on the exchange. It's
+// implemented by the binance client, and by fakes in the tests.
+type Exchange interface {
+	GetAccount(ctx context.Context) (*futures.Account, error)
+	GetUSDTBalance(ctx context.Context) (*futures.Balance, error)
+
+	CreateOrder(ctx context.Context, order *models.Order) (*OrderResponse, error)
+	CreateBracketOrder(ctx context.Context, order *models.BracketOrder) (*BracketOrderResponse, error)
+	RestoreBracketOrders(ctx context.Context) error
+	GetOrder(ctx context.Context, symbol string, orderID int64, clientOrderID string) (*futures.Order, error)
+	ListOpenOrders(ctx context.Context, symbol string) ([]*futures.Order, error)
+	ListOrders(ctx context.Context, symbol string, limit int) ([]*futures.Order, error)
+	CancelOrder(ctx context.Context, symbol string, orderID int64, clientOrderID string) (*futures.CancelOrderResponse, error)
+	CancelMultipleOrders(ctx context.Context, symbol string, orderIDs []int64, clientOrderIDs []string) ([]*futures.CancelOrderResponse, error)
+	CancelAllOrders(ctx context.Context, symbol string) error
+
+	ListPositions(ctx context.Context, symbol string, minNotional float64) ([]*Position, error)
+	ClosePositions(ctx context.Context, symbol string) ([]*ClosePositionResult, error)
+	CloseAllPositions(ctx context.Context, symbol string, side futures.SideType, stopPrice string) (*futures.CreateOrderResponse, error)
+	GetPositionMode(ctx context.Context) (*futures.PositionMode, error)
+	ChangePositionMode(ctx context.Context, dualSide bool) error
+
+	ChangeSymbolLeverage(ctx context.Context, symbol string, leverage int, positions []*futures.AccountPosition) (bool, error)
+	ChangeSymbolMarginType(ctx context.Context, symbol string, marginType futures.MarginType, positions []*futures.AccountPosition) (bool, error)
+	GetLeverageBrackets(ctx context.Context, symbol string) ([]futures.Bracket, error)
+}
+
+var _ Exchange = (*binanceClient)(nil)
+
+// TimeSource sets the time offset the clients sign their requests with, e.g.
+// the shared clock.
+type TimeSource interface {
+	Apply(client *futures.Client)
+}
+
+// ExchangeFactory returns the Exchange of a user.
+type ExchangeFactory func(user *models.User) Exchange
+
+// NewExchangeFactory returns an ExchangeFactory creating binance clients that
+// look up last prices in prices, exchange info in symbols, order books in
+// books and mark prices in markPrices, with their time offset set by clock.
+func NewExchangeFactory(
+	prices store.PriceSource,
+	symbols store.SymbolInfoSource,
+	books store.OrderBookSource,
+	markPrices store.MarkPriceSource,
+	clock TimeSource,
+) ExchangeFactory {
+	return func(user *models.User) Exchange {
+		return newClient(user, prices, symbols, books, markPrices, clock)
+	}
+}
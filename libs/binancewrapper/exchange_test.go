@@ -0,0 +1,261 @@
+package binancewrapper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePrices is a fake store.PriceSource.
+type fakePrices map[string]string
+
+func (p fakePrices) GetLastPrice(symbol string) string {
+	return p[symbol]
+}
+
+func (p fakePrices) GetLastPriceFresh(symbol string, maxAge time.Duration) (string, error) {
+	price, ok := p[symbol]
+	if !ok {
+		return "", errors.NewUnknownSymbol(symbol)
+	}
+	return price, nil
+}
+
+// fakeSymbols is a fake store.SymbolInfoSource.
+type fakeSymbols map[string]futures.Symbol
+
+func (s fakeSymbols) GetSymbol(symbol string) (futures.Symbol, bool) {
+	info, ok := s[symbol]
+	return info, ok
+}
+
+// fakeMarkPrices is a fake store.MarkPriceSource.
+type fakeMarkPrices map[string]string
+
+func (p fakeMarkPrices) GetMarkPrice(symbol string) (store.MarkPrice, bool) {
+	price, ok := p[symbol]
+	return store.MarkPrice{Symbol: symbol, MarkPrice: price}, ok
+}
+
+func (p fakeMarkPrices) GetMarkPriceFresh(symbol string, maxAge time.Duration) (string, error) {
+	price, ok := p[symbol]
+	if !ok {
+		return "", errors.NewUnknownSymbol(symbol)
+	}
+	return price, nil
+}
+
+// fakeClock is a fake TimeSource with a fixed offset in ms.
+type fakeClock int64
+
+func (c fakeClock) Apply(client *futures.Client) {
+	client.TimeOffset = -int64(c)
+}
+
+// snapshotStores returns fake stores holding a snapshot of binance's last
+// prices, exchange info and mark prices.
+func snapshotStores(t *testing.T) (fakePrices, fakeSymbols, fakeMarkPrices) {
+	ctx := context.Background()
+	client := ratelimit.NewClient("", "")
+
+	tickers, err := client.NewListPricesService().Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := make(fakePrices)
+	for _, ticker := range tickers {
+		prices[ticker.Symbol] = ticker.Price
+	}
+
+	exchangeInfo, err := client.NewExchangeInfoService().Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := make(fakeSymbols)
+	for _, symbol := range exchangeInfo.Symbols {
+		symbols[symbol.Symbol] = symbol
+	}
+
+	premiums, err := client.NewPremiumIndexService().Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markPrices := make(fakeMarkPrices)
+	for _, premium := range premiums {
+		markPrices[premium.Symbol] = premium.MarkPrice
+	}
+	return prices, symbols, markPrices
+}
+
+// newFactoryClient returns the user's binance client built by an
+// ExchangeFactory with the stores and the shared clock.
+func newFactoryClient(
+	user *models.User,
+	prices store.PriceSource,
+	symbols store.SymbolInfoSource,
+	books store.OrderBookSource,
+	markPrices store.MarkPriceSource,
+) *binanceClient {
+	factory := NewExchangeFactory(prices, symbols, books, markPrices, clock.NewClock())
+	return factory(user).(*binanceClient)
+}
+
+// newTestClient returns the user's binance client built by an
+// ExchangeFactory with fake stores holding a snapshot of binance's market
+// data.
+func newTestClient(t *testing.T, user *models.User) *binanceClient {
+	prices, symbols, markPrices := snapshotStores(t)
+	return newFactoryClient(user, prices, symbols, &fakeBooks{}, markPrices)
+}
+
+// btcusdt is the exchange info of BTCUSDT with only the filters used by the
+// quantity calculation and the MIN_NOTIONAL filter check.
+var btcusdt = futures.Symbol{
+	Symbol:            "BTCUSDT",
+	Status:            "TRADING",
+	QuantityPrecision: 3,
+	Filters: []map[string]interface{}{
+		{"filterType": "LOT_SIZE", "minQty": "0.001", "maxQty": "1000", "stepSize": "0.001"},
+		{"filterType": "MARKET_LOT_SIZE", "minQty": "0.001", "maxQty": "120", "stepSize": "0.001"},
+		{"filterType": "MIN_NOTIONAL", "notional": "5"},
+	},
+}
+
+func TestCalculateQuantityWithFakeStores(t *testing.T) {
+	client := &binanceClient{
+		prices:  fakePrices{"BTCUSDT": "50000"},
+		symbols: fakeSymbols{"BTCUSDT": btcusdt},
+	}
+
+	tests := []struct {
+		name        string
+		symbol      string
+		size        float64
+		orderType   futures.OrderType
+		price       string
+		expected    string
+		expectedErr error
+	}{
+		{
+			name:      "market quantity rounded down to the step size",
+			symbol:    "BTCUSDT",
+			size:      1000,
+			orderType: futures.OrderTypeMarket,
+			price:     client.prices.GetLastPrice("BTCUSDT"),
+			expected:  "0.020",
+		},
+		{
+			name:      "limit quantity rounded down to the step size",
+			symbol:    "BTCUSDT",
+			size:      1000,
+			orderType: futures.OrderTypeLimit,
+			price:     "60000",
+			expected:  "0.016",
+		},
+		{
+			name:        "unknown symbol",
+			symbol:      "FOOUSDT",
+			size:        1000,
+			orderType:   futures.OrderTypeMarket,
+			price:       "1",
+			expectedErr: errors.NewUnknownSymbol("FOOUSDT"),
+		},
+	}
+
+	for _, tc := range tests {
+		quantity, err := client.calculateQuantity(tc.size, tc.symbol, tc.orderType, tc.price)
+		if tc.expectedErr != nil {
+			assert.EqualError(t, err, tc.expectedErr.Error(), tc.name)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.expected, quantity, tc.name)
+	}
+}
+
+func TestSizingPrice(t *testing.T) {
+	client := &binanceClient{
+		prices:     fakePrices{"BTCUSDT": "50000"},
+		markPrices: fakeMarkPrices{"BTCUSDT": "50100"},
+	}
+
+	price, err := client.sizingPrice(&models.Order{Type: futures.OrderTypeMarket, Symbol: "BTCUSDT"})
+	assert.NoError(t, err)
+	assert.Equal(t, "50000", price, "last price by default")
+
+	price, err = client.sizingPrice(&models.Order{Type: futures.OrderTypeMarket, Symbol: "BTCUSDT", SizingPrice: models.SizingPriceLast})
+	assert.NoError(t, err)
+	assert.Equal(t, "50000", price)
+
+	price, err = client.sizingPrice(&models.Order{Type: futures.OrderTypeMarket, Symbol: "BTCUSDT", SizingPrice: models.SizingPriceMark})
+	assert.NoError(t, err)
+	assert.Equal(t, "50100", price)
+
+	_, err = client.sizingPrice(&models.Order{Type: futures.OrderTypeMarket, Symbol: "FOOUSDT", SizingPrice: models.SizingPriceMark})
+	assert.EqualError(t, err, errors.NewUnknownSymbol("FOOUSDT").Error())
+}
+
+func TestCheckFiltersWithFakeStores(t *testing.T) {
+	client := &binanceClient{
+		prices:  fakePrices{"BTCUSDT": "50000"},
+		symbols: fakeSymbols{"BTCUSDT": btcusdt},
+	}
+	order := &models.Order{Type: futures.OrderTypeMarket, Symbol: "BTCUSDT"}
+
+	// MARKET orders use the last price for the notional, 0.001 * 50000 = 50
+	err := client.checkFilters(context.Background(), &btcusdt, order, "0.001")
+	assert.NoError(t, err)
+
+	client.prices = fakePrices{"BTCUSDT": "4000"}
+	err = client.checkFilters(context.Background(), &btcusdt, order, "0.001")
+	_, ok := errors.AsFilterError(err)
+	assert.True(t, ok, "notional below MIN_NOTIONAL")
+
+	// Reduce only orders are exempt from MIN_NOTIONAL
+	order.ReduceOnly = true
+	err = client.checkFilters(context.Background(), &btcusdt, order, "0.001")
+	assert.NoError(t, err, "reduce only notional below MIN_NOTIONAL")
+}
+
+func TestCreateOrderSymbolNotTrading(t *testing.T) {
+	settling := btcusdt
+	settling.Status = "SETTLING"
+	client := &binanceClient{
+		prices:  fakePrices{"BTCUSDT": "50000"},
+		symbols: fakeSymbols{"BTCUSDT": settling},
+	}
+
+	order := models.Order{Type: futures.OrderTypeMarket, Symbol: "BTCUSDT", Side: futures.SideTypeBuy, Percentage: 0.5}
+	_, err := client.CreateOrder(context.Background(), &order)
+	assert.EqualError(t, err, errors.NewSymbolNotTrading("BTCUSDT", "SETTLING").Error())
+
+	_, err = client.CreateBracketOrder(context.Background(), &models.BracketOrder{
+		Order:           order,
+		TakeProfitPrice: "60000",
+		StopLossPrice:   "40000",
+	})
+	assert.EqualError(t, err, errors.NewSymbolNotTrading("BTCUSDT", "SETTLING").Error(), "bracket order")
+}
+
+func TestExchangeFactory(t *testing.T) {
+	// The exchanges are created without any binance request
+	factory := NewExchangeFactory(fakePrices{}, fakeSymbols{}, &fakeBooks{}, fakeMarkPrices{}, fakeClock(1500))
+	exchange := factory(&models.User{APIKey: "key", APISecret: "secret", Leverage: 20})
+
+	client, ok := exchange.(*binanceClient)
+	if !ok {
+		t.Fatal("not a binance client")
+	}
+	assert.Equal(t, int64(-1500), client.c.TimeOffset, "offset applied")
+	assert.Equal(t, 20, client.leverage)
+}
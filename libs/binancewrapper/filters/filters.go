@@ -0,0 +1,301 @@
+// Package filters enforces the binance futures symbol filters on orders
+// before they're sent to binance.
+//
+// See https://binance-docs.github.io/apidocs/futures/en/#filters
+package filters
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+)
+
+// epsilon compensates for float64 representation errors when rounding to a
+// step or tick size, e.g. 0.3 / 0.1 = 2.9999999999999996.
+const epsilon = 1e-9
+
+// leverageBracketFilter isn't a binance symbol filter, but the leverage
+// brackets are enforced the same way.
+const leverageBracketFilter = "LEVERAGE_BRACKET"
+
+// Quantity rounds quantity down to the symbol's step size and checks it's
+// within the symbol's min and max quantity. MARKET orders use the
+// MARKET_LOT_SIZE filter and every other order type uses the LOT_SIZE filter.
+func Quantity(s *futures.Symbol, orderType futures.OrderType, quantity float64) (string, error) {
+	filterType := futures.SymbolFilterTypeLotSize
+	var minQty, maxQty, stepSize string
+	if lot := s.LotSizeFilter(); lot != nil {
+		minQty, maxQty, stepSize = lot.MinQuantity, lot.MaxQuantity, lot.StepSize
+	}
+	if orderType == futures.OrderTypeMarket {
+		if lot := s.MarketLotSizeFilter(); lot != nil {
+			filterType = futures.SymbolFilterTypeMarketLotSize
+			minQty, maxQty, stepSize = lot.MinQuantity, lot.MaxQuantity, lot.StepSize
+		}
+	}
+
+	step := parse(stepSize)
+	precision := s.QuantityPrecision
+	if step > 0 {
+		quantity = math.Floor(quantity/step+epsilon) * step
+		precision = decimals(stepSize)
+	}
+	rounded := strconv.FormatFloat(quantity, 'f', precision, 64)
+
+	if min := parse(minQty); quantity < min {
+		return "", errors.NewFilterError(
+			s.Symbol,
+			string(filterType),
+			fmt.Sprintf("quantity %s is less than the min quantity %s", rounded, minQty),
+		)
+	}
+	if max := parse(maxQty); max > 0 && quantity > max {
+		return "", errors.NewFilterError(
+			s.Symbol,
+			string(filterType),
+			fmt.Sprintf("quantity %s is greater than the max quantity %s", rounded, maxQty),
+		)
+	}
+	return rounded, nil
+}
+
+// Split splits a MARKET order's quantity into as few quantities as possible
+// of at most the symbol's MARKET_LOT_SIZE max quantity, as even as the step
+// size allows so none of them is left below the min quantity. The quantity
+// must already be a multiple of the step size, e.g. a position's amount.
+func Split(s *futures.Symbol, quantity string) []string {
+	lot := s.MarketLotSizeFilter()
+	if lot == nil {
+		return []string{quantity}
+	}
+	max := parse(lot.MaxQuantity)
+	total := parse(quantity)
+	if max <= 0 || total <= max {
+		return []string{quantity}
+	}
+
+	step := parse(lot.StepSize)
+	precision := decimals(lot.StepSize)
+	if step <= 0 {
+		precision = decimals(quantity)
+		step = math.Pow10(-precision)
+	}
+
+	// The quantities are split in whole steps so they add up exactly
+	steps := int64(math.Round(total / step))
+	maxSteps := int64(math.Floor(max/step + epsilon))
+	n := (steps + maxSteps - 1) / maxSteps
+	quantities := make([]string, n)
+	for i := int64(0); i < n; i++ {
+		chunk := steps / n
+		if i < steps%n {
+			chunk++
+		}
+		quantities[i] = strconv.FormatFloat(float64(chunk)*step, 'f', precision, 64)
+	}
+	return quantities
+}
+
+// Price rounds price to the nearest multiple of the symbol's tick size and
+// checks it's within the symbol's min and max price.
+func Price(s *futures.Symbol, price string) (string, error) {
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return "", errors.NewFilterError(
+			s.Symbol,
+			string(futures.SymbolFilterTypePrice),
+			fmt.Sprintf("invalid price %q", price),
+		)
+	}
+
+	f := s.PriceFilter()
+	if f == nil {
+		return price, nil
+	}
+
+	precision := s.PricePrecision
+	if tick := parse(f.TickSize); tick > 0 {
+		p = math.Round(p/tick) * tick
+		precision = decimals(f.TickSize)
+	}
+	rounded := strconv.FormatFloat(p, 'f', precision, 64)
+
+	if min := parse(f.MinPrice); p < min {
+		return "", errors.NewFilterError(
+			s.Symbol,
+			string(futures.SymbolFilterTypePrice),
+			fmt.Sprintf("price %s is less than the min price %s", rounded, f.MinPrice),
+		)
+	}
+	if max := parse(f.MaxPrice); max > 0 && p > max {
+		return "", errors.NewFilterError(
+			s.Symbol,
+			string(futures.SymbolFilterTypePrice),
+			fmt.Sprintf("price %s is greater than the max price %s", rounded, f.MaxPrice),
+		)
+	}
+	return rounded, nil
+}
+
+// PercentPrice checks a LIMIT order's price against the reference (mark)
+// price. A BUY price can't be above referencePrice * multiplierUp and a SELL
+// price can't be below referencePrice * multiplierDown.
+func PercentPrice(
+	s *futures.Symbol,
+	side futures.SideType,
+	price float64,
+	referencePrice float64,
+) error {
+	f := s.PercentPriceFilter()
+	if f == nil || referencePrice <= 0 {
+		return nil
+	}
+
+	switch side {
+	case futures.SideTypeBuy:
+		up := parse(f.MultiplierUp)
+		if up > 0 && price > referencePrice*up+epsilon {
+			return errors.NewFilterError(
+				s.Symbol,
+				string(futures.SymbolFilterTypePercentPrice),
+				fmt.Sprintf("BUY price %v is greater than %v * %s", price, referencePrice, f.MultiplierUp),
+			)
+		}
+	case futures.SideTypeSell:
+		down := parse(f.MultiplierDown)
+		if price < referencePrice*down-epsilon {
+			return errors.NewFilterError(
+				s.Symbol,
+				string(futures.SymbolFilterTypePercentPrice),
+				fmt.Sprintf("SELL price %v is less than %v * %s", price, referencePrice, f.MultiplierDown),
+			)
+		}
+	}
+	return nil
+}
+
+// MinNotional checks the order's notional value (quantity * price) is at
+// least the symbol's min notional.
+func MinNotional(s *futures.Symbol, quantity, price float64) error {
+	f := s.MinNotionalFilter()
+	if f == nil {
+		return nil
+	}
+
+	if min := parse(f.Notional); quantity*price < min-epsilon {
+		return errors.NewFilterError(
+			s.Symbol,
+			string(futures.SymbolFilterTypeMinNotional),
+			fmt.Sprintf("notional %v is less than the min notional %s", quantity*price, f.Notional),
+		)
+	}
+	return nil
+}
+
+// MaxNumOrders checks another order can be opened given the symbol's open
+// orders. STOP_MARKET, TAKE_PROFIT_MARKET and other conditional orders are
+// limited by the MAX_NUM_ALGO_ORDERS filter, every other order type by the
+// MAX_NUM_ORDERS filter.
+func MaxNumOrders(
+	s *futures.Symbol,
+	orderType futures.OrderType,
+	openOrders []*futures.Order,
+) error {
+	filterType := futures.SymbolFilterTypeMaxNumOrders
+	var limit int64
+	if isAlgo(orderType) {
+		filterType = futures.SymbolFilterTypeMaxNumAlgoOrders
+		if f := s.MaxNumAlgoOrdersFilter(); f != nil {
+			limit = f.Limit
+		}
+	} else if f := s.MaxNumOrdersFilter(); f != nil {
+		limit = f.Limit
+	}
+
+	var count int64
+	for _, o := range openOrders {
+		if isAlgo(o.Type) == isAlgo(orderType) {
+			count++
+		}
+	}
+
+	if limit > 0 && count >= limit {
+		return errors.NewFilterError(
+			s.Symbol,
+			string(filterType),
+			fmt.Sprintf("%d open orders, the max is %d", count, limit),
+		)
+	}
+	return nil
+}
+
+// LeverageBracket checks the leverage is allowed for the position notional by
+// the symbol's leverage brackets. The bracket containing the notional sets the
+// max initial leverage.
+func LeverageBracket(
+	symbol string,
+	brackets []futures.Bracket,
+	leverage int,
+	notional float64,
+) error {
+	for _, bracket := range brackets {
+		if notional < bracket.NotionalFloor || notional >= bracket.NotionalCap {
+			continue
+		}
+		if leverage > bracket.InitialLeverage {
+			return errors.NewFilterError(
+				symbol,
+				leverageBracketFilter,
+				fmt.Sprintf(
+					"leverage %dx is greater than the max leverage %dx for notional %v",
+					leverage,
+					bracket.InitialLeverage,
+					notional,
+				),
+			)
+		}
+		return nil
+	}
+
+	if len(brackets) == 0 {
+		return nil
+	}
+	return errors.NewFilterError(
+		symbol,
+		leverageBracketFilter,
+		fmt.Sprintf("notional %v is greater than the max notional of every bracket", notional),
+	)
+}
+
+// isAlgo returns whether the order type is a conditional order.
+func isAlgo(orderType futures.OrderType) bool {
+	switch orderType {
+	case futures.OrderTypeStop,
+		futures.OrderTypeStopMarket,
+		futures.OrderTypeTakeProfit,
+		futures.OrderTypeTakeProfitMarket,
+		futures.OrderTypeTrailingStopMarket:
+		return true
+	}
+	return false
+}
+
+// parse returns the float value of a filter, or 0 if the filter is empty.
+func parse(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
+
+// decimals returns the number of significant decimal places of a step or tick
+// size, e.g. 3 for "0.00100000" and 0 for "1".
+func decimals(size string) int {
+	i := strings.IndexByte(size, '.')
+	if i < 0 {
+		return 0
+	}
+	return len(strings.TrimRight(size[i+1:], "0"))
+}
@@ -0,0 +1,430 @@
+package filters
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadSymbols returns the symbols of the stored exchangeInfo fixture.
+func loadSymbols(t *testing.T) map[string]*futures.Symbol {
+	data, err := ioutil.ReadFile("testdata/exchangeInfo.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exchangeInfo futures.ExchangeInfo
+	err = json.Unmarshal(data, &exchangeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	symbols := make(map[string]*futures.Symbol)
+	for i := range exchangeInfo.Symbols {
+		s := &exchangeInfo.Symbols[i]
+		symbols[s.Symbol] = s
+	}
+	return symbols
+}
+
+// filterOf returns the filter type of a FilterError, or "" if err isn't one.
+func filterOf(err error) string {
+	if filterErr, ok := err.(*errors.FilterError); ok {
+		return filterErr.Filter
+	}
+	return ""
+}
+
+// openOrders returns n open BTCUSDT orders of orderType.
+func openOrders(n int, orderType futures.OrderType) []*futures.Order {
+	orders := make([]*futures.Order, n)
+	for i := range orders {
+		orders[i] = &futures.Order{Symbol: "BTCUSDT", Type: orderType}
+	}
+	return orders
+}
+
+func TestQuantity(t *testing.T) {
+	symbols := loadSymbols(t)
+
+	tests := []struct {
+		name           string
+		symbol         string
+		orderType      futures.OrderType
+		quantity       float64
+		expected       string
+		expectedFilter futures.SymbolFilterType
+	}{
+		{
+			name:      "round BTCUSDT quantity down to step size",
+			symbol:    "BTCUSDT",
+			orderType: futures.OrderTypeLimit,
+			quantity:  1.8518518,
+			expected:  "1.851",
+		},
+		{
+			name:      "keep exact BTCUSDT quantity",
+			symbol:    "BTCUSDT",
+			orderType: futures.OrderTypeLimit,
+			quantity:  0.3,
+			expected:  "0.300",
+		},
+		{
+			name:      "round TRXUSDT quantity down to whole step size",
+			symbol:    "TRXUSDT",
+			orderType: futures.OrderTypeMarket,
+			quantity:  1234.99,
+			expected:  "1234",
+		},
+		{
+			name:           "BTCUSDT quantity rounded below min quantity",
+			symbol:         "BTCUSDT",
+			orderType:      futures.OrderTypeLimit,
+			quantity:       0.0009,
+			expectedFilter: futures.SymbolFilterTypeLotSize,
+		},
+		{
+			name:           "BTCUSDT limit quantity above max quantity",
+			symbol:         "BTCUSDT",
+			orderType:      futures.OrderTypeLimit,
+			quantity:       1000.5,
+			expectedFilter: futures.SymbolFilterTypeLotSize,
+		},
+		{
+			name:      "BTCUSDT limit quantity above market max quantity",
+			symbol:    "BTCUSDT",
+			orderType: futures.OrderTypeLimit,
+			quantity:  500,
+			expected:  "500.000",
+		},
+		{
+			name:           "BTCUSDT market quantity above market max quantity",
+			symbol:         "BTCUSDT",
+			orderType:      futures.OrderTypeMarket,
+			quantity:       500,
+			expectedFilter: futures.SymbolFilterTypeMarketLotSize,
+		},
+	}
+
+	for _, tc := range tests {
+		actual, err := Quantity(symbols[tc.symbol], tc.orderType, tc.quantity)
+		if tc.expectedFilter != "" {
+			assert.Equal(t, string(tc.expectedFilter), filterOf(err), tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, actual, tc.name)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	symbols := loadSymbols(t)
+
+	tests := []struct {
+		name     string
+		symbol   string
+		quantity string
+		expected []string
+	}{
+		{
+			name:     "BTCUSDT quantity within market max quantity",
+			symbol:   "BTCUSDT",
+			quantity: "1.5",
+			expected: []string{"1.5"},
+		},
+		{
+			name:     "BTCUSDT quantity at market max quantity",
+			symbol:   "BTCUSDT",
+			quantity: "120",
+			expected: []string{"120"},
+		},
+		{
+			name:     "BTCUSDT quantity split evenly",
+			symbol:   "BTCUSDT",
+			quantity: "250",
+			expected: []string{"83.334", "83.333", "83.333"},
+		},
+		{
+			name:     "BTCUSDT quantity split just above market max quantity",
+			symbol:   "BTCUSDT",
+			quantity: "120.001",
+			expected: []string{"60.001", "60.000"},
+		},
+		{
+			name:     "TRXUSDT quantity split in whole steps",
+			symbol:   "TRXUSDT",
+			quantity: "5000001",
+			expected: []string{"2500001", "2500000"},
+		},
+	}
+
+	for _, tc := range tests {
+		actual := Split(symbols[tc.symbol], tc.quantity)
+		assert.Equal(t, tc.expected, actual, tc.name)
+	}
+}
+
+func TestPrice(t *testing.T) {
+	symbols := loadSymbols(t)
+
+	tests := []struct {
+		name           string
+		symbol         string
+		price          string
+		expected       string
+		expectedFilter futures.SymbolFilterType
+	}{
+		{
+			name:     "round BTCUSDT price to tick size",
+			symbol:   "BTCUSDT",
+			price:    "60000.126",
+			expected: "60000.13",
+		},
+		{
+			name:     "round TRXUSDT price to tick size",
+			symbol:   "TRXUSDT",
+			price:    "0.0987654",
+			expected: "0.09877",
+		},
+		{
+			name:           "ETHUSDT price below min price",
+			symbol:         "ETHUSDT",
+			price:          "10",
+			expectedFilter: futures.SymbolFilterTypePrice,
+		},
+		{
+			name:           "TRXUSDT price above max price",
+			symbol:         "TRXUSDT",
+			price:          "21",
+			expectedFilter: futures.SymbolFilterTypePrice,
+		},
+		{
+			name:           "invalid price",
+			symbol:         "BTCUSDT",
+			price:          "sixty thousand",
+			expectedFilter: futures.SymbolFilterTypePrice,
+		},
+	}
+
+	for _, tc := range tests {
+		actual, err := Price(symbols[tc.symbol], tc.price)
+		if tc.expectedFilter != "" {
+			assert.Equal(t, string(tc.expectedFilter), filterOf(err), tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, actual, tc.name)
+	}
+}
+
+func TestPercentPrice(t *testing.T) {
+	symbols := loadSymbols(t)
+
+	tests := []struct {
+		name           string
+		symbol         string
+		side           futures.SideType
+		price          float64
+		referencePrice float64
+		expectedErr    bool
+	}{
+		{
+			name:           "BTCUSDT buy within multiplier up",
+			symbol:         "BTCUSDT",
+			side:           futures.SideTypeBuy,
+			price:          62900,
+			referencePrice: 60000,
+		},
+		{
+			name:           "BTCUSDT buy above multiplier up",
+			symbol:         "BTCUSDT",
+			side:           futures.SideTypeBuy,
+			price:          63100,
+			referencePrice: 60000,
+			expectedErr:    true,
+		},
+		{
+			name:           "BTCUSDT sell far above reference price",
+			symbol:         "BTCUSDT",
+			side:           futures.SideTypeSell,
+			price:          70000,
+			referencePrice: 60000,
+		},
+		{
+			name:           "BTCUSDT sell below multiplier down",
+			symbol:         "BTCUSDT",
+			side:           futures.SideTypeSell,
+			price:          56900,
+			referencePrice: 60000,
+			expectedErr:    true,
+		},
+		{
+			name:           "TRXUSDT sell within wider multiplier down",
+			symbol:         "TRXUSDT",
+			side:           futures.SideTypeSell,
+			price:          0.086,
+			referencePrice: 0.1,
+		},
+		{
+			name:           "no reference price",
+			symbol:         "BTCUSDT",
+			side:           futures.SideTypeBuy,
+			price:          100000,
+			referencePrice: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		err := PercentPrice(symbols[tc.symbol], tc.side, tc.price, tc.referencePrice)
+		if tc.expectedErr {
+			assert.Equal(t, string(futures.SymbolFilterTypePercentPrice), filterOf(err), tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+	}
+}
+
+func TestMinNotional(t *testing.T) {
+	symbols := loadSymbols(t)
+
+	tests := []struct {
+		name        string
+		symbol      string
+		quantity    float64
+		price       float64
+		expectedErr bool
+	}{
+		{
+			name:     "BTCUSDT notional above min notional",
+			symbol:   "BTCUSDT",
+			quantity: 0.001,
+			price:    60000,
+		},
+		{
+			name:     "TRXUSDT notional equal to min notional",
+			symbol:   "TRXUSDT",
+			quantity: 50,
+			price:    0.1,
+		},
+		{
+			name:        "TRXUSDT notional below min notional",
+			symbol:      "TRXUSDT",
+			quantity:    49,
+			price:       0.1,
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		err := MinNotional(symbols[tc.symbol], tc.quantity, tc.price)
+		if tc.expectedErr {
+			assert.Equal(t, string(futures.SymbolFilterTypeMinNotional), filterOf(err), tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+	}
+}
+
+func TestMaxNumOrders(t *testing.T) {
+	symbols := loadSymbols(t)
+
+	tests := []struct {
+		name           string
+		orderType      futures.OrderType
+		openOrders     []*futures.Order
+		expectedFilter futures.SymbolFilterType
+	}{
+		{
+			name:       "limit order below max num orders",
+			orderType:  futures.OrderTypeLimit,
+			openOrders: openOrders(199, futures.OrderTypeLimit),
+		},
+		{
+			name:           "limit order at max num orders",
+			orderType:      futures.OrderTypeLimit,
+			openOrders:     openOrders(200, futures.OrderTypeLimit),
+			expectedFilter: futures.SymbolFilterTypeMaxNumOrders,
+		},
+		{
+			name:       "stop market order below max num algo orders",
+			orderType:  futures.OrderTypeStopMarket,
+			openOrders: append(openOrders(9, futures.OrderTypeStopMarket), openOrders(50, futures.OrderTypeLimit)...),
+		},
+		{
+			name:           "stop market order at max num algo orders",
+			orderType:      futures.OrderTypeStopMarket,
+			openOrders:     openOrders(10, futures.OrderTypeTakeProfitMarket),
+			expectedFilter: futures.SymbolFilterTypeMaxNumAlgoOrders,
+		},
+	}
+
+	for _, tc := range tests {
+		err := MaxNumOrders(symbols["BTCUSDT"], tc.orderType, tc.openOrders)
+		if tc.expectedFilter != "" {
+			assert.Equal(t, string(tc.expectedFilter), filterOf(err), tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+	}
+}
+
+func TestLeverageBracket(t *testing.T) {
+	brackets := []futures.Bracket{
+		{Bracket: 1, InitialLeverage: 125, NotionalFloor: 0, NotionalCap: 50000},
+		{Bracket: 2, InitialLeverage: 100, NotionalFloor: 50000, NotionalCap: 250000},
+		{Bracket: 3, InitialLeverage: 50, NotionalFloor: 250000, NotionalCap: 1000000},
+	}
+
+	tests := []struct {
+		name        string
+		brackets    []futures.Bracket
+		leverage    int
+		notional    float64
+		expectedErr bool
+	}{
+		{
+			name:     "max leverage in first bracket",
+			brackets: brackets,
+			leverage: 125,
+			notional: 49999,
+		},
+		{
+			name:        "leverage above second bracket max",
+			brackets:    brackets,
+			leverage:    125,
+			notional:    50000,
+			expectedErr: true,
+		},
+		{
+			name:     "leverage within third bracket",
+			brackets: brackets,
+			leverage: 20,
+			notional: 500000,
+		},
+		{
+			name:        "notional above every bracket",
+			brackets:    brackets,
+			leverage:    1,
+			notional:    1000000,
+			expectedErr: true,
+		},
+		{
+			name:     "no brackets",
+			leverage: 125,
+			notional: 1000000,
+		},
+	}
+
+	for _, tc := range tests {
+		err := LeverageBracket("BTCUSDT", tc.brackets, tc.leverage, tc.notional)
+		if tc.expectedErr {
+			assert.Equal(t, leverageBracketFilter, filterOf(err), tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+	}
+}
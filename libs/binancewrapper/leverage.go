@@ -3,18 +3,86 @@ package binancewrapper
 
 import (
 	"context"
+	"math"
 	"strconv"
 
 	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/filters"
 	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	// defaultLeverage is 10x cross
+	// defaultLeverage is 10x, used when neither the order nor the user set a
+	// leverage
 	defaultLeverage = 10
+
+	// defaultMarginType is cross, used when neither the order nor the user set
+	// a margin type
+	defaultMarginType = futures.MarginTypeCrossed
+
+	// maxLeverage is the highest leverage binance allows for any symbol
+	maxLeverage = 125
 )
 
+// getLeverage returns the leverage and margin type of the order, falling back
+// to the user's and then to the defaults.
+func (b *binanceClient) getLeverage(order *models.Order) (int, futures.MarginType, error) {
+	leverage := order.Leverage
+	if leverage == 0 {
+		leverage = b.leverage
+	}
+	if leverage == 0 {
+		leverage = defaultLeverage
+	}
+	if leverage < 1 || leverage > maxLeverage {
+		return 0, "", errors.NewValidationError(
+			"leverage",
+			"must be between 1 and "+strconv.Itoa(maxLeverage),
+		)
+	}
+
+	marginType := order.MarginType
+	if marginType == "" {
+		marginType = b.marginType
+	}
+	if marginType == "" {
+		marginType = defaultMarginType
+	}
+	if marginType != futures.MarginTypeCrossed && marginType != futures.MarginTypeIsolated {
+		return 0, "", errors.NewValidationError(
+			"marginType",
+			"must be either ISOLATED or CROSSED",
+		)
+	}
+	return leverage, marginType, nil
+}
+
+// applyLeverage changes the order symbol's margin type and leverage to the
+// order's if they differ from the ones in the account's positions.
+func (b *binanceClient) applyLeverage(
+	ctx context.Context,
+	order *models.Order,
+	positions []*futures.AccountPosition,
+) error {
+	leverage, marginType, err := b.getLeverage(order)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.ChangeSymbolMarginType(ctx, order.Symbol, marginType, positions)
+	if err != nil {
+		return err
+	}
+
+	// Since the default leverage for symbols is 20x, we might need to update
+	// the symbol leverage
+	_, err = b.ChangeSymbolLeverage(ctx, order.Symbol, leverage, positions)
+	return err
+}
+
 // changeLeverage changes the symbol's initial leverage.
 func (b *binanceClient) changeLeverage(
 	ctx context.Context,
@@ -24,17 +92,11 @@ func (b *binanceClient) changeLeverage(
 	svc := b.c.NewChangeLeverageService().
 		Leverage(leverage).
 		Symbol(symbol)
-	var res *futures.SymbolLeverage
-	res, err := svc.Do(ctx)
+	res, err := retry.Do(ctx, b.c, "ChangeLeverage", func(opts ...futures.RequestOption) (*futures.SymbolLeverage, error) {
+		return svc.Do(ctx, opts...)
+	})
 	if err != nil {
-		retryRes, err := retry.Do(err, func(opts ...futures.RequestOption) (interface{}, error) {
-			log.WithField("recvWindow", opts).Info("Retrying ChangeLeverage request")
-			return svc.Do(ctx, opts...)
-		})
-		if err != nil {
-			return err
-		}
-		res = retryRes.(*futures.SymbolLeverage)
+		return err
 	}
 
 	log.WithFields(log.Fields{
@@ -44,12 +106,13 @@ func (b *binanceClient) changeLeverage(
 	return nil
 }
 
-// changeSymbolLeverage will change the symbol's initial leverage if its not the
+// ChangeSymbolLeverage will change the symbol's initial leverage if its not the
 // same as the desired symbol leverage. Returns whether or not the leverage was
 // changed.
-func (b *binanceClient) changeSymbolLeverage(
+func (b *binanceClient) ChangeSymbolLeverage(
 	ctx context.Context,
 	symbol string,
+	leverage int,
 	positions []*futures.AccountPosition,
 ) (bool, error) {
 	changed := false
@@ -57,8 +120,8 @@ func (b *binanceClient) changeSymbolLeverage(
 	if err != nil {
 		return changed, err
 	}
-	if currentLeverage != defaultLeverage {
-		err := b.changeLeverage(ctx, symbol, defaultLeverage)
+	if currentLeverage != leverage {
+		err := b.changeLeverage(ctx, symbol, leverage)
 		if err != nil {
 			return changed, err
 		}
@@ -81,3 +144,102 @@ func getCurrentLeverage(symbol string, positions []*futures.AccountPosition) (in
 	}
 	return currentLeverage, nil
 }
+
+// changeMarginType changes the symbol's margin type.
+func (b *binanceClient) changeMarginType(
+	ctx context.Context,
+	symbol string,
+	marginType futures.MarginType,
+) error {
+	svc := b.c.NewChangeMarginTypeService().
+		MarginType(marginType).
+		Symbol(symbol)
+	err := retry.DoErr(ctx, b.c, "ChangeMarginType", func(opts ...futures.RequestOption) error {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"Symbol":         symbol,
+		"New MarginType": marginType,
+	}).Info("Changed symbol margin type")
+	return nil
+}
+
+// ChangeSymbolMarginType will change the symbol's margin type if its not the
+// same as the desired margin type. Returns whether or not the margin type was
+// changed.
+func (b *binanceClient) ChangeSymbolMarginType(
+	ctx context.Context,
+	symbol string,
+	marginType futures.MarginType,
+	positions []*futures.AccountPosition,
+) (bool, error) {
+	if getCurrentMarginType(symbol, positions) == marginType {
+		return false, nil
+	}
+	err := b.changeMarginType(ctx, symbol, marginType)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getCurrentMarginType returns the current margin type for a symbol.
+func getCurrentMarginType(symbol string, positions []*futures.AccountPosition) futures.MarginType {
+	for _, position := range positions {
+		if position.Symbol == symbol && position.Isolated {
+			return futures.MarginTypeIsolated
+		}
+	}
+	return futures.MarginTypeCrossed
+}
+
+// GetLeverageBrackets returns the notional and leverage brackets for a symbol.
+func (b *binanceClient) GetLeverageBrackets(
+	ctx context.Context,
+	symbol string,
+) ([]futures.Bracket, error) {
+	svc := b.c.NewGetLeverageBracketService().Symbol(symbol)
+	res, err := retry.Do(ctx, b.c, "GetLeverageBracket", func(opts ...futures.RequestOption) ([]*futures.LeverageBracket, error) {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, leverageBracket := range res {
+		if leverageBracket.Symbol == symbol {
+			return leverageBracket.Brackets, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkLeverageBracket checks the leverage is allowed for the symbol's
+// position notional after adding positionSize to the current position on the
+// position side.
+func (b *binanceClient) checkLeverageBracket(
+	ctx context.Context,
+	symbol string,
+	positionSide futures.PositionSideType,
+	leverage int,
+	positionSize float64,
+	positions []*futures.AccountPosition,
+) error {
+	brackets, err := b.GetLeverageBrackets(ctx, symbol)
+	if err != nil {
+		return err
+	}
+
+	notional := positionSize
+	for _, position := range positions {
+		if position.Symbol == symbol && position.PositionSide == positionSide {
+			current, _ := strconv.ParseFloat(position.Notional, 64)
+			notional += math.Abs(current)
+		}
+	}
+	return filters.LeverageBracket(symbol, brackets, leverage, notional)
+}
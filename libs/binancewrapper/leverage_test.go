@@ -5,6 +5,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/adshao/go-binance/v2/futures"
 	"github.com/bosdhill/golang-binance-service/core/models"
 	"github.com/bosdhill/golang-binance-service/libs/test"
 	"github.com/stretchr/testify/assert"
@@ -21,7 +22,7 @@ func TestChangeSymbolLeverage(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	client := NewClient(&user)
+	client := newTestClient(t, &user)
 
 	tests := []struct {
 		name     string
@@ -63,7 +64,7 @@ func TestChangeSymbolLeverage(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		changed, err := client.changeSymbolLeverage(ctx, tc.symbol, account.Positions)
+		changed, err := client.ChangeSymbolLeverage(ctx, tc.symbol, defaultLeverage, account.Positions)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -71,3 +72,115 @@ func TestChangeSymbolLeverage(t *testing.T) {
 		assert.Equal(t, tc.expected, changed, tc.name)
 	}
 }
+
+func TestChangeSymbolMarginType(t *testing.T) {
+	user := models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	ctx := context.Background()
+	client := newTestClient(t, &user)
+
+	tests := []struct {
+		name       string
+		symbol     string
+		marginType futures.MarginType
+		expected   bool
+	}{
+		{
+			name:       "change ETHUSDT margin type to isolated",
+			symbol:     "ETHUSDT",
+			marginType: futures.MarginTypeIsolated,
+			expected:   true,
+		},
+		{
+			name:       "don't change ETHUSDT margin type",
+			symbol:     "ETHUSDT",
+			marginType: futures.MarginTypeIsolated,
+			expected:   false,
+		},
+		{
+			name:       "change ETHUSDT margin type back to crossed",
+			symbol:     "ETHUSDT",
+			marginType: futures.MarginTypeCrossed,
+			expected:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		account, err := client.GetAccount(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changed, err := client.ChangeSymbolMarginType(ctx, tc.symbol, tc.marginType, account.Positions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, tc.expected, changed, tc.name)
+	}
+}
+
+func TestGetLeverage(t *testing.T) {
+	user := models.User{
+		Leverage:   5,
+		MarginType: futures.MarginTypeIsolated,
+	}
+	client := newTestClient(t, &user)
+
+	tests := []struct {
+		name               string
+		client             *binanceClient
+		order              *models.Order
+		expectedLeverage   int
+		expectedMarginType futures.MarginType
+		expectedErr        bool
+	}{
+		{
+			name:               "defaults",
+			client:             newFactoryClient(&models.User{}, fakePrices{}, fakeSymbols{}, &fakeBooks{}, fakeMarkPrices{}),
+			order:              &models.Order{},
+			expectedLeverage:   defaultLeverage,
+			expectedMarginType: defaultMarginType,
+		},
+		{
+			name:               "user defaults",
+			client:             client,
+			order:              &models.Order{},
+			expectedLeverage:   5,
+			expectedMarginType: futures.MarginTypeIsolated,
+		},
+		{
+			name:               "order overrides user defaults",
+			client:             client,
+			order:              &models.Order{Leverage: 20, MarginType: futures.MarginTypeCrossed},
+			expectedLeverage:   20,
+			expectedMarginType: futures.MarginTypeCrossed,
+		},
+		{
+			name:        "leverage above max leverage",
+			client:      client,
+			order:       &models.Order{Leverage: 126},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid margin type",
+			client:      client,
+			order:       &models.Order{MarginType: "PORTFOLIO"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		leverage, marginType, err := tc.client.getLeverage(tc.order)
+		if tc.expectedErr {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expectedLeverage, leverage, tc.name)
+		assert.Equal(t, tc.expectedMarginType, marginType, tc.name)
+	}
+}
@@ -4,48 +4,63 @@ package binancewrapper
 import (
 	"context"
 	"strconv"
+	"time"
 
 	"github.com/adshao/go-binance/v2/futures"
 	"github.com/bosdhill/golang-binance-service/core/errors"
 	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/filters"
 	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
-	"github.com/bosdhill/golang-binance-service/libs/store/info"
-	"github.com/bosdhill/golang-binance-service/libs/store/stats"
 	log "github.com/sirupsen/logrus"
 )
 
+// maxPriceAge is how old the last price used to size and check MARKET and
+// LIMIT orders can be. Older prices are refreshed, or the order is rejected.
+var maxPriceAge = 5 * time.Second
+
+// symbolStatusTrading is the status of a symbol that can be traded, others
+// are e.g. SETTLING or BREAK.
+const symbolStatusTrading = "TRADING"
+
 // CloseAllPositions will create a STOP_MARKET order that will be triggered when
 // the stopPrice is met with closePosition=true. If triggered, it will close all
 // open long (BUY) positions if the side is SELL, otherwise it will close all
-// open short (SELL) positions if the side is BUY.
+// open short (SELL) positions if the side is BUY. In hedge mode the order is
+// placed for the LONG position side if the side is SELL, otherwise for the
+// SHORT position side.
 //
-// TODO: This doesn't guarantee all positions would be closed. In order to close a
-// position, a market order must be placed in the opposite direction for the
-// same quantity. OR this can be managed with all the frontend server bookkeeping
-// (api keys, order info, position info)
+// This doesn't guarantee all positions would be closed, use ClosePositions to
+// close positions immediately.
 func (b *binanceClient) CloseAllPositions(
 	ctx context.Context,
 	symbol string,
 	side futures.SideType,
 	stopPrice string,
 ) (*futures.CreateOrderResponse, error) {
+	positionSide, err := b.getPositionSide(ctx, &models.Order{
+		Type:          futures.OrderTypeStopMarket,
+		Side:          side,
+		ClosePosition: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	svc := b.c.NewCreateOrderService().
 		Type(futures.OrderTypeStopMarket).
 		Symbol(symbol).
 		Side(side).
+		PositionSide(positionSide).
 		StopPrice(stopPrice).
 		ClosePosition(true)
-	var res *futures.CreateOrderResponse
-	res, err := svc.Do(ctx)
+	// The order doesn't have a clientOrderId to look it up by, so it isn't
+	// retried if its status is unknown
+	res, err := retry.DoOnce(ctx, b.c, "CloseAllPositions", func(opts ...futures.RequestOption) (*futures.CreateOrderResponse, error) {
+		return svc.Do(ctx, opts...)
+	}, nil)
 	if err != nil {
-		retryRes, err := retry.Do(err, func(opts ...futures.RequestOption) (interface{}, error) {
-			log.WithField("recvWindow", opts).Info("Retrying CloseAllPositions request")
-			return svc.Do(ctx, opts...)
-		})
-		if err != nil {
-			return nil, err
-		}
-		res = retryRes.(*futures.CreateOrderResponse)
+		b.checkPositionMode(err)
+		return nil, err
 	}
 
 	log.WithFields(log.Fields{
@@ -54,10 +69,7 @@ func (b *binanceClient) CloseAllPositions(
 		"StopPrice": stopPrice,
 	}).Info("New Stop Market Order")
 
-	if err != nil {
-		return nil, err
-	}
-	return res, err
+	return res, nil
 }
 
 // CancelMultipleOrders cancels multiple open orders for a specified symbol.
@@ -73,17 +85,11 @@ func (b *binanceClient) CancelMultipleOrders(
 		OrderIDList(orderIDs).
 		OrigClientOrderIDList(clientOrderIDs).
 		Symbol(symbol)
-	var res []*futures.CancelOrderResponse
-	res, err := svc.Do(ctx)
+	res, err := retry.Do(ctx, b.c, "CancelMultipleOrders", func(opts ...futures.RequestOption) ([]*futures.CancelOrderResponse, error) {
+		return svc.Do(ctx, opts...)
+	})
 	if err != nil {
-		retryRes, err := retry.Do(err, func(opts ...futures.RequestOption) (interface{}, error) {
-			log.WithField("recvWindow", opts).Info("Retrying CancelMultipleOrders request")
-			return svc.Do(ctx, opts...)
-		})
-		if err != nil {
-			return nil, err
-		}
-		res = retryRes.([]*futures.CancelOrderResponse)
+		return nil, err
 	}
 
 	log.WithFields(log.Fields{
@@ -92,44 +98,65 @@ func (b *binanceClient) CancelMultipleOrders(
 		"ClientOrderIDs": clientOrderIDs,
 	}).Info("New Cancel Multiple Orders")
 
-	if err != nil {
-		return nil, err
-	}
 	return res, nil
 }
 
 // CancelAllOrders cancels all open futures orders for a specified symbol.
 func (b *binanceClient) CancelAllOrders(ctx context.Context, symbol string) error {
 	svc := b.c.NewCancelAllOpenOrdersService().Symbol(symbol)
-	err := svc.Do(ctx)
+	err := retry.DoErr(ctx, b.c, "CancelAllOrders", func(opts ...futures.RequestOption) error {
+		return svc.Do(ctx, opts...)
+	})
 	if err != nil {
-		_, err := retry.Do(err, func(opts ...futures.RequestOption) (interface{}, error) {
-			log.WithField("recvWindow", opts).Info("Retrying CancelAllOrders request")
-			return nil, svc.Do(ctx, opts...)
-		})
-		if err != nil {
-			return err
-		}
+		return err
 	}
 	return nil
 }
 
-// CreateOrder creates a futures order.
+// CreateOrder creates a futures order. A MARKET order with a maxSlippageBps
+// is checked against its fill estimated from the order book first, and the
+// response has its expected and actual slippage.
 func (b *binanceClient) CreateOrder(
 	ctx context.Context,
 	order *models.Order,
-) (*futures.CreateOrderResponse, error) {
+) (*OrderResponse, error) {
+	symbol, err := b.tradingSymbol(order.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err = roundPrices(&symbol, order)
+	if err != nil {
+		return nil, err
+	}
+
+	order.PositionSide, err = b.getPositionSide(ctx, order)
+	if err != nil {
+		return nil, err
+	}
+
 	svc := b.c.NewCreateOrderService()
 
 	svc.Type(order.Type).
 		Symbol(order.Symbol).
-		Side(order.Side)
+		Side(order.Side).
+		PositionSide(order.PositionSide)
 
+	if order.NewClientOrderID != "" {
+		svc.NewClientOrderID(order.NewClientOrderID)
+	}
+
+	if order.ReduceOnly {
+		svc.ReduceOnly(true)
+	}
+
+	// positions are the account's positions the order was sized with, nil
+	// for closePosition orders since they don't have a quantity
 	var quantity string
-	var err error
+	var positions []*futures.AccountPosition
 	switch order.Type {
 	case futures.OrderTypeMarket:
-		quantity, err = b.calculateMarketQuantity(ctx, order)
+		quantity, positions, err = b.calculateMarketQuantity(ctx, order)
 		if err != nil {
 			return nil, err
 		}
@@ -143,7 +170,7 @@ func (b *binanceClient) CreateOrder(
 			"Percentage": order.Percentage,
 		}).Info("New Market Order")
 	case futures.OrderTypeLimit:
-		quantity, err = b.calculateLimitQuantity(ctx, order)
+		quantity, positions, err = b.calculateLimitQuantity(ctx, order)
 		if err != nil {
 			return nil, err
 		}
@@ -161,7 +188,20 @@ func (b *binanceClient) CreateOrder(
 			"TimeInForce": order.TimeInForce,
 		}).Info("New Limit Order")
 	case futures.OrderTypeStopMarket:
-		quantity, err = b.calculateStopMarketQuantity(ctx, order)
+		if order.ClosePosition {
+			svc.StopPrice(order.StopPrice).
+				ClosePosition(true)
+
+			log.WithFields(log.Fields{
+				"Symbol":       order.Symbol,
+				"Side":         order.Side,
+				"PositionSide": order.PositionSide,
+				"StopPrice":    order.StopPrice,
+			}).Info("New Close Position Order")
+			break
+		}
+
+		quantity, positions, err = b.calculateStopMarketQuantity(ctx, order)
 		if err != nil {
 			return nil, err
 		}
@@ -180,100 +220,363 @@ func (b *binanceClient) CreateOrder(
 		}).Info("New Market Order")
 	}
 
-	var res *futures.CreateOrderResponse
-	res, err = svc.Do(ctx)
+	// The order is checked locally before the symbol's margin type and
+	// leverage are changed, so a rejected order doesn't change them
+	err = b.checkFilters(ctx, &symbol, order, quantity)
 	if err != nil {
-		retryRes, err := retry.Do(err, func(opts ...futures.RequestOption) (interface{}, error) {
-			log.WithField("recvWindow", opts).Info("Retrying CreateOrder request")
-			return svc.Do(ctx, opts...)
-		})
+		return nil, err
+	}
+
+	var slippage *Slippage
+	if order.Type == futures.OrderTypeMarket && order.MaxSlippageBps > 0 {
+		slippage, err = b.estimateSlippage(ctx, &symbol, order, quantity)
 		if err != nil {
 			return nil, err
 		}
-		res = retryRes.(*futures.CreateOrderResponse)
+
+		if slippage.LimitPrice != "" {
+			svc.Type(futures.OrderTypeLimit).
+				Price(slippage.LimitPrice).
+				TimeInForce(futures.TimeInForceTypeIOC)
+
+			log.WithFields(log.Fields{
+				"Symbol":     order.Symbol,
+				"Side":       order.Side,
+				"Quantity":   quantity,
+				"LimitPrice": slippage.LimitPrice,
+			}).Info("Market Order sent as Limit IOC Order")
+		}
+
+		// The actual fill is only in the RESULT response
+		svc.NewOrderResponseType(futures.NewOrderRespTypeRESULT)
+	}
+
+	if positions != nil {
+		err = b.applyLeverage(ctx, order, positions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := retry.DoOnce(ctx, b.c, "CreateOrder", func(opts ...futures.RequestOption) (*futures.CreateOrderResponse, error) {
+		return svc.Do(ctx, opts...)
+	}, b.orderLanded(order.Symbol, order.NewClientOrderID))
+	if err != nil {
+		b.checkPositionMode(err)
+		return nil, err
+	}
+
+	if slippage != nil {
+		slippage.setActual(order.Side, res.AvgPrice)
+	}
+	return &OrderResponse{CreateOrderResponse: res, Slippage: slippage}, nil
+}
+
+// orderLanded returns a retry.LandedFunc looking up the symbol's order by its
+// clientOrderID, or nil if the order doesn't have one since it can't be looked
+// up.
+func (b *binanceClient) orderLanded(
+	symbol string,
+	clientOrderID string,
+) retry.LandedFunc[*futures.CreateOrderResponse] {
+	if clientOrderID == "" {
+		return nil
+	}
+	return func(ctx context.Context) (*futures.CreateOrderResponse, bool, error) {
+		order, err := b.GetOrder(ctx, symbol, 0, clientOrderID)
+		if err != nil {
+			if apiErr := errors.NewAPIError(err); apiErr != nil && apiErr.Code == -2013 { // NO_SUCH_ORDER
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		return newCreateOrderResponse(order), true, nil
+	}
+}
+
+// newCreateOrderResponse returns the order as the response of the request
+// that created it.
+func newCreateOrderResponse(order *futures.Order) *futures.CreateOrderResponse {
+	return &futures.CreateOrderResponse{
+		Symbol:           order.Symbol,
+		OrderID:          order.OrderID,
+		ClientOrderID:    order.ClientOrderID,
+		Price:            order.Price,
+		OrigQuantity:     order.OrigQuantity,
+		ExecutedQuantity: order.ExecutedQuantity,
+		CumQuote:         order.CumQuote,
+		ReduceOnly:       order.ReduceOnly,
+		Status:           order.Status,
+		StopPrice:        order.StopPrice,
+		TimeInForce:      order.TimeInForce,
+		Type:             order.Type,
+		Side:             order.Side,
+		UpdateTime:       order.UpdateTime,
+		WorkingType:      order.WorkingType,
+		ActivatePrice:    order.ActivatePrice,
+		PriceRate:        order.PriceRate,
+		AvgPrice:         order.AvgPrice,
+		PositionSide:     order.PositionSide,
+		ClosePosition:    order.ClosePosition,
+		PriceProtect:     order.PriceProtect,
+	}
+}
+
+// roundPrices returns a copy of the order with its price and stop price
+// rounded to the symbol's tick size, or an error if they're outside of the
+// symbol's PRICE_FILTER.
+func roundPrices(symbol *futures.Symbol, order *models.Order) (*models.Order, error) {
+	rounded := *order
+	var err error
+	if order.Type == futures.OrderTypeLimit {
+		rounded.Price, err = filters.Price(symbol, order.Price)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if order.Type == futures.OrderTypeStopMarket {
+		rounded.StopPrice, err = filters.Price(symbol, order.StopPrice)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &rounded, nil
+}
+
+// checkFilters checks the order passes the symbol's MIN_NOTIONAL,
+// PERCENT_PRICE, MAX_NUM_ORDERS and MAX_NUM_ALGO_ORDERS filters before it's
+// sent to binance. MARKET orders' notional is valued at the last price, and
+// LIMIT orders' price is checked against the mark price. Reduce only orders
+// don't have to pass MIN_NOTIONAL.
+func (b *binanceClient) checkFilters(
+	ctx context.Context,
+	symbol *futures.Symbol,
+	order *models.Order,
+	quantity string,
+) error {
+	if order.ClosePosition {
+		return b.checkMaxNumOrders(ctx, symbol, order)
+	}
+
+	qty, err := strconv.ParseFloat(quantity, 64)
+	if err != nil {
+		return err
+	}
+
+	var price float64
+	switch order.Type {
+	case futures.OrderTypeMarket:
+		price, err = b.lastPrice(order.Symbol)
+	case futures.OrderTypeLimit:
+		price, err = strconv.ParseFloat(order.Price, 64)
+	case futures.OrderTypeStopMarket:
+		price, err = strconv.ParseFloat(order.StopPrice, 64)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Binance exempts reduce only orders from MIN_NOTIONAL, so a small
+	// position can still be closed
+	if !order.ReduceOnly {
+		err = filters.MinNotional(symbol, qty, price)
+		if err != nil {
+			return err
+		}
+	}
+
+	if order.Type == futures.OrderTypeLimit {
+		err = b.checkPercentPrice(symbol, order.Side, price)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.checkMaxNumOrders(ctx, symbol, order)
+}
+
+// lastPrice returns the symbol's last price, if it's at most maxPriceAge old.
+func (b *binanceClient) lastPrice(symbol string) (float64, error) {
+	price, err := b.prices.GetLastPriceFresh(symbol, maxPriceAge)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(price, 64)
+}
+
+// checkPercentPrice checks a LIMIT order's price passes the symbol's
+// PERCENT_PRICE filter against its mark price, if it's at most maxPriceAge
+// old, like binance checks it.
+func (b *binanceClient) checkPercentPrice(
+	symbol *futures.Symbol,
+	side futures.SideType,
+	price float64,
+) error {
+	markPrice, err := b.markPrices.GetMarkPriceFresh(symbol.Symbol, maxPriceAge)
+	if err != nil {
+		return err
+	}
+	mark, err := strconv.ParseFloat(markPrice, 64)
+	if err != nil {
+		return err
+	}
+	return filters.PercentPrice(symbol, side, price, mark)
+}
+
+// checkMaxNumOrders checks the order passes the symbol's MAX_NUM_ORDERS and
+// MAX_NUM_ALGO_ORDERS filters. MARKET orders are filled immediately so they
+// don't count towards the open orders limits.
+func (b *binanceClient) checkMaxNumOrders(
+	ctx context.Context,
+	symbol *futures.Symbol,
+	order *models.Order,
+) error {
+	if order.Type == futures.OrderTypeMarket {
+		return nil
 	}
-	return res, err
+
+	openOrders, err := b.ListOpenOrders(ctx, order.Symbol)
+	if err != nil {
+		return err
+	}
+	return filters.MaxNumOrders(symbol, order.Type, openOrders)
 }
 
-// calculateMarketQuantity returns the quantity of a market order.
+// calculateMarketQuantity returns the quantity of a market order and the
+// account's positions it was sized with.
 func (b *binanceClient) calculateMarketQuantity(ctx context.Context,
-	order *models.Order) (string, error) {
+	order *models.Order) (string, []*futures.AccountPosition, error) {
 	return b.calculate(
 		ctx,
 		order,
 		func(size float64) (string, error) {
-			lastPrice := stats.NewStore().GetLastPrice(order.Symbol)
-			return calculateQuantity(size, order.Symbol, lastPrice)
+			price, err := b.sizingPrice(order)
+			if err != nil {
+				return "", err
+			}
+			return b.calculateQuantity(size, order.Symbol, order.Type, price)
 		},
 	)
 }
 
+// sizingPrice returns the price a MARKET order's position size is converted
+// to its quantity at: the symbol's mark price if the order's sizingPrice is
+// MARK, otherwise its last price. Either is at most maxPriceAge old.
+func (b *binanceClient) sizingPrice(order *models.Order) (string, error) {
+	if order.SizingPrice == models.SizingPriceMark {
+		return b.markPrices.GetMarkPriceFresh(order.Symbol, maxPriceAge)
+	}
+	return b.prices.GetLastPriceFresh(order.Symbol, maxPriceAge)
+}
+
 // calculateStopMarketQuantity returns the quantity of a stop market order
 // (similar to calculateLimitQuantity except it uses StopPrice).
 func (b *binanceClient) calculateStopMarketQuantity(
 	ctx context.Context,
 	order *models.Order,
-) (string, error) {
+) (string, []*futures.AccountPosition, error) {
 	return b.calculate(
 		ctx,
 		order,
 		func(size float64) (string, error) {
-			return calculateQuantity(size, order.Symbol, order.StopPrice)
+			return b.calculateQuantity(size, order.Symbol, order.Type, order.StopPrice)
 		},
 	)
 }
 
-// calculateLimitQuantity returns the quantity of a limit order.
+// calculateLimitQuantity returns the quantity of a limit order and the
+// account's positions it was sized with.
 func (b *binanceClient) calculateLimitQuantity(ctx context.Context,
-	order *models.Order) (string, error) {
+	order *models.Order) (string, []*futures.AccountPosition, error) {
 	return b.calculate(
 		ctx,
 		order,
 		func(size float64) (string, error) {
-			return calculateQuantity(size, order.Symbol, order.Price)
+			return b.calculateQuantity(size, order.Symbol, order.Type, order.Price)
 		},
 	)
 }
 
-// calculateQuantity returns the quantity for a given size, symbol, and price.
-func calculateQuantity(size float64, symbol, orderPrice string) (string, error) {
+// calculateQuantity returns the quantity for a given size, symbol, order type,
+// and price, rounded down to the symbol's step size.
+func (b *binanceClient) calculateQuantity(
+	size float64,
+	symbol string,
+	orderType futures.OrderType,
+	orderPrice string,
+) (string, error) {
 	price, err := strconv.ParseFloat(orderPrice, 64)
 	if err != nil {
 		return "", err
 	}
 
+	s, ok := b.symbols.GetSymbol(symbol)
+	if !ok {
+		return "", errors.NewUnknownSymbol(symbol)
+	}
+
 	quantity := size / price
-	precision := info.NewStore().GetQuantityPrecision(symbol)
-	return strconv.FormatFloat(quantity, 'f', precision, 64), nil
+	return filters.Quantity(&s, orderType, quantity)
+}
+
+// tradingSymbol returns the exchange info of the symbol, or an error if it's
+// unknown or isn't trading.
+func (b *binanceClient) tradingSymbol(symbol string) (futures.Symbol, error) {
+	s, ok := b.symbols.GetSymbol(symbol)
+	if !ok {
+		return s, errors.NewUnknownSymbol(symbol)
+	}
+	if s.Status != symbolStatusTrading {
+		return s, errors.NewSymbolNotTrading(symbol, s.Status)
+	}
+	return s, nil
 }
 
 // calcFunc is the function used for calculating the quantity given the size.
 type calcFunc func(size float64) (string, error)
 
 // calculate returns the quantity by first calculating the position size for the
-// symbol and then calcFunc to calculate the order quantity.
+// symbol and then calcFunc to calculate the order quantity, along with the
+// account's positions the position size was calculated with.
 func (b *binanceClient) calculate(
 	ctx context.Context,
 	order *models.Order,
 	calcQuantity calcFunc,
-) (string, error) {
-	size, err := b.calculatePositionSize(ctx, order.Symbol, order.Percentage)
+) (string, []*futures.AccountPosition, error) {
+	size, positions, err := b.calculatePositionSize(ctx, order)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	quantity, err := calcQuantity(size)
+	if err != nil {
+		return "", nil, err
 	}
-	return calcQuantity(size)
+	return quantity, positions, nil
 }
 
 // calculatePositionSize returns the user's position size. The position size
-// is calculated using Order.Size * usdtBalance * 10 (at 10x leverage). So if
-// Order.Size is 0.10, then 0.10 * 10 * usdtBalance = usdtBalance position is
+// is calculated using Order.Size * usdtBalance * leverage. So if Order.Size is
+// 0.10 at 10x leverage, then 0.10 * 10 * usdtBalance = usdtBalance position is
 // opened for the user, with a margin cost of 0.10 * usdtBalance. The risk would
 // be 1/leverage or 1/10 in this case.
-func (b *binanceClient) calculatePositionSize(ctx context.Context,
-	symbol string, percentage float64) (float64, error) {
+//
+// The leverage is checked to be allowed for the resulting position notional
+// by the symbol's leverage brackets. The account's positions are returned so
+// the symbol's margin type and leverage can be changed once the order passed
+// its filters, see applyLeverage.
+func (b *binanceClient) calculatePositionSize(
+	ctx context.Context,
+	order *models.Order,
+) (float64, []*futures.AccountPosition, error) {
+	symbol, percentage := order.Symbol, order.Percentage
+	leverage, marginType, err := b.getLeverage(order)
+	if err != nil {
+		return 0.0, nil, err
+	}
+
 	account, err := b.GetAccount(ctx)
 	if err != nil {
-		return 0.0, err
+		return 0.0, nil, err
 	}
 
 	var usdtBalance float64
@@ -281,28 +584,127 @@ func (b *binanceClient) calculatePositionSize(ctx context.Context,
 		if asset.Asset == "USDT" {
 			usdtBalance, err = strconv.ParseFloat(asset.WalletBalance, 64)
 			if err != nil {
-				return 0.0, err
+				return 0.0, nil, err
 			}
 		}
 	}
 
-	// Since the default leverage for symbols is 20x, we might need to update
-	// the symbol leverage
-	_, err = b.changeSymbolLeverage(ctx, symbol, account.Positions)
-	if err != nil {
-		return 0.0, err
-	}
+	positionSize := percentage * usdtBalance * float64(leverage)
 
-	positionSize := percentage * usdtBalance * float64(defaultLeverage)
+	if positionSize == 0.0 || positionSize > usdtBalance*float64(leverage) {
+		return positionSize, nil, errors.NewPositionSizeInvalid()
+	}
 
-	if positionSize == 0.0 || positionSize > usdtBalance*float64(defaultLeverage) {
-		return positionSize, errors.NewPositionSizeInvalid()
+	err = b.checkLeverageBracket(
+		ctx,
+		symbol,
+		order.PositionSide,
+		leverage,
+		positionSize,
+		account.Positions,
+	)
+	if err != nil {
+		return 0.0, nil, err
 	}
 
 	log.WithFields(log.Fields{
 		"Balance":      usdtBalance,
+		"Leverage":     leverage,
+		"MarginType":   marginType,
 		"PositionSize": positionSize,
 	}).Info("Calculated position size")
 
-	return positionSize, nil
+	return positionSize, account.Positions, nil
+}
+
+// ListOpenOrders returns all open futures orders for a symbol, or for every
+// symbol if symbol is empty.
+func (b *binanceClient) ListOpenOrders(
+	ctx context.Context,
+	symbol string,
+) ([]*futures.Order, error) {
+	svc := b.c.NewListOpenOrdersService()
+	if symbol != "" {
+		svc.Symbol(symbol)
+	}
+	res, err := retry.Do(ctx, b.c, "ListOpenOrders", func(opts ...futures.RequestOption) ([]*futures.Order, error) {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListOrders returns the order history (open, cancelled and filled orders) for
+// a symbol. If limit is 0 the binance default of 500 is used.
+func (b *binanceClient) ListOrders(
+	ctx context.Context,
+	symbol string,
+	limit int,
+) ([]*futures.Order, error) {
+	svc := b.c.NewListOrdersService().Symbol(symbol)
+	if limit > 0 {
+		svc.Limit(limit)
+	}
+	res, err := retry.Do(ctx, b.c, "ListOrders", func(opts ...futures.RequestOption) ([]*futures.Order, error) {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetOrder returns a futures order for a symbol either by its orderID or, if
+// orderID is 0, by its clientOrderID.
+func (b *binanceClient) GetOrder(
+	ctx context.Context,
+	symbol string,
+	orderID int64,
+	clientOrderID string,
+) (*futures.Order, error) {
+	svc := b.c.NewGetOrderService().Symbol(symbol)
+	if orderID != 0 {
+		svc.OrderID(orderID)
+	} else {
+		svc.OrigClientOrderID(clientOrderID)
+	}
+	res, err := retry.Do(ctx, b.c, "GetOrder", func(opts ...futures.RequestOption) (*futures.Order, error) {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CancelOrder cancels an open futures order for a symbol either by its orderID
+// or, if orderID is 0, by its clientOrderID.
+func (b *binanceClient) CancelOrder(
+	ctx context.Context,
+	symbol string,
+	orderID int64,
+	clientOrderID string,
+) (*futures.CancelOrderResponse, error) {
+	svc := b.c.NewCancelOrderService().Symbol(symbol)
+	if orderID != 0 {
+		svc.OrderID(orderID)
+	} else {
+		svc.OrigClientOrderID(clientOrderID)
+	}
+	res, err := retry.Do(ctx, b.c, "CancelOrder", func(opts ...futures.RequestOption) (*futures.CancelOrderResponse, error) {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"Symbol":        symbol,
+		"OrderID":       orderID,
+		"ClientOrderID": clientOrderID,
+	}).Info("Cancelled order")
+
+	return res, nil
 }
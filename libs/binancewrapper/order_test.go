@@ -3,6 +3,7 @@ package binancewrapper
 import (
 	"context"
 	"encoding/json"
+	"math"
 	"os"
 	"strconv"
 	"testing"
@@ -11,9 +12,11 @@ import (
 	"github.com/adshao/go-binance/v2/futures"
 	"github.com/bosdhill/golang-binance-service/core/errors"
 	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
 	"github.com/bosdhill/golang-binance-service/libs/store/info"
 	"github.com/bosdhill/golang-binance-service/libs/store/stats"
 	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,6 +41,13 @@ func lastPriceDecreased(symbol string) string {
 	return calcLastPrice(-percentage, symbol)
 }
 
+// floorQuantity returns the quantity rounded down to precision, the same as
+// rounding it down to the symbol's step size.
+func floorQuantity(quantity float64, precision int) string {
+	p := math.Pow10(precision)
+	return strconv.FormatFloat(math.Floor(quantity*p)/p, 'f', precision, 64)
+}
+
 func init() {
 	test.InitializeBinanceTests()
 }
@@ -49,7 +59,7 @@ func TestCalculatePositionSize(t *testing.T) {
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	client := NewClient(&user)
+	client := newTestClient(t, &user)
 	defer cancel()
 
 	b, err := client.GetUSDTBalance(ctx)
@@ -108,7 +118,11 @@ func TestCalculatePositionSize(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		actual, err := client.calculatePositionSize(ctx, tc.symbol, tc.percentage)
+		actual, _, err := client.calculatePositionSize(ctx, &models.Order{
+			Symbol:       tc.symbol,
+			Percentage:   tc.percentage,
+			PositionSide: futures.PositionSideTypeBoth,
+		})
 
 		if err != nil {
 			assert.EqualError(t, err, errors.NewPositionSizeInvalid().Error(), tc.name)
@@ -125,7 +139,7 @@ func TestCalculateLimitQuantity(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	client := NewClient(user)
+	client := newTestClient(t, user)
 
 	b, err := client.GetUSDTBalance(ctx)
 	if err != nil {
@@ -175,13 +189,13 @@ func TestCalculateLimitQuantity(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		quantity, err := client.calculateLimitQuantity(ctx, tc.order)
+		quantity, _, err := client.calculateLimitQuantity(ctx, tc.order)
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		precision := info.NewStore().GetQuantityPrecision(tc.order.Symbol)
-		expected := strconv.FormatFloat(tc.expected, 'f', precision, 32)
+		expected := floorQuantity(tc.expected, precision)
 		assert.Equal(t, expected, quantity, tc.name)
 	}
 }
@@ -217,14 +231,15 @@ func TestCalculateMarketQuantity(t *testing.T) {
 		},
 	}
 
+	client := &binanceClient{symbols: info.NewStore()}
 	for _, tc := range tests {
-		quantity, err := calculateQuantity(tc.size, tc.symbol, tc.lastPrice)
+		quantity, err := client.calculateQuantity(tc.size, tc.symbol, futures.OrderTypeMarket, tc.lastPrice)
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		precision := info.NewStore().GetQuantityPrecision(tc.symbol)
-		expected := strconv.FormatFloat(tc.expected, 'f', precision, 32)
+		expected := floorQuantity(tc.expected, precision)
 		assert.Equal(t, expected, quantity, tc.name)
 	}
 }
@@ -236,7 +251,7 @@ func TestCreateMarketOrder(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	client := NewClient(user)
+	client := newTestClient(t, user)
 
 	tests := []struct {
 		name      string
@@ -309,7 +324,7 @@ func TestCreateLimitOrder(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	client := NewClient(user)
+	client := newTestClient(t, user)
 
 	tests := []struct {
 		name  string
@@ -367,7 +382,7 @@ func TestCreateStopMarketOrder(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	client := NewClient(user)
+	client := newTestClient(t, user)
 
 	tests := []struct {
 		name      string
@@ -418,3 +433,193 @@ func TestCreateStopMarketOrder(t *testing.T) {
 		}
 	}
 }
+
+func TestGetAndCancelOrder(t *testing.T) {
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	ctx := context.Background()
+	client := newTestClient(t, user)
+
+	order := &models.Order{
+		Type:        futures.OrderTypeLimit,
+		Symbol:      "BTCUSDT",
+		Side:        futures.SideTypeBuy,
+		Percentage:  0.01,
+		TimeInForce: futures.TimeInForceTypeGTC,
+		Price:       lastPriceDecreased("BTCUSDT"),
+	}
+
+	res, err := client.CreateOrder(ctx, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get the order by orderId and by clientOrderId
+	got, err := client.GetOrder(ctx, order.Symbol, res.OrderID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.ClientOrderID, got.ClientOrderID, "get by orderId")
+
+	got, err = client.GetOrder(ctx, order.Symbol, 0, res.ClientOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.OrderID, got.OrderID, "get by clientOrderId")
+
+	openOrders, err := client.ListOpenOrders(ctx, order.Symbol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, openOrders, "open orders empty")
+
+	cancelled, err := client.CancelOrder(ctx, order.Symbol, res.OrderID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderStatusTypeCanceled, cancelled.Status)
+
+	orders, err := client.ListOrders(ctx, order.Symbol, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, orders, "order history empty")
+}
+
+func TestCreateOrderUnknownStatus(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("binance errors can only be scripted against the fake server")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	ctx := context.Background()
+	client := newTestClient(t, user)
+
+	order := &models.Order{
+		Type:             futures.OrderTypeLimit,
+		Symbol:           "BTCUSDT",
+		Side:             futures.SideTypeBuy,
+		Percentage:       0.01,
+		TimeInForce:      futures.TimeInForceTypeGTC,
+		Price:            lastPriceDecreased("BTCUSDT"),
+		NewClientOrderID: "unknown-status-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+
+	// The order isn't found by its clientOrderId, so it's retried once
+	fake.Fail("/fapi/v1/order", fakebinance.Failure{Code: -1007, Message: "Timeout waiting for response from backend server."})
+	res, err := client.CreateOrder(ctx, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, order.NewClientOrderID, res.ClientOrderID)
+
+	var created int
+	for _, o := range fake.Orders(order.Symbol) {
+		if o.ClientOrderID == order.NewClientOrderID {
+			created++
+		}
+	}
+	assert.Equal(t, 1, created, "orders created")
+
+	// Orders without a clientOrderId aren't retried
+	order.NewClientOrderID = ""
+	fake.Fail("/fapi/v1/order", fakebinance.Failure{Code: -1007, Message: "Timeout waiting for response from backend server."})
+	_, err = client.CreateOrder(ctx, order)
+	assert.Equal(t, int64(-1007), errors.NewAPIError(err).Code)
+
+	_, err = client.CancelOrder(ctx, order.Symbol, res.OrderID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateOrderFiltersBeforeLeverage(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the leverage requests can only be counted against the fake server")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	// BTCUSDT with a PERCENT_PRICE filter, and a mark price far below the
+	// last price
+	prices, symbols, markPrices := snapshotStores(t)
+	symbol := symbols["BTCUSDT"]
+	symbol.Filters = append(append([]map[string]interface{}{}, symbol.Filters...), map[string]interface{}{
+		"filterType": "PERCENT_PRICE", "multiplierUp": "1.05", "multiplierDown": "0.95", "multiplierDecimal": "4",
+	})
+	symbols["BTCUSDT"] = symbol
+	lastPrice := prices["BTCUSDT"]
+	mark, _ := strconv.ParseFloat(lastPrice, 64)
+	markPrices["BTCUSDT"] = strconv.FormatFloat(mark/2, 'f', 2, 64)
+
+	client := newFactoryClient(user, prices, symbols, &fakeBooks{}, markPrices)
+	leverageRequests := fake.Requests("/fapi/v1/leverage")
+	marginTypeRequests := fake.Requests("/fapi/v1/marginType")
+
+	// The price is checked against the mark price, and the order is rejected
+	// before the symbol's margin type and leverage are changed
+	_, err := client.CreateOrder(context.Background(), &models.Order{
+		Type:        futures.OrderTypeLimit,
+		Symbol:      "BTCUSDT",
+		Side:        futures.SideTypeBuy,
+		Percentage:  0.01,
+		Leverage:    7,
+		MarginType:  futures.MarginTypeIsolated,
+		TimeInForce: futures.TimeInForceTypeGTC,
+		Price:       lastPrice,
+	})
+	filterErr, ok := errors.AsFilterError(err)
+	if assert.True(t, ok, "order rejected by PERCENT_PRICE") {
+		assert.Equal(t, "PERCENT_PRICE", filterErr.Filter)
+	}
+	assert.Equal(t, leverageRequests, fake.Requests("/fapi/v1/leverage"), "leverage unchanged")
+	assert.Equal(t, marginTypeRequests, fake.Requests("/fapi/v1/marginType"), "margin type unchanged")
+}
+
+// waitSyncInterval waits until the shared clock can be synced again.
+func waitSyncInterval() {
+	if lastSync := clock.NewClock().Status().LastSync; lastSync != nil {
+		time.Sleep(time.Until(lastSync.Add(time.Second)))
+	}
+}
+
+func TestTimestampResync(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet server time can't be moved")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	ctx := context.Background()
+	client := newTestClient(t, user)
+	waitSyncInterval()
+
+	// The server time jumps ahead of the client's offset by more than the
+	// largest retry recvWindow, so only the resynced offset is accepted
+	fake.SetTimeOffset(15 * time.Second)
+	defer func() {
+		fake.SetTimeOffset(0)
+		waitSyncInterval()
+		clock.NewClock().Sync(ctx)
+	}()
+
+	_, err := client.GetAccount(ctx)
+	assert.NoError(t, err)
+	assert.InDelta(t, -15000, client.c.TimeOffset, 500)
+}
@@ -0,0 +1,541 @@
+// Package binancewrapper wraps the binance api client
+package binancewrapper
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/filters"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// closeConfirmAttempts is how many times a closed symbol's positions are
+	// checked before giving up on confirming they're flat.
+	closeConfirmAttempts = 5
+
+	// closeConfirmDelay is how long to wait between checking a closed symbol's
+	// positions.
+	closeConfirmDelay = 500 * time.Millisecond
+
+	// closeAttempts is how many times a symbol's positions that are still open
+	// are closed before giving up.
+	closeAttempts = 3
+
+	// positionModes are the users' position modes by their api key, so the
+	// mode (weight 30) isn't requested for every order
+	positionModes = &positionModeCache{modes: make(map[string]bool)}
+)
+
+// positionModeCache caches whether the users are in hedge mode by their api
+// key.
+type positionModeCache struct {
+	m     sync.RWMutex
+	modes map[string]bool
+}
+
+// get returns whether the user is in hedge mode, and whether it's cached.
+func (c *positionModeCache) get(apiKey string) (bool, bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	dualSide, ok := c.modes[apiKey]
+	return dualSide, ok
+}
+
+func (c *positionModeCache) set(apiKey string, dualSide bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.modes[apiKey] = dualSide
+}
+
+func (c *positionModeCache) forget(apiKey string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.modes, apiKey)
+}
+
+// GetPositionMode returns the user's position mode, either hedge mode
+// (dualSidePosition=true) or one-way mode (dualSidePosition=false).
+func (b *binanceClient) GetPositionMode(ctx context.Context) (*futures.PositionMode, error) {
+	svc := b.c.NewGetPositionModeService()
+	res, err := retry.Do(ctx, b.c, "GetPositionMode", func(opts ...futures.RequestOption) (*futures.PositionMode, error) {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	positionModes.set(b.c.APIKey, res.DualSidePosition)
+	return res, nil
+}
+
+// ChangePositionMode changes the user's position mode to hedge mode if
+// dualSide is true, otherwise to one-way mode. Binance doesn't allow changing
+// the mode while there are open positions or orders.
+func (b *binanceClient) ChangePositionMode(ctx context.Context, dualSide bool) error {
+	svc := b.c.NewChangePositionModeService().DualSide(dualSide)
+	err := retry.DoErr(ctx, b.c, "ChangePositionMode", func(opts ...futures.RequestOption) error {
+		return svc.Do(ctx, opts...)
+	})
+	// The mode may have changed even if the request failed
+	positionModes.forget(b.c.APIKey)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("DualSidePosition", dualSide).Info("Changed position mode")
+	return nil
+}
+
+// getPositionSide returns the position side of the order in the user's
+// position mode. The mode is cached until it's changed.
+func (b *binanceClient) getPositionSide(
+	ctx context.Context,
+	order *models.Order,
+) (futures.PositionSideType, error) {
+	dualSide, ok := positionModes.get(b.c.APIKey)
+	if !ok {
+		mode, err := b.GetPositionMode(ctx)
+		if err != nil {
+			return "", err
+		}
+		dualSide = mode.DualSidePosition
+	}
+	return resolvePositionSide(order, dualSide)
+}
+
+// checkPositionMode forgets the user's cached position mode if the order
+// failed with -4061, since its position side was resolved in the wrong mode,
+// e.g. after the mode was changed outside of the service.
+func (b *binanceClient) checkPositionMode(err error) {
+	if apiErr := errors.NewAPIError(err); apiErr != nil && apiErr.Code == -4061 { // INVALID_POSITION_SIDE
+		positionModes.forget(b.c.APIKey)
+	}
+}
+
+// resolvePositionSide returns the position side of the order and checks its
+// reduceOnly and closePosition combination is valid in the position mode.
+//
+// In one-way mode the position side is always BOTH, and reduceOnly and
+// closePosition can be used to only reduce or close the position.
+//
+// In hedge mode the position side is either LONG or SHORT and reduceOnly
+// can't be used, a position is reduced by an order in the opposite side with
+// the same position side (e.g. SELL LONG reduces the LONG position). If the
+// position side isn't set it's LONG for BUY and SHORT for SELL orders, unless
+// the order closes the position, in which case it's the opposite.
+func resolvePositionSide(order *models.Order, dualSide bool) (futures.PositionSideType, error) {
+	if order.ClosePosition {
+		if order.Type != futures.OrderTypeStopMarket {
+			return "", errors.NewValidationError(
+				"closePosition",
+				"can only be used by STOP_MARKET orders",
+			)
+		}
+		if order.ReduceOnly {
+			return "", errors.NewValidationError(
+				"closePosition",
+				"can't be used with reduceOnly",
+			)
+		}
+	}
+
+	if !dualSide {
+		switch order.PositionSide {
+		case "", futures.PositionSideTypeBoth:
+			return futures.PositionSideTypeBoth, nil
+		default:
+			return "", errors.NewValidationError(
+				"positionSide",
+				"must be BOTH in one-way mode",
+			)
+		}
+	}
+
+	if order.ReduceOnly {
+		return "", errors.NewValidationError(
+			"reduceOnly",
+			"can't be used in hedge mode, use the opposite side with the same positionSide",
+		)
+	}
+
+	// closing side is the position side closed by the order's side
+	closingSide := futures.PositionSideTypeShort
+	openingSide := futures.PositionSideTypeLong
+	if order.Side == futures.SideTypeSell {
+		closingSide = futures.PositionSideTypeLong
+		openingSide = futures.PositionSideTypeShort
+	}
+
+	switch order.PositionSide {
+	case "":
+		if order.ClosePosition {
+			return closingSide, nil
+		}
+		return openingSide, nil
+	case futures.PositionSideTypeLong, futures.PositionSideTypeShort:
+		if order.ClosePosition && order.PositionSide != closingSide {
+			return "", errors.NewValidationError(
+				"positionSide",
+				"closePosition can only close the LONG position with SELL or the SHORT position with BUY",
+			)
+		}
+		return order.PositionSide, nil
+	default:
+		return "", errors.NewValidationError(
+			"positionSide",
+			"must be either LONG or SHORT in hedge mode",
+		)
+	}
+}
+
+// Position is a non-zero position with its risk metrics.
+type Position struct {
+	Symbol           string  `json:"symbol"`
+	PositionSide     string  `json:"positionSide"`
+	PositionAmt      string  `json:"positionAmt"`
+	EntryPrice       string  `json:"entryPrice"`
+	MarkPrice        string  `json:"markPrice"`
+	LiquidationPrice string  `json:"liquidationPrice"`
+	Leverage         string  `json:"leverage"`
+	MarginType       string  `json:"marginType"`
+	Notional         string  `json:"notional"`
+	UnrealizedProfit string  `json:"unrealizedProfit"`
+	MaintMargin      string  `json:"maintMargin"`
+	MarginRatio      float64 `json:"marginRatio"`
+	ROE              float64 `json:"roe"`
+	// LiquidationDistance is the percent the mark price has to move to reach
+	// the liquidation price, or 0 if the position can't be liquidated.
+	LiquidationDistance float64 `json:"liquidationDistance"`
+}
+
+// getPositionRisks returns the position risk of every position, or only the
+// symbol's positions if the symbol isn't empty.
+func (b *binanceClient) getPositionRisks(
+	ctx context.Context,
+	symbol string,
+) ([]*futures.PositionRisk, error) {
+	svc := b.c.NewGetPositionRiskService()
+	if symbol != "" {
+		svc.Symbol(symbol)
+	}
+	res, err := retry.Do(ctx, b.c, "GetPositionRisk", func(opts ...futures.RequestOption) ([]*futures.PositionRisk, error) {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListPositions returns the user's non-zero positions with their risk
+// metrics. If symbol isn't empty only the symbol's positions are returned, and
+// positions with an absolute notional below minNotional are left out.
+func (b *binanceClient) ListPositions(
+	ctx context.Context,
+	symbol string,
+	minNotional float64,
+) ([]*Position, error) {
+	risks, err := b.getPositionRisks(ctx, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	// The maintenance margins and margin balance used by the margin ratio are
+	// only in the account
+	account, err := b.GetAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := []*Position{}
+	for _, risk := range risks {
+		amount, err := strconv.ParseFloat(risk.PositionAmt, 64)
+		if err != nil {
+			return nil, err
+		}
+		if amount == 0 {
+			continue
+		}
+
+		notional, _ := strconv.ParseFloat(risk.Notional, 64)
+		if math.Abs(notional) < minNotional {
+			continue
+		}
+
+		positions = append(positions, newPosition(risk, account))
+	}
+	return positions, nil
+}
+
+// newPosition returns the position of risk with its risk metrics.
+//
+// The margin ratio is the maintenance margin over the margin balance, which
+// is the position's isolated margin for isolated positions and the account's
+// margin balance for cross positions. The ROE is the unrealized profit over
+// the initial margin (entry notional / leverage) in percent.
+func newPosition(risk *futures.PositionRisk, account *futures.Account) *Position {
+	position := &Position{
+		Symbol:           risk.Symbol,
+		PositionSide:     risk.PositionSide,
+		PositionAmt:      risk.PositionAmt,
+		EntryPrice:       risk.EntryPrice,
+		MarkPrice:        risk.MarkPrice,
+		LiquidationPrice: risk.LiquidationPrice,
+		Leverage:         risk.Leverage,
+		MarginType:       risk.MarginType,
+		Notional:         risk.Notional,
+		UnrealizedProfit: risk.UnRealizedProfit,
+	}
+
+	amount, _ := strconv.ParseFloat(risk.PositionAmt, 64)
+	entryPrice, _ := strconv.ParseFloat(risk.EntryPrice, 64)
+	markPrice, _ := strconv.ParseFloat(risk.MarkPrice, 64)
+	liquidationPrice, _ := strconv.ParseFloat(risk.LiquidationPrice, 64)
+	leverage, _ := strconv.ParseFloat(risk.Leverage, 64)
+	unrealizedProfit, _ := strconv.ParseFloat(risk.UnRealizedProfit, 64)
+
+	if initialMargin := math.Abs(amount) * entryPrice / leverage; initialMargin > 0 {
+		position.ROE = unrealizedProfit / initialMargin * 100
+	}
+
+	if liquidationPrice > 0 && markPrice > 0 {
+		position.LiquidationDistance = math.Abs(markPrice-liquidationPrice) / markPrice * 100
+	}
+
+	for _, p := range account.Positions {
+		if p.Symbol == risk.Symbol && string(p.PositionSide) == risk.PositionSide {
+			position.MaintMargin = p.MaintMargin
+			break
+		}
+	}
+
+	maintMargin, _ := strconv.ParseFloat(position.MaintMargin, 64)
+	marginBalance, _ := strconv.ParseFloat(account.TotalMarginBalance, 64)
+	// position risk margin types are lowercase, e.g. "isolated"
+	if strings.EqualFold(risk.MarginType, string(futures.MarginTypeIsolated)) {
+		marginBalance, _ = strconv.ParseFloat(risk.IsolatedMargin, 64)
+	}
+	if marginBalance > 0 {
+		position.MarginRatio = maintMargin / marginBalance
+	}
+	return position
+}
+
+// ClosePositionResult is the result of closing a symbol's positions. Errors
+// has every step that failed, Flat is whether the symbol's positions were
+// confirmed closed.
+type ClosePositionResult struct {
+	Symbol string                         `json:"symbol"`
+	Orders []*futures.CreateOrderResponse `json:"orders"`
+	Flat   bool                           `json:"flat"`
+	Errors []string                       `json:"errors,omitempty"`
+}
+
+// ClosePositions closes the symbol's positions, or every open position if the
+// symbol is empty. For each symbol its open orders are cancelled, then its
+// positions are read again and MARKET orders in the opposite direction are
+// created for each position's exact amount, and finally the symbol's positions
+// are checked until they're flat. Whatever is still open is closed again, up
+// to closeAttempts times. A symbol that fails to close doesn't stop the
+// others from being closed.
+func (b *binanceClient) ClosePositions(
+	ctx context.Context,
+	symbol string,
+) ([]*ClosePositionResult, error) {
+	symbols := []string{symbol}
+	if symbol == "" {
+		positions, err := b.openPositions(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		symbols = nil
+		for _, position := range positions {
+			if len(symbols) == 0 || symbols[len(symbols)-1] != position.Symbol {
+				symbols = append(symbols, position.Symbol)
+			}
+		}
+	}
+
+	results := make([]*ClosePositionResult, 0, len(symbols))
+	for _, s := range symbols {
+		results = append(results, b.closeSymbolPositions(ctx, s))
+	}
+	return results, nil
+}
+
+// closeSymbolPositions cancels the symbol's open orders, closes its positions
+// and confirms they're flat, closing whatever is left again.
+func (b *binanceClient) closeSymbolPositions(ctx context.Context, symbol string) *ClosePositionResult {
+	result := &ClosePositionResult{
+		Symbol: symbol,
+		Orders: []*futures.CreateOrderResponse{},
+	}
+
+	// The open orders are cancelled first so none of them can reopen the
+	// position once it's closed, and the positions are read afterwards so an
+	// order filled in between is closed too
+	err := b.CancelAllOrders(ctx, symbol)
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("cancel open orders: %v", err))
+	}
+
+	positions, err := b.openPositions(ctx, symbol)
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("get positions: %v", err))
+	}
+	for attempt := 1; err == nil && len(positions) > 0 && attempt <= closeAttempts; attempt++ {
+		for _, position := range positions {
+			orders, closeErr := b.closePosition(ctx, position)
+			result.Orders = append(result.Orders, orders...)
+			if closeErr != nil {
+				result.Errors = append(
+					result.Errors,
+					fmt.Sprintf("close %s position: %v", position.PositionSide, closeErr),
+				)
+			}
+		}
+
+		positions, err = b.waitFlat(ctx, symbol)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("confirm flat: %v", err))
+		}
+	}
+	result.Flat = err == nil && len(positions) == 0
+
+	log.WithFields(log.Fields{
+		"Symbol": symbol,
+		"Orders": len(result.Orders),
+		"Flat":   result.Flat,
+		"Errors": result.Errors,
+	}).Info("Closed symbol positions")
+
+	return result
+}
+
+// closePosition creates MARKET orders in the opposite direction of the
+// position for its exact amount, split into orders of at most the symbol's
+// MARKET_LOT_SIZE max quantity. In one-way mode (positionSide BOTH) the orders
+// are reduce only, in hedge mode they're for the position's side. The orders
+// created before one fails are returned with its error.
+func (b *binanceClient) closePosition(
+	ctx context.Context,
+	position *futures.PositionRisk,
+) ([]*futures.CreateOrderResponse, error) {
+	side := futures.SideTypeSell
+	if strings.HasPrefix(position.PositionAmt, "-") {
+		side = futures.SideTypeBuy
+	}
+	quantity := strings.TrimPrefix(position.PositionAmt, "-")
+	positionSide := futures.PositionSideType(position.PositionSide)
+
+	quantities := []string{quantity}
+	if s, ok := b.symbols.GetSymbol(position.Symbol); ok {
+		quantities = filters.Split(&s, quantity)
+	}
+
+	id, err := newCloseID()
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]*futures.CreateOrderResponse, 0, len(quantities))
+	for i, quantity := range quantities {
+		clientOrderID := fmt.Sprintf("%s-%d", id, i)
+		svc := b.c.NewCreateOrderService().
+			Type(futures.OrderTypeMarket).
+			Symbol(position.Symbol).
+			Side(side).
+			PositionSide(positionSide).
+			Quantity(quantity).
+			NewClientOrderID(clientOrderID)
+		if positionSide == futures.PositionSideTypeBoth {
+			svc.ReduceOnly(true)
+		}
+		// Closing twice would open a position in the opposite direction, so
+		// it's only retried if it's not found by its clientOrderId
+		res, err := retry.DoOnce(ctx, b.c, "ClosePosition", func(opts ...futures.RequestOption) (*futures.CreateOrderResponse, error) {
+			return svc.Do(ctx, opts...)
+		}, b.orderLanded(position.Symbol, clientOrderID))
+		if err != nil {
+			b.checkPositionMode(err)
+			return orders, err
+		}
+		orders = append(orders, res)
+
+		log.WithFields(log.Fields{
+			"Symbol":       position.Symbol,
+			"Side":         side,
+			"PositionSide": positionSide,
+			"Quantity":     quantity,
+		}).Info("New Close Position Market Order")
+	}
+	return orders, nil
+}
+
+// newCloseID returns a random clientOrderId prefix for a position's close
+// orders.
+func newCloseID() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return "cls" + hex.EncodeToString(buf), nil
+}
+
+// openPositions returns the symbol's open positions, or every open position
+// if the symbol is empty, sorted by symbol.
+func (b *binanceClient) openPositions(ctx context.Context, symbol string) ([]*futures.PositionRisk, error) {
+	risks, err := b.getPositionRisks(ctx, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	var positions []*futures.PositionRisk
+	for _, risk := range risks {
+		amount, err := strconv.ParseFloat(risk.PositionAmt, 64)
+		if err != nil {
+			return nil, err
+		}
+		if amount != 0 && (symbol == "" || risk.Symbol == symbol) {
+			positions = append(positions, risk)
+		}
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return positions[i].Symbol < positions[j].Symbol
+	})
+	return positions, nil
+}
+
+// waitFlat returns the symbol's positions that are still open, checking up to
+// closeConfirmAttempts times since MARKET orders aren't always filled by the
+// time they're created.
+func (b *binanceClient) waitFlat(ctx context.Context, symbol string) ([]*futures.PositionRisk, error) {
+	for attempt := 1; ; attempt++ {
+		positions, err := b.openPositions(ctx, symbol)
+		if err != nil {
+			return nil, err
+		}
+		if len(positions) == 0 || attempt == closeConfirmAttempts {
+			return positions, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(closeConfirmDelay):
+		}
+	}
+}
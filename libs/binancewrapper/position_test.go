@@ -0,0 +1,355 @@
+package binancewrapper
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvePositionSide(t *testing.T) {
+	tests := []struct {
+		name        string
+		order       *models.Order
+		dualSide    bool
+		expected    futures.PositionSideType
+		expectedErr bool
+	}{
+		{
+			name:     "one-way mode defaults to BOTH",
+			order:    &models.Order{Type: futures.OrderTypeMarket, Side: futures.SideTypeBuy},
+			expected: futures.PositionSideTypeBoth,
+		},
+		{
+			name:     "one-way mode reduce only",
+			order:    &models.Order{Type: futures.OrderTypeMarket, Side: futures.SideTypeSell, ReduceOnly: true},
+			expected: futures.PositionSideTypeBoth,
+		},
+		{
+			name:        "one-way mode rejects LONG",
+			order:       &models.Order{Type: futures.OrderTypeMarket, Side: futures.SideTypeBuy, PositionSide: futures.PositionSideTypeLong},
+			expectedErr: true,
+		},
+		{
+			name:     "hedge mode BUY defaults to LONG",
+			order:    &models.Order{Type: futures.OrderTypeLimit, Side: futures.SideTypeBuy},
+			dualSide: true,
+			expected: futures.PositionSideTypeLong,
+		},
+		{
+			name:     "hedge mode SELL defaults to SHORT",
+			order:    &models.Order{Type: futures.OrderTypeLimit, Side: futures.SideTypeSell},
+			dualSide: true,
+			expected: futures.PositionSideTypeShort,
+		},
+		{
+			name:     "hedge mode SELL reduces LONG",
+			order:    &models.Order{Type: futures.OrderTypeMarket, Side: futures.SideTypeSell, PositionSide: futures.PositionSideTypeLong},
+			dualSide: true,
+			expected: futures.PositionSideTypeLong,
+		},
+		{
+			name:     "hedge mode close position defaults to closing side",
+			order:    &models.Order{Type: futures.OrderTypeStopMarket, Side: futures.SideTypeSell, ClosePosition: true},
+			dualSide: true,
+			expected: futures.PositionSideTypeLong,
+		},
+		{
+			name:        "hedge mode close position on opening side",
+			order:       &models.Order{Type: futures.OrderTypeStopMarket, Side: futures.SideTypeBuy, PositionSide: futures.PositionSideTypeLong, ClosePosition: true},
+			dualSide:    true,
+			expectedErr: true,
+		},
+		{
+			name:        "hedge mode rejects reduce only",
+			order:       &models.Order{Type: futures.OrderTypeMarket, Side: futures.SideTypeSell, ReduceOnly: true},
+			dualSide:    true,
+			expectedErr: true,
+		},
+		{
+			name:        "hedge mode rejects BOTH",
+			order:       &models.Order{Type: futures.OrderTypeMarket, Side: futures.SideTypeBuy, PositionSide: futures.PositionSideTypeBoth},
+			dualSide:    true,
+			expectedErr: true,
+		},
+		{
+			name:        "close position only for STOP_MARKET",
+			order:       &models.Order{Type: futures.OrderTypeLimit, Side: futures.SideTypeSell, ClosePosition: true},
+			expectedErr: true,
+		},
+		{
+			name:        "close position with reduce only",
+			order:       &models.Order{Type: futures.OrderTypeStopMarket, Side: futures.SideTypeSell, ClosePosition: true, ReduceOnly: true},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		actual, err := resolvePositionSide(tc.order, tc.dualSide)
+		if tc.expectedErr {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, actual, tc.name)
+	}
+}
+
+func TestNewPosition(t *testing.T) {
+	account := &futures.Account{
+		TotalMarginBalance: "10000",
+		Positions: []*futures.AccountPosition{
+			{Symbol: "BTCUSDT", PositionSide: futures.PositionSideTypeBoth, MaintMargin: "240"},
+			{Symbol: "ETHUSDT", PositionSide: futures.PositionSideTypeShort, MaintMargin: "5"},
+		},
+	}
+
+	tests := []struct {
+		name                        string
+		risk                        *futures.PositionRisk
+		expectedROE                 float64
+		expectedMarginRatio         float64
+		expectedLiquidationDistance float64
+	}{
+		{
+			name: "cross long in profit",
+			risk: &futures.PositionRisk{
+				Symbol:           "BTCUSDT",
+				PositionSide:     "BOTH",
+				PositionAmt:      "1",
+				EntryPrice:       "60000",
+				MarkPrice:        "61200",
+				LiquidationPrice: "45900",
+				Leverage:         "10",
+				MarginType:       "cross",
+				UnRealizedProfit: "1200",
+			},
+			expectedROE:                 20,
+			expectedMarginRatio:         0.024,
+			expectedLiquidationDistance: 25,
+		},
+		{
+			name: "isolated short at a loss",
+			risk: &futures.PositionRisk{
+				Symbol:           "ETHUSDT",
+				PositionSide:     "SHORT",
+				PositionAmt:      "-1",
+				EntryPrice:       "4000",
+				MarkPrice:        "4100",
+				LiquidationPrice: "4920",
+				Leverage:         "20",
+				MarginType:       "isolated",
+				IsolatedMargin:   "100",
+				UnRealizedProfit: "-100",
+			},
+			expectedROE:                 -50,
+			expectedMarginRatio:         0.05,
+			expectedLiquidationDistance: 20,
+		},
+		{
+			name: "no liquidation price",
+			risk: &futures.PositionRisk{
+				Symbol:           "XRPUSDT",
+				PositionSide:     "BOTH",
+				PositionAmt:      "10",
+				EntryPrice:       "1",
+				MarkPrice:        "1",
+				LiquidationPrice: "0",
+				Leverage:         "1",
+				MarginType:       "cross",
+				UnRealizedProfit: "0",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		actual := newPosition(tc.risk, account)
+		assert.InDelta(t, tc.expectedROE, actual.ROE, 1e-9, tc.name)
+		assert.InDelta(t, tc.expectedMarginRatio, actual.MarginRatio, 1e-9, tc.name)
+		assert.InDelta(t, tc.expectedLiquidationDistance, actual.LiquidationDistance, 1e-9, tc.name)
+	}
+}
+
+func TestClosePositions(t *testing.T) {
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	ctx := context.Background()
+	client := newTestClient(t, user)
+
+	// Open a position and leave an open order that would reopen it
+	_, err := client.CreateOrder(ctx, &models.Order{
+		Type:       futures.OrderTypeMarket,
+		Symbol:     "BTCUSDT",
+		Side:       futures.SideTypeBuy,
+		Percentage: 0.01,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.CreateOrder(ctx, &models.Order{
+		Type:        futures.OrderTypeLimit,
+		Symbol:      "BTCUSDT",
+		Side:        futures.SideTypeBuy,
+		Percentage:  0.01,
+		TimeInForce: futures.TimeInForceTypeGTC,
+		Price:       lastPriceDecreased("BTCUSDT"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.ClosePositions(ctx, "BTCUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, res, 1)
+	assert.Empty(t, res[0].Errors, "close errors")
+	assert.True(t, res[0].Flat, "position not flat")
+
+	openOrders, err := client.ListOpenOrders(ctx, "BTCUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, openOrders, "open orders not cancelled")
+
+	positions, err := client.ListPositions(ctx, "BTCUSDT", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, positions, "positions not closed")
+}
+
+func TestPositionModeCache(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the position mode can only be changed outside of the service against the fake server")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	ctx := context.Background()
+	client := newTestClient(t, user)
+	positionModes.forget(user.APIKey)
+	requests := fake.Requests("/fapi/v1/positionSide/dual")
+
+	order := &models.Order{Type: futures.OrderTypeMarket, Side: futures.SideTypeBuy}
+	for i := 0; i < 2; i++ {
+		positionSide, err := client.getPositionSide(ctx, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, futures.PositionSideTypeBoth, positionSide)
+	}
+	assert.Equal(t, requests+1, fake.Requests("/fapi/v1/positionSide/dual"), "position mode cached")
+
+	// The mode is changed outside of the service, so the order is rejected
+	// with -4061 and the cached mode forgotten
+	fake.SetDualSidePosition(true)
+	defer fake.SetDualSidePosition(false)
+	_, err := client.CloseAllPositions(ctx, "BTCUSDT", futures.SideTypeSell, lastPriceDecreased("BTCUSDT"))
+	assert.Equal(t, int64(-4061), errors.NewAPIError(err).Code)
+
+	positionSide, err := client.getPositionSide(ctx, order)
+	assert.NoError(t, err)
+	assert.Equal(t, futures.PositionSideTypeLong, positionSide, "hedge mode")
+
+	// Changing the mode forgets it, even if it fails since the other tests
+	// may have left open positions
+	client.ChangePositionMode(ctx, false)
+	_, ok := positionModes.get(user.APIKey)
+	assert.False(t, ok, "position mode forgotten")
+}
+
+func TestClosePositionsSplit(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("a position above the MARKET_LOT_SIZE max quantity can only be set on the fake server")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	ctx := context.Background()
+	client := newTestClient(t, user)
+
+	// The BTCUSDT MARKET_LOT_SIZE max quantity is 120, and the first close
+	// order's status is unknown but it isn't found, so it's sent again
+	fake.SetPosition(fakebinance.Position{Symbol: "BTCUSDT", Amount: 250, EntryPrice: 100})
+	fake.Fail("/fapi/v1/order", fakebinance.Failure{Code: -1007, Message: "Timeout waiting for response from backend server."})
+	res, err := client.ClosePositions(ctx, "BTCUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, res, 1) {
+		return
+	}
+	assert.Empty(t, res[0].Errors, "close errors")
+	assert.True(t, res[0].Flat, "position not flat")
+
+	var quantities []string
+	for _, order := range res[0].Orders {
+		quantities = append(quantities, order.OrigQuantity)
+	}
+	assert.Equal(t, []string{"83.334", "83.333", "83.333"}, quantities, "close orders")
+
+	created := make(map[string]int)
+	for _, order := range fake.Orders("BTCUSDT") {
+		for _, closeOrder := range res[0].Orders {
+			if order.ClientOrderID == closeOrder.ClientOrderID {
+				created[order.ClientOrderID]++
+			}
+		}
+	}
+	assert.Len(t, created, 3)
+	for id, n := range created {
+		assert.Equal(t, 1, n, "orders created for %s", id)
+	}
+}
+
+func TestClosePositionsRemaining(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("a close order can only be failed on the fake server")
+	}
+	closeConfirmDelay = time.Millisecond
+	t.Cleanup(func() { closeConfirmDelay = 500 * time.Millisecond })
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	ctx := context.Background()
+	client := newTestClient(t, user)
+
+	// The first close order is rejected, so the position is still open once
+	// it's checked and closed again
+	fake.SetPosition(fakebinance.Position{Symbol: "ETHUSDT", Amount: -2, EntryPrice: 4000})
+	fake.FailOrder(futures.OrderTypeMarket, fakebinance.Failure{Code: -2019, Message: "Margin is insufficient."})
+	res, err := client.ClosePositions(ctx, "ETHUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, res, 1) {
+		return
+	}
+	assert.True(t, res[0].Flat, "position not flat")
+	assert.Len(t, res[0].Errors, 1, "first close rejected")
+	if assert.Len(t, res[0].Orders, 1) {
+		assert.Equal(t, futures.SideTypeBuy, res[0].Orders[0].Side)
+		assert.Equal(t, "2", res[0].Orders[0].OrigQuantity)
+	}
+}
@@ -0,0 +1,508 @@
+// ratelimit implements a limiter shared by every binance api request, keeping
+// the server's IP request weight and each account's order counts under the
+// binance limits. 5xx responses without an api error are returned as
+// UpstreamErrors.
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	l        *Limiter
+	once     sync.Once
+	nowFunc  = time.Now
+	sleepFor = sleep
+
+	// defaultWeightLimit is the futures REQUEST_WEIGHT limit per minute per IP
+	defaultWeightLimit = 2400
+
+	// defaultOrderLimit1m and defaultOrderLimit10s are the futures ORDERS
+	// limits per account
+	defaultOrderLimit1m  = 1200
+	defaultOrderLimit10s = 300
+
+	// headroom is the fraction of each limit used before requests are delayed,
+	// leaving room for the requests made outside of the limiter
+	headroom = 0.9
+
+	// defaultRetryAfter is how long requests are held back after a 429 or 418
+	// response without a Retry-After header
+	defaultRetryAfter = 1 * time.Minute
+)
+
+// Usage is the limiter's current usage of the binance limits.
+type Usage struct {
+	Weight      int          `json:"weight"`
+	WeightLimit int          `json:"weightLimit"`
+	Orders      []OrderUsage `json:"orders"`
+	BannedUntil *time.Time   `json:"bannedUntil,omitempty"`
+	Delayed     int64        `json:"delayed"`
+	Rejected    int64        `json:"rejected"`
+}
+
+// OrderUsage is an account's usage of the order limits.
+type OrderUsage struct {
+	Account    string `json:"account"`
+	Orders1m   int    `json:"orders1m"`
+	Limit1m    int    `json:"limit1m"`
+	Orders10s  int    `json:"orders10s"`
+	Limit10s   int    `json:"limit10s"`
+	LastUpdate int64  `json:"lastUpdate"`
+}
+
+// counter counts the usage of a limit in fixed windows, like binance does.
+type counter struct {
+	interval time.Duration
+	window   time.Time
+	used     int
+}
+
+// roll resets the counter if now is in a new window.
+func (c *counter) roll(now time.Time) {
+	window := now.Truncate(c.interval)
+	if !window.Equal(c.window) {
+		c.window = window
+		c.used = 0
+	}
+}
+
+// delay returns how long until n more can be used without exceeding limit.
+func (c *counter) delay(now time.Time, n int, limit int) time.Duration {
+	c.roll(now)
+	if float64(c.used+n) <= float64(limit)*headroom {
+		return 0
+	}
+	return c.window.Add(c.interval).Sub(now)
+}
+
+// set sets the used count reported by binance, keeping the local count if
+// it's higher since it includes the requests still in flight.
+func (c *counter) set(now time.Time, used int) {
+	c.roll(now)
+	if used > c.used {
+		c.used = used
+	}
+}
+
+// account is an account's order counters.
+type account struct {
+	orders1m   counter
+	orders10s  counter
+	lastUpdate time.Time
+}
+
+// Limiter delays binance requests before they would exceed the IP request
+// weight limit or the account's order limits, and holds back every request
+// after binance responds with 429 TOO_MANY_REQUESTS or 418 IP banned until
+// the Retry-After has passed.
+//
+// The usage is tracked from the X-MBX-USED-WEIGHT-1M and X-MBX-ORDER-COUNT-*
+// response headers, and estimated from the endpoint weights for the requests
+// in flight.
+type Limiter struct {
+	m sync.Mutex
+
+	weight      counter
+	weightLimit int
+
+	accounts      map[string]*account
+	orderLimit1m  int
+	orderLimit10s int
+
+	bannedUntil time.Time
+	delayed     int64
+	rejected    int64
+
+	base http.RoundTripper
+}
+
+// NewLimiter returns a reference to the limiter shared by every binance
+// client.
+func NewLimiter() *Limiter {
+	once.Do(func() {
+		l = newLimiter()
+	})
+	return l
+}
+
+// newLimiter returns a limiter with the default futures limits.
+func newLimiter() *Limiter {
+	return &Limiter{
+		weight:        counter{interval: time.Minute},
+		weightLimit:   defaultWeightLimit,
+		accounts:      make(map[string]*account),
+		orderLimit1m:  defaultOrderLimit1m,
+		orderLimit10s: defaultOrderLimit10s,
+	}
+}
+
+// Client returns an http client making its requests through the limiter, for
+// futures.Client.HTTPClient.
+func (l *Limiter) Client() *http.Client {
+	return &http.Client{Transport: l}
+}
+
+// NewClient returns a futures client making its requests through the shared
+// limiter.
+func NewClient(apiKey, secretKey string) *futures.Client {
+	client := futures.NewClient(apiKey, secretKey)
+	client.HTTPClient = NewLimiter().Client()
+	return client
+}
+
+// SetRateLimits sets the limits from the exchange info's rate limits.
+func (l *Limiter) SetRateLimits(rateLimits []futures.RateLimit) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, r := range rateLimits {
+		switch {
+		case r.RateLimitType == "REQUEST_WEIGHT" && r.Interval == "MINUTE" && r.IntervalNum == 1:
+			l.weightLimit = int(r.Limit)
+		case r.RateLimitType == "ORDERS" && r.Interval == "MINUTE" && r.IntervalNum == 1:
+			l.orderLimit1m = int(r.Limit)
+		case r.RateLimitType == "ORDERS" && r.Interval == "SECOND" && r.IntervalNum == 10:
+			l.orderLimit10s = int(r.Limit)
+		}
+	}
+}
+
+// Usage returns the limiter's current usage.
+func (l *Limiter) Usage() *Usage {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := nowFunc()
+
+	l.weight.roll(now)
+	usage := &Usage{
+		Weight:      l.weight.used,
+		WeightLimit: l.weightLimit,
+		Orders:      []OrderUsage{},
+		Delayed:     l.delayed,
+		Rejected:    l.rejected,
+	}
+	if now.Before(l.bannedUntil) {
+		bannedUntil := l.bannedUntil
+		usage.BannedUntil = &bannedUntil
+	}
+
+	for apiKey, a := range l.accounts {
+		a.orders1m.roll(now)
+		a.orders10s.roll(now)
+		usage.Orders = append(usage.Orders, OrderUsage{
+			Account:    maskAPIKey(apiKey),
+			Orders1m:   a.orders1m.used,
+			Limit1m:    l.orderLimit1m,
+			Orders10s:  a.orders10s.used,
+			Limit10s:   l.orderLimit10s,
+			LastUpdate: a.lastUpdate.UnixNano() / int64(time.Millisecond),
+		})
+	}
+	sort.Slice(usage.Orders, func(i, j int) bool {
+		return usage.Orders[i].Account < usage.Orders[j].Account
+	})
+	return usage
+}
+
+// RoundTrip waits until the request can be sent without exceeding the limits,
+// sends it and updates the usage from the response.
+func (l *Limiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	apiKey := req.Header.Get("X-MBX-APIKEY")
+	order := isOrder(req)
+
+	err := l.wait(req.Context(), apiKey, weight(req), order)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := l.transport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	l.update(apiKey, res)
+	return checkUpstream(res)
+}
+
+// checkUpstream returns an UpstreamError instead of a 5xx response without an
+// api error, since the client would only see an api error with code 0 and
+// couldn't tell it from a 4xx one.
+func checkUpstream(res *http.Response) (*http.Response, error) {
+	if res.StatusCode < http.StatusInternalServerError {
+		return res, nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var apiErr common.APIError
+	if json.Unmarshal(body, &apiErr) != nil || apiErr.Code == 0 {
+		return nil, errors.NewUpstreamError(res.StatusCode)
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// transport returns the transport the requests are sent with, by default the
+// http.DefaultClient's so it can be replaced in the tests.
+func (l *Limiter) transport() http.RoundTripper {
+	if l.base != nil {
+		return l.base
+	}
+	if http.DefaultClient.Transport != nil {
+		return http.DefaultClient.Transport
+	}
+	return http.DefaultTransport
+}
+
+// wait blocks until the request's weight, and order if it's one, can be used
+// and reserves them. A RateLimitError is returned if the limits won't reset
+// before ctx is done.
+func (l *Limiter) wait(ctx context.Context, apiKey string, weight int, order bool) error {
+	for {
+		l.m.Lock()
+		now := nowFunc()
+		delay, limit := l.delay(now, apiKey, weight, order)
+		if delay == 0 {
+			l.reserve(now, apiKey, weight, order)
+			l.m.Unlock()
+			return nil
+		}
+
+		deadline, ok := ctx.Deadline()
+		if ok && deadline.Before(now.Add(delay)) {
+			l.rejected++
+			l.m.Unlock()
+			return errors.NewRateLimitError(limit, delay)
+		}
+		l.delayed++
+		l.m.Unlock()
+
+		log.WithFields(log.Fields{
+			"Limit": limit,
+			"Delay": delay,
+		}).Warn("Delaying binance request")
+
+		err := sleepFor(ctx, delay)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// delay returns how long the request has to wait for the limits, and the
+// limit it's waiting for. Must be called with l.m held.
+func (l *Limiter) delay(now time.Time, apiKey string, weight int, order bool) (time.Duration, string) {
+	if now.Before(l.bannedUntil) {
+		return l.bannedUntil.Sub(now), "RETRY_AFTER"
+	}
+	if d := l.weight.delay(now, weight, l.weightLimit); d > 0 {
+		return d, "REQUEST_WEIGHT"
+	}
+	if order && apiKey != "" {
+		a := l.account(apiKey)
+		if d := a.orders10s.delay(now, 1, l.orderLimit10s); d > 0 {
+			return d, "ORDERS_10S"
+		}
+		if d := a.orders1m.delay(now, 1, l.orderLimit1m); d > 0 {
+			return d, "ORDERS_1M"
+		}
+	}
+	return 0, ""
+}
+
+// reserve counts the request towards the limits. Must be called with l.m
+// held.
+func (l *Limiter) reserve(now time.Time, apiKey string, weight int, order bool) {
+	l.weight.roll(now)
+	l.weight.used += weight
+	if order && apiKey != "" {
+		a := l.account(apiKey)
+		a.orders1m.roll(now)
+		a.orders1m.used++
+		a.orders10s.roll(now)
+		a.orders10s.used++
+	}
+}
+
+// account returns the account's order counters. Must be called with l.m
+// held.
+func (l *Limiter) account(apiKey string) *account {
+	a, ok := l.accounts[apiKey]
+	if !ok {
+		a = &account{
+			orders1m:  counter{interval: time.Minute},
+			orders10s: counter{interval: 10 * time.Second},
+		}
+		l.accounts[apiKey] = a
+	}
+	return a
+}
+
+// update updates the usage from the response's headers, and holds back every
+// request for the Retry-After if the response is a 429 or 418.
+func (l *Limiter) update(apiKey string, res *http.Response) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	now := nowFunc()
+
+	if used, ok := header(res, "X-MBX-USED-WEIGHT-1M"); ok {
+		l.weight.set(now, used)
+	}
+
+	if apiKey != "" {
+		used1m, ok1m := header(res, "X-MBX-ORDER-COUNT-1M")
+		used10s, ok10s := header(res, "X-MBX-ORDER-COUNT-10S")
+		if ok1m || ok10s {
+			a := l.account(apiKey)
+			if ok1m {
+				a.orders1m.set(now, used1m)
+			}
+			if ok10s {
+				a.orders10s.set(now, used10s)
+			}
+			a.lastUpdate = now
+		}
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusTeapot {
+		retryAfter := defaultRetryAfter
+		if seconds, ok := header(res, "Retry-After"); ok {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		if until := now.Add(retryAfter); until.After(l.bannedUntil) {
+			l.bannedUntil = until
+		}
+
+		log.WithFields(log.Fields{
+			"Status":     res.StatusCode,
+			"RetryAfter": retryAfter,
+		}).Error("Binance rate limit exceeded, holding back requests")
+	}
+}
+
+// header returns the response header's int value and whether it's set.
+func header(res *http.Response, key string) (int, bool) {
+	value, err := strconv.Atoi(res.Header.Get(key))
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// isOrder returns whether the request counts towards the order limits.
+func isOrder(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	return strings.HasSuffix(req.URL.Path, "/fapi/v1/order") ||
+		strings.HasSuffix(req.URL.Path, "/fapi/v1/batchOrders")
+}
+
+// weight returns the request weight of the futures endpoint. Every endpoint
+// the service calls is listed, the others are assumed to weigh 1. See
+// https://binance-docs.github.io/apidocs/futures/en/#general-info
+func weight(req *http.Request) int {
+	query := req.URL.Query()
+	hasSymbol := query.Get("symbol") != ""
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/ticker/24hr"), strings.HasSuffix(path, "/openOrders"):
+		if hasSymbol {
+			return 1
+		}
+		return 40
+	case strings.HasSuffix(path, "/ticker/price"), strings.HasSuffix(path, "/ticker/bookTicker"):
+		if hasSymbol {
+			return 1
+		}
+		return 2
+	case strings.HasSuffix(path, "/account"),
+		strings.HasSuffix(path, "/balance"),
+		strings.HasSuffix(path, "/positionRisk"),
+		strings.HasSuffix(path, "/allOrders"):
+		return 5
+	case strings.HasSuffix(path, "/batchOrders"):
+		// Placing a batch of orders weighs 5, cancelling one weighs 1
+		if req.Method == http.MethodPost {
+			return 5
+		}
+		return 1
+	case strings.HasSuffix(path, "/positionSide/dual"):
+		// Getting the position mode weighs 30, changing it weighs 1
+		if req.Method == http.MethodGet {
+			return 30
+		}
+		return 1
+	case strings.HasSuffix(path, "/leverageBracket"),
+		strings.HasSuffix(path, "/premiumIndex"),
+		strings.HasSuffix(path, "/fundingRate"),
+		strings.HasSuffix(path, "/leverage"),
+		strings.HasSuffix(path, "/marginType"),
+		strings.HasSuffix(path, "/allOpenOrders"),
+		strings.HasSuffix(path, "/order"),
+		strings.HasSuffix(path, "/listenKey"),
+		strings.HasSuffix(path, "/exchangeInfo"),
+		strings.HasSuffix(path, "/time"):
+		return 1
+	case strings.HasSuffix(path, "/depth"):
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		switch {
+		case limit > 500:
+			return 20
+		case limit > 100 || limit == 0:
+			return 10
+		case limit > 50:
+			return 5
+		}
+		return 2
+	case strings.HasSuffix(path, "/klines"):
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		switch {
+		case limit > 1000:
+			return 10
+		case limit > 500 || limit == 0:
+			return 5
+		case limit >= 100:
+			return 2
+		}
+		return 1
+	}
+	return 1
+}
+
+// maskAPIKey returns the api key with all but its last 4 characters masked.
+func maskAPIKey(apiKey string) string {
+	if len(apiKey) <= 4 {
+		return "****"
+	}
+	return "****" + apiKey[len(apiKey)-4:]
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,260 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock replaces nowFunc and sleepFor, sleeping moves the clock forward
+// and records the delay.
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func newFakeClock(t *testing.T) *fakeClock {
+	clock := &fakeClock{now: time.Date(2021, 11, 12, 10, 30, 15, 0, time.UTC)}
+	nowFunc = func() time.Time { return clock.now }
+	sleepFor = func(ctx context.Context, d time.Duration) error {
+		clock.delays = append(clock.delays, d)
+		clock.now = clock.now.Add(d)
+		return nil
+	}
+	t.Cleanup(func() {
+		nowFunc = time.Now
+		sleepFor = sleep
+	})
+	return clock
+}
+
+// newTestServer returns a server responding with the status and headers.
+func newTestServer(t *testing.T, status int, headers map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range headers {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newRequest returns a request to the server's path with the api key.
+func newRequest(ctx context.Context, t *testing.T, method, url, apiKey string) *http.Request {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-MBX-APIKEY", apiKey)
+	}
+	return req
+}
+
+func TestUsageFromHeaders(t *testing.T) {
+	newFakeClock(t)
+	srv := newTestServer(t, http.StatusOK, map[string]string{
+		"X-MBX-USED-WEIGHT-1M":  "100",
+		"X-MBX-ORDER-COUNT-1M":  "12",
+		"X-MBX-ORDER-COUNT-10S": "3",
+	})
+
+	l := newLimiter()
+	l.base = http.DefaultTransport
+	res, err := l.Client().Do(newRequest(context.Background(), t, "POST", srv.URL+"/fapi/v1/order", "apikey1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	usage := l.Usage()
+	assert.Equal(t, 100, usage.Weight)
+	assert.Equal(t, defaultWeightLimit, usage.WeightLimit)
+	assert.Len(t, usage.Orders, 1)
+	assert.Equal(t, "****1234", usage.Orders[0].Account)
+	assert.Equal(t, 12, usage.Orders[0].Orders1m)
+	assert.Equal(t, 3, usage.Orders[0].Orders10s)
+	assert.Nil(t, usage.BannedUntil)
+}
+
+func TestDelayBeforeLimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		weight        int
+		orders10s     int
+		expectedDelay time.Duration
+	}{
+		{
+			name:          "request under the weight limit",
+			method:        "GET",
+			path:          "/fapi/v1/ticker/price?symbol=BTCUSDT",
+			weight:        100,
+			expectedDelay: 0,
+		},
+		{
+			name:          "request weight delayed to the next minute",
+			method:        "GET",
+			path:          "/fapi/v1/ticker/24hr",
+			weight:        2150,
+			expectedDelay: 45 * time.Second,
+		},
+		{
+			name:          "order delayed to the next 10 seconds",
+			method:        "POST",
+			path:          "/fapi/v1/order",
+			orders10s:     270,
+			expectedDelay: 5 * time.Second,
+		},
+	}
+
+	srv := newTestServer(t, http.StatusOK, nil)
+	for _, tc := range tests {
+		clock := newFakeClock(t)
+		l := newLimiter()
+		l.base = http.DefaultTransport
+		l.weight.set(clock.now, tc.weight)
+		l.account("apikey").orders10s.set(clock.now, tc.orders10s)
+
+		res, err := l.Client().Do(newRequest(context.Background(), t, tc.method, srv.URL+tc.path, "apikey"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		var delay time.Duration
+		for _, d := range clock.delays {
+			delay += d
+		}
+		assert.Equal(t, tc.expectedDelay, delay, tc.name)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	clock := newFakeClock(t)
+	banned := newTestServer(t, http.StatusTooManyRequests, map[string]string{"Retry-After": "30"})
+	srv := newTestServer(t, http.StatusOK, nil)
+
+	l := newLimiter()
+	l.base = http.DefaultTransport
+	res, err := l.Client().Do(newRequest(context.Background(), t, "GET", banned.URL+"/fapi/v1/time", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.NotNil(t, l.Usage().BannedUntil)
+
+	// Requests that can't wait for the Retry-After are rejected
+	ctx, cancel := context.WithDeadline(context.Background(), clock.now.Add(10*time.Second))
+	defer cancel()
+	_, err = l.Client().Do(newRequest(ctx, t, "GET", srv.URL+"/fapi/v1/time", ""))
+	rateLimitErr, ok := errors.AsRateLimitError(err)
+	assert.True(t, ok, "rate limit error")
+	if ok {
+		assert.Equal(t, 30*time.Second, rateLimitErr.RetryAfter)
+	}
+
+	// Otherwise they're delayed until the Retry-After has passed
+	res, err = l.Client().Do(newRequest(context.Background(), t, "GET", srv.URL+"/fapi/v1/time", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, []time.Duration{30 * time.Second}, clock.delays)
+
+	usage := l.Usage()
+	assert.Equal(t, int64(1), usage.Delayed)
+	assert.Equal(t, int64(1), usage.Rejected)
+}
+
+func TestUpstreamError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected bool
+	}{
+		{name: "5xx without an api error", status: http.StatusBadGateway, body: "<html>Bad Gateway</html>", expected: true},
+		{name: "5xx with an api error", status: http.StatusServiceUnavailable, body: `{"code":-1001,"msg":"Internal error"}`},
+		{name: "4xx without an api error", status: http.StatusNotFound, body: "<html>Not Found</html>"},
+	}
+
+	for _, tc := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+
+		l := newLimiter()
+		l.base = http.DefaultTransport
+		res, err := l.Client().Do(newRequest(context.Background(), t, "GET", srv.URL+"/fapi/v1/time", ""))
+		srv.Close()
+
+		upstreamErr, ok := errors.AsUpstreamError(err)
+		assert.Equal(t, tc.expected, ok, tc.name)
+		if ok {
+			assert.Equal(t, tc.status, upstreamErr.StatusCode, tc.name)
+			continue
+		}
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, tc.body, string(body), tc.name)
+	}
+}
+
+func TestSetRateLimits(t *testing.T) {
+	l := newLimiter()
+	l.SetRateLimits([]futures.RateLimit{
+		{RateLimitType: "REQUEST_WEIGHT", Interval: "MINUTE", IntervalNum: 1, Limit: 1200},
+		{RateLimitType: "ORDERS", Interval: "MINUTE", IntervalNum: 1, Limit: 600},
+		{RateLimitType: "ORDERS", Interval: "SECOND", IntervalNum: 10, Limit: 100},
+	})
+	assert.Equal(t, 1200, l.weightLimit)
+	assert.Equal(t, 600, l.orderLimit1m)
+	assert.Equal(t, 100, l.orderLimit10s)
+}
+
+func TestWeight(t *testing.T) {
+	tests := []struct {
+		method   string
+		url      string
+		expected int
+	}{
+		{url: "/fapi/v1/ticker/24hr?symbol=BTCUSDT", expected: 1},
+		{url: "/fapi/v1/ticker/24hr", expected: 40},
+		{url: "/fapi/v1/openOrders", expected: 40},
+		{url: "/fapi/v2/account", expected: 5},
+		{url: "/fapi/v1/depth?symbol=BTCUSDT&limit=1000", expected: 20},
+		{url: "/fapi/v1/depth?symbol=BTCUSDT", expected: 10},
+		{url: "/fapi/v1/klines?symbol=BTCUSDT&interval=1m&limit=50", expected: 1},
+		{url: "/fapi/v1/order", expected: 1},
+		{method: "POST", url: "/fapi/v1/batchOrders", expected: 5},
+		{method: "DELETE", url: "/fapi/v1/batchOrders?symbol=BTCUSDT", expected: 1},
+		{url: "/fapi/v1/positionSide/dual", expected: 30},
+		{method: "POST", url: "/fapi/v1/positionSide/dual", expected: 1},
+		{url: "/fapi/v1/leverageBracket?symbol=BTCUSDT", expected: 1},
+		{url: "/fapi/v1/premiumIndex", expected: 1},
+	}
+
+	for _, tc := range tests {
+		method := tc.method
+		if method == "" {
+			method = "GET"
+		}
+		req := newRequest(context.Background(), t, method, "https://fapi.binance.com"+tc.url, "")
+		assert.Equal(t, tc.expected, weight(req), method+" "+tc.url)
+	}
+}
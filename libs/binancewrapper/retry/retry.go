@@ -3,97 +3,344 @@ package retry
 
 import (
 	"context"
+	stderrors "errors"
+	"math/rand"
+	"net"
+	"time"
 
 	"github.com/adshao/go-binance/v2/common"
 	"github.com/adshao/go-binance/v2/futures"
 	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
 	log "github.com/sirupsen/logrus"
 )
 
-// recvWindow retry schedule in ms which will retry a request 3 times with
-// varying recvWindow intervals.
-var recvWindowSchedule = []int64{
-	5000,
-	7000,
-	10000,
+var (
+	nowFunc  = time.Now
+	sleepFor = sleep
+	resync   = ServerTimeSync
+)
+
+// Class is a class of errors that are retried with the same policy.
+type Class int
+
+const (
+	// ClassNone errors aren't retried
+	ClassNone Class = iota
+
+	// ClassTimestamp errors are -1021 INVALID_TIMESTAMP, the request was
+	// rejected because its timestamp was outside of the recvWindow or ahead of
+	// the server's time.
+	ClassTimestamp
+
+	// ClassUnknownStatus errors are -1007 TIMEOUT, -1001 DISCONNECTED, 5xx
+	// responses and network errors, the request may or may not have been
+	// executed.
+	ClassUnknownStatus
+
+	// ClassRateLimit errors are -1003 TOO_MANY_REQUESTS and -1015
+	// TOO_MANY_ORDERS, the request was rejected because a rate limit was
+	// exceeded.
+	ClassRateLimit
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassTimestamp:
+		return "timestamp"
+	case ClassUnknownStatus:
+		return "unknown status"
+	case ClassRateLimit:
+		return "rate limit"
+	}
+	return "none"
 }
 
-// DoFunc is used to call the binance sdk service's Do method.
-type DoFunc func(...futures.RequestOption) (interface{}, error)
+// Policy is how requests failing with a class of errors are retried.
+type Policy struct {
+	// MaxRetries is how many times the request is retried
+	MaxRetries int
+
+	// Backoff returns how long to wait before the nth retry, starting at 0.
+	// The retry isn't delayed if it's nil.
+	Backoff func(n int) time.Duration
+
+	// RecvWindows are the recvWindows in ms of each retry, the last one is
+	// used for the remaining retries. The default recvWindow is used if it's
+	// empty.
+	RecvWindows []int64
+
+	// ResyncTime resyncs the time offset with the server time and applies it
+	// to the client before the first retry
+	ResyncTime bool
+}
 
-// Do will retry do according to recvWindowSchedule.
-func Do(err error, do DoFunc) (interface{}, error) {
-	if retryable(err) {
-		return retryWithRecvWindow(do)
+// Policies are the retry policies of each class of errors. Errors of classes
+// without a policy aren't retried.
+type Policies map[Class]Policy
+
+// DefaultPolicies are the policies used unless the Retrier sets its own.
+var DefaultPolicies = Policies{
+	// Covers the cases of the request timestamp being 1000ms or more ahead of
+	// the server's time, and of the request being outside of the recvWindow.
+	// See https://github.com/adshao/go-binance/issues/127
+	ClassTimestamp: {
+		MaxRetries:  3,
+		RecvWindows: []int64{5000, 7000, 10000},
+		ResyncTime:  true,
+	},
+	ClassUnknownStatus: {
+		MaxRetries: 3,
+		Backoff:    ExponentialBackoff(250*time.Millisecond, 4*time.Second),
+	},
+	// The rate limiter holds the retry back until the limit's window resets
+	// or the Retry-After has passed, the backoff only covers the limits it
+	// doesn't know are exceeded.
+	ClassRateLimit: {
+		MaxRetries: 2,
+		Backoff:    WindowReset(10 * time.Second),
+	},
+}
+
+// ExponentialBackoff returns a backoff doubling from base up to max, with full
+// jitter so concurrent retries are spread out.
+func ExponentialBackoff(base, max time.Duration) func(n int) time.Duration {
+	return func(n int) time.Duration {
+		backoff := base << uint(n)
+		if backoff > max || backoff <= 0 {
+			backoff = max
+		}
+		return time.Duration(rand.Int63n(int64(backoff) + 1))
 	}
-	return nil, err
 }
 
-// retryWithRecvWindow resyncs the system time with the server time and retries
-// the request according to recvWindowSchedule.
-func retryWithRecvWindow(do DoFunc) (interface{}, error) {
-	// Covers the first case of the request timestamp being 1000ms or more ahead
-	// of the binance server's time.
-	err := ServerTimeSync()
-	if err != nil {
-		return nil, err
+// WindowReset returns a backoff waiting until the start of the next rate limit
+// window of the interval.
+func WindowReset(interval time.Duration) func(n int) time.Duration {
+	return func(n int) time.Duration {
+		now := nowFunc()
+		return now.Truncate(interval).Add(interval).Sub(now)
 	}
+}
+
+// DoFunc is used to call the binance sdk service's Do method.
+type DoFunc[T any] func(opts ...futures.RequestOption) (T, error)
+
+// LandedFunc checks whether a failed call was executed by binance anyway, and
+// returns its result if it was.
+type LandedFunc[T any] func(ctx context.Context) (T, bool, error)
+
+// Retrier retries a binance call according to its policies.
+type Retrier[T any] struct {
+	// Name of the call in the logs
+	Name string
+
+	// Client signs do's requests, its time offset is updated when the time is
+	// resynced. Clients keep the offset they're created with, so without it
+	// the retry would be signed with the same out of sync timestamp.
+	Client *futures.Client
+
+	// Policies are the retry policies, DefaultPolicies if nil
+	Policies Policies
+
+	// Idempotent calls can be retried after ClassUnknownStatus errors.
+	// Otherwise they're only retried if Landed finds that the failed attempt
+	// wasn't executed.
+	Idempotent bool
 
-	// Covers the second case of the request being outside of the recvWindow.
-	for _, w := range recvWindowSchedule {
-		res, err := do(futures.WithRecvWindow(w))
-		if err == nil {
-			return res, nil
+	// Landed checks whether a failed attempt of a non idempotent call was
+	// executed, e.g. by looking up the order by its newClientOrderId
+	Landed LandedFunc[T]
+}
+
+// Do calls the idempotent do, which sends its requests with the client,
+// retrying it according to DefaultPolicies.
+func Do[T any](ctx context.Context, client *futures.Client, name string, do DoFunc[T]) (T, error) {
+	r := &Retrier[T]{Name: name, Client: client, Idempotent: true}
+	return r.Do(ctx, do)
+}
+
+// DoErr calls the idempotent do, which sends its requests with the client and
+// only returns an error, retrying it according to DefaultPolicies.
+func DoErr(ctx context.Context, client *futures.Client, name string, do func(opts ...futures.RequestOption) error) error {
+	_, err := Do(ctx, client, name, func(opts ...futures.RequestOption) (struct{}, error) {
+		return struct{}{}, do(opts...)
+	})
+	return err
+}
+
+// DoOnce calls the non idempotent do, which sends its requests with the
+// client, retrying it according to DefaultPolicies. After ClassUnknownStatus
+// errors it's only retried if landed finds the failed attempt wasn't executed,
+// or isn't retried if landed is nil.
+func DoOnce[T any](ctx context.Context, client *futures.Client, name string, do DoFunc[T], landed LandedFunc[T]) (T, error) {
+	r := &Retrier[T]{Name: name, Client: client, Landed: landed}
+	return r.Do(ctx, do)
+}
+
+// Do calls do, retrying it according to the policy of each error's class, and
+// returns the result of the last attempt.
+func (r *Retrier[T]) Do(ctx context.Context, do DoFunc[T]) (T, error) {
+	policies := r.Policies
+	if policies == nil {
+		policies = DefaultPolicies
+	}
+
+	res, err := do()
+	retries := make(map[Class]int)
+	for err != nil {
+		var zero T
+		class := Classify(err)
+		policy, ok := policies[class]
+		if !ok || retries[class] >= policy.MaxRetries {
+			return zero, err
+		}
+
+		if class == ClassUnknownStatus && !r.Idempotent {
+			if r.Landed == nil {
+				return zero, err
+			}
+			landedRes, landed, landedErr := r.Landed(ctx)
+			if landedErr != nil {
+				log.WithField("Error", landedErr).Error("Could not check whether " + r.Name + " request was executed")
+				return zero, err
+			}
+			if landed {
+				return landedRes, nil
+			}
 		}
+
+		n := retries[class]
+		retries[class]++
+
+		if policy.ResyncTime && n == 0 {
+			resyncErr := resync(r.Client)
+			if resyncErr != nil {
+				return zero, resyncErr
+			}
+		}
+
+		var delay time.Duration
+		if policy.Backoff != nil {
+			delay = policy.Backoff(n)
+		}
+		sleepErr := sleepFor(ctx, delay)
+		if sleepErr != nil {
+			return zero, err
+		}
+
+		var opts []futures.RequestOption
+		var recvWindow int64
+		if len(policy.RecvWindows) != 0 {
+			recvWindow = policy.RecvWindows[len(policy.RecvWindows)-1]
+			if n < len(policy.RecvWindows) {
+				recvWindow = policy.RecvWindows[n]
+			}
+			opts = append(opts, futures.WithRecvWindow(recvWindow))
+		}
+
+		log.WithFields(log.Fields{
+			"Class":      class.String(),
+			"Retry":      n + 1,
+			"Delay":      delay,
+			"recvWindow": recvWindow,
+		}).Info("Retrying " + r.Name + " request")
+
+		res, err = do(opts...)
 	}
-	return nil, err
+	return res, nil
 }
 
-// ServerTimeSync sets the time offset for each request to the binance server time.
-func ServerTimeSync() error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	client := futures.NewClient("", "")
-	serverTime, err := client.NewServerTimeService().Do(ctx)
-	if err == nil {
-		log.WithField("ServerTime", serverTime).Info("Updated time offset")
+// ServerTimeSync syncs the shared clock with the binance server time and
+// applies the updated time offset to the client, if it isn't nil.
+func ServerTimeSync(client *futures.Client) error {
+	c := clock.NewClock()
+	err := c.Sync(context.Background())
+	if err != nil {
+		return err
 	}
-	return err
+	if client != nil {
+		c.Apply(client)
+	}
+	return nil
 }
 
-// retryable returns whether or not the request should be retried based on the
-// api error code. The request will only be retried if the api call failed with
-// error codes:
+// Classify returns the class of the error a binance call failed with:
 // -1021 INVALID_TIMESTAMP
-// 	- Timestamp for this request is outside of the recvWindow.
-// 	- Timestamp for this request was 1000ms ahead of the server's time.
-// 	See https://github.com/adshao/go-binance/issues/127
+//   - Timestamp for this request is outside of the recvWindow.
+//   - Timestamp for this request was 1000ms ahead of the server's time.
 //
-// -1007 TIMEOUT
-// 	- Timeout waiting for response from backend server. Send status unknown;
-// 	execution status unknown.
+// -1007 TIMEOUT, -1001 DISCONNECTED, 5xx responses without an api error and
+// network errors
+//   - Send status unknown; execution status unknown.
 //
-// Other cases with different retry strategies and schedules will need to
-// eventually be added, such as for when we're rate limited:
-// -1015 TOO_MANY_ORDERS
-// -1003 TOO_MANY_REQUESTS
+// -1003 TOO_MANY_REQUESTS, -1015 TOO_MANY_ORDERS
+//   - A rate limit was exceeded.
 //
-// See https://github.com/binance/binance-spot-api-docs/blob/master/errors.md
-func retryable(err error) bool {
+// Requests held back by the rate limiter, cancelled requests and 4xx
+// responses without an api error aren't retried. See https://binance-docs.github.io/apidocs/futures/en/#error-codes
+func Classify(err error) Class {
+	if err == nil {
+		return ClassNone
+	}
+	if _, ok := errors.AsRateLimitError(err); ok {
+		return ClassNone
+	}
+	if stderrors.Is(err, context.Canceled) || stderrors.Is(err, context.DeadlineExceeded) {
+		return ClassNone
+	}
+
 	if common.IsAPIError(err) {
 		// TODO: go-binance sdk doesn't have api error types
 		switch apiErr := errors.NewAPIError(err); apiErr.Code {
 		case -1021: // INVALID_TIMESTAMP
 			log.WithField("Code", apiErr.Code).
 				Error("Binance API error: server time out of sync or recvWindow too small")
-			return true
+			return ClassTimestamp
 		case -1007: // TIMEOUT
 			log.WithField("Code", apiErr.Code).
 				Error("Binance API error: timeout waiting for response from backend server")
-			return true
+			return ClassUnknownStatus
+		case -1001: // DISCONNECTED
+			log.WithField("Code", apiErr.Code).
+				Error("Binance API error: internal error")
+			return ClassUnknownStatus
+		case -1003, -1015: // TOO_MANY_REQUESTS, TOO_MANY_ORDERS
+			log.WithField("Code", apiErr.Code).
+				Error("Binance API error: rate limit exceeded")
+			return ClassRateLimit
 		default:
 			log.WithField("Code", apiErr.Code).Error("Binance API error")
 		}
+		return ClassNone
+	}
+
+	// A 5xx without an api error, see ratelimit.checkUpstream. A 4xx
+	// without one is an api error with code 0, which isn't retried
+	if _, ok := errors.AsUpstreamError(err); ok {
+		log.WithField("Error", err).Error("Binance API error: unexpected response")
+		return ClassUnknownStatus
+	}
+
+	var netErr net.Error
+	if stderrors.As(err, &netErr) {
+		log.WithField("Error", err).Error("Binance request failed")
+		return ClassUnknownStatus
+	}
+	return ClassNone
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return false
 }
@@ -0,0 +1,221 @@
+package retry
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHooks replaces sleepFor and resync, recording the delays and resyncs.
+type fakeHooks struct {
+	delays  []time.Duration
+	resyncs []*futures.Client
+}
+
+func newFakeHooks(t *testing.T) *fakeHooks {
+	hooks := &fakeHooks{}
+	sleepFor = func(ctx context.Context, d time.Duration) error {
+		hooks.delays = append(hooks.delays, d)
+		return nil
+	}
+	resync = func(client *futures.Client) error {
+		hooks.resyncs = append(hooks.resyncs, client)
+		return nil
+	}
+	t.Cleanup(func() {
+		sleepFor = sleep
+		resync = ServerTimeSync
+	})
+	return hooks
+}
+
+// fakeServer responds to the account requests with the api error codes in
+// order, then with an empty account. It records the recvWindow of each
+// request.
+type fakeServer struct {
+	codes       []int64
+	recvWindows []string
+}
+
+// newClient returns a client sending its requests to a new fakeServer.
+func newClient(t *testing.T, codes ...int64) (*futures.Client, *fakeServer) {
+	s := &fakeServer{codes: codes}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.recvWindows = append(s.recvWindows, r.URL.Query().Get("recvWindow"))
+		if len(s.codes) == 0 {
+			w.Write([]byte("{}"))
+			return
+		}
+		code := s.codes[0]
+		s.codes = s.codes[1:]
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"code":%d,"msg":"error"}`, code)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := futures.NewClient("key", "secret")
+	client.BaseURL = srv.URL
+	return client, s
+}
+
+func apiError(code int64) error {
+	return &common.APIError{Code: code, Message: "error"}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected Class
+	}{
+		{name: "nil", err: nil, expected: ClassNone},
+		{name: "INVALID_TIMESTAMP", err: apiError(-1021), expected: ClassTimestamp},
+		{name: "TIMEOUT", err: apiError(-1007), expected: ClassUnknownStatus},
+		{name: "DISCONNECTED", err: apiError(-1001), expected: ClassUnknownStatus},
+		{name: "5xx without an api error", err: &url.Error{Op: "Get", URL: "/fapi/v2/account", Err: errors.NewUpstreamError(502)}, expected: ClassUnknownStatus},
+		{name: "4xx without an api error", err: apiError(0), expected: ClassNone},
+		{name: "TOO_MANY_REQUESTS", err: apiError(-1003), expected: ClassRateLimit},
+		{name: "TOO_MANY_ORDERS", err: apiError(-1015), expected: ClassRateLimit},
+		{name: "NO_SUCH_ORDER", err: apiError(-2013), expected: ClassNone},
+		{name: "network error", err: &net.OpError{Op: "dial", Err: stderrors.New("connection refused")}, expected: ClassUnknownStatus},
+		{name: "held back by the rate limiter", err: errors.NewRateLimitError("REQUEST_WEIGHT", time.Second), expected: ClassNone},
+		{name: "cancelled", err: context.Canceled, expected: ClassNone},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, Classify(tc.err), tc.name)
+	}
+}
+
+func TestTimestampRetries(t *testing.T) {
+	hooks := newFakeHooks(t)
+	ctx := context.Background()
+	client, srv := newClient(t, -1021, -1021, -1021)
+	svc := client.NewGetAccountService()
+
+	_, err := Do(ctx, client, "GetAccount", func(opts ...futures.RequestOption) (*futures.Account, error) {
+		return svc.Do(ctx, opts...)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "5000", "7000", "10000"}, srv.recvWindows)
+	assert.Equal(t, []*futures.Client{client}, hooks.resyncs, "client resynced once")
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	newFakeHooks(t)
+	ctx := context.Background()
+	client, srv := newClient(t, -1021, -1021, -1021, -1007, -1001, -1001, -1001)
+	svc := client.NewGetAccountService()
+
+	// Each class has its own retries, the last attempt's error is returned
+	_, err := Do(ctx, client, "GetAccount", func(opts ...futures.RequestOption) (*futures.Account, error) {
+		return svc.Do(ctx, opts...)
+	})
+	assert.Equal(t, int64(-1001), errors.NewAPIError(err).Code)
+	assert.Len(t, srv.recvWindows, 7, "requests")
+
+	client, srv = newClient(t, -1007, -1007, -1007, -1007)
+	svc = client.NewGetAccountService()
+	_, err = Do(ctx, client, "GetAccount", func(opts ...futures.RequestOption) (*futures.Account, error) {
+		return svc.Do(ctx, opts...)
+	})
+	assert.Equal(t, int64(-1007), errors.NewAPIError(err).Code)
+	assert.Len(t, srv.recvWindows, 4, "requests")
+}
+
+func TestUnknownStatusBackoff(t *testing.T) {
+	hooks := newFakeHooks(t)
+	ctx := context.Background()
+	client, _ := newClient(t, -1007, -1001, -1007)
+	svc := client.NewGetAccountService()
+
+	_, err := Do(ctx, client, "GetAccount", func(opts ...futures.RequestOption) (*futures.Account, error) {
+		return svc.Do(ctx, opts...)
+	})
+	assert.NoError(t, err)
+	assert.Len(t, hooks.delays, 3)
+	for n, delay := range hooks.delays {
+		assert.LessOrEqual(t, delay, (250*time.Millisecond)<<uint(n))
+	}
+	assert.Empty(t, hooks.resyncs)
+}
+
+func TestNonIdempotent(t *testing.T) {
+	newFakeHooks(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name             string
+		landed           LandedFunc[string]
+		expectedRes      string
+		expectedCode     int64
+		expectedRequests int
+	}{
+		{
+			name:             "not retried without landed",
+			expectedCode:     -1007,
+			expectedRequests: 1,
+		},
+		{
+			name: "landed result returned",
+			landed: func(ctx context.Context) (string, bool, error) {
+				return "landed", true, nil
+			},
+			expectedRes:      "landed",
+			expectedRequests: 1,
+		},
+		{
+			name: "retried if not landed",
+			landed: func(ctx context.Context) (string, bool, error) {
+				return "", false, nil
+			},
+			expectedRes:      "ok",
+			expectedRequests: 2,
+		},
+		{
+			name: "not retried if landed fails",
+			landed: func(ctx context.Context) (string, bool, error) {
+				return "", false, stderrors.New("lookup failed")
+			},
+			expectedCode:     -1007,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		client, srv := newClient(t, -1007)
+		svc := client.NewGetAccountService()
+		res, err := DoOnce(ctx, client, "CreateOrder", func(opts ...futures.RequestOption) (string, error) {
+			_, err := svc.Do(ctx, opts...)
+			if err != nil {
+				return "", err
+			}
+			return "ok", nil
+		}, tc.landed)
+
+		assert.Equal(t, tc.expectedRes, res, tc.name)
+		if tc.expectedCode != 0 {
+			assert.Equal(t, tc.expectedCode, errors.NewAPIError(err).Code, tc.name)
+		} else {
+			assert.NoError(t, err, tc.name)
+		}
+		assert.Len(t, srv.recvWindows, tc.expectedRequests, tc.name)
+	}
+}
+
+func TestWindowReset(t *testing.T) {
+	nowFunc = func() time.Time { return time.Date(2021, 11, 12, 10, 30, 17, 0, time.UTC) }
+	defer func() { nowFunc = time.Now }()
+	assert.Equal(t, 3*time.Second, WindowReset(10*time.Second)(0))
+}
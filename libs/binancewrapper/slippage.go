@@ -0,0 +1,176 @@
+// Package binancewrapper wraps the binance api client
+package binancewrapper
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/filters"
+	log "github.com/sirupsen/logrus"
+)
+
+// OrderResponse is the response of a created order. Slippage is only set for
+// MARKET orders with a maxSlippageBps.
+type OrderResponse struct {
+	*futures.CreateOrderResponse
+	Slippage *Slippage `json:"slippage,omitempty"`
+}
+
+// Slippage is a MARKET order's fill estimated from the order book before it
+// was sent, and its actual fill. The slippages are in basis points from the
+// reference price, the best ask of a BUY or the best bid of a SELL, and are
+// positive when the fill is worse than it.
+type Slippage struct {
+	MaxSlippageBps      int     `json:"maxSlippageBps"`
+	ReferencePrice      string  `json:"referencePrice"`
+	ExpectedAvgPrice    string  `json:"expectedAvgPrice"`
+	ExpectedSlippageBps float64 `json:"expectedSlippageBps"`
+
+	// LimitPrice is the price of the LIMIT IOC order sent instead of the
+	// MARKET order, if its expected slippage exceeded the max
+	LimitPrice string `json:"limitPrice,omitempty"`
+
+	// ActualAvgPrice and ActualSlippageBps are empty if nothing was filled
+	ActualAvgPrice    string   `json:"actualAvgPrice,omitempty"`
+	ActualSlippageBps *float64 `json:"actualSlippageBps,omitempty"`
+}
+
+// estimateSlippage estimates the fill of the MARKET order's quantity from the
+// symbol's order book. If its slippage exceeds the order's maxSlippageBps, or
+// the book isn't deep enough to fill it, the order is either rejected with a
+// SlippageError, or the returned slippage has the LimitPrice of the LIMIT IOC
+// order to send instead, at the slippage bound rounded towards the reference
+// price.
+func (b *binanceClient) estimateSlippage(
+	ctx context.Context,
+	symbol *futures.Symbol,
+	order *models.Order,
+	quantity string,
+) (*Slippage, error) {
+	qty, err := strconv.ParseFloat(quantity, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	bid, ask, err := b.books.GetBestBidAsk(ctx, order.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	reference := ask.Price
+	if order.Side == futures.SideTypeSell {
+		reference = bid.Price
+	}
+	if reference == 0 {
+		return nil, &errors.SlippageError{Symbol: order.Symbol, MaxSlippageBps: order.MaxSlippageBps}
+	}
+
+	fill, err := b.books.EstimateFill(ctx, order.Symbol, order.Side, qty)
+	if err != nil {
+		return nil, err
+	}
+
+	slippage := &Slippage{
+		MaxSlippageBps:      order.MaxSlippageBps,
+		ReferencePrice:      formatPrice(reference),
+		ExpectedAvgPrice:    formatPrice(fill.AvgPrice),
+		ExpectedSlippageBps: slippageBps(order.Side, reference, fill.AvgPrice),
+	}
+
+	log.WithFields(log.Fields{
+		"Symbol":              order.Symbol,
+		"Side":                order.Side,
+		"Quantity":            quantity,
+		"ReferencePrice":      slippage.ReferencePrice,
+		"ExpectedAvgPrice":    slippage.ExpectedAvgPrice,
+		"ExpectedSlippageBps": slippage.ExpectedSlippageBps,
+		"Complete":            fill.Complete,
+	}).Info("Estimated slippage")
+
+	if fill.Complete && slippage.ExpectedSlippageBps <= float64(order.MaxSlippageBps) {
+		return slippage, nil
+	}
+
+	if order.SlippageAction != models.SlippageActionLimitIOC {
+		err := &errors.SlippageError{
+			Symbol:              order.Symbol,
+			MaxSlippageBps:      order.MaxSlippageBps,
+			ExpectedSlippageBps: slippage.ExpectedSlippageBps,
+			ReferencePrice:      slippage.ReferencePrice,
+		}
+		if fill.Complete {
+			err.ExpectedAvgPrice = slippage.ExpectedAvgPrice
+		}
+		return nil, err
+	}
+
+	slippage.LimitPrice, err = limitPrice(symbol, order.Side, reference, order.MaxSlippageBps)
+	if err != nil {
+		return nil, err
+	}
+
+	// The LIMIT order has to pass the PERCENT_PRICE filter, which MARKET
+	// orders don't
+	price, _ := strconv.ParseFloat(slippage.LimitPrice, 64)
+	err = b.checkPercentPrice(symbol, order.Side, price)
+	if err != nil {
+		return nil, err
+	}
+	return slippage, nil
+}
+
+// setActual sets the slippage's actual fill from the order's average price,
+// unless nothing was filled.
+func (s *Slippage) setActual(side futures.SideType, avgPrice string) {
+	avg, _ := strconv.ParseFloat(avgPrice, 64)
+	if avg == 0 {
+		return
+	}
+	reference, _ := strconv.ParseFloat(s.ReferencePrice, 64)
+	bps := slippageBps(side, reference, avg)
+	s.ActualAvgPrice = avgPrice
+	s.ActualSlippageBps = &bps
+}
+
+// limitPrice returns the price maxSlippageBps worse than the reference price
+// for the side, rounded to the symbol's tick size towards the reference price
+// so the order can't fill past the bound.
+func limitPrice(symbol *futures.Symbol, side futures.SideType, reference float64, maxSlippageBps int) (string, error) {
+	bound := float64(maxSlippageBps) / 1e4
+	price := reference * (1 + bound)
+	if side == futures.SideTypeSell {
+		price = reference * (1 - bound)
+	}
+
+	if f := symbol.PriceFilter(); f != nil {
+		if tick, _ := strconv.ParseFloat(f.TickSize, 64); tick > 0 {
+			// The epsilon keeps a price already on a tick from being rounded
+			// to the next one
+			if side == futures.SideTypeSell {
+				price = math.Ceil(price/tick-1e-9) * tick
+			} else {
+				price = math.Floor(price/tick+1e-9) * tick
+			}
+		}
+	}
+	return filters.Price(symbol, strconv.FormatFloat(price, 'f', -1, 64))
+}
+
+// slippageBps returns how much worse the average price is than the reference
+// price for the side, in basis points rounded to 2 decimals.
+func slippageBps(side futures.SideType, reference, avgPrice float64) float64 {
+	bps := (avgPrice - reference) / reference * 1e4
+	if side == futures.SideTypeSell {
+		bps = -bps
+	}
+	return math.Round(bps*100) / 100
+}
+
+// formatPrice formats the estimated price, rounded to 8 decimals like the
+// binance prices.
+func formatPrice(price float64) string {
+	return strconv.FormatFloat(math.Round(price*1e8)/1e8, 'f', -1, 64)
+}
@@ -0,0 +1,200 @@
+package binancewrapper
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBooks is a fake store.OrderBookSource with the same best bid and ask
+// and estimated fill for every symbol.
+type fakeBooks struct {
+	bid, ask store.Level
+	fill     store.Fill
+}
+
+func (f *fakeBooks) GetBestBidAsk(ctx context.Context, symbol string) (store.Level, store.Level, error) {
+	return f.bid, f.ask, nil
+}
+
+func (f *fakeBooks) GetDepth(ctx context.Context, symbol string, side futures.SideType, notional float64) (store.Fill, error) {
+	return f.fill, nil
+}
+
+func (f *fakeBooks) EstimateFill(ctx context.Context, symbol string, side futures.SideType, quantity float64) (store.Fill, error) {
+	return f.fill, nil
+}
+
+func TestCreateOrderSlippage(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the order book is scripted around the fake server's fill price")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+	books := &fakeBooks{}
+	prices, symbols, markPrices := snapshotStores(t)
+	client := newFactoryClient(user, prices, symbols, books, markPrices)
+	ctx := context.Background()
+
+	last, err := strconv.ParseFloat(prices["ETHUSDT"], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := &models.Order{
+		Type:           futures.OrderTypeMarket,
+		Symbol:         "ETHUSDT",
+		Side:           futures.SideTypeBuy,
+		Percentage:     0.01,
+		MaxSlippageBps: 50,
+	}
+
+	// Within the bound the MARKET order is sent
+	books.bid = store.Level{Price: last - 0.01, Quantity: 100}
+	books.ask = store.Level{Price: last, Quantity: 100}
+	books.fill = store.Fill{AvgPrice: last * 1.001, Complete: true}
+	res, err := client.CreateOrder(ctx, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderTypeMarket, res.Type)
+	if assert.NotNil(t, res.Slippage) {
+		assert.Equal(t, 10.0, res.Slippage.ExpectedSlippageBps)
+		assert.Empty(t, res.Slippage.LimitPrice)
+		assert.Equal(t, res.AvgPrice, res.Slippage.ActualAvgPrice)
+		assert.NotNil(t, res.Slippage.ActualSlippageBps, "filled")
+	}
+
+	// Past the bound the order is rejected by default
+	books.fill = store.Fill{AvgPrice: last * 1.01, Complete: true}
+	orders := len(fake.Orders("ETHUSDT"))
+	_, err = client.CreateOrder(ctx, order)
+	var slippageErr *errors.SlippageError
+	if assert.ErrorAs(t, err, &slippageErr) {
+		assert.Equal(t, 100.0, slippageErr.ExpectedSlippageBps)
+		assert.NotEmpty(t, slippageErr.ExpectedAvgPrice)
+	}
+
+	// A book that isn't deep enough is rejected too
+	books.fill = store.Fill{AvgPrice: last, Complete: false}
+	_, err = client.CreateOrder(ctx, order)
+	if assert.ErrorAs(t, err, &slippageErr) {
+		assert.Empty(t, slippageErr.ExpectedAvgPrice)
+	}
+	assert.Len(t, fake.Orders("ETHUSDT"), orders, "rejected orders not sent")
+
+	// Or sent as a LIMIT IOC order at the bound, which expires if the market
+	// moved past it
+	books.ask = store.Level{Price: last * 0.99, Quantity: 1}
+	books.fill = store.Fill{AvgPrice: last * 0.999, Complete: true}
+	order.SlippageAction = models.SlippageActionLimitIOC
+	res, err = client.CreateOrder(ctx, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderTypeLimit, res.Type)
+	assert.Equal(t, futures.TimeInForceTypeIOC, res.TimeInForce)
+	assert.Equal(t, futures.OrderStatusTypeExpired, res.Status)
+	if assert.NotNil(t, res.Slippage) {
+		assert.Equal(t, res.Price, res.Slippage.LimitPrice)
+		assert.Empty(t, res.Slippage.ActualAvgPrice, "nothing filled")
+		assert.Nil(t, res.Slippage.ActualSlippageBps)
+	}
+}
+
+func TestSlippagePercentPrice(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the order book is scripted around the fake server's fill price")
+	}
+
+	user := &models.User{
+		APIKey:    os.Getenv("FUTURES_API_KEY"),
+		APISecret: os.Getenv("FUTURES_API_SECRET"),
+	}
+
+	// ETHUSDT with a PERCENT_PRICE filter, and a mark price 10% below the
+	// last price
+	prices, symbols, markPrices := snapshotStores(t)
+	symbol := symbols["ETHUSDT"]
+	symbol.Filters = append(append([]map[string]interface{}{}, symbol.Filters...), map[string]interface{}{
+		"filterType": "PERCENT_PRICE", "multiplierUp": "1.05", "multiplierDown": "0.95", "multiplierDecimal": "4",
+	})
+	symbols["ETHUSDT"] = symbol
+	last, err := strconv.ParseFloat(prices["ETHUSDT"], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markPrices["ETHUSDT"] = strconv.FormatFloat(last*0.9, 'f', 2, 64)
+	books := &fakeBooks{
+		bid:  store.Level{Price: last - 0.01, Quantity: 100},
+		ask:  store.Level{Price: last, Quantity: 100},
+		fill: store.Fill{AvgPrice: last * 1.01, Complete: true},
+	}
+	client := newFactoryClient(user, prices, symbols, books, markPrices)
+	orders := len(fake.Orders("ETHUSDT"))
+
+	// The LIMIT IOC price is within 5% of the last price, but not of the
+	// mark price binance checks it against
+	_, err = client.CreateOrder(context.Background(), &models.Order{
+		Type:           futures.OrderTypeMarket,
+		Symbol:         "ETHUSDT",
+		Side:           futures.SideTypeBuy,
+		Percentage:     0.01,
+		MaxSlippageBps: 50,
+		SlippageAction: models.SlippageActionLimitIOC,
+	})
+	filterErr, ok := errors.AsFilterError(err)
+	if assert.True(t, ok, "order rejected by PERCENT_PRICE") {
+		assert.Equal(t, "PERCENT_PRICE", filterErr.Filter)
+	}
+	assert.Len(t, fake.Orders("ETHUSDT"), orders, "rejected order not sent")
+}
+
+func TestLimitPrice(t *testing.T) {
+	symbol := futures.Symbol{
+		Symbol:         "BTCUSDT",
+		PricePrecision: 2,
+		Filters: []map[string]interface{}{
+			{"filterType": "PRICE_FILTER", "minPrice": "0.10", "maxPrice": "1000000", "tickSize": "0.10"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		side      futures.SideType
+		reference float64
+		bps       int
+		expected  string
+	}{
+		{name: "buy rounded down", side: futures.SideTypeBuy, reference: 50000.3, bps: 10, expected: "50050.3"},
+		{name: "buy on a tick", side: futures.SideTypeBuy, reference: 50000, bps: 10, expected: "50050.0"},
+		{name: "buy below a tick", side: futures.SideTypeBuy, reference: 50000.05, bps: 1, expected: "50005.0"},
+		{name: "sell rounded up", side: futures.SideTypeSell, reference: 50000.05, bps: 1, expected: "49995.1"},
+		{name: "sell on a tick", side: futures.SideTypeSell, reference: 50000, bps: 10, expected: "49950.0"},
+	}
+
+	for _, tc := range tests {
+		price, err := limitPrice(&symbol, tc.side, tc.reference, tc.bps)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, price, tc.name)
+	}
+}
+
+func TestSlippageBps(t *testing.T) {
+	assert.Equal(t, 20.0, slippageBps(futures.SideTypeBuy, 100, 100.2))
+	assert.Equal(t, -20.0, slippageBps(futures.SideTypeBuy, 100, 99.8), "better than the reference")
+	assert.Equal(t, 20.0, slippageBps(futures.SideTypeSell, 100, 99.8))
+	assert.Equal(t, 3.33, slippageBps(futures.SideTypeSell, 30, 29.99))
+}
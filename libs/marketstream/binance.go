@@ -0,0 +1,117 @@
+package marketstream
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+)
+
+// markPriceRate is how often the mark price stream pushes the mark prices,
+// either every 1s or 3s.
+var markPriceRate = 1 * time.Second
+
+// ServeBinance connects the channel's binance futures stream: the all market
+// ticker, mark price or book ticker stream, or a kline channel's combined
+// kline stream for the symbols.
+func ServeBinance(
+	channel Channel,
+	symbols []string,
+	handler func(Event),
+	errHandler futures.ErrHandler,
+) (doneC, stopC chan struct{}, err error) {
+	switch channel {
+	case ChannelTicker:
+		return futures.WsAllMarketTickerServe(func(events futures.WsAllMarketTickerEvent) {
+			for _, e := range events {
+				handler(Event{Channel: channel, Symbol: e.Symbol, Data: newTicker(e)})
+			}
+		}, errHandler)
+	case ChannelMarkPrice:
+		return futures.WsAllMarkPriceServeWithRate(markPriceRate, func(events futures.WsAllMarkPriceEvent) {
+			for _, e := range events {
+				handler(Event{Channel: channel, Symbol: e.Symbol, Data: newMarkPrice(e)})
+			}
+		}, errHandler)
+	case ChannelBookTicker:
+		return futures.WsAllBookTickerServe(func(e *futures.WsBookTickerEvent) {
+			handler(Event{Channel: channel, Symbol: e.Symbol, Data: newBookTicker(e)})
+		}, errHandler)
+	}
+
+	interval := channel.Interval()
+	if interval == "" {
+		return nil, nil, errors.NewValidationError("channel", fmt.Sprintf("unknown channel %q", channel))
+	}
+	pairs := make(map[string]string, len(symbols))
+	for _, symbol := range symbols {
+		pairs[symbol] = interval
+	}
+	return futures.WsCombinedKlineServe(pairs, func(e *futures.WsKlineEvent) {
+		handler(Event{Channel: channel, Symbol: e.Symbol, Data: newKline(e.Symbol, &e.Kline)})
+	}, errHandler)
+}
+
+// newTicker returns the ticker of the 24hr ticker event.
+func newTicker(e *futures.WsMarketTickerEvent) store.Ticker {
+	return store.Ticker{
+		Symbol:             e.Symbol,
+		LastPrice:          e.ClosePrice,
+		LastQuantity:       e.CloseQty,
+		PriceChange:        e.PriceChange,
+		PriceChangePercent: e.PriceChangePercent,
+		WeightedAvgPrice:   e.WeightedAvgPrice,
+		OpenPrice:          e.OpenPrice,
+		HighPrice:          e.HighPrice,
+		LowPrice:           e.LowPrice,
+		Volume:             e.BaseVolume,
+		QuoteVolume:        e.QuoteVolume,
+		UpdateTime:         time.UnixMilli(e.Time),
+	}
+}
+
+// newMarkPrice returns the mark price of the mark price event.
+func newMarkPrice(e *futures.WsMarkPriceEvent) store.MarkPrice {
+	return store.MarkPrice{
+		Symbol:               e.Symbol,
+		MarkPrice:            e.MarkPrice,
+		IndexPrice:           e.IndexPrice,
+		EstimatedSettlePrice: e.EstimatedSettlePrice,
+		FundingRate:          e.FundingRate,
+		NextFundingTime:      time.UnixMilli(e.NextFundingTime),
+		UpdateTime:           time.UnixMilli(e.Time),
+	}
+}
+
+// newBookTicker returns the book ticker of the book ticker event.
+func newBookTicker(e *futures.WsBookTickerEvent) store.BookTicker {
+	return store.BookTicker{
+		Symbol:     e.Symbol,
+		BidPrice:   e.BestBidPrice,
+		BidQty:     e.BestBidQty,
+		AskPrice:   e.BestAskPrice,
+		AskQty:     e.BestAskQty,
+		UpdateID:   e.UpdateID,
+		UpdateTime: time.UnixMilli(e.Time),
+	}
+}
+
+// newKline returns the symbol's kline of the kline event.
+func newKline(symbol string, k *futures.WsKline) store.Kline {
+	return store.Kline{
+		Symbol:      symbol,
+		Interval:    k.Interval,
+		OpenTime:    time.UnixMilli(k.StartTime),
+		CloseTime:   time.UnixMilli(k.EndTime),
+		Open:        k.Open,
+		High:        k.High,
+		Low:         k.Low,
+		Close:       k.Close,
+		Volume:      k.Volume,
+		QuoteVolume: k.QuoteVolume,
+		Trades:      k.TradeNum,
+		Closed:      k.IsFinal,
+	}
+}
@@ -0,0 +1,504 @@
+// Package marketstream fans out the binance futures market streams to
+// subscribers in the process.
+//
+// A single upstream stream is connected per channel, no matter how many
+// subscribers it has: the all market ticker, mark price and book ticker
+// streams, and a combined kline stream per interval with every subscribed
+// symbol. A channel's stream is connected once it has a subscriber,
+// reconnected with backoff whenever it's dropped, and closed once its last
+// subscriber unsubscribes.
+//
+// Subscribers never hold up the streams. Each subscription only keeps the
+// latest pending event of each channel's symbols, so a slow subscriber skips
+// the intermediate updates instead of falling further and further behind.
+package marketstream
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// reconnectBackoff is how long to wait before the nth reconnect of a
+	// stream, starting at 0. It starts over once a connection stays up for
+	// the minConnection.
+	reconnectBackoff = retry.ExponentialBackoff(500*time.Millisecond, 30*time.Second)
+
+	// minConnection is how long a stream has to stay connected for its
+	// reconnect backoff to start over
+	minConnection = 10 * time.Second
+
+	// maxTopics is how many channel symbols a subscription can subscribe to
+	maxTopics = 1000
+
+	hub     *Hub
+	hubOnce sync.Once
+)
+
+// Channel is a kind of market data event.
+type Channel string
+
+const (
+	// ChannelTicker is the symbols' 24hr tickers, as store.Ticker
+	ChannelTicker Channel = "ticker"
+
+	// ChannelMarkPrice is the symbols' mark prices and funding rates every
+	// second, as store.MarkPrice
+	ChannelMarkPrice Channel = "markPrice"
+
+	// ChannelBookTicker is the symbols' best bids and asks, as
+	// store.BookTicker
+	ChannelBookTicker Channel = "bookTicker"
+
+	// klinePrefix prefixes the kline channels, e.g. kline_1m, whose events
+	// are store.Kline
+	klinePrefix = "kline_"
+)
+
+// KlineIntervals are the intervals of the kline channels, from the shortest
+// to the longest.
+var KlineIntervals = []string{"1m", "3m", "5m", "15m", "30m", "1h", "2h", "4h", "6h", "8h", "12h", "1d", "3d", "1w", "1M"}
+
+// IsKlineInterval returns whether the interval is one of the KlineIntervals.
+func IsKlineInterval(interval string) bool {
+	for _, i := range KlineIntervals {
+		if i == interval {
+			return true
+		}
+	}
+	return false
+}
+
+// KlineChannel returns the channel of the interval's klines.
+func KlineChannel(interval string) Channel {
+	return Channel(klinePrefix + interval)
+}
+
+// Interval returns the kline channel's interval, or an empty string if it
+// isn't a kline channel.
+func (ch Channel) Interval() string {
+	if !strings.HasPrefix(string(ch), klinePrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(string(ch), klinePrefix)
+}
+
+// ParseChannel returns the channel, or a validation error if there isn't
+// one with that name.
+func ParseChannel(name string) (Channel, error) {
+	switch ch := Channel(name); ch {
+	case ChannelTicker, ChannelMarkPrice, ChannelBookTicker:
+		return ch, nil
+	}
+	if IsKlineInterval(Channel(name).Interval()) {
+		return Channel(name), nil
+	}
+	return "", errors.NewValidationError("channels", fmt.Sprintf(
+		"%q must be one of ticker, markPrice, bookTicker, kline_<interval> with an interval of %s",
+		name, strings.Join(KlineIntervals, ", ")))
+}
+
+// Event is a channel's market data event for a symbol.
+type Event struct {
+	Channel Channel `json:"channel"`
+	Symbol  string  `json:"symbol"`
+
+	// Data is the event's store.Ticker, store.MarkPrice, store.BookTicker
+	// or store.Kline, depending on the channel
+	Data interface{} `json:"data"`
+}
+
+// eventKey identifies the events replacing each other while they're pending.
+// Klines are also identified by their open time, so a kline isn't replaced
+// by the next one before it's delivered.
+type eventKey struct {
+	channel  Channel
+	symbol   string
+	openTime int64
+}
+
+func (e *Event) key() eventKey {
+	key := eventKey{channel: e.Channel, symbol: e.Symbol}
+	if kline, ok := e.Data.(store.Kline); ok {
+		key.openTime = kline.OpenTime.UnixMilli()
+	}
+	return key
+}
+
+// ServeFunc connects the channel's upstream stream, calling handler with its
+// events. The symbols are only used by the kline channels, the other
+// channels' streams are for every symbol.
+type ServeFunc func(
+	channel Channel,
+	symbols []string,
+	handler func(Event),
+	errHandler futures.ErrHandler,
+) (doneC, stopC chan struct{}, err error)
+
+// Hub connects the channels' upstream streams and publishes their events to
+// the subscriptions.
+type Hub struct {
+	serve ServeFunc
+
+	m sync.RWMutex
+
+	// topics are the subscriptions of each channel's symbols
+	topics    map[Channel]map[string]map[*Subscription]struct{}
+	upstreams map[Channel]*upstream
+}
+
+// NewHub returns a hub connecting the upstream streams with serve, e.g.
+// ServeBinance.
+func NewHub(serve ServeFunc) *Hub {
+	return &Hub{
+		serve:     serve,
+		topics:    make(map[Channel]map[string]map[*Subscription]struct{}),
+		upstreams: make(map[Channel]*upstream),
+	}
+}
+
+// BinanceHub returns the hub shared by the process, connecting the binance
+// streams with ServeBinance.
+func BinanceHub() *Hub {
+	hubOnce.Do(func() {
+		hub = NewHub(ServeBinance)
+	})
+	return hub
+}
+
+// Status returns whether the channel's upstream stream is connected, and how
+// many times it was reconnected.
+func (h *Hub) Status(channel Channel) (bool, int) {
+	h.m.RLock()
+	u := h.upstreams[channel]
+	h.m.RUnlock()
+	if u == nil {
+		return false, 0
+	}
+	u.m.Lock()
+	defer u.m.Unlock()
+	return u.connected, u.reconnects
+}
+
+// NewSubscription returns a subscription without any channels.
+func (h *Hub) NewSubscription() *Subscription {
+	return &Subscription{
+		hub:     h,
+		topics:  make(map[Channel]map[string]struct{}),
+		pending: make(map[eventKey]Event),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// publish sends the event to the subscriptions of its channel's symbol.
+func (h *Hub) publish(event Event) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	for sub := range h.topics[event.Channel][event.Symbol] {
+		sub.push(event)
+	}
+}
+
+// sync connects the channel's upstream stream if it has subscriptions, and
+// closes it otherwise. A kline channel's stream is replaced whenever its
+// symbols change. Must be called with h.m held.
+func (h *Hub) sync(channel Channel) {
+	symbols := h.topics[channel]
+	u := h.upstreams[channel]
+	if len(symbols) == 0 {
+		if u != nil {
+			u.stop()
+			delete(h.upstreams, channel)
+		}
+		return
+	}
+
+	var subscribed []string
+	if channel.Interval() != "" {
+		subscribed = make([]string, 0, len(symbols))
+		for symbol := range symbols {
+			subscribed = append(subscribed, symbol)
+		}
+		sort.Strings(subscribed)
+	}
+	if u != nil && equal(u.symbols, subscribed) {
+		return
+	}
+
+	// The old stream keeps publishing its symbols' events until it's closed,
+	// the new one is already connecting by then
+	h.upstreams[channel] = h.start(channel, subscribed)
+	if u != nil {
+		u.stop()
+	}
+}
+
+// upstream is a channel's stream.
+type upstream struct {
+	channel Channel
+	symbols []string
+	done    chan struct{}
+	once    sync.Once
+
+	m          sync.Mutex
+	connected  bool
+	reconnects int
+}
+
+// setConnected records whether the stream is connected, counting its
+// reconnects.
+func (u *upstream) setConnected(connected bool) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if !connected && u.connected {
+		u.reconnects++
+	}
+	u.connected = connected
+}
+
+// start connects the channel's stream for the symbols in the background.
+func (h *Hub) start(channel Channel, symbols []string) *upstream {
+	u := &upstream{channel: channel, symbols: symbols, done: make(chan struct{})}
+	go h.run(u)
+	return u
+}
+
+// stop closes the stream.
+func (u *upstream) stop() {
+	u.once.Do(func() {
+		close(u.done)
+	})
+}
+
+// run keeps the stream connected until it's stopped, reconnecting it with
+// backoff whenever it's dropped.
+func (h *Hub) run(u *upstream) {
+	logger := log.WithField("Channel", u.channel)
+	errHandler := func(err error) {
+		logger.WithError(err).Warn("Market stream error")
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(reconnectBackoff(attempt - 1)):
+			case <-u.done:
+				return
+			}
+		}
+
+		doneC, stopC, err := h.serve(u.channel, u.symbols, h.publish, errHandler)
+		if err != nil {
+			logger.WithField("Attempt", attempt).Error(err)
+			continue
+		}
+		connectedAt := time.Now()
+		u.setConnected(true)
+		logger.WithField("Symbols", len(u.symbols)).Info("Connected market stream")
+
+		select {
+		case <-u.done:
+			close(stopC)
+			logger.Info("Closed market stream")
+			return
+		case <-doneC:
+		}
+		u.setConnected(false)
+
+		connected := time.Since(connectedAt)
+		logger.WithField("Connected", connected).Warn("Market stream disconnected, reconnecting")
+		if connected > minConnection {
+			attempt = 0
+		}
+	}
+}
+
+// Subscription is a subscriber to the channels' symbols. Its events are
+// received with Ready and Events.
+type Subscription struct {
+	hub *Hub
+
+	// topics are the subscribed symbols of each channel, guarded by hub.m
+	topics map[Channel]map[string]struct{}
+
+	// pending are the events that weren't received yet, by their key in the
+	// order they were published
+	m       sync.Mutex
+	pending map[eventKey]Event
+	order   []eventKey
+	skipped int
+	ready   chan struct{}
+}
+
+// Subscribe subscribes to the channels' symbols. A subscription can have
+// at most maxTopics channel symbols.
+func (s *Subscription) Subscribe(channels []Channel, symbols []string) error {
+	h := s.hub
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	topics := 0
+	for _, symbols := range s.topics {
+		topics += len(symbols)
+	}
+	for _, channel := range channels {
+		for _, symbol := range symbols {
+			if _, ok := s.topics[channel][symbol]; !ok {
+				topics++
+			}
+		}
+	}
+	if topics > maxTopics {
+		return errors.NewValidationError("symbols", fmt.Sprintf("at most %d channel symbols can be subscribed", maxTopics))
+	}
+
+	for _, channel := range channels {
+		if s.topics[channel] == nil {
+			s.topics[channel] = make(map[string]struct{})
+		}
+		if h.topics[channel] == nil {
+			h.topics[channel] = make(map[string]map[*Subscription]struct{})
+		}
+		for _, symbol := range symbols {
+			s.topics[channel][symbol] = struct{}{}
+			if h.topics[channel][symbol] == nil {
+				h.topics[channel][symbol] = make(map[*Subscription]struct{})
+			}
+			h.topics[channel][symbol][s] = struct{}{}
+		}
+		h.sync(channel)
+	}
+	return nil
+}
+
+// Unsubscribe unsubscribes from the channels' symbols, or from every symbol
+// of the channels if symbols is empty.
+func (s *Subscription) Unsubscribe(channels []Channel, symbols []string) {
+	h := s.hub
+	h.m.Lock()
+	defer h.m.Unlock()
+	s.unsubscribe(channels, symbols)
+}
+
+// unsubscribe unsubscribes from the channels' symbols. Must be called with
+// hub.m held.
+func (s *Subscription) unsubscribe(channels []Channel, symbols []string) {
+	h := s.hub
+	for _, channel := range channels {
+		unsubscribed := symbols
+		if len(unsubscribed) == 0 {
+			for symbol := range s.topics[channel] {
+				unsubscribed = append(unsubscribed, symbol)
+			}
+		}
+
+		for _, symbol := range unsubscribed {
+			delete(s.topics[channel], symbol)
+			delete(h.topics[channel][symbol], s)
+			if len(h.topics[channel][symbol]) == 0 {
+				delete(h.topics[channel], symbol)
+			}
+		}
+		if len(s.topics[channel]) == 0 {
+			delete(s.topics, channel)
+		}
+		if len(h.topics[channel]) == 0 {
+			delete(h.topics, channel)
+		}
+		h.sync(channel)
+	}
+}
+
+// Close unsubscribes from every channel.
+func (s *Subscription) Close() {
+	h := s.hub
+	h.m.Lock()
+	defer h.m.Unlock()
+	channels := make([]Channel, 0, len(s.topics))
+	for channel := range s.topics {
+		channels = append(channels, channel)
+	}
+	s.unsubscribe(channels, nil)
+}
+
+// Topics returns the sorted subscribed symbols of each channel.
+func (s *Subscription) Topics() map[Channel][]string {
+	s.hub.m.RLock()
+	defer s.hub.m.RUnlock()
+	topics := make(map[Channel][]string, len(s.topics))
+	for channel, symbols := range s.topics {
+		for symbol := range symbols {
+			topics[channel] = append(topics[channel], symbol)
+		}
+		sort.Strings(topics[channel])
+	}
+	return topics
+}
+
+// Ready receives once there are pending events.
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Events returns the pending events in the order they were published and
+// clears them.
+func (s *Subscription) Events() []Event {
+	s.m.Lock()
+	defer s.m.Unlock()
+	events := make([]Event, 0, len(s.order))
+	for _, key := range s.order {
+		events = append(events, s.pending[key])
+	}
+	s.pending = make(map[eventKey]Event, len(s.order))
+	s.order = nil
+	return events
+}
+
+// Skipped returns how many events were replaced by a newer one of the same
+// channel and symbol before they were received.
+func (s *Subscription) Skipped() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.skipped
+}
+
+// push adds the event to the pending events, replacing the pending event of
+// the same channel and symbol, if any. It never blocks.
+func (s *Subscription) push(event Event) {
+	key := event.key()
+	s.m.Lock()
+	if _, ok := s.pending[key]; ok {
+		s.skipped++
+	} else {
+		s.order = append(s.order, key)
+	}
+	s.pending[key] = event
+	s.m.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// equal returns whether the sorted symbols are the same.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
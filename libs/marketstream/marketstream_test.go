@@ -0,0 +1,252 @@
+package marketstream
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStream is an upstream stream connected by fakeServe.
+type fakeStream struct {
+	channel Channel
+	symbols []string
+	handler func(Event)
+	doneC   chan struct{}
+	stopC   chan struct{}
+}
+
+// fakeServe connects fake streams that are only closed by the hub or
+// disconnect.
+type fakeServe struct {
+	m       sync.Mutex
+	streams []*fakeStream
+}
+
+func (f *fakeServe) serve(
+	channel Channel,
+	symbols []string,
+	handler func(Event),
+	errHandler futures.ErrHandler,
+) (doneC, stopC chan struct{}, err error) {
+	s := &fakeStream{
+		channel: channel,
+		symbols: symbols,
+		handler: handler,
+		doneC:   make(chan struct{}),
+		stopC:   make(chan struct{}),
+	}
+	go func() {
+		<-s.stopC
+		close(s.doneC)
+	}()
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.streams = append(f.streams, s)
+	return s.doneC, s.stopC, nil
+}
+
+// connected returns the channel's streams that weren't closed by the hub.
+func (f *fakeServe) connected(channel Channel) []*fakeStream {
+	f.m.Lock()
+	defer f.m.Unlock()
+	var streams []*fakeStream
+	for _, s := range f.streams {
+		select {
+		case <-s.stopC:
+			continue
+		default:
+		}
+		if s.channel == channel {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
+// waitConnected waits for the channel to have a single stream, and returns
+// it.
+func (f *fakeServe) waitConnected(t *testing.T, channel Channel) *fakeStream {
+	assert.Eventually(t, func() bool {
+		return len(f.connected(channel)) == 1
+	}, time.Second, 10*time.Millisecond, "%s connected", channel)
+	streams := f.connected(channel)
+	if len(streams) != 1 {
+		t.FailNow()
+	}
+	return streams[0]
+}
+
+// disconnect drops the stream as if binance closed it.
+func (s *fakeStream) disconnect() {
+	close(s.stopC)
+}
+
+func ticker(symbol, price string) Event {
+	return Event{Channel: ChannelTicker, Symbol: symbol, Data: store.Ticker{Symbol: symbol, LastPrice: price}}
+}
+
+func TestParseChannel(t *testing.T) {
+	for _, name := range []string{"ticker", "markPrice", "bookTicker", "kline_1m", "kline_1M"} {
+		channel, err := ParseChannel(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, Channel(name), channel)
+	}
+	for _, name := range []string{"trades", "kline_", "kline_2m", "Ticker"} {
+		_, err := ParseChannel(name)
+		assert.Error(t, err, name)
+	}
+	assert.Equal(t, "1h", KlineChannel("1h").Interval())
+	assert.Equal(t, "", ChannelTicker.Interval())
+}
+
+func TestFanOut(t *testing.T) {
+	fake := &fakeServe{}
+	hub := NewHub(fake.serve)
+
+	btc := hub.NewSubscription()
+	err := btc.Subscribe([]Channel{ChannelTicker}, []string{"BTCUSDT"})
+	assert.NoError(t, err)
+	both := hub.NewSubscription()
+	err = both.Subscribe([]Channel{ChannelTicker}, []string{"BTCUSDT", "ETHUSDT"})
+	assert.NoError(t, err)
+
+	stream := fake.waitConnected(t, ChannelTicker)
+	assert.Len(t, fake.streams, 1, "one stream per channel")
+
+	stream.handler(ticker("BTCUSDT", "60000"))
+	stream.handler(ticker("ETHUSDT", "4000"))
+	stream.handler(ticker("TRXUSDT", "0.1"))
+
+	<-btc.Ready()
+	assert.Equal(t, []Event{ticker("BTCUSDT", "60000")}, btc.Events())
+	<-both.Ready()
+	assert.Equal(t, []Event{ticker("BTCUSDT", "60000"), ticker("ETHUSDT", "4000")}, both.Events())
+
+	btc.Close()
+	assert.Len(t, fake.connected(ChannelTicker), 1, "still subscribed")
+	both.Unsubscribe([]Channel{ChannelTicker}, []string{"BTCUSDT"})
+	assert.Equal(t, map[Channel][]string{ChannelTicker: {"ETHUSDT"}}, both.Topics())
+
+	both.Close()
+	assert.Eventually(t, func() bool {
+		return len(fake.connected(ChannelTicker)) == 0
+	}, time.Second, 10*time.Millisecond, "closed after the last subscription")
+}
+
+func TestKlineSymbols(t *testing.T) {
+	fake := &fakeServe{}
+	hub := NewHub(fake.serve)
+	channel := KlineChannel("1m")
+
+	sub := hub.NewSubscription()
+	err := sub.Subscribe([]Channel{channel}, []string{"BTCUSDT"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"BTCUSDT"}, fake.waitConnected(t, channel).symbols)
+
+	// The combined stream is replaced with one for every subscribed symbol
+	err = sub.Subscribe([]Channel{channel}, []string{"ETHUSDT"})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		streams := fake.connected(channel)
+		return len(streams) == 1 && equal(streams[0].symbols, []string{"BTCUSDT", "ETHUSDT"})
+	}, time.Second, 10*time.Millisecond)
+
+	// A pending kline isn't replaced by the next one
+	stream := fake.waitConnected(t, channel)
+	open := time.UnixMilli(0)
+	for i, close := range []string{"1", "2", "3"} {
+		stream.handler(Event{Channel: channel, Symbol: "BTCUSDT", Data: store.Kline{
+			Symbol:   "BTCUSDT",
+			OpenTime: open.Add(time.Duration(i/2) * time.Minute),
+			Close:    close,
+		}})
+	}
+	<-sub.Ready()
+	events := sub.Events()
+	assert.Len(t, events, 2)
+	assert.Equal(t, "2", events[0].Data.(store.Kline).Close, "last update of the first kline")
+	assert.Equal(t, "3", events[1].Data.(store.Kline).Close)
+	assert.Equal(t, 1, sub.Skipped())
+
+	sub.Unsubscribe([]Channel{channel}, nil)
+	assert.Empty(t, sub.Topics())
+	assert.Eventually(t, func() bool {
+		return len(fake.connected(channel)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	fake := &fakeServe{}
+	hub := NewHub(fake.serve)
+
+	slow := hub.NewSubscription()
+	err := slow.Subscribe([]Channel{ChannelTicker}, []string{"BTCUSDT", "ETHUSDT"})
+	assert.NoError(t, err)
+	stream := fake.waitConnected(t, ChannelTicker)
+
+	// The stream isn't held up by a subscriber that doesn't receive its events
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			stream.handler(ticker("BTCUSDT", "60000"))
+		}
+		stream.handler(ticker("ETHUSDT", "4000"))
+		stream.handler(ticker("BTCUSDT", "60001"))
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("stream blocked by the subscriber")
+	}
+
+	assert.Equal(t, []Event{ticker("BTCUSDT", "60001"), ticker("ETHUSDT", "4000")}, slow.Events(), "latest events")
+	assert.Equal(t, 1000, slow.Skipped())
+	slow.Close()
+}
+
+func TestMaxTopics(t *testing.T) {
+	fake := &fakeServe{}
+	hub := NewHub(fake.serve)
+	defer func(max int) { maxTopics = max }(maxTopics)
+	maxTopics = 3
+
+	sub := hub.NewSubscription()
+	err := sub.Subscribe([]Channel{ChannelTicker, ChannelMarkPrice}, []string{"BTCUSDT"})
+	assert.NoError(t, err)
+	err = sub.Subscribe([]Channel{ChannelTicker, ChannelMarkPrice}, []string{"BTCUSDT", "ETHUSDT"})
+	assert.Error(t, err)
+	assert.Equal(t, map[Channel][]string{
+		ChannelTicker:    {"BTCUSDT"},
+		ChannelMarkPrice: {"BTCUSDT"},
+	}, sub.Topics(), "unchanged")
+	sub.Close()
+}
+
+func TestReconnect(t *testing.T) {
+	defer func(backoff func(int) time.Duration) { reconnectBackoff = backoff }(reconnectBackoff)
+	reconnectBackoff = func(int) time.Duration { return time.Millisecond }
+
+	fake := &fakeServe{}
+	hub := NewHub(fake.serve)
+
+	sub := hub.NewSubscription()
+	err := sub.Subscribe([]Channel{ChannelBookTicker}, []string{"BTCUSDT"})
+	assert.NoError(t, err)
+	fake.waitConnected(t, ChannelBookTicker).disconnect()
+
+	stream := fake.waitConnected(t, ChannelBookTicker)
+	assert.Eventually(t, func() bool {
+		connected, reconnects := hub.Status(ChannelBookTicker)
+		return connected && reconnects == 1
+	}, time.Second, 10*time.Millisecond, "reconnect counted")
+	stream.handler(Event{Channel: ChannelBookTicker, Symbol: "BTCUSDT", Data: store.BookTicker{Symbol: "BTCUSDT"}})
+	<-sub.Ready()
+	assert.Len(t, sub.Events(), 1, "events after reconnecting")
+	sub.Close()
+}
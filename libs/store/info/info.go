@@ -3,10 +3,12 @@ package info
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,19 +16,63 @@ var (
 	e            *exchangeInfoStore
 	once         sync.Once
 	defaultDelay = "30m"
+
+	// refreshTimeout is the timeout of an exchange info request
+	refreshTimeout = 30 * time.Second
+)
+
+// SymbolEventType is the kind of change of a symbol between two refreshes.
+type SymbolEventType string
+
+const (
+	// SymbolAdded is a newly listed symbol
+	SymbolAdded SymbolEventType = "ADDED"
+
+	// SymbolRemoved is a delisted symbol
+	SymbolRemoved SymbolEventType = "REMOVED"
+
+	// SymbolStatusChanged is a symbol whose status changed, e.g. from TRADING
+	// to SETTLING or BREAK
+	SymbolStatusChanged SymbolEventType = "STATUS_CHANGED"
 )
 
+// SymbolEvent is a change of a symbol's exchange info found by a refresh.
+type SymbolEvent struct {
+	Type   SymbolEventType
+	Symbol string
+
+	// Status is the symbol's new status, empty if it was removed
+	Status string
+
+	// PreviousStatus is the symbol's old status, empty if it was added
+	PreviousStatus string
+}
+
+// exchangeInfoStore stores the exchange info of all futures symbols. It's
+// refreshed every updateDelay, and the last good exchange info is kept if a
+// refresh fails.
 type exchangeInfoStore struct {
 	info        map[string]futures.Symbol
 	m           sync.RWMutex
 	updateDelay time.Duration
 	symbols     []string
+
+	// refreshM serializes the refreshes, so an older exchange info is never
+	// swapped in after a newer one
+	refreshM sync.Mutex
+
+	// delayC resets the refresh ticker to a new updateDelay
+	delayC chan time.Duration
+
+	// handlers are called with the symbol events of each refresh
+	handlers  []func(SymbolEvent)
+	handlersM sync.Mutex
 }
 
 // NewStore returns a reference to the in memory exchangeInfo store
 func NewStore() *exchangeInfoStore {
 	once.Do(func() {
-		e = &exchangeInfoStore{}
+		e = &exchangeInfoStore{delayC: make(chan time.Duration, 1)}
 		e.init()
 	})
 	return e
@@ -38,25 +84,12 @@ func (e *exchangeInfoStore) init() {
 	e.startUpdates()
 }
 
+// fetchExchangeInfo initializes the exchange info map. The service can't
+// validate or place orders without it, so it exits if it can't be fetched.
 func (e *exchangeInfoStore) fetchExchangeInfo() {
-	exchangeInfo, err := futures.NewClient("", "").
-		NewExchangeInfoService().
-		Do(context.Background())
-
+	err := e.refresh()
 	if err != nil {
 		log.Fatal(err)
-		return
-	}
-
-	e.info = make(map[string]futures.Symbol)
-	for _, s := range exchangeInfo.Symbols {
-
-		e.symbols = append(e.symbols, s.Symbol)
-		// We only care about BaseAssetPrecision (used in new order quantity calc)
-		// from binance:
-		// base asset refers to the asset that is the quantity of a symbol.
-		// quote asset refers to the asset that is the price of a symbol.
-		e.info[s.Symbol] = s
 	}
 }
 
@@ -101,38 +134,166 @@ func (e *exchangeInfoStore) GetPriceFilter(symbol string) *futures.PriceFilter {
 	return s.PriceFilter()
 }
 
-// WithDelay is the last price update delay in duration string format.
+// GetSymbol returns the exchange info for a futures symbol, including its
+// filters, and whether the symbol exists.
+func (e *exchangeInfoStore) GetSymbol(symbol string) (futures.Symbol, bool) {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	s, ok := e.info[symbol]
+	return s, ok
+}
+
+// GetSymbols returns the sorted list of futures symbols.
+func (e *exchangeInfoStore) GetSymbols() []string {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	return e.symbols
+}
+
+// WithDelay is the exchange info refresh interval in duration string format.
 func (e *exchangeInfoStore) WithDelay(d string) {
-	e.updateDelay, _ = time.ParseDuration(d)
+	delay, err := time.ParseDuration(d)
+	if err != nil || delay <= 0 {
+		log.WithField("exchange info store update delay", d).Error("Invalid delay")
+		return
+	}
+	e.m.Lock()
+	e.updateDelay = delay
+	e.m.Unlock()
+
+	// Replace a delay the refresh loop hasn't received yet
+	select {
+	case <-e.delayC:
+	default:
+	}
+	e.delayC <- delay
 	log.WithFields(log.Fields{"exchange info store update delay": d}).Info()
 }
 
-func (e *exchangeInfoStore) update() {
-	exchangeInfo, err := futures.NewClient("", "").
+// OnSymbolEvent registers a handler called with each symbol added, removed or
+// whose status changed. Handlers are called one at a time after the refresh
+// that found the change.
+func (e *exchangeInfoStore) OnSymbolEvent(handler func(SymbolEvent)) {
+	e.handlersM.Lock()
+	defer e.handlersM.Unlock()
+	e.handlers = append(e.handlers, handler)
+}
+
+// refresh fetches the exchange info and swaps it in, then publishes the
+// symbol events. The exchange info is fetched without holding the lock, and
+// is kept unchanged if the request fails.
+func (e *exchangeInfoStore) refresh() error {
+	e.refreshM.Lock()
+	defer e.refreshM.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+	exchangeInfo, err := ratelimit.NewClient("", "").
 		NewExchangeInfoService().
-		Do(context.Background())
+		Do(ctx)
 
 	if err != nil {
-		log.Fatal(err)
-		return
+		return err
 	}
 
+	ratelimit.NewLimiter().SetRateLimits(exchangeInfo.RateLimits)
+
+	info := make(map[string]futures.Symbol, len(exchangeInfo.Symbols))
+	symbols := make([]string, 0, len(exchangeInfo.Symbols))
 	for _, s := range exchangeInfo.Symbols {
 		log.WithFields(log.Fields{"symbol": s.Symbol,
 			"info": s}).
 			Debug("Updating symbol's exchange info")
 
-		e.info[s.Symbol] = s
+		// We only care about BaseAssetPrecision (used in new order quantity calc)
+		// from binance:
+		// base asset refers to the asset that is the quantity of a symbol.
+		// quote asset refers to the asset that is the price of a symbol.
+		info[s.Symbol] = s
+		symbols = append(symbols, s.Symbol)
+	}
+	sort.Strings(symbols)
+
+	e.m.Lock()
+	previous := e.info
+	e.info = info
+	e.symbols = symbols
+	e.m.Unlock()
+
+	// The initial fetch has nothing to compare to
+	if previous != nil {
+		e.publish(diffSymbols(previous, info))
+	}
+	return nil
+}
+
+// diffSymbols returns the events of the symbols added, removed or whose
+// status changed from previous to current, sorted by symbol.
+func diffSymbols(previous, current map[string]futures.Symbol) []SymbolEvent {
+	var events []SymbolEvent
+	for symbol, s := range current {
+		old, ok := previous[symbol]
+		switch {
+		case !ok:
+			events = append(events, SymbolEvent{Type: SymbolAdded, Symbol: symbol, Status: s.Status})
+		case old.Status != s.Status:
+			events = append(events, SymbolEvent{
+				Type:           SymbolStatusChanged,
+				Symbol:         symbol,
+				Status:         s.Status,
+				PreviousStatus: old.Status,
+			})
+		}
 	}
+	for symbol, old := range previous {
+		if _, ok := current[symbol]; !ok {
+			events = append(events, SymbolEvent{Type: SymbolRemoved, Symbol: symbol, PreviousStatus: old.Status})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Symbol < events[j].Symbol
+	})
+	return events
 }
 
-// startUpdates opens the websocket and will start updating the entire
-// statsStore every updateInterval + 1 sec.
-func (c *exchangeInfoStore) startUpdates() {
+// publish logs the symbol events and calls the handlers with them.
+func (e *exchangeInfoStore) publish(events []SymbolEvent) {
+	e.handlersM.Lock()
+	handlers := e.handlers
+	e.handlersM.Unlock()
+
+	for _, event := range events {
+		log.WithFields(log.Fields{
+			"Symbol":         event.Symbol,
+			"Status":         event.Status,
+			"PreviousStatus": event.PreviousStatus,
+		}).Warn("Symbol ", event.Type)
+
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// startUpdates refreshes the exchange info every updateDelay until the
+// process exits. The ticker is reset when the delay is changed.
+func (e *exchangeInfoStore) startUpdates() {
+	e.m.RLock()
+	ticker := time.NewTicker(e.updateDelay)
+	e.m.RUnlock()
+
 	go func() {
-		time.Sleep(c.updateDelay)
-		e.m.Lock()
-		defer e.m.Unlock()
-		c.update()
+		defer ticker.Stop()
+		for {
+			select {
+			case delay := <-e.delayC:
+				ticker.Reset(delay)
+			case <-ticker.C:
+				err := e.refresh()
+				if err != nil {
+					log.WithError(err).Error("Exchange info refresh failed, keeping the last exchange info")
+				}
+			}
+		}
 	}()
 }
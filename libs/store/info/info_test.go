@@ -4,7 +4,9 @@ package info
 import (
 	"testing"
 
+	"github.com/adshao/go-binance/v2/futures"
 	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -71,3 +73,73 @@ func TestInfo(t *testing.T) {
 		assert.Equal(t, tc.expectedQuote, actual, tc.name)
 	}
 }
+
+func TestDiffSymbols(t *testing.T) {
+	previous := map[string]futures.Symbol{
+		"BTCUSDT": {Symbol: "BTCUSDT", Status: "TRADING"},
+		"ETHUSDT": {Symbol: "ETHUSDT", Status: "TRADING"},
+		"DOTUSDT": {Symbol: "DOTUSDT", Status: "TRADING"},
+	}
+	current := map[string]futures.Symbol{
+		"BTCUSDT": {Symbol: "BTCUSDT", Status: "TRADING"},
+		"ETHUSDT": {Symbol: "ETHUSDT", Status: "SETTLING"},
+		"XRPUSDT": {Symbol: "XRPUSDT", Status: "TRADING"},
+	}
+
+	assert.Equal(t, []SymbolEvent{
+		{Type: SymbolRemoved, Symbol: "DOTUSDT", PreviousStatus: "TRADING"},
+		{Type: SymbolStatusChanged, Symbol: "ETHUSDT", Status: "SETTLING", PreviousStatus: "TRADING"},
+		{Type: SymbolAdded, Symbol: "XRPUSDT", Status: "TRADING"},
+	}, diffSymbols(previous, current))
+
+	assert.Empty(t, diffSymbols(current, current), "unchanged")
+}
+
+func TestRefresh(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet exchange info can't be changed")
+	}
+	info := NewStore()
+
+	var events []SymbolEvent
+	info.OnSymbolEvent(func(event SymbolEvent) {
+		events = append(events, event)
+	})
+
+	xrpusdt, _ := info.GetSymbol("XRPUSDT")
+	fake.SetSymbolStatus("DOTUSDT", "SETTLING")
+	fake.RemoveSymbol("XRPUSDT")
+	defer fake.SetSymbol(xrpusdt)
+	defer fake.SetSymbolStatus("DOTUSDT", "TRADING")
+
+	err := info.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []SymbolEvent{
+		{Type: SymbolStatusChanged, Symbol: "DOTUSDT", Status: "SETTLING", PreviousStatus: "TRADING"},
+		{Type: SymbolRemoved, Symbol: "XRPUSDT", PreviousStatus: "TRADING"},
+	}, events)
+	_, ok := info.GetSymbol("XRPUSDT")
+	assert.False(t, ok, "removed symbol")
+	assert.NotContains(t, info.GetSymbols(), "XRPUSDT")
+
+	// A failed refresh keeps the last exchange info
+	events = nil
+	fake.SetSymbol(xrpusdt)
+	fake.Fail("/fapi/v1/exchangeInfo", fakebinance.Failure{Status: 503, Code: -1001, Message: "Internal error"})
+	err = info.refresh()
+	assert.Error(t, err)
+	assert.Empty(t, events)
+	dotusdt, ok := info.GetSymbol("DOTUSDT")
+	assert.True(t, ok)
+	assert.Equal(t, "SETTLING", dotusdt.Status)
+
+	err = info.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []SymbolEvent{{Type: SymbolAdded, Symbol: "XRPUSDT", Status: "TRADING"}}, events)
+	assert.Contains(t, info.GetSymbols(), "XRPUSDT")
+}
@@ -0,0 +1,344 @@
+// Package klines implements an in memory store for the futures symbols'
+// klines.
+//
+// A symbol's klines of an interval are only stored once they're requested:
+// the first request subscribes to the symbol's kline stream, backfills the
+// last windowSize klines from a REST snapshot, and then keeps them up to date
+// from the stream. The klines are kept in a bounded ring buffer per symbol and
+// interval, which is evicted and unsubscribed once it isn't requested for the
+// idleTimeout.
+package klines
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	nowFunc = time.Now
+
+	// windowSize is how many klines are kept per symbol and interval, which
+	// is the most that can be requested
+	windowSize = 500
+
+	// idleTimeout is how long a symbol's klines of an interval are kept
+	// without being requested
+	idleTimeout = 10 * time.Minute
+
+	// evictInterval is how often the idle klines are evicted
+	evictInterval = 1 * time.Minute
+
+	// backfillTimeout is the timeout of a backfill request
+	backfillTimeout = 10 * time.Second
+)
+
+// seriesKey identifies a symbol's klines of an interval.
+type seriesKey struct {
+	symbol   string
+	interval string
+}
+
+// series is a symbol's klines of an interval, in a ring buffer ordered by
+// open time.
+type series struct {
+	klines []store.Kline
+	start  int
+	len    int
+
+	// ready is closed once the klines were first backfilled, err is the
+	// backfill's error
+	ready      chan struct{}
+	err        error
+	backfilled bool
+
+	// backfilling is true while the klines are being backfilled, the stream's
+	// klines are pending until they're merged into the backfilled ones
+	backfilling bool
+	pending     []store.Kline
+
+	lastRequest time.Time
+}
+
+// klineStore stores the requested symbols' klines of each interval, which are
+// kept up to date by the market stream hub's kline channels.
+type klineStore struct {
+	sub    *marketstream.Subscription
+	series map[seriesKey]*series
+	m      sync.Mutex
+}
+
+// NewStore returns a klines store subscribed to the hub's kline channels.
+func NewStore(hub *marketstream.Hub) *klineStore {
+	k := &klineStore{
+		sub:    hub.NewSubscription(),
+		series: make(map[seriesKey]*series),
+	}
+	go k.receive()
+	go k.evict()
+	return k
+}
+
+// GetKlines returns the symbol's last klines of the interval, up to limit and
+// ordered by open time. The first request of a symbol's interval subscribes
+// to its stream and waits for its klines to be backfilled.
+func (k *klineStore) GetKlines(ctx context.Context, symbol, interval string, limit int) ([]store.Kline, error) {
+	if !marketstream.IsKlineInterval(interval) {
+		return nil, errors.NewValidationError("interval", fmt.Sprintf(
+			"%q must be one of %s", interval, strings.Join(marketstream.KlineIntervals, ", ")))
+	}
+	if limit < 1 || limit > windowSize {
+		return nil, errors.NewValidationError("limit", fmt.Sprintf("must be between 1 and %d", windowSize))
+	}
+
+	key := seriesKey{symbol: symbol, interval: interval}
+	s, err := k.request(key)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	k.m.Lock()
+	defer k.m.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.last(limit), nil
+}
+
+// request returns the key's series, subscribing to its stream and starting
+// its backfill if it isn't stored yet.
+func (k *klineStore) request(key seriesKey) (*series, error) {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	s, ok := k.series[key]
+	if !ok {
+		// The stream is subscribed before the backfill, so no kline is missed
+		// in between
+		channel := marketstream.KlineChannel(key.interval)
+		err := k.sub.Subscribe([]marketstream.Channel{channel}, []string{key.symbol})
+		if err != nil {
+			return nil, err
+		}
+
+		s = &series{
+			klines:      make([]store.Kline, windowSize),
+			ready:       make(chan struct{}),
+			backfilling: true,
+		}
+		k.series[key] = s
+		go k.backfill(key, s)
+	}
+	s.lastRequest = nowFunc()
+	return s, nil
+}
+
+// backfill replaces the series' klines with the last windowSize klines from
+// a REST snapshot, then merges the stream's pending klines. If the first
+// backfill fails, the series is removed so the next request retries it.
+func (k *klineStore) backfill(key seriesKey, s *series) {
+	ctx, cancel := context.WithTimeout(context.Background(), backfillTimeout)
+	defer cancel()
+	klines, err := ratelimit.NewClient("", "").
+		NewKlinesService().
+		Symbol(key.symbol).
+		Interval(key.interval).
+		Limit(windowSize).
+		Do(ctx)
+
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	first := !s.backfilled
+	pending := s.pending
+	s.backfilling = false
+	s.pending = nil
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Symbol":   key.symbol,
+			"Interval": key.interval,
+		}).Error(err)
+		if first {
+			s.err = err
+			k.remove(key, s)
+			close(s.ready)
+			return
+		}
+	} else {
+		now := nowFunc()
+		s.start, s.len = 0, 0
+		for _, kline := range klines {
+			s.push(newKline(key, kline, now))
+		}
+	}
+	s.backfilled = true
+
+	// The stream's klines are kept even if they don't follow the backfilled
+	// ones, rather than backfilling again until it succeeds
+	for _, kline := range pending {
+		if !s.merge(kline) {
+			s.push(kline)
+		}
+	}
+
+	if first {
+		close(s.ready)
+	}
+}
+
+// receive merges the kline events into their series until the subscription
+// is closed.
+func (k *klineStore) receive() {
+	for range k.sub.Ready() {
+		for _, event := range k.sub.Events() {
+			kline, ok := event.Data.(store.Kline)
+			if ok {
+				k.update(kline)
+			}
+		}
+	}
+}
+
+// update merges the stream's kline into its series. A kline that doesn't
+// follow the series' last one means the stream missed klines, e.g. while it
+// was reconnecting, so the series is backfilled again.
+func (k *klineStore) update(kline store.Kline) {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	key := seriesKey{symbol: kline.Symbol, interval: kline.Interval}
+	s, ok := k.series[key]
+	if !ok {
+		return
+	}
+	if s.backfilling {
+		s.pending = append(s.pending, kline)
+		return
+	}
+	if !s.merge(kline) {
+		s.backfilling = true
+		s.pending = []store.Kline{kline}
+		go k.backfill(key, s)
+	}
+}
+
+// evict removes the series that weren't requested for the idleTimeout every
+// evictInterval.
+func (k *klineStore) evict() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		k.evictIdle()
+	}
+}
+
+// evictIdle removes the series that weren't requested for the idleTimeout.
+func (k *klineStore) evictIdle() {
+	k.m.Lock()
+	defer k.m.Unlock()
+	for key, s := range k.series {
+		if s.backfilling || nowFunc().Sub(s.lastRequest) < idleTimeout {
+			continue
+		}
+		k.remove(key, s)
+		log.WithFields(log.Fields{
+			"Symbol":   key.symbol,
+			"Interval": key.interval,
+		}).Info("Evicted idle klines")
+	}
+}
+
+// remove removes the series and unsubscribes from its stream. Must be called
+// with k.m held.
+func (k *klineStore) remove(key seriesKey, s *series) {
+	if k.series[key] != s {
+		return
+	}
+	delete(k.series, key)
+	channel := marketstream.KlineChannel(key.interval)
+	k.sub.Unsubscribe([]marketstream.Channel{channel}, []string{key.symbol})
+}
+
+// merge updates the series' current kline or appends the next one, and
+// returns false if the kline is after the next one. Klines older than the
+// current one are ignored.
+func (s *series) merge(kline store.Kline) bool {
+	if s.len == 0 {
+		s.push(kline)
+		return true
+	}
+	last := s.at(s.len - 1)
+	switch {
+	case kline.OpenTime.Equal(last.OpenTime):
+		*last = kline
+	case kline.OpenTime.Before(last.OpenTime):
+	case kline.OpenTime.After(last.CloseTime.Add(time.Millisecond)):
+		return false
+	default:
+		s.push(kline)
+	}
+	return true
+}
+
+// push appends the kline, replacing the oldest one once the buffer is full.
+func (s *series) push(kline store.Kline) {
+	if s.len < len(s.klines) {
+		s.len++
+	} else {
+		s.start = (s.start + 1) % len(s.klines)
+	}
+	*s.at(s.len - 1) = kline
+}
+
+// at returns the series' ith kline, from the oldest.
+func (s *series) at(i int) *store.Kline {
+	return &s.klines[(s.start+i)%len(s.klines)]
+}
+
+// last returns a copy of the series' last klines, up to limit.
+func (s *series) last(limit int) []store.Kline {
+	if limit > s.len {
+		limit = s.len
+	}
+	klines := make([]store.Kline, 0, limit)
+	for i := s.len - limit; i < s.len; i++ {
+		klines = append(klines, *s.at(i))
+	}
+	return klines
+}
+
+// newKline returns the key's kline from the REST kline, which is closed once
+// its close time is past.
+func newKline(key seriesKey, k *futures.Kline, now time.Time) store.Kline {
+	closeTime := time.UnixMilli(k.CloseTime)
+	return store.Kline{
+		Symbol:      key.symbol,
+		Interval:    key.interval,
+		OpenTime:    time.UnixMilli(k.OpenTime),
+		CloseTime:   closeTime,
+		Open:        k.Open,
+		High:        k.High,
+		Low:         k.Low,
+		Close:       k.Close,
+		Volume:      k.Volume,
+		QuoteVolume: k.QuoteAssetVolume,
+		Trades:      k.TradeNum,
+		Closed:      closeTime.Before(now),
+	}
+}
@@ -0,0 +1,215 @@
+package klines
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	test.IntializeStoreTests()
+}
+
+// fakeStreams records the handlers and symbols of the connected kline
+// streams by channel, so the tests can publish their klines.
+type fakeStreams struct {
+	m        sync.Mutex
+	handlers map[marketstream.Channel]func(marketstream.Event)
+	symbols  map[marketstream.Channel][]string
+	stops    map[marketstream.Channel]chan struct{}
+}
+
+func newFakeStreams() *fakeStreams {
+	return &fakeStreams{
+		handlers: make(map[marketstream.Channel]func(marketstream.Event)),
+		symbols:  make(map[marketstream.Channel][]string),
+		stops:    make(map[marketstream.Channel]chan struct{}),
+	}
+}
+
+func (f *fakeStreams) serve(
+	channel marketstream.Channel,
+	symbols []string,
+	handler func(marketstream.Event),
+	errHandler futures.ErrHandler,
+) (doneC, stopC chan struct{}, err error) {
+	doneC, stopC = make(chan struct{}), make(chan struct{})
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.handlers[channel] = handler
+	f.symbols[channel] = symbols
+	f.stops[channel] = stopC
+	go func() {
+		<-stopC
+		close(doneC)
+		f.m.Lock()
+		defer f.m.Unlock()
+		// The stream may already be replaced by one with other symbols
+		if f.stops[channel] == stopC {
+			delete(f.handlers, channel)
+			delete(f.symbols, channel)
+			delete(f.stops, channel)
+		}
+	}()
+	return doneC, stopC, nil
+}
+
+// connected returns the symbols of the channel's stream, or nil if it isn't
+// connected.
+func (f *fakeStreams) connected(channel marketstream.Channel) []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.symbols[channel]
+}
+
+// publish publishes the kline on its interval's stream.
+func (f *fakeStreams) publish(kline store.Kline) {
+	f.m.Lock()
+	handler := f.handlers[marketstream.KlineChannel(kline.Interval)]
+	f.m.Unlock()
+	handler(marketstream.Event{
+		Channel: marketstream.KlineChannel(kline.Interval),
+		Symbol:  kline.Symbol,
+		Data:    kline,
+	})
+}
+
+// next returns the kline following k, with the close price.
+func next(k store.Kline, close string) store.Kline {
+	return store.Kline{
+		Symbol:    k.Symbol,
+		Interval:  k.Interval,
+		OpenTime:  k.CloseTime.Add(time.Millisecond),
+		CloseTime: k.CloseTime.Add(k.CloseTime.Sub(k.OpenTime) + time.Millisecond),
+		Close:     close,
+	}
+}
+
+func TestGetKlines(t *testing.T) {
+	if test.FakeBinance() == nil {
+		t.Skip("the testnet klines aren't predictable")
+	}
+	streams := newFakeStreams()
+	k := NewStore(marketstream.NewHub(streams.serve))
+	ctx := context.Background()
+
+	klines, err := k.GetKlines(ctx, "BTCUSDT", "1m", 10)
+	assert.NoError(t, err)
+	if !assert.Len(t, klines, 10) {
+		t.FailNow()
+	}
+	assert.Equal(t, []string{"BTCUSDT"}, streams.connected("kline_1m"), "subscribed on the first request")
+	last := klines[9]
+	assert.Equal(t, "BTCUSDT", last.Symbol)
+	assert.Equal(t, "1m", last.Interval)
+	assert.False(t, last.Closed, "current kline")
+	assert.True(t, klines[8].Closed)
+	assert.Equal(t, time.Minute, last.OpenTime.Sub(klines[8].OpenTime))
+
+	// The current kline is updated, then the next one appended
+	current := last
+	current.Close = "70000"
+	streams.publish(current)
+	streams.publish(next(current, "70001"))
+	assert.Eventually(t, func() bool {
+		klines, _ = k.GetKlines(ctx, "BTCUSDT", "1m", 10)
+		return len(klines) == 10 && klines[9].Close == "70001"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "70000", klines[8].Close)
+	assert.Equal(t, current.OpenTime, klines[8].OpenTime)
+
+	klines, err = k.GetKlines(ctx, "BTCUSDT", "1m", windowSize)
+	assert.NoError(t, err)
+	assert.Len(t, klines, windowSize, "bounded by the window")
+
+	for _, tc := range []struct {
+		interval string
+		limit    int
+	}{
+		{interval: "2m", limit: 10},
+		{interval: "1m", limit: 0},
+		{interval: "1m", limit: windowSize + 1},
+	} {
+		_, err = k.GetKlines(ctx, "BTCUSDT", tc.interval, tc.limit)
+		assert.Equal(t, errors.CodeValidation, errors.AsServiceError(err).ErrorCode(), tc)
+	}
+}
+
+func TestGetKlinesUnknownSymbol(t *testing.T) {
+	if test.FakeBinance() == nil {
+		t.Skip("the testnet klines aren't predictable")
+	}
+	streams := newFakeStreams()
+	k := NewStore(marketstream.NewHub(streams.serve))
+
+	_, err := k.GetKlines(context.Background(), "FOOUSDT", "1m", 10)
+	assert.Error(t, err)
+	assert.Empty(t, k.series, "removed after the failed backfill")
+	assert.Eventually(t, func() bool {
+		return streams.connected("kline_1m") == nil
+	}, time.Second, 10*time.Millisecond, "unsubscribed")
+}
+
+func TestEvictIdle(t *testing.T) {
+	if test.FakeBinance() == nil {
+		t.Skip("the testnet klines aren't predictable")
+	}
+	defer func(now func() time.Time) { nowFunc = now }(nowFunc)
+	streams := newFakeStreams()
+	k := NewStore(marketstream.NewHub(streams.serve))
+	ctx := context.Background()
+
+	_, err := k.GetKlines(ctx, "BTCUSDT", "5m", 1)
+	assert.NoError(t, err)
+	nowFunc = func() time.Time { return time.Now().Add(idleTimeout / 2) }
+	_, err = k.GetKlines(ctx, "ETHUSDT", "5m", 1)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(streams.connected("kline_5m")) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	nowFunc = func() time.Time { return time.Now().Add(idleTimeout) }
+	k.evictIdle()
+	assert.Len(t, k.series, 1)
+	assert.Eventually(t, func() bool {
+		symbols := streams.connected("kline_5m")
+		return len(symbols) == 1 && symbols[0] == "ETHUSDT"
+	}, time.Second, 10*time.Millisecond, "idle symbol unsubscribed")
+}
+
+func TestSeries(t *testing.T) {
+	s := &series{klines: make([]store.Kline, 3)}
+	open := time.UnixMilli(0)
+	kline := func(i int, close string) store.Kline {
+		return store.Kline{
+			OpenTime:  open.Add(time.Duration(i) * time.Minute),
+			CloseTime: open.Add(time.Duration(i+1)*time.Minute - time.Millisecond),
+			Close:     close,
+		}
+	}
+
+	for i, close := range []string{"1", "2", "3", "4"} {
+		assert.True(t, s.merge(kline(i, close)))
+	}
+	assert.True(t, s.merge(kline(3, "5")), "current kline updated")
+	assert.True(t, s.merge(kline(0, "0")), "old kline ignored")
+	assert.False(t, s.merge(kline(5, "6")), "gap")
+
+	closes := func(klines []store.Kline) []string {
+		var closes []string
+		for _, k := range klines {
+			closes = append(closes, k.Close)
+		}
+		return closes
+	}
+	assert.Equal(t, []string{"2", "3", "5"}, closes(s.last(10)), "oldest replaced")
+	assert.Equal(t, []string{"3", "5"}, closes(s.last(2)))
+}
@@ -0,0 +1,318 @@
+// Package markprice implements an in memory store for the futures symbols'
+// mark prices and funding rates.
+//
+// Every symbol's mark price, index price, funding rate and next funding time
+// are kept up to date by the market stream hub's mark price channel, which
+// pushes them every second, so the store shares its upstream stream with the
+// stream's clients. The symbols are subscribed from the REST snapshots, and
+// the mark prices are polled from snapshots while the stream doesn't send
+// updates. The past funding rates aren't stored, they're requested from
+// binance.
+package markprice
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	p    *markPriceStore
+	once sync.Once
+
+	nowFunc = time.Now
+
+	// streamTimeout is how long the stream can go without an update before
+	// the mark prices are polled from REST snapshots until it's back
+	streamTimeout = 10 * time.Second
+
+	// watchInterval is how often the stream is checked for updates
+	watchInterval = 1 * time.Second
+
+	// pollInterval is how often the mark prices are polled while the stream
+	// doesn't send updates
+	pollInterval = 5 * time.Second
+
+	// minSnapshotInterval is the least time between two snapshots, so stale
+	// reads don't each take one
+	minSnapshotInterval = 1 * time.Second
+
+	// snapshotTimeout is the timeout of a snapshot request
+	snapshotTimeout = 10 * time.Second
+
+	// maxHistoryLimit is the most funding rates that can be requested at once
+	maxHistoryLimit = 1000
+)
+
+// markPriceStore stores the mark prices and funding rates of all futures
+// symbols, updated by the hub's mark price channel.
+type markPriceStore struct {
+	prices map[string]store.MarkPrice
+	m      sync.RWMutex
+
+	hub *marketstream.Hub
+	sub *marketstream.Subscription
+
+	lastEvent  time.Time
+	lastUpdate time.Time
+	lastErr    error
+
+	// snapshotM serializes the snapshots, lastSnapshot is when the last one
+	// was attempted
+	snapshotM    sync.Mutex
+	lastSnapshot time.Time
+}
+
+// NewStore returns a reference to the in memory mark price store, subscribed
+// to the shared hub.
+func NewStore() *markPriceStore {
+	once.Do(func() {
+		p = newStore(marketstream.BinanceHub())
+		p.init()
+	})
+	return p
+}
+
+// newStore returns a mark price store subscribing to the hub.
+func newStore(hub *marketstream.Hub) *markPriceStore {
+	return &markPriceStore{
+		prices: make(map[string]store.MarkPrice),
+		hub:    hub,
+		sub:    hub.NewSubscription(),
+	}
+}
+
+// init takes the first snapshot, which subscribes its symbols to the stream.
+// A failed snapshot is only logged, the next one fills the store.
+func (p *markPriceStore) init() {
+	err := p.snapshot()
+	if err != nil {
+		log.Error(err)
+	}
+	go p.receive()
+	go p.watch()
+}
+
+// GetMarkPrice returns the symbol's mark price and funding rate and whether
+// the symbol has one.
+func (p *markPriceStore) GetMarkPrice(symbol string) (store.MarkPrice, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	price, ok := p.prices[symbol]
+	return price, ok
+}
+
+// GetMarkPriceFresh gets the mark price for a futures symbol if it was
+// updated within maxAge. A stale mark price is refreshed with a REST snapshot
+// before a StaleDataError is returned.
+func (p *markPriceStore) GetMarkPriceFresh(symbol string, maxAge time.Duration) (string, error) {
+	price, age, ok := p.markPrice(symbol)
+	if ok && age <= maxAge {
+		return price, nil
+	}
+
+	err := p.snapshot()
+	if err != nil {
+		log.WithField("Symbol", symbol).Error(err)
+	}
+
+	price, age, ok = p.markPrice(symbol)
+	if !ok {
+		return "", errors.NewUnknownSymbol(symbol)
+	}
+	if age > maxAge {
+		return "", errors.NewStaleData(symbol, age)
+	}
+	return price, nil
+}
+
+// markPrice returns the symbol's mark price, how long ago it was updated and
+// whether the symbol has a mark price.
+func (p *markPriceStore) markPrice(symbol string) (string, time.Duration, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	price, ok := p.prices[symbol]
+	if !ok || price.MarkPrice == "" {
+		return "", 0, false
+	}
+	return price.MarkPrice, nowFunc().Sub(price.UpdateTime), true
+}
+
+// GetMarkPrices returns every symbol's mark price and funding rate, sorted by
+// symbol.
+func (p *markPriceStore) GetMarkPrices() []store.MarkPrice {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	prices := make([]store.MarkPrice, 0, len(p.prices))
+	for _, price := range p.prices {
+		prices = append(prices, price)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].Symbol < prices[j].Symbol
+	})
+	return prices
+}
+
+// GetFundingHistory returns the symbol's settled funding rates between
+// startTime and endTime, oldest first and up to limit. Zero times aren't
+// bounded, so without a startTime the last funding rates are returned.
+func (p *markPriceStore) GetFundingHistory(
+	ctx context.Context,
+	symbol string,
+	startTime time.Time,
+	endTime time.Time,
+	limit int,
+) ([]store.FundingRate, error) {
+	if limit < 1 || limit > maxHistoryLimit {
+		return nil, errors.NewValidationError("limit", fmt.Sprintf("must be between 1 and %d", maxHistoryLimit))
+	}
+	if !startTime.IsZero() && !endTime.IsZero() && endTime.Before(startTime) {
+		return nil, errors.NewValidationError("endTime", "must be after the startTime")
+	}
+
+	svc := ratelimit.NewClient("", "").
+		NewFundingRateService().
+		Symbol(symbol).
+		Limit(limit)
+	if !startTime.IsZero() {
+		svc.StartTime(startTime.UnixMilli())
+	}
+	if !endTime.IsZero() {
+		svc.EndTime(endTime.UnixMilli())
+	}
+	rates, err := svc.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]store.FundingRate, 0, len(rates))
+	for _, rate := range rates {
+		history = append(history, store.FundingRate{
+			Symbol:      rate.Symbol,
+			FundingRate: rate.FundingRate,
+			FundingTime: time.UnixMilli(rate.FundingTime),
+		})
+	}
+	return history, nil
+}
+
+// Health returns the state of the stream. The store is healthy if it was
+// updated within the stream timeout, by the stream or a snapshot.
+func (p *markPriceStore) Health() store.Health {
+	connected, reconnects := p.hub.Status(marketstream.ChannelMarkPrice)
+	p.m.RLock()
+	defer p.m.RUnlock()
+	health := store.Health{
+		Healthy:    nowFunc().Sub(p.lastUpdate) <= streamTimeout,
+		Connected:  connected,
+		LastUpdate: p.lastUpdate,
+		Reconnects: reconnects,
+	}
+	if p.lastErr != nil {
+		health.LastError = p.lastErr.Error()
+	}
+	return health
+}
+
+// update updates the symbol's mark price from the stream's event. Must be
+// called with p.m held.
+func (p *markPriceStore) update(price store.MarkPrice) {
+	now := nowFunc()
+	price.UpdateTime = now
+	p.prices[price.Symbol] = price
+	p.lastEvent = now
+	p.lastUpdate = now
+}
+
+// snapshot updates the mark prices and funding rates from a REST snapshot,
+// unless one was attempted within the minSnapshotInterval. The snapshot
+// doesn't have the index and estimated settle prices, so the stream's last
+// ones are kept.
+func (p *markPriceStore) snapshot() error {
+	p.snapshotM.Lock()
+	defer p.snapshotM.Unlock()
+	if nowFunc().Sub(p.lastSnapshot) < minSnapshotInterval {
+		return nil
+	}
+	p.lastSnapshot = nowFunc()
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	premiums, err := ratelimit.NewClient("", "").
+		NewPremiumIndexService().
+		Do(ctx)
+
+	p.m.Lock()
+	if err != nil {
+		p.lastErr = err
+		p.m.Unlock()
+		return err
+	}
+
+	now := nowFunc()
+	symbols := make([]string, 0, len(premiums))
+	for _, premium := range premiums {
+		price := p.prices[premium.Symbol]
+		price.Symbol = premium.Symbol
+		price.MarkPrice = premium.MarkPrice
+		price.FundingRate = premium.LastFundingRate
+		price.NextFundingTime = time.UnixMilli(premium.NextFundingTime)
+		price.UpdateTime = now
+		p.prices[premium.Symbol] = price
+		symbols = append(symbols, premium.Symbol)
+	}
+	p.lastUpdate = now
+	p.m.Unlock()
+
+	log.WithField("Symbols", len(premiums)).Info("Updated mark prices from snapshot")
+
+	// The symbols listed since the last snapshot are subscribed too, the
+	// subscribed ones are unchanged
+	return p.sub.Subscribe([]marketstream.Channel{marketstream.ChannelMarkPrice}, symbols)
+}
+
+// receive updates the mark prices from the stream's events.
+func (p *markPriceStore) receive() {
+	for range p.sub.Ready() {
+		events := p.sub.Events()
+		p.m.Lock()
+		for _, event := range events {
+			price, ok := event.Data.(store.MarkPrice)
+			if ok {
+				p.update(price)
+			}
+		}
+		p.m.Unlock()
+	}
+}
+
+// watch polls the mark prices from snapshots while the stream doesn't send
+// updates, e.g. while the hub reconnects it.
+func (p *markPriceStore) watch() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	var lastPoll time.Time
+	for range ticker.C {
+		now := nowFunc()
+
+		p.m.RLock()
+		dropped := now.Sub(p.lastEvent) > streamTimeout
+		p.m.RUnlock()
+
+		if dropped && now.Sub(lastPoll) >= pollInterval {
+			lastPoll = now
+			err := p.snapshot()
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
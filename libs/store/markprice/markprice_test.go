@@ -0,0 +1,127 @@
+package markprice
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	test.IntializeStoreTests()
+}
+
+func TestGetMarkPrices(t *testing.T) {
+	p := NewStore()
+
+	assert.Eventually(t, func() bool {
+		price, ok := p.GetMarkPrice("BTCUSDT")
+		return ok && price.IndexPrice != ""
+	}, 5*time.Second, 100*time.Millisecond, "updated by the stream")
+
+	price, _ := p.GetMarkPrice("BTCUSDT")
+	assert.NotEmpty(t, price.MarkPrice)
+	assert.NotEmpty(t, price.FundingRate)
+	assert.True(t, price.NextFundingTime.After(time.Now()), "next funding in the future")
+
+	_, ok := p.GetMarkPrice("FOOUSDT")
+	assert.False(t, ok, "unknown symbol")
+
+	prices := p.GetMarkPrices()
+	assert.NotEmpty(t, prices)
+	assert.True(t, sort.SliceIsSorted(prices, func(i, j int) bool {
+		return prices[i].Symbol < prices[j].Symbol
+	}), "sorted by symbol")
+}
+
+func TestReconnect(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet streams can't be disconnected")
+	}
+	p := NewStore()
+	assert.Eventually(t, func() bool { return p.Health().Connected }, 5*time.Second, 100*time.Millisecond)
+	reconnects := p.Health().Reconnects
+
+	fake.DisconnectStreams()
+
+	assert.Eventually(t, func() bool {
+		health := p.Health()
+		return health.Connected && health.Reconnects > reconnects
+	}, 5*time.Second, 100*time.Millisecond, "stream reconnected")
+
+	_, err := p.GetMarkPriceFresh("BTCUSDT", 2*time.Second)
+	assert.NoError(t, err)
+}
+
+func TestGetMarkPriceFresh(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet snapshots can't be failed")
+	}
+	NewStore()
+
+	// A store whose stream stopped updating a minute ago
+	stale := func() *markPriceStore {
+		p := newStore(marketstream.BinanceHub())
+		t.Cleanup(p.sub.Close)
+		p.prices["BTCUSDT"] = store.MarkPrice{Symbol: "BTCUSDT", MarkPrice: "1", IndexPrice: "1", UpdateTime: time.Now().Add(-time.Minute)}
+		p.lastUpdate = time.Now().Add(-time.Minute)
+		return p
+	}
+
+	p := stale()
+	assert.False(t, p.Health().Healthy)
+	price, err := p.GetMarkPriceFresh("BTCUSDT", 5*time.Second)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "1", price, "mark price refreshed from the snapshot")
+	assert.True(t, p.Health().Healthy)
+	markPrice, _ := p.GetMarkPrice("BTCUSDT")
+	assert.Equal(t, "1", markPrice.IndexPrice, "index price kept")
+
+	p = stale()
+	fake.Fail("/fapi/v1/premiumIndex", fakebinance.Failure{Status: 503, Code: -1001, Message: "Internal error"})
+	_, err = p.GetMarkPriceFresh("BTCUSDT", 5*time.Second)
+	assert.Equal(t, errors.CodeStaleData, errors.AsServiceError(err).ErrorCode(), "snapshot failed")
+	assert.NotEmpty(t, p.Health().LastError)
+
+	_, err = p.GetMarkPriceFresh("FOOUSDT", 5*time.Second)
+	assert.Error(t, err, "unknown symbol")
+}
+
+func TestGetFundingHistory(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet funding rates aren't predictable")
+	}
+	fake.SetFundingRate("DOTUSDT", "-0.00030000")
+	p := NewStore()
+	ctx := context.Background()
+
+	history, err := p.GetFundingHistory(ctx, "DOTUSDT", time.Time{}, time.Time{}, 3)
+	assert.NoError(t, err)
+	if !assert.Len(t, history, 3) {
+		t.FailNow()
+	}
+	assert.Equal(t, store.FundingRate{Symbol: "DOTUSDT", FundingRate: "-0.00030000", FundingTime: history[0].FundingTime}, history[0])
+	assert.Equal(t, 8*time.Hour, history[2].FundingTime.Sub(history[1].FundingTime), "oldest first")
+	assert.False(t, history[2].FundingTime.After(time.Now()), "settled")
+
+	start := history[1].FundingTime
+	history, err = p.GetFundingHistory(ctx, "DOTUSDT", start, time.Time{}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, start, history[0].FundingTime)
+
+	_, err = p.GetFundingHistory(ctx, "DOTUSDT", time.Time{}, time.Time{}, maxHistoryLimit+1)
+	assert.Equal(t, errors.CodeValidation, errors.AsServiceError(err).ErrorCode())
+	_, err = p.GetFundingHistory(ctx, "DOTUSDT", start, start.Add(-time.Hour), 10)
+	assert.Equal(t, errors.CodeValidation, errors.AsServiceError(err).ErrorCode())
+}
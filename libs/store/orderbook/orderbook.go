@@ -0,0 +1,542 @@
+// Package orderbook implements an in memory store for the futures symbols'
+// local order books.
+//
+// A symbol's order book is only kept once it's requested. The first request
+// connects the symbol's diff depth stream and syncs the book from a REST
+// snapshot, following the binance rules for a local order book:
+//
+//  1. The stream's events are buffered while the snapshot is taken.
+//  2. The events whose last update ID (u) is before the snapshot's
+//     lastUpdateId are dropped.
+//  3. The first event applied has to span the snapshot's lastUpdateId, i.e.
+//     U <= lastUpdateId <= u.
+//  4. Every following event's previous last update ID (pu) has to be the
+//     last applied event's u.
+//
+// Otherwise events were missed, so the book is synced again from a new
+// snapshot. It's also synced again whenever the stream reconnects, and it's
+// closed once the book isn't requested for the idleTimeout.
+package orderbook
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	o    *orderBookStore
+	once sync.Once
+
+	nowFunc = time.Now
+
+	// snapshotLimit is how many levels of each side the snapshots have
+	snapshotLimit = 1000
+
+	// snapshotTimeout is the timeout of a snapshot request
+	snapshotTimeout = 10 * time.Second
+
+	// syncTimeout is how long a request waits for its book to be synced
+	syncTimeout = 10 * time.Second
+
+	// maxBuffered is how many events are buffered while a book is syncing,
+	// the oldest ones are dropped beyond it
+	maxBuffered = 1000
+
+	// retryBackoff is how long to wait before the nth reconnect of a stream
+	// or retry of a snapshot, starting at 0
+	retryBackoff = retry.ExponentialBackoff(500*time.Millisecond, 30*time.Second)
+
+	// minConnection is how long a stream has to stay connected for its
+	// reconnect backoff to start over
+	minConnection = 10 * time.Second
+
+	// idleTimeout is how long a symbol's book is kept without being requested
+	idleTimeout = 10 * time.Minute
+
+	// evictInterval is how often the idle books are closed
+	evictInterval = 1 * time.Minute
+)
+
+// epsilon is the relative rounding error tolerated when comparing a fill with
+// the requested quantity or notional
+const epsilon = 1e-9
+
+// ServeFunc connects a symbol's diff depth stream, e.g.
+// futures.WsDiffDepthServe.
+type ServeFunc func(
+	symbol string,
+	handler futures.WsDepthHandler,
+	errHandler futures.ErrHandler,
+) (doneC, stopC chan struct{}, err error)
+
+// book is a symbol's local order book, with the bids from the highest price
+// and the asks from the lowest.
+type book struct {
+	symbol string
+	m      sync.Mutex
+
+	bids []store.Level
+	asks []store.Level
+
+	// lastUpdateID is the last update ID of the snapshot or the last applied
+	// event. first is true until the first event after the snapshot is
+	// applied.
+	lastUpdateID int64
+	first        bool
+
+	// synced is true while the book is in sync with the stream, ready is
+	// closed once it is. err is the first sync's error, after which the book
+	// is closed.
+	synced bool
+	ready  chan struct{}
+	err    error
+
+	// buffered are the stream's events received while syncing
+	buffered []*futures.WsDepthEvent
+
+	// conn is the number of the stream's current connection, whose events
+	// are the only ones applied
+	conn int
+
+	// updateTime is when the book was last updated, resyncs how many times
+	// it was synced again after missing events
+	updateTime time.Time
+	resyncs    int
+
+	// done closes the stream, lastRequest is guarded by the store's lock
+	done        chan struct{}
+	lastRequest time.Time
+}
+
+// orderBookStore stores the requested symbols' order books, which are kept
+// in sync with their diff depth streams.
+type orderBookStore struct {
+	serve ServeFunc
+	books map[string]*book
+	m     sync.Mutex
+}
+
+// NewStore returns a reference to the in memory order book store, which
+// connects the binance diff depth streams.
+func NewStore() *orderBookStore {
+	once.Do(func() {
+		o = newStore(futures.WsDiffDepthServe)
+	})
+	return o
+}
+
+// newStore returns an order book store connecting the diff depth streams
+// with serve.
+func newStore(serve ServeFunc) *orderBookStore {
+	o := &orderBookStore{
+		serve: serve,
+		books: make(map[string]*book),
+	}
+	go o.evict()
+	return o
+}
+
+// GetBestBidAsk returns the symbol's best bid and ask, or an empty level if
+// the side is empty.
+func (o *orderBookStore) GetBestBidAsk(ctx context.Context, symbol string) (bid, ask store.Level, err error) {
+	err = o.read(ctx, symbol, func(b *book) {
+		if len(b.bids) > 0 {
+			bid = b.bids[0]
+		}
+		if len(b.asks) > 0 {
+			ask = b.asks[0]
+		}
+	})
+	return bid, ask, err
+}
+
+// GetDepth returns the fill of a side's order for the notional, walking the
+// asks for a BUY and the bids for a SELL.
+func (o *orderBookStore) GetDepth(ctx context.Context, symbol string, side futures.SideType, notional float64) (store.Fill, error) {
+	var fill store.Fill
+	err := o.read(ctx, symbol, func(b *book) {
+		fill = walk(b.side(side), 0, notional)
+	})
+	return fill, err
+}
+
+// EstimateFill returns the estimated fill of a side's market order for the
+// quantity, walking the asks for a BUY and the bids for a SELL.
+func (o *orderBookStore) EstimateFill(ctx context.Context, symbol string, side futures.SideType, quantity float64) (store.Fill, error) {
+	var fill store.Fill
+	err := o.read(ctx, symbol, func(b *book) {
+		fill = walk(b.side(side), quantity, 0)
+	})
+	return fill, err
+}
+
+// read calls f with the symbol's synced book locked. The first request of a
+// symbol connects its stream, and a request waits up to the syncTimeout for
+// its book to be synced.
+func (o *orderBookStore) read(ctx context.Context, symbol string, f func(b *book)) error {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+
+	b := o.request(symbol)
+	for {
+		b.m.Lock()
+		if b.err != nil {
+			b.m.Unlock()
+			return b.err
+		}
+		if b.synced {
+			defer b.m.Unlock()
+			f(b)
+			return nil
+		}
+		ready := b.ready
+		updateTime := b.updateTime
+		b.m.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			if updateTime.IsZero() {
+				return ctx.Err()
+			}
+			return errors.NewStaleData(symbol, nowFunc().Sub(updateTime))
+		}
+	}
+}
+
+// request returns the symbol's book, connecting its stream if it isn't
+// stored yet.
+func (o *orderBookStore) request(symbol string) *book {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	b, ok := o.books[symbol]
+	if !ok {
+		b = &book{
+			symbol: symbol,
+			ready:  make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		o.books[symbol] = b
+		go o.run(b)
+	}
+	b.lastRequest = nowFunc()
+	return b
+}
+
+// run keeps the book's stream connected until the book is closed,
+// reconnecting it with backoff whenever it's dropped. The book is synced
+// again on every connection.
+func (o *orderBookStore) run(b *book) {
+	logger := log.WithField("Symbol", b.symbol)
+	errHandler := func(err error) {
+		logger.WithError(err).Warn("Depth stream error")
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryBackoff(attempt - 1)):
+			case <-b.done:
+				return
+			}
+		}
+
+		b.m.Lock()
+		b.conn++
+		conn := b.conn
+		b.unsync()
+		b.m.Unlock()
+
+		doneC, stopC, err := o.serve(b.symbol, func(e *futures.WsDepthEvent) {
+			o.handle(b, conn, e)
+		}, errHandler)
+		if err != nil {
+			logger.WithField("Attempt", attempt).Error(err)
+			continue
+		}
+		connectedAt := time.Now()
+		logger.Info("Connected depth stream")
+		go o.sync(b, conn)
+
+		select {
+		case <-b.done:
+			close(stopC)
+			logger.Info("Closed depth stream")
+			return
+		case <-doneC:
+		}
+
+		connected := time.Since(connectedAt)
+		logger.WithField("Connected", connected).Warn("Depth stream disconnected, reconnecting")
+		if connected > minConnection {
+			attempt = 0
+		}
+	}
+}
+
+// handle applies the connection's event to the book, or buffers it while the
+// book is syncing. The book is synced again if the event doesn't follow the
+// last applied one.
+func (o *orderBookStore) handle(b *book, conn int, e *futures.WsDepthEvent) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if conn != b.conn {
+		return
+	}
+
+	if !b.synced {
+		b.buffered = append(b.buffered, e)
+		if len(b.buffered) > maxBuffered {
+			b.buffered = b.buffered[1:]
+		}
+		return
+	}
+
+	if !b.apply(e) {
+		log.WithFields(log.Fields{
+			"Symbol":       b.symbol,
+			"LastUpdateID": b.lastUpdateID,
+			"U":            e.FirstUpdateID,
+			"PU":           e.PrevLastUpdateID,
+			"Resyncs":      b.resyncs + 1,
+		}).Warn("Depth stream missed events, syncing the order book again")
+		b.resyncs++
+		b.unsync()
+		b.buffered = append(b.buffered, e)
+		go o.sync(b, conn)
+	}
+}
+
+// sync syncs the book with the connection's buffered events from a snapshot,
+// retrying with backoff until it succeeds or the connection is replaced. If
+// the book's first sync fails, the book is closed so the next request
+// retries it.
+func (o *orderBookStore) sync(b *book, conn int) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryBackoff(attempt - 1)):
+			case <-b.done:
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+		snapshot, err := ratelimit.NewClient("", "").
+			NewDepthService().
+			Symbol(b.symbol).
+			Limit(snapshotLimit).
+			Do(ctx)
+		cancel()
+
+		b.m.Lock()
+		if conn != b.conn {
+			b.m.Unlock()
+			return
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Symbol":  b.symbol,
+				"Attempt": attempt,
+			}).Error(err)
+			if b.updateTime.IsZero() {
+				b.err = err
+				close(b.ready)
+				b.m.Unlock()
+				o.close(b)
+				return
+			}
+			b.m.Unlock()
+			continue
+		}
+
+		synced := b.load(snapshot)
+		b.m.Unlock()
+		if synced {
+			return
+		}
+	}
+}
+
+// load loads the snapshot and applies the buffered events after it. It
+// returns false if the buffered events don't span the snapshot, which is
+// then too old. Must be called with b.m held.
+func (b *book) load(snapshot *futures.DepthResponse) bool {
+	b.bids = b.bids[:0]
+	b.asks = b.asks[:0]
+	b.bids = update(b.bids, snapshot.Bids, true)
+	b.asks = update(b.asks, snapshot.Asks, false)
+	b.lastUpdateID = snapshot.LastUpdateID
+	b.first = true
+
+	for i, e := range b.buffered {
+		if !b.apply(e) {
+			// The snapshot is older than the buffered events, the next one
+			// has to span them
+			b.buffered = b.buffered[i:]
+			return false
+		}
+	}
+	b.buffered = nil
+	b.synced = true
+	b.updateTime = nowFunc()
+	close(b.ready)
+	return true
+}
+
+// apply applies the event if it follows the last applied one, and returns
+// false if events were missed in between. Events before the last update are
+// dropped. Must be called with b.m held.
+func (b *book) apply(e *futures.WsDepthEvent) bool {
+	if e.LastUpdateID < b.lastUpdateID {
+		return true
+	}
+	if b.first && e.FirstUpdateID > b.lastUpdateID {
+		return false
+	}
+	if !b.first && e.PrevLastUpdateID != b.lastUpdateID {
+		return false
+	}
+
+	b.bids = update(b.bids, e.Bids, true)
+	b.asks = update(b.asks, e.Asks, false)
+	b.lastUpdateID = e.LastUpdateID
+	b.first = false
+	b.updateTime = nowFunc()
+	return true
+}
+
+// unsync marks the book as syncing and drops its buffered events. Must be
+// called with b.m held.
+func (b *book) unsync() {
+	if b.synced {
+		b.synced = false
+		b.ready = make(chan struct{})
+	}
+	b.buffered = nil
+}
+
+// side returns the levels a side's order walks.
+func (b *book) side(side futures.SideType) []store.Level {
+	if side == futures.SideTypeBuy {
+		return b.asks
+	}
+	return b.bids
+}
+
+// evict closes the books that weren't requested for the idleTimeout every
+// evictInterval.
+func (o *orderBookStore) evict() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		o.evictIdle()
+	}
+}
+
+// evictIdle closes the books that weren't requested for the idleTimeout.
+func (o *orderBookStore) evictIdle() {
+	o.m.Lock()
+	var idle []*book
+	for _, b := range o.books {
+		if nowFunc().Sub(b.lastRequest) >= idleTimeout {
+			idle = append(idle, b)
+		}
+	}
+	o.m.Unlock()
+
+	for _, b := range idle {
+		o.close(b)
+		log.WithField("Symbol", b.symbol).Info("Closed idle order book")
+	}
+}
+
+// close removes the book and closes its stream.
+func (o *orderBookStore) close(b *book) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if o.books[b.symbol] != b {
+		return
+	}
+	delete(o.books, b.symbol)
+	close(b.done)
+}
+
+// update sets the quantities of the side's price levels, removing the ones
+// with a 0 quantity, and returns the side. The bids are ordered from the
+// highest price, the asks from the lowest.
+func update(levels []store.Level, updates []common.PriceLevel, bids bool) []store.Level {
+	for _, u := range updates {
+		price, quantity, err := u.Parse()
+		if err != nil {
+			log.WithField("Level", u).Warn(err)
+			continue
+		}
+
+		i := sort.Search(len(levels), func(i int) bool {
+			if bids {
+				return levels[i].Price <= price
+			}
+			return levels[i].Price >= price
+		})
+		found := i < len(levels) && levels[i].Price == price
+		switch {
+		case quantity == 0 && found:
+			levels = append(levels[:i], levels[i+1:]...)
+		case quantity == 0:
+		case found:
+			levels[i].Quantity = quantity
+		default:
+			levels = append(levels, store.Level{})
+			copy(levels[i+1:], levels[i:])
+			levels[i] = store.Level{Price: price, Quantity: quantity}
+		}
+	}
+	return levels
+}
+
+// walk returns the fill of an order for the quantity, or for the notional if
+// the quantity is 0, walking the levels from the best one.
+func walk(levels []store.Level, quantity, notional float64) store.Fill {
+	var fill store.Fill
+	for _, level := range levels {
+		remaining := level.Quantity
+		if quantity > 0 {
+			remaining = quantity - fill.Quantity
+		} else if notional > 0 {
+			remaining = (notional - fill.Notional) / level.Price
+		}
+		if remaining <= 0 {
+			break
+		}
+		if remaining > level.Quantity {
+			remaining = level.Quantity
+		}
+
+		fill.Quantity += remaining
+		fill.Notional += remaining * level.Price
+		fill.WorstPrice = level.Price
+		fill.Levels++
+	}
+
+	if fill.Quantity > 0 {
+		fill.AvgPrice = fill.Notional / fill.Quantity
+	}
+	if quantity > 0 {
+		fill.Complete = fill.Quantity >= quantity*(1-epsilon)
+	} else {
+		fill.Complete = fill.Notional >= notional*(1-epsilon)
+	}
+	return fill
+}
@@ -0,0 +1,195 @@
+package orderbook
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	test.IntializeStoreTests()
+	retryBackoff = func(int) time.Duration { return time.Millisecond }
+}
+
+// fakeStreams records the handlers of the connected depth streams by symbol,
+// so the tests can publish their events.
+type fakeStreams struct {
+	m        sync.Mutex
+	handlers map[string]futures.WsDepthHandler
+	stops    map[string]chan struct{}
+}
+
+func newFakeStreams() *fakeStreams {
+	return &fakeStreams{
+		handlers: make(map[string]futures.WsDepthHandler),
+		stops:    make(map[string]chan struct{}),
+	}
+}
+
+func (f *fakeStreams) serve(
+	symbol string,
+	handler futures.WsDepthHandler,
+	errHandler futures.ErrHandler,
+) (doneC, stopC chan struct{}, err error) {
+	doneC, stopC = make(chan struct{}), make(chan struct{})
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.handlers[symbol] = handler
+	f.stops[symbol] = stopC
+	go func() {
+		<-stopC
+		close(doneC)
+		f.m.Lock()
+		defer f.m.Unlock()
+		if f.stops[symbol] == stopC {
+			delete(f.handlers, symbol)
+			delete(f.stops, symbol)
+		}
+	}()
+	return doneC, stopC, nil
+}
+
+// connected returns whether the symbol's stream is connected.
+func (f *fakeStreams) connected(symbol string) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.handlers[symbol] != nil
+}
+
+// publish publishes the depth event on the symbol's stream.
+func (f *fakeStreams) publish(symbol string, e futures.WsDepthEvent) {
+	f.m.Lock()
+	handler := f.handlers[symbol]
+	f.m.Unlock()
+	e.Symbol = symbol
+	handler(&e)
+}
+
+// levels returns the price levels of the alternating prices and quantities.
+func levels(values ...string) []common.PriceLevel {
+	var levels []common.PriceLevel
+	for i := 0; i+1 < len(values); i += 2 {
+		levels = append(levels, common.PriceLevel{Price: values[i], Quantity: values[i+1]})
+	}
+	return levels
+}
+
+func TestSync(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet order book isn't predictable")
+	}
+	fake.SetDepth("DOTUSDT", futures.DepthResponse{
+		LastUpdateID: 100,
+		Bids:         levels("29.9", "10", "29.8", "20"),
+		Asks:         levels("30.1", "5", "30.2", "15"),
+	})
+	streams := newFakeStreams()
+	o := newStore(streams.serve)
+	ctx := context.Background()
+
+	bid, ask, err := o.GetBestBidAsk(ctx, "DOTUSDT")
+	assert.NoError(t, err)
+	assert.Equal(t, store.Level{Price: 29.9, Quantity: 10}, bid)
+	assert.Equal(t, store.Level{Price: 30.1, Quantity: 5}, ask)
+
+	// Events before the snapshot are dropped, the first one spans it
+	streams.publish("DOTUSDT", futures.WsDepthEvent{FirstUpdateID: 90, LastUpdateID: 95, PrevLastUpdateID: 89, Bids: levels("29.9", "1")})
+	streams.publish("DOTUSDT", futures.WsDepthEvent{FirstUpdateID: 96, LastUpdateID: 105, PrevLastUpdateID: 95, Asks: levels("30.1", "0", "30.05", "2")})
+	streams.publish("DOTUSDT", futures.WsDepthEvent{FirstUpdateID: 106, LastUpdateID: 110, PrevLastUpdateID: 105, Bids: levels("30", "3")})
+	bid, ask, err = o.GetBestBidAsk(ctx, "DOTUSDT")
+	assert.NoError(t, err)
+	assert.Equal(t, store.Level{Price: 30, Quantity: 3}, bid)
+	assert.Equal(t, store.Level{Price: 30.05, Quantity: 2}, ask)
+
+	// A gap syncs the book again from a new snapshot
+	fake.SetDepth("DOTUSDT", futures.DepthResponse{
+		LastUpdateID: 205,
+		Bids:         levels("28", "1"),
+		Asks:         levels("32", "1"),
+	})
+	streams.publish("DOTUSDT", futures.WsDepthEvent{FirstUpdateID: 201, LastUpdateID: 210, PrevLastUpdateID: 200, Bids: levels("28.5", "4")})
+	assert.Eventually(t, func() bool {
+		bid, ask, err = o.GetBestBidAsk(ctx, "DOTUSDT")
+		return err == nil && bid.Price == 28.5
+	}, time.Second, 10*time.Millisecond, "synced from the new snapshot")
+	assert.Equal(t, store.Level{Price: 32, Quantity: 1}, ask)
+
+	streams.publish("DOTUSDT", futures.WsDepthEvent{FirstUpdateID: 211, LastUpdateID: 215, PrevLastUpdateID: 210, Asks: levels("31", "2")})
+	fill, err := o.EstimateFill(ctx, "DOTUSDT", futures.SideTypeBuy, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, store.Fill{Quantity: 3, Notional: 94, AvgPrice: 94.0 / 3, WorstPrice: 32, Levels: 2, Complete: true}, fill)
+
+	fill, err = o.GetDepth(ctx, "DOTUSDT", futures.SideTypeSell, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, fill.Quantity)
+	assert.False(t, fill.Complete, "book not deep enough")
+}
+
+func TestUnknownSymbol(t *testing.T) {
+	if test.FakeBinance() == nil {
+		t.Skip("the testnet order book isn't predictable")
+	}
+	streams := newFakeStreams()
+	o := newStore(streams.serve)
+
+	_, _, err := o.GetBestBidAsk(context.Background(), "FOOUSDT")
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		return !streams.connected("FOOUSDT")
+	}, time.Second, 10*time.Millisecond, "closed after the failed sync")
+}
+
+func TestEvictIdle(t *testing.T) {
+	if test.FakeBinance() == nil {
+		t.Skip("the testnet order book isn't predictable")
+	}
+	defer func(now func() time.Time) { nowFunc = now }(nowFunc)
+	streams := newFakeStreams()
+	o := newStore(streams.serve)
+	ctx := context.Background()
+
+	_, _, err := o.GetBestBidAsk(ctx, "BTCUSDT")
+	assert.NoError(t, err)
+	nowFunc = func() time.Time { return time.Now().Add(idleTimeout / 2) }
+	_, _, err = o.GetBestBidAsk(ctx, "ETHUSDT")
+	assert.NoError(t, err)
+
+	nowFunc = func() time.Time { return time.Now().Add(idleTimeout) }
+	o.evictIdle()
+	assert.Eventually(t, func() bool {
+		return !streams.connected("BTCUSDT") && streams.connected("ETHUSDT")
+	}, time.Second, 10*time.Millisecond, "idle book closed")
+}
+
+func TestUpdate(t *testing.T) {
+	bids := update(nil, levels("10", "1", "12", "1", "11", "1"), true)
+	assert.Equal(t, []store.Level{{Price: 12, Quantity: 1}, {Price: 11, Quantity: 1}, {Price: 10, Quantity: 1}}, bids, "highest first")
+	bids = update(bids, levels("11", "0", "12", "5", "9", "0"), true)
+	assert.Equal(t, []store.Level{{Price: 12, Quantity: 5}, {Price: 10, Quantity: 1}}, bids)
+
+	asks := update(nil, levels("10", "1", "12", "1", "11", "1"), false)
+	assert.Equal(t, []store.Level{{Price: 10, Quantity: 1}, {Price: 11, Quantity: 1}, {Price: 12, Quantity: 1}}, asks, "lowest first")
+}
+
+func TestWalk(t *testing.T) {
+	asks := []store.Level{{Price: 100, Quantity: 1}, {Price: 101, Quantity: 2}, {Price: 102, Quantity: 3}}
+
+	fill := walk(asks, 2, 0)
+	assert.Equal(t, store.Fill{Quantity: 2, Notional: 201, AvgPrice: 100.5, WorstPrice: 101, Levels: 2, Complete: true}, fill)
+
+	fill = walk(asks, 0, 302)
+	assert.Equal(t, store.Fill{Quantity: 3, Notional: 302, AvgPrice: 302.0 / 3, WorstPrice: 101, Levels: 2, Complete: true}, fill)
+
+	fill = walk(asks, 10, 0)
+	assert.Equal(t, 6.0, fill.Quantity)
+	assert.Equal(t, 102.0, fill.WorstPrice)
+	assert.False(t, fill.Complete)
+}
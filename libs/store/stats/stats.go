@@ -3,10 +3,15 @@ package stats
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
+	"github.com/bosdhill/golang-binance-service/libs/store"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,6 +19,32 @@ var (
 	s            *statsStore
 	once         sync.Once
 	defaultDelay = "0s"
+
+	nowFunc = time.Now
+
+	// streamTimeout is how long the stream can go without an update before
+	// it's considered dropped. It's then reconnected, and the last prices are
+	// polled from REST snapshots until it's back.
+	streamTimeout = 10 * time.Second
+
+	// reconnectBackoff is how long to wait before the nth reconnect of the
+	// stream, starting at 0. It starts over once a connection stays up for
+	// the streamTimeout.
+	reconnectBackoff = retry.ExponentialBackoff(500*time.Millisecond, 30*time.Second)
+
+	// watchInterval is how often the stream is checked for updates
+	watchInterval = 1 * time.Second
+
+	// pollInterval is how often the last prices are polled while the stream
+	// is dropped
+	pollInterval = 5 * time.Second
+
+	// minSnapshotInterval is the least time between two snapshots, so stale
+	// reads don't each take one
+	minSnapshotInterval = 1 * time.Second
+
+	// snapshotTimeout is the timeout of a snapshot request
+	snapshotTimeout = 10 * time.Second
 )
 
 // Stats stores various price stats for a futures symbol.
@@ -23,6 +54,15 @@ type Stats struct {
 	WeightedAvgPrice   string
 	LastPrice          string
 	LastQuantity       string
+	OpenPrice          string
+	HighPrice          string
+	LowPrice           string
+	Volume             string
+	QuoteVolume        string
+
+	// UpdateTime is when the stats were last updated, by the stream or a
+	// snapshot
+	UpdateTime time.Time
 }
 
 // statsStore stores various price stats for all futures symbols. A single
@@ -30,11 +70,26 @@ type Stats struct {
 //
 // On each update, the entire stats map is updated, which happens every
 // updateDelay + 1 seconds (websocket has a default of 1 update every second).
+// The websocket is reconnected with backoff whenever it drops or stops
+// sending updates.
 type statsStore struct {
 	stats       map[string]Stats
 	m           sync.RWMutex
 	updateDelay time.Duration
 	symbols     []string
+
+	// stopC disconnects the stream, it's nil while the stream is disconnected
+	stopC       chan struct{}
+	connectedAt time.Time
+	lastEvent   time.Time
+	lastUpdate  time.Time
+	reconnects  int
+	lastErr     error
+
+	// snapshotM serializes the snapshots, lastSnapshot is when the last one
+	// was attempted
+	snapshotM    sync.Mutex
+	lastSnapshot time.Time
 }
 
 // NewStore returns a reference to the in memory latest price store.
@@ -65,16 +120,112 @@ func (s *statsStore) GetLastPrice(symbol string) string {
 	return s.stats[symbol].LastPrice
 }
 
+// GetLastPriceFresh gets the last price for a futures symbol if it was
+// updated within maxAge. A stale price is refreshed with a REST snapshot
+// before a StaleDataError is returned.
+func (s *statsStore) GetLastPriceFresh(symbol string, maxAge time.Duration) (string, error) {
+	price, age, ok := s.lastPrice(symbol)
+	if ok && age <= maxAge {
+		return price, nil
+	}
+
+	err := s.snapshot()
+	if err != nil {
+		log.WithField("Symbol", symbol).Error(err)
+	}
+
+	price, age, ok = s.lastPrice(symbol)
+	if !ok {
+		return "", errors.NewUnknownSymbol(symbol)
+	}
+	if age > maxAge {
+		return "", errors.NewStaleData(symbol, age)
+	}
+	return price, nil
+}
+
+// lastPrice returns the symbol's last price, how long ago it was updated and
+// whether the symbol has a price.
+func (s *statsStore) lastPrice(symbol string) (string, time.Duration, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	stats, ok := s.stats[symbol]
+	if !ok || stats.LastPrice == "" {
+		return "", 0, false
+	}
+	return stats.LastPrice, nowFunc().Sub(stats.UpdateTime), true
+}
+
+// GetTicker returns the symbol's 24hr ticker and whether the symbol has one.
+func (s *statsStore) GetTicker(symbol string) (store.Ticker, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	stats, ok := s.stats[symbol]
+	if !ok {
+		return store.Ticker{}, false
+	}
+	return stats.ticker(symbol), true
+}
+
+// GetTickers returns every symbol's 24hr ticker, sorted by symbol.
+func (s *statsStore) GetTickers() []store.Ticker {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	tickers := make([]store.Ticker, 0, len(s.stats))
+	for symbol, stats := range s.stats {
+		tickers = append(tickers, stats.ticker(symbol))
+	}
+	sort.Slice(tickers, func(i, j int) bool {
+		return tickers[i].Symbol < tickers[j].Symbol
+	})
+	return tickers
+}
+
+// ticker returns the stats as the symbol's ticker.
+func (stats Stats) ticker(symbol string) store.Ticker {
+	return store.Ticker{
+		Symbol:             symbol,
+		LastPrice:          stats.LastPrice,
+		LastQuantity:       stats.LastQuantity,
+		PriceChange:        stats.PriceChange,
+		PriceChangePercent: stats.PriceChangePercent,
+		WeightedAvgPrice:   stats.WeightedAvgPrice,
+		OpenPrice:          stats.OpenPrice,
+		HighPrice:          stats.HighPrice,
+		LowPrice:           stats.LowPrice,
+		Volume:             stats.Volume,
+		QuoteVolume:        stats.QuoteVolume,
+		UpdateTime:         stats.UpdateTime,
+	}
+}
+
 // GetSymbols returns the list of futures symbols.
 func (s *statsStore) GetSymbols() []string {
 	return s.symbols
 }
 
+// Health returns the state of the stream. The store is healthy if it was
+// updated within the stream timeout, by the stream or a snapshot.
+func (s *statsStore) Health() store.Health {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	health := store.Health{
+		Healthy:    nowFunc().Sub(s.lastUpdate) <= streamTimeout,
+		Connected:  s.stopC != nil,
+		LastUpdate: s.lastUpdate,
+		Reconnects: s.reconnects,
+	}
+	if s.lastErr != nil {
+		health.LastError = s.lastErr.Error()
+	}
+	return health
+}
+
 // fetchSymbolsAndPriceStats initializes the price stats map.
 func (s *statsStore) fetchSymbolsAndPriceStats() {
 	s.stats = make(map[string]Stats)
 
-	priceStats, err := futures.NewClient("", "").
+	priceStats, err := ratelimit.NewClient("", "").
 		NewListPriceChangeStatsService().
 		Do(context.Background())
 
@@ -83,6 +234,7 @@ func (s *statsStore) fetchSymbolsAndPriceStats() {
 		return
 	}
 
+	now := nowFunc()
 	for _, priceStat := range priceStats {
 		log.Debug(log.Fields{"symbol": priceStat.Symbol,
 			"last price": priceStat.LastPrice})
@@ -94,12 +246,20 @@ func (s *statsStore) fetchSymbolsAndPriceStats() {
 			WeightedAvgPrice:   priceStat.WeightedAvgPrice,
 			LastPrice:          priceStat.LastPrice,
 			LastQuantity:       priceStat.LastQuantity,
+			OpenPrice:          priceStat.OpenPrice,
+			HighPrice:          priceStat.HighPrice,
+			LowPrice:           priceStat.LowPrice,
+			Volume:             priceStat.Volume,
+			QuoteVolume:        priceStat.QuoteVolume,
+			UpdateTime:         now,
 		}
 	}
+	s.lastUpdate = now
 }
 
 // update will update the actual map used to store each symbol's price stats
 func (s *statsStore) update(events futures.WsAllMarketTickerEvent) {
+	now := nowFunc()
 	for _, priceStat := range events {
 		log.WithFields(log.Fields{"symbol": priceStat.Symbol,
 			"last price": priceStat.ClosePrice}).
@@ -112,13 +272,64 @@ func (s *statsStore) update(events futures.WsAllMarketTickerEvent) {
 			WeightedAvgPrice:   priceStat.WeightedAvgPrice,
 			LastPrice:          priceStat.ClosePrice,
 			LastQuantity:       priceStat.CloseQty,
+			OpenPrice:          priceStat.OpenPrice,
+			HighPrice:          priceStat.HighPrice,
+			LowPrice:           priceStat.LowPrice,
+			Volume:             priceStat.BaseVolume,
+			QuoteVolume:        priceStat.QuoteVolume,
+			UpdateTime:         now,
 		}
 	}
+	s.lastEvent = now
+	s.lastUpdate = now
+}
+
+// snapshot updates the last prices from a REST snapshot, unless one was
+// attempted within the minSnapshotInterval.
+func (s *statsStore) snapshot() error {
+	s.snapshotM.Lock()
+	defer s.snapshotM.Unlock()
+	if nowFunc().Sub(s.lastSnapshot) < minSnapshotInterval {
+		return nil
+	}
+	s.lastSnapshot = nowFunc()
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	prices, err := ratelimit.NewClient("", "").
+		NewListPricesService().
+		Do(ctx)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err != nil {
+		s.lastErr = err
+		return err
+	}
+
+	now := nowFunc()
+	for _, price := range prices {
+		stats := s.stats[price.Symbol]
+		stats.LastPrice = price.Price
+		stats.UpdateTime = now
+		s.stats[price.Symbol] = stats
+	}
+	s.lastUpdate = now
+
+	log.WithField("Symbols", len(prices)).Info("Updated last prices from snapshot")
+	return nil
 }
 
-// startUpdates opens the websocket and will start updating the entire
-// statsStore every updateInterval + 1 sec.
+// startUpdates connects the websocket, which will start updating the entire
+// statsStore every updateInterval + 1 sec, and watches it for updates.
 func (s *statsStore) startUpdates() {
+	go s.connect()
+	go s.watch()
+}
+
+// connect keeps the websocket connected, reconnecting it with backoff
+// whenever it's dropped.
+func (s *statsStore) connect() {
 	eventHandler := func(events futures.WsAllMarketTickerEvent) {
 		time.Sleep(s.updateDelay)
 		s.m.Lock()
@@ -127,12 +338,75 @@ func (s *statsStore) startUpdates() {
 	}
 
 	errHandler := func(err error) {
-		log.Trace(err)
+		log.WithError(err).Warn("Market ticker stream error")
+		s.m.Lock()
+		defer s.m.Unlock()
+		s.lastErr = err
 	}
 
-	_, _, err := futures.WsAllMarketTickerServe(eventHandler, errHandler)
-	if err != nil {
-		log.Fatal(err)
-		return
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(reconnectBackoff(attempt - 1))
+		}
+
+		doneC, stopC, err := futures.WsAllMarketTickerServe(eventHandler, errHandler)
+		if err != nil {
+			log.WithField("Attempt", attempt).Error(err)
+			s.m.Lock()
+			s.lastErr = err
+			s.m.Unlock()
+			continue
+		}
+
+		s.m.Lock()
+		s.stopC = stopC
+		s.connectedAt = nowFunc()
+		s.m.Unlock()
+		log.Info("Connected market ticker stream")
+
+		<-doneC
+
+		s.m.Lock()
+		s.stopC = nil
+		s.reconnects++
+		connected := nowFunc().Sub(s.connectedAt)
+		s.m.Unlock()
+		log.WithField("Connected", connected).Warn("Market ticker stream disconnected, reconnecting")
+
+		if connected > streamTimeout {
+			attempt = 0
+		}
+	}
+}
+
+// watch disconnects the websocket if it stops sending updates, so it's
+// reconnected, and polls the last prices from snapshots while it's dropped.
+func (s *statsStore) watch() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	var lastPoll time.Time
+	for range ticker.C {
+		now := nowFunc()
+
+		s.m.Lock()
+		lastEvent := s.lastEvent
+		if s.connectedAt.After(lastEvent) {
+			lastEvent = s.connectedAt
+		}
+		dropped := now.Sub(lastEvent) > streamTimeout
+		if dropped && s.stopC != nil {
+			log.WithField("LastEvent", s.lastEvent).Warn("Market ticker stream stopped sending updates")
+			close(s.stopC)
+			s.stopC = nil
+		}
+		s.m.Unlock()
+
+		if dropped && now.Sub(lastPoll) >= pollInterval {
+			lastPoll = now
+			err := s.snapshot()
+			if err != nil {
+				log.Error(err)
+			}
+		}
 	}
 }
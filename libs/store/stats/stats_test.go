@@ -3,10 +3,13 @@ package stats
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/bosdhill/golang-binance-service/core/errors"
 	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -52,3 +55,75 @@ func TestGetLastPrice(t *testing.T) {
 		)
 	}
 }
+
+func TestReconnect(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet streams can't be disconnected")
+	}
+	stats := NewStore()
+	assert.Eventually(t, func() bool { return stats.Health().Connected }, 5*time.Second, 100*time.Millisecond)
+	reconnects := stats.Health().Reconnects
+
+	fake.DisconnectStreams()
+
+	assert.Eventually(t, func() bool {
+		health := stats.Health()
+		return health.Connected && health.Reconnects > reconnects
+	}, 5*time.Second, 100*time.Millisecond, "stream reconnected")
+
+	_, err := stats.GetLastPriceFresh("BTCUSDT", 2*time.Second)
+	assert.NoError(t, err)
+}
+
+func TestGetLastPriceFresh(t *testing.T) {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet snapshots can't be failed")
+	}
+	NewStore()
+
+	// A store whose stream stopped updating a minute ago
+	stale := func() *statsStore {
+		return &statsStore{
+			stats: map[string]Stats{
+				"BTCUSDT": {LastPrice: "1", UpdateTime: time.Now().Add(-time.Minute)},
+			},
+			lastUpdate: time.Now().Add(-time.Minute),
+		}
+	}
+
+	s := stale()
+	assert.False(t, s.Health().Healthy)
+	price, err := s.GetLastPriceFresh("BTCUSDT", 5*time.Second)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "1", price, "price refreshed from the snapshot")
+	assert.True(t, s.Health().Healthy)
+
+	s = stale()
+	fake.Fail("/fapi/v1/ticker/price", fakebinance.Failure{Status: 503, Code: -1001, Message: "Internal error"})
+	_, err = s.GetLastPriceFresh("BTCUSDT", 5*time.Second)
+	assert.Equal(t, errors.CodeStaleData, errors.AsServiceError(err).ErrorCode(), "snapshot failed")
+	assert.NotEmpty(t, s.Health().LastError)
+
+	_, err = s.GetLastPriceFresh("FOOUSDT", 5*time.Second)
+	assert.Error(t, err, "unknown symbol")
+}
+
+func TestGetTickers(t *testing.T) {
+	stats := NewStore()
+
+	ticker, ok := stats.GetTicker("BTCUSDT")
+	assert.True(t, ok)
+	assert.Equal(t, "BTCUSDT", ticker.Symbol)
+	assert.NotEmpty(t, ticker.LastPrice)
+
+	_, ok = stats.GetTicker("FOOUSDT")
+	assert.False(t, ok, "unknown symbol")
+
+	tickers := stats.GetTickers()
+	assert.Len(t, tickers, len(stats.GetSymbols()))
+	assert.True(t, sort.SliceIsSorted(tickers, func(i, j int) bool {
+		return tickers[i].Symbol < tickers[j].Symbol
+	}), "sorted by symbol")
+}
@@ -0,0 +1,215 @@
+// Package store defines the interfaces of the in memory stores, so their
+// consumers can be tested with fakes instead of the websocket backed stores.
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+)
+
+// PriceSource is a source of the futures symbols' last prices, e.g. the
+// stats store.
+type PriceSource interface {
+	// GetLastPrice gets the last price for a futures symbol, or an empty
+	// string if it's unknown.
+	GetLastPrice(symbol string) string
+
+	// GetLastPriceFresh gets the last price for a futures symbol if it was
+	// updated within maxAge, otherwise an error.
+	GetLastPriceFresh(symbol string, maxAge time.Duration) (string, error)
+}
+
+// SymbolInfoSource is a source of the futures symbols' exchange info, e.g.
+// the exchange info store.
+type SymbolInfoSource interface {
+	// GetSymbol returns the exchange info for a futures symbol, including its
+	// filters, and whether the symbol exists.
+	GetSymbol(symbol string) (futures.Symbol, bool)
+}
+
+// SymbolListSource is a source of every futures symbol's exchange info, e.g.
+// the exchange info store.
+type SymbolListSource interface {
+	SymbolInfoSource
+
+	// GetSymbols returns the sorted list of futures symbols.
+	GetSymbols() []string
+}
+
+// TickerSource is a source of the futures symbols' 24hr tickers, e.g. the
+// stats store.
+type TickerSource interface {
+	// GetTicker returns the symbol's ticker and whether the symbol has one.
+	GetTicker(symbol string) (Ticker, bool)
+
+	// GetTickers returns every symbol's ticker, sorted by symbol.
+	GetTickers() []Ticker
+}
+
+// MarkPriceSource is a source of the futures symbols' mark prices, e.g. the
+// mark price store.
+type MarkPriceSource interface {
+	// GetMarkPrice returns the symbol's mark price and funding rate and
+	// whether the symbol has one.
+	GetMarkPrice(symbol string) (MarkPrice, bool)
+
+	// GetMarkPriceFresh gets the mark price for a futures symbol if it was
+	// updated within maxAge, otherwise an error.
+	GetMarkPriceFresh(symbol string, maxAge time.Duration) (string, error)
+}
+
+// FundingSource is a source of the futures symbols' current and past funding
+// rates, e.g. the mark price store.
+type FundingSource interface {
+	// GetMarkPrices returns every symbol's mark price and funding rate,
+	// sorted by symbol.
+	GetMarkPrices() []MarkPrice
+
+	// GetFundingHistory returns the symbol's settled funding rates between
+	// startTime and endTime, oldest first and up to limit. Zero times aren't
+	// bounded.
+	GetFundingHistory(ctx context.Context, symbol string, startTime, endTime time.Time, limit int) ([]FundingRate, error)
+}
+
+// KlineSource is a source of the futures symbols' klines, e.g. the klines
+// store.
+type KlineSource interface {
+	// GetKlines returns the symbol's last klines of the interval, up to limit
+	// and ordered by open time, the last one being the current kline.
+	GetKlines(ctx context.Context, symbol, interval string, limit int) ([]Kline, error)
+}
+
+// OrderBookSource is a source of the futures symbols' order books, e.g. the
+// order book store. A BUY walks the asks from the best one, a SELL the bids.
+type OrderBookSource interface {
+	// GetBestBidAsk returns the symbol's best bid and ask.
+	GetBestBidAsk(ctx context.Context, symbol string) (bid, ask Level, err error)
+
+	// GetDepth returns the fill of a side's order for the notional, i.e. the
+	// levels' depth up to the notional.
+	GetDepth(ctx context.Context, symbol string, side futures.SideType, notional float64) (Fill, error)
+
+	// EstimateFill returns the estimated fill of a side's market order for
+	// the quantity.
+	EstimateFill(ctx context.Context, symbol string, side futures.SideType, quantity float64) (Fill, error)
+}
+
+// Level is a price level of an order book side.
+type Level struct {
+	Price    float64 `json:"price"`
+	Quantity float64 `json:"quantity"`
+}
+
+// Fill is the estimated fill of an order walking an order book side.
+type Fill struct {
+	// Quantity and Notional are the filled quantity and its notional value,
+	// less than requested if the book isn't deep enough
+	Quantity float64 `json:"quantity"`
+	Notional float64 `json:"notional"`
+
+	// AvgPrice is the volume weighted average price of the fill
+	AvgPrice float64 `json:"avgPrice"`
+
+	// WorstPrice is the price of the last level the fill reaches
+	WorstPrice float64 `json:"worstPrice"`
+
+	// Levels is how many levels the fill reaches
+	Levels int `json:"levels"`
+
+	// Complete is false if the book isn't deep enough for the whole order
+	Complete bool `json:"complete"`
+}
+
+// Ticker is a futures symbol's 24hr rolling window price stats.
+type Ticker struct {
+	Symbol             string `json:"symbol"`
+	LastPrice          string `json:"lastPrice"`
+	LastQuantity       string `json:"lastQty"`
+	PriceChange        string `json:"priceChange"`
+	PriceChangePercent string `json:"priceChangePercent"`
+	WeightedAvgPrice   string `json:"weightedAvgPrice"`
+	OpenPrice          string `json:"openPrice"`
+	HighPrice          string `json:"highPrice"`
+	LowPrice           string `json:"lowPrice"`
+	Volume             string `json:"volume"`
+	QuoteVolume        string `json:"quoteVolume"`
+
+	// UpdateTime is when the ticker was last updated, by the stream or a
+	// snapshot
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// MarkPrice is a futures symbol's mark price and funding rate.
+type MarkPrice struct {
+	Symbol               string    `json:"symbol"`
+	MarkPrice            string    `json:"markPrice"`
+	IndexPrice           string    `json:"indexPrice"`
+	EstimatedSettlePrice string    `json:"estimatedSettlePrice"`
+	FundingRate          string    `json:"fundingRate"`
+	NextFundingTime      time.Time `json:"nextFundingTime"`
+	UpdateTime           time.Time `json:"updateTime"`
+}
+
+// FundingRate is a futures symbol's settled funding rate.
+type FundingRate struct {
+	Symbol      string    `json:"symbol"`
+	FundingRate string    `json:"fundingRate"`
+	FundingTime time.Time `json:"fundingTime"`
+}
+
+// BookTicker is a futures symbol's best bid and ask.
+type BookTicker struct {
+	Symbol     string    `json:"symbol"`
+	BidPrice   string    `json:"bidPrice"`
+	BidQty     string    `json:"bidQty"`
+	AskPrice   string    `json:"askPrice"`
+	AskQty     string    `json:"askQty"`
+	UpdateID   int64     `json:"updateId"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// Kline is a futures symbol's candlestick for an interval.
+type Kline struct {
+	Symbol      string    `json:"symbol"`
+	Interval    string    `json:"interval"`
+	OpenTime    time.Time `json:"openTime"`
+	CloseTime   time.Time `json:"closeTime"`
+	Open        string    `json:"open"`
+	High        string    `json:"high"`
+	Low         string    `json:"low"`
+	Close       string    `json:"close"`
+	Volume      string    `json:"volume"`
+	QuoteVolume string    `json:"quoteVolume"`
+	Trades      int64     `json:"trades"`
+
+	// Closed is true once the kline's interval is over and it won't change
+	Closed bool `json:"closed"`
+}
+
+// HealthSource is a store kept up to date by a stream, which reports whether
+// its data is fresh.
+type HealthSource interface {
+	Health() Health
+}
+
+// Health is the state of a store's stream.
+type Health struct {
+	// Healthy is true if the store was updated recently enough for its data
+	// to be used
+	Healthy bool `json:"healthy"`
+
+	// Connected is true if the store's stream is connected
+	Connected bool `json:"connected"`
+
+	// LastUpdate is when the store was last updated, by its stream or a
+	// snapshot
+	LastUpdate time.Time `json:"lastUpdate"`
+
+	// Reconnects is how many times the stream was reconnected
+	Reconnects int `json:"reconnects"`
+
+	// LastError is the last stream or snapshot error
+	LastError string `json:"lastError,omitempty"`
+}
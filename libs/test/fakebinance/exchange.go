@@ -0,0 +1,173 @@
+package fakebinance
+
+import (
+	"math"
+
+	"github.com/adshao/go-binance/v2/futures"
+)
+
+// maintMarginRatio is the maintenance margin ratio of every position
+const maintMarginRatio = 0.004
+
+// isOpen returns whether the order can still be filled or cancelled.
+func isOpen(o *futures.Order) bool {
+	return o.Status == futures.OrderStatusTypeNew ||
+		o.Status == futures.OrderStatusTypePartiallyFilled
+}
+
+// triggered returns whether the open order is filled at the price. LIMIT
+// orders are filled once the price crosses their price, conditional orders
+// once the price crosses their stop price.
+func triggered(o *futures.Order, price float64) bool {
+	buy := o.Side == futures.SideTypeBuy
+	switch o.Type {
+	case futures.OrderTypeLimit:
+		limit := parse(o.Price)
+		return buy && price <= limit || !buy && price >= limit
+	case futures.OrderTypeStopMarket, futures.OrderTypeStop:
+		stop := parse(o.StopPrice)
+		return buy && price >= stop || !buy && price <= stop
+	case futures.OrderTypeTakeProfitMarket, futures.OrderTypeTakeProfit:
+		stop := parse(o.StopPrice)
+		return buy && price <= stop || !buy && price >= stop
+	}
+	return false
+}
+
+// matchOrders fills the symbol's open orders triggered by its last price.
+// Must be called with s.m held.
+func (s *Server) matchOrders(symbol string) {
+	price := s.lastPrice(symbol)
+	for _, o := range s.orders {
+		if o.Symbol != symbol || !isOpen(o) || !triggered(o, price) {
+			continue
+		}
+		fillPrice := price
+		if o.Type == futures.OrderTypeLimit {
+			fillPrice = parse(o.Price)
+		}
+		s.fill(o, fillPrice)
+	}
+}
+
+// fill fills the rest of the order at price. Must be called with s.m held.
+func (s *Server) fill(o *futures.Order, price float64) {
+	s.fillQuantity(o, parse(o.OrigQuantity)-parse(o.ExecutedQuantity), price)
+}
+
+// fillQuantity fills quantity of the order at price, leaving it partially
+// filled if quantity is less than the rest of the order, updating its
+// position and the USDT balance and publishing the order and account updates.
+// Must be called with s.m held.
+func (s *Server) fillQuantity(o *futures.Order, quantity float64, price float64) {
+	key := positionKey{o.Symbol, o.PositionSide}
+	position, ok := s.positions[key]
+	if !ok {
+		position = &Position{Symbol: o.Symbol, PositionSide: o.PositionSide}
+	}
+
+	remaining := parse(o.OrigQuantity) - parse(o.ExecutedQuantity)
+	quantity = math.Min(quantity, remaining)
+	partial := quantity < remaining
+	if o.ClosePosition || o.ReduceOnly {
+		// reduce only orders can't increase or flip the position
+		closable := math.Abs(position.Amount)
+		if o.ClosePosition || quantity > closable {
+			quantity = closable
+			partial = false
+		}
+	}
+	if quantity == 0 {
+		o.Status = futures.OrderStatusTypeExpired
+		o.UpdateTime = s.now()
+		s.publishOrder(o, futures.OrderExecutionTypeExpired, 0)
+		return
+	}
+
+	delta := quantity
+	if o.Side == futures.SideTypeSell {
+		delta = -quantity
+	}
+	s.wallet["USDT"] += position.apply(delta, price)
+	if position.Amount == 0 {
+		delete(s.positions, key)
+	} else {
+		s.positions[key] = position
+	}
+
+	executed := round(parse(o.ExecutedQuantity) + quantity)
+	cumQuote := parse(o.CumQuote) + quantity*price
+	o.Status = futures.OrderStatusTypeFilled
+	if partial {
+		o.Status = futures.OrderStatusTypePartiallyFilled
+	}
+	o.ExecutedQuantity = format(executed)
+	o.CumQuantity = format(executed)
+	o.CumQuote = format(cumQuote)
+	o.AvgPrice = format(cumQuote / executed)
+	o.UpdateTime = s.now()
+
+	s.publishOrder(o, futures.OrderExecutionTypeTrade, quantity)
+	s.publishAccount(position)
+}
+
+// apply adds delta to the position at price and returns the realized profit.
+func (p *Position) apply(delta float64, price float64) float64 {
+	realized := 0.0
+	switch {
+	case p.Amount == 0 || p.Amount > 0 == (delta > 0):
+		// opening or increasing the position
+		p.EntryPrice = (p.EntryPrice*math.Abs(p.Amount) + price*math.Abs(delta)) /
+			(math.Abs(p.Amount) + math.Abs(delta))
+		p.Amount += delta
+	default:
+		// reducing, closing or flipping the position
+		closed := math.Min(math.Abs(delta), math.Abs(p.Amount))
+		direction := 1.0
+		if p.Amount < 0 {
+			direction = -1.0
+		}
+		realized = closed * (price - p.EntryPrice) * direction
+		p.Amount += delta
+		if math.Abs(p.Amount) < 1e-12 {
+			p.Amount = 0
+			p.EntryPrice = 0
+		} else if p.Amount > 0 != (direction > 0) {
+			p.EntryPrice = price
+		}
+	}
+	return realized
+}
+
+// unrealizedProfit returns the position's unrealized profit at the symbol's
+// last price. Must be called with s.m held.
+func (s *Server) unrealizedProfit(p *Position) float64 {
+	return p.Amount * (s.lastPrice(p.Symbol) - p.EntryPrice)
+}
+
+// notional returns the position's notional at the symbol's last price. Must
+// be called with s.m held.
+func (s *Server) notional(p *Position) float64 {
+	return p.Amount * s.lastPrice(p.Symbol)
+}
+
+// positionSides returns the position sides of the position mode.
+func (s *Server) positionSides() []futures.PositionSideType {
+	if s.dualSide {
+		return []futures.PositionSideType{futures.PositionSideTypeLong, futures.PositionSideTypeShort}
+	}
+	return []futures.PositionSideType{futures.PositionSideTypeBoth}
+}
+
+// liquidationPrice returns the position's approximate liquidation price, or 0
+// if it's closed. Must be called with s.m held.
+func (s *Server) liquidationPrice(p *Position) float64 {
+	if p.Amount == 0 {
+		return 0
+	}
+	margin := 1 / float64(s.leverage[p.Symbol])
+	if p.Amount > 0 {
+		return p.EntryPrice * (1 - margin + maintMarginRatio)
+	}
+	return p.EntryPrice * (1 + margin - maintMarginRatio)
+}
@@ -0,0 +1,482 @@
+// Package fakebinance implements a fake binance futures server for hermetic
+// tests.
+//
+// The server implements the futures REST endpoints and websocket streams used
+// by this service against an in memory exchange whose state (prices,
+// balances, positions, fills and errors) is scripted by the tests. Clients
+// either set their BaseURL to the server's URL and their HTTPClient to the
+// server's Client, or the server is installed to redirect every binance REST
+// request and websocket stream to it:
+//
+//	server := fakebinance.New()
+//	defer server.Close()
+//	defer server.Install()()
+//
+//	server.SetPrice("BTCUSDT", "60000")
+//	server.Fail("/fapi/v1/order", fakebinance.Failure{Code: -1021, Message: "Timestamp for this request is outside of the recvWindow."})
+package fakebinance
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/gorilla/websocket"
+)
+
+//go:embed testdata/exchangeInfo.json
+var exchangeInfoJSON []byte
+
+var (
+	// defaultBalance is the USDT wallet balance of a new server
+	defaultBalance = 100000.0
+
+	// defaultLeverage is the leverage of every symbol of a new server
+	defaultLeverage = 20
+
+	// defaultFundingRate is the funding rate of every symbol of a new server
+	defaultFundingRate = "0.00010000"
+
+	// fundingInterval is how often the symbols' funding is settled
+	fundingInterval = 8 * time.Hour
+
+	// defaultBrackets are the leverage brackets of every symbol of a new server
+	defaultBrackets = []futures.Bracket{
+		{Bracket: 1, InitialLeverage: 125, NotionalCap: 50000, NotionalFloor: 0, MaintMarginRatio: 0.004, Cum: 0},
+		{Bracket: 2, InitialLeverage: 100, NotionalCap: 250000, NotionalFloor: 50000, MaintMarginRatio: 0.005, Cum: 50},
+		{Bracket: 3, InitialLeverage: 50, NotionalCap: 1000000, NotionalFloor: 250000, MaintMarginRatio: 0.01, Cum: 1300},
+		{Bracket: 4, InitialLeverage: 20, NotionalCap: 10000000, NotionalFloor: 1000000, MaintMarginRatio: 0.025, Cum: 16300},
+	}
+
+	// binanceHosts are the hosts redirected to the server once it's installed
+	binanceHosts = []string{"binance.com", "binancefuture.com"}
+)
+
+// Failure is a scripted error response. Status defaults to 400.
+type Failure struct {
+	Status  int
+	Code    int64
+	Message string
+	Header  http.Header
+}
+
+// Position is a scripted position.
+type Position struct {
+	Symbol       string
+	PositionSide futures.PositionSideType
+	Amount       float64
+	EntryPrice   float64
+}
+
+// Server is a fake binance futures server.
+type Server struct {
+	// URL is the base URL of the REST endpoints, e.g. for futures.Client.BaseURL
+	URL string
+
+	srv *httptest.Server
+	m   sync.Mutex
+
+	exchangeInfo futures.ExchangeInfo
+	tickers      map[string]*futures.PriceChangeStats
+	depths       map[string]*futures.DepthResponse
+	fundingRates map[string]string
+	wallet       map[string]float64
+	positions    map[positionKey]*Position
+	leverage     map[string]int
+	isolated     map[string]bool
+	brackets     []futures.Bracket
+	dualSide     bool
+	timeOffset   time.Duration
+
+	orders      []*futures.Order
+	nextOrderID int64
+
+	failures      map[string][]Failure
+	orderFailures map[futures.OrderType][]Failure
+	requests      map[string]int
+
+	listenKeys     map[string]bool
+	nextKey        int
+	userConns      map[string][]*conn
+	tickerConns    []*conn
+	markPriceConns []*conn
+}
+
+// positionKey identifies a position by its symbol and position side.
+type positionKey struct {
+	symbol string
+	side   futures.PositionSideType
+}
+
+// New starts a fake binance futures server with the exchange info of BTCUSDT,
+// ETHUSDT, TRXUSDT, DOTUSDT and XRPUSDT and a 100000 USDT balance.
+func New() *Server {
+	s := &Server{
+		tickers:       make(map[string]*futures.PriceChangeStats),
+		depths:        make(map[string]*futures.DepthResponse),
+		fundingRates:  make(map[string]string),
+		wallet:        map[string]float64{"USDT": defaultBalance},
+		positions:     make(map[positionKey]*Position),
+		leverage:      make(map[string]int),
+		isolated:      make(map[string]bool),
+		brackets:      defaultBrackets,
+		nextOrderID:   1,
+		failures:      make(map[string][]Failure),
+		orderFailures: make(map[futures.OrderType][]Failure),
+		requests:      make(map[string]int),
+		listenKeys:    make(map[string]bool),
+		userConns:     make(map[string][]*conn),
+	}
+
+	err := json.Unmarshal(exchangeInfoJSON, &s.exchangeInfo)
+	if err != nil {
+		panic(err)
+	}
+	for _, symbol := range s.exchangeInfo.Symbols {
+		s.leverage[symbol.Symbol] = defaultLeverage
+		s.tickers[symbol.Symbol] = &futures.PriceChangeStats{
+			Symbol:             symbol.Symbol,
+			PriceChange:        "0",
+			PriceChangePercent: "0",
+			WeightedAvgPrice:   "0",
+			LastPrice:          "0",
+			LastQuantity:       "0",
+			Volume:             "0",
+			QuoteVolume:        "0",
+		}
+	}
+
+	s.srv = httptest.NewTLSServer(s.routes())
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close disconnects every stream and shuts down the server.
+func (s *Server) Close() {
+	s.DisconnectStreams()
+	s.srv.Close()
+}
+
+// Client returns an http client that trusts the server's certificate.
+func (s *Server) Client() *http.Client {
+	return s.srv.Client()
+}
+
+// Install points every binance REST request made through http.DefaultClient
+// and every websocket stream dialed by websocket.DefaultDialer at the server.
+// The go-binance clients and streams use both, so they don't need to be
+// configured. Returns a function that restores them.
+func (s *Server) Install() func() {
+	transport := http.DefaultClient.Transport
+	dialer := websocket.DefaultDialer
+
+	http.DefaultClient.Transport = &redirectTransport{
+		host:     s.srv.Listener.Addr().String(),
+		server:   s.srv.Client().Transport,
+		fallback: transport,
+	}
+
+	certs := x509.NewCertPool()
+	certs.AddCert(s.srv.Certificate())
+	d := *websocket.DefaultDialer
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, s.srv.Listener.Addr().String())
+	}
+	// httptest certificates are valid for example.com
+	d.TLSClientConfig = &tls.Config{RootCAs: certs, ServerName: "example.com"}
+	websocket.DefaultDialer = &d
+
+	return func() {
+		http.DefaultClient.Transport = transport
+		websocket.DefaultDialer = dialer
+	}
+}
+
+// redirectTransport sends the requests to binance hosts to the server.
+type redirectTransport struct {
+	host     string
+	server   http.RoundTripper
+	fallback http.RoundTripper
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for _, host := range binanceHosts {
+		if strings.HasSuffix(req.URL.Hostname(), host) {
+			req = req.Clone(req.Context())
+			req.URL.Scheme = "https"
+			req.URL.Host = t.host
+			req.Host = t.host
+			return t.server.RoundTrip(req)
+		}
+	}
+	if t.fallback == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// SetPrice sets the symbol's last and mark price, triggers the symbol's open
+// orders crossed by the price and pushes the tickers to the ticker streams.
+func (s *Server) SetPrice(symbol string, price string) {
+	s.m.Lock()
+	ticker, ok := s.tickers[symbol]
+	if !ok {
+		ticker = &futures.PriceChangeStats{Symbol: symbol}
+		s.tickers[symbol] = ticker
+	}
+	ticker.LastPrice = price
+	ticker.LastQuantity = "1"
+	ticker.CloseTime = s.now()
+	s.matchOrders(symbol)
+	s.m.Unlock()
+
+	s.PublishTickers()
+	s.PublishMarkPrices()
+}
+
+// SetTicker sets the symbol's 24hr ticker stats.
+func (s *Server) SetTicker(ticker futures.PriceChangeStats) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.tickers[ticker.Symbol] = &ticker
+}
+
+// SetDepth sets the symbol's order book snapshot. Without one the order book
+// is generated around the symbol's last price.
+func (s *Server) SetDepth(symbol string, depth futures.DepthResponse) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.depths[symbol] = &depth
+}
+
+// SetFundingRate sets the symbol's funding rate, which is defaultFundingRate
+// otherwise. Its funding history is at the same rate.
+func (s *Server) SetFundingRate(symbol string, rate string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.fundingRates[symbol] = rate
+}
+
+// SetBalance sets the asset's wallet balance.
+func (s *Server) SetBalance(asset string, balance float64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.wallet[asset] = balance
+}
+
+// SetPosition sets a position, an Amount of 0 closes it. The position side
+// defaults to BOTH.
+func (s *Server) SetPosition(position Position) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if position.PositionSide == "" {
+		position.PositionSide = futures.PositionSideTypeBoth
+	}
+	key := positionKey{position.Symbol, position.PositionSide}
+	if position.Amount == 0 {
+		delete(s.positions, key)
+		return
+	}
+	s.positions[key] = &position
+}
+
+// SetDualSidePosition sets the position mode, hedge mode if dualSide is true.
+func (s *Server) SetDualSidePosition(dualSide bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.dualSide = dualSide
+}
+
+// SetBrackets sets the leverage brackets of every symbol.
+func (s *Server) SetBrackets(brackets []futures.Bracket) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.brackets = brackets
+}
+
+// SetSymbol adds the symbol to the exchange info, or replaces it if it's
+// already listed.
+func (s *Server) SetSymbol(symbol futures.Symbol) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if listed, ok := s.symbol(symbol.Symbol); ok {
+		*listed = symbol
+		return
+	}
+	s.exchangeInfo.Symbols = append(s.exchangeInfo.Symbols, symbol)
+}
+
+// SetSymbolStatus sets the symbol's status in the exchange info, e.g.
+// SETTLING or BREAK.
+func (s *Server) SetSymbolStatus(symbol string, status string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if listed, ok := s.symbol(symbol); ok {
+		listed.Status = status
+	}
+}
+
+// RemoveSymbol delists the symbol from the exchange info.
+func (s *Server) RemoveSymbol(symbol string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	symbols := make([]futures.Symbol, 0, len(s.exchangeInfo.Symbols))
+	for _, listed := range s.exchangeInfo.Symbols {
+		if listed.Symbol != symbol {
+			symbols = append(symbols, listed)
+		}
+	}
+	s.exchangeInfo.Symbols = symbols
+}
+
+// SetTimeOffset sets how far the server time is ahead of the local time.
+func (s *Server) SetTimeOffset(offset time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.timeOffset = offset
+}
+
+// Fail makes the next request to the path fail. Calling Fail more than once
+// for a path fails that many requests, in order.
+func (s *Server) Fail(path string, failure Failure) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.failures[path] = append(s.failures[path], failure)
+}
+
+// FailOrder makes the next new order of the type fail with the failure, e.g.
+// to fail one of the orders placed by a single call.
+func (s *Server) FailOrder(orderType futures.OrderType, failure Failure) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.orderFailures[orderType] = append(s.orderFailures[orderType], failure)
+}
+
+// Requests returns how many requests were made to the path.
+func (s *Server) Requests(path string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.requests[path]
+}
+
+// Orders returns every order of the symbol, or every order if symbol is
+// empty.
+func (s *Server) Orders(symbol string) []futures.Order {
+	s.m.Lock()
+	defer s.m.Unlock()
+	orders := []futures.Order{}
+	for _, o := range s.orders {
+		if symbol == "" || o.Symbol == symbol {
+			orders = append(orders, *o)
+		}
+	}
+	return orders
+}
+
+// Positions returns every open position.
+func (s *Server) Positions() []Position {
+	s.m.Lock()
+	defer s.m.Unlock()
+	positions := []Position{}
+	for _, p := range s.positions {
+		positions = append(positions, *p)
+	}
+	return positions
+}
+
+// Fill fills the open order at its price, or the last price for orders
+// without one.
+func (s *Server) Fill(orderID int64) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, o := range s.orders {
+		if o.OrderID == orderID && isOpen(o) {
+			price := parse(o.Price)
+			if price == 0 {
+				price = s.lastPrice(o.Symbol)
+			}
+			s.fill(o, price)
+			return true
+		}
+	}
+	return false
+}
+
+// FillPartially fills quantity of the open order at its price, or the last
+// price for orders without one, leaving it PARTIALLY_FILLED if it's less than
+// the rest of the order.
+func (s *Server) FillPartially(orderID int64, quantity string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, o := range s.orders {
+		if o.OrderID == orderID && isOpen(o) {
+			price := parse(o.Price)
+			if price == 0 {
+				price = s.lastPrice(o.Symbol)
+			}
+			s.fillQuantity(o, parse(quantity), price)
+			return true
+		}
+	}
+	return false
+}
+
+// now returns the server time in ms.
+func (s *Server) now() int64 {
+	return time.Now().Add(s.timeOffset).UnixNano() / int64(time.Millisecond)
+}
+
+// lastPrice returns the symbol's last price. Must be called with s.m held.
+func (s *Server) lastPrice(symbol string) float64 {
+	if ticker, ok := s.tickers[symbol]; ok {
+		return parse(ticker.LastPrice)
+	}
+	return 0
+}
+
+// fundingRate returns the symbol's funding rate. Must be called with s.m
+// held.
+func (s *Server) fundingRate(symbol string) string {
+	if rate, ok := s.fundingRates[symbol]; ok {
+		return rate
+	}
+	return defaultFundingRate
+}
+
+// symbol returns the symbol's exchange info.
+func (s *Server) symbol(symbol string) (*futures.Symbol, bool) {
+	for i := range s.exchangeInfo.Symbols {
+		if s.exchangeInfo.Symbols[i].Symbol == symbol {
+			return &s.exchangeInfo.Symbols[i], true
+		}
+	}
+	return nil, false
+}
+
+// parse returns the float value of s, or 0 if it isn't a number.
+func parse(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// round rounds f to 8 decimals, the precision of binance quantities.
+func round(f float64) float64 {
+	return math.Round(f*1e8) / 1e8
+}
+
+// format returns the string value of f.
+func format(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
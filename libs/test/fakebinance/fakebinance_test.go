@@ -0,0 +1,262 @@
+package fakebinance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrders(t *testing.T) {
+	server := New()
+	defer server.Close()
+	server.SetPrice("BTCUSDT", "60000")
+
+	ctx := context.Background()
+	client := futures.NewClient("key", "secret")
+	client.BaseURL = server.URL
+	client.HTTPClient = server.Client()
+
+	// MARKET orders are filled at the last price
+	res, err := client.NewCreateOrderService().
+		Symbol("BTCUSDT").
+		Side(futures.SideTypeBuy).
+		Type(futures.OrderTypeMarket).
+		Quantity("0.5").
+		Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderStatusTypeFilled, res.Status)
+
+	risks, err := client.NewGetPositionRiskService().Symbol("BTCUSDT").Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, risks, 1)
+	assert.Equal(t, "0.5", risks[0].PositionAmt)
+	assert.Equal(t, "60000", risks[0].EntryPrice)
+
+	// LIMIT orders rest until the price crosses them
+	limit, err := client.NewCreateOrderService().
+		Symbol("BTCUSDT").
+		Side(futures.SideTypeSell).
+		Type(futures.OrderTypeLimit).
+		TimeInForce(futures.TimeInForceTypeGTC).
+		Price("61000").
+		Quantity("0.5").
+		ReduceOnly(true).
+		Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderStatusTypeNew, limit.Status)
+
+	open, err := client.NewListOpenOrdersService().Symbol("BTCUSDT").Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, open, 1)
+
+	server.SetPrice("BTCUSDT", "61000")
+	order, err := client.NewGetOrderService().Symbol("BTCUSDT").OrderID(limit.OrderID).Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderStatusTypeFilled, order.Status)
+	assert.Empty(t, server.Positions(), "position not closed")
+
+	balances, err := client.NewGetBalanceService().Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "100500", balances[0].Balance, "realized profit")
+
+	// reduce only orders without a position are rejected
+	_, err = client.NewCreateOrderService().
+		Symbol("BTCUSDT").
+		Side(futures.SideTypeSell).
+		Type(futures.OrderTypeMarket).
+		Quantity("0.5").
+		ReduceOnly(true).
+		Do(ctx)
+	assert.Equal(t, int64(-2022), apiCode(err))
+}
+
+func TestFillPartially(t *testing.T) {
+	server := New()
+	defer server.Close()
+	server.SetPrice("BTCUSDT", "60000")
+
+	ctx := context.Background()
+	client := futures.NewClient("key", "secret")
+	client.BaseURL = server.URL
+	client.HTTPClient = server.Client()
+
+	limit, err := client.NewCreateOrderService().
+		Symbol("BTCUSDT").
+		Side(futures.SideTypeBuy).
+		Type(futures.OrderTypeLimit).
+		TimeInForce(futures.TimeInForceTypeGTC).
+		Price("59000").
+		Quantity("1").
+		Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The order stays open until the rest of it is filled
+	assert.True(t, server.FillPartially(limit.OrderID, "0.4"))
+	order, err := client.NewGetOrderService().Symbol("BTCUSDT").OrderID(limit.OrderID).Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderStatusTypePartiallyFilled, order.Status)
+	assert.Equal(t, "0.4", order.ExecutedQuantity)
+	assert.Equal(t, 0.4, server.Positions()[0].Amount)
+
+	assert.True(t, server.Fill(limit.OrderID))
+	order, err = client.NewGetOrderService().Symbol("BTCUSDT").OrderID(limit.OrderID).Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, futures.OrderStatusTypeFilled, order.Status)
+	assert.Equal(t, "1", order.ExecutedQuantity)
+	assert.Equal(t, "59000", order.AvgPrice)
+	assert.False(t, server.Fill(limit.OrderID), "filled orders aren't open")
+}
+
+func TestFail(t *testing.T) {
+	server := New()
+	defer server.Close()
+
+	ctx := context.Background()
+	client := futures.NewClient("key", "secret")
+	client.BaseURL = server.URL
+	client.HTTPClient = server.Client()
+
+	server.Fail("/fapi/v1/account", Failure{Code: -1021, Message: "Timestamp for this request is outside of the recvWindow."})
+
+	_, err := client.NewGetAccountService().Do(ctx)
+	assert.Equal(t, int64(-1021), apiCode(err))
+
+	_, err = client.NewGetAccountService().Do(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.Requests("/fapi/v1/account"))
+}
+
+func TestInstall(t *testing.T) {
+	server := New()
+	defer server.Close()
+	defer server.Install()()
+
+	server.SetPrice("ETHUSDT", "4000")
+
+	// futures.NewClient isn't configured, its requests are redirected
+	info, err := futures.NewClient("", "").NewExchangeInfoService().Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, info.Symbols, 5)
+
+	events := make(chan futures.WsAllMarketTickerEvent, 10)
+	_, stopC, err := futures.WsAllMarketTickerServe(
+		func(event futures.WsAllMarketTickerEvent) { events <- event },
+		func(err error) {},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(stopC)
+
+	server.SetPrice("ETHUSDT", "4100")
+	assert.True(t, receivePrice(events, "ETHUSDT", "4100"), "ticker not received")
+}
+
+func TestUserDataStream(t *testing.T) {
+	server := New()
+	defer server.Close()
+	defer server.Install()()
+	server.SetPrice("BTCUSDT", "60000")
+
+	ctx := context.Background()
+	client := futures.NewClient("key", "secret")
+	listenKey, err := client.NewStartUserStreamService().Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *futures.WsUserDataEvent, 10)
+	_, stopC, err := futures.WsUserDataServe(
+		listenKey,
+		func(event *futures.WsUserDataEvent) { events <- event },
+		func(err error) {},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(stopC)
+
+	_, err = client.NewCreateOrderService().
+		Symbol("BTCUSDT").
+		Side(futures.SideTypeBuy).
+		Type(futures.OrderTypeMarket).
+		Quantity("1").
+		NewClientOrderID("fill").
+		Do(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []futures.OrderStatusType
+	var accountUpdates int
+	timeout := time.After(time.Second)
+	for len(statuses) < 2 || accountUpdates < 1 {
+		select {
+		case event := <-events:
+			switch event.Event {
+			case futures.UserDataEventTypeOrderTradeUpdate:
+				assert.Equal(t, "fill", event.OrderTradeUpdate.ClientOrderID)
+				statuses = append(statuses, event.OrderTradeUpdate.Status)
+			case futures.UserDataEventTypeAccountUpdate:
+				accountUpdates++
+				assert.Equal(t, "1", event.AccountUpdate.Positions[0].Amount)
+			}
+		case <-timeout:
+			t.Fatal("user data events not received")
+		}
+	}
+	assert.Equal(t, []futures.OrderStatusType{
+		futures.OrderStatusTypeNew,
+		futures.OrderStatusTypeFilled,
+	}, statuses)
+}
+
+// apiCode returns the code of a binance api error, or 0 if err isn't one.
+func apiCode(err error) int64 {
+	if apiErr, ok := err.(*common.APIError); ok {
+		return apiErr.Code
+	}
+	return 0
+}
+
+// receivePrice returns whether the symbol's price is received from the
+// events within a second.
+func receivePrice(events chan futures.WsAllMarketTickerEvent, symbol, price string) bool {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-events:
+			for _, ticker := range event {
+				if ticker.Symbol == symbol && ticker.ClosePrice == price {
+					return true
+				}
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
@@ -0,0 +1,982 @@
+package fakebinance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/adshao/go-binance/v2/futures"
+)
+
+// routes returns the server's handler, which counts every request and
+// responds with the scripted failures before routing it.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fapi/v1/ping", s.ping)
+	mux.HandleFunc("/fapi/v1/time", s.serverTime)
+	mux.HandleFunc("/fapi/v1/exchangeInfo", s.getExchangeInfo)
+	mux.HandleFunc("/fapi/v1/ticker/24hr", s.ticker24hr)
+	mux.HandleFunc("/fapi/v1/ticker/price", s.tickerPrice)
+	mux.HandleFunc("/fapi/v1/klines", s.klines)
+	mux.HandleFunc("/fapi/v1/depth", s.depth)
+	mux.HandleFunc("/fapi/v1/premiumIndex", s.premiumIndex)
+	mux.HandleFunc("/fapi/v1/fundingRate", s.fundingRateHistory)
+	mux.HandleFunc("/fapi/v1/account", s.account)
+	mux.HandleFunc("/fapi/v2/balance", s.balance)
+	mux.HandleFunc("/fapi/v1/order", s.order)
+	mux.HandleFunc("/fapi/v1/openOrders", s.openOrders)
+	mux.HandleFunc("/fapi/v1/allOrders", s.allOrders)
+	mux.HandleFunc("/fapi/v1/allOpenOrders", s.cancelAllOpenOrders)
+	mux.HandleFunc("/fapi/v1/batchOrders", s.batchOrders)
+	mux.HandleFunc("/fapi/v1/leverage", s.changeLeverage)
+	mux.HandleFunc("/fapi/v1/marginType", s.changeMarginType)
+	mux.HandleFunc("/fapi/v1/positionSide/dual", s.positionMode)
+	mux.HandleFunc("/fapi/v1/leverageBracket", s.leverageBracket)
+	mux.HandleFunc("/fapi/v2/positionRisk", s.positionRisk)
+	mux.HandleFunc("/fapi/v1/listenKey", s.listenKey)
+	mux.HandleFunc("/ws/", s.serveStream)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.m.Lock()
+		s.requests[r.URL.Path]++
+		failures := s.failures[r.URL.Path]
+		var failure *Failure
+		if len(failures) > 0 {
+			failure = &failures[0]
+			s.failures[r.URL.Path] = failures[1:]
+		}
+		s.m.Unlock()
+
+		if failure == nil && !s.checkTimestamp(r) {
+			failure = &Failure{Code: -1021, Message: "Timestamp for this request is outside of the recvWindow."}
+		}
+
+		if failure != nil {
+			writeFailure(w, failure)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// writeFailure responds with the scripted failure.
+func writeFailure(w http.ResponseWriter, failure *Failure) {
+	for key, values := range failure.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	status := failure.Status
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	writeError(w, status, failure.Code, failure.Message)
+}
+
+// checkTimestamp returns whether the signed request's timestamp is within its
+// recvWindow of the server time and less than 1000ms ahead of it, like
+// binance checks. Unsigned requests don't have a timestamp.
+func (s *Server) checkTimestamp(r *http.Request) bool {
+	query := r.URL.Query()
+	if query.Get("timestamp") == "" {
+		return true
+	}
+	timestamp, err := strconv.ParseInt(query.Get("timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	recvWindow := int64(5000)
+	if value := query.Get("recvWindow"); value != "" {
+		recvWindow, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+	}
+
+	s.m.Lock()
+	serverTime := s.now()
+	s.m.Unlock()
+	return timestamp < serverTime+1000 && serverTime-timestamp <= recvWindow
+}
+
+// params returns the request's query and form body parameters. The form body
+// is parsed for every method since binance DELETE requests have one.
+func params(r *http.Request) url.Values {
+	values := r.URL.Query()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return values
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return values
+	}
+	for key, v := range form {
+		values[key] = append(values[key], v...)
+	}
+	return values
+}
+
+// writeJSON responds with v as json.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with a binance api error.
+func writeError(w http.ResponseWriter, status int, code int64, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(common.APIError{Code: code, Message: message})
+}
+
+// methodNotAllowed responds with a 405.
+func methodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, -1000, "method not allowed")
+}
+
+func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct{}{})
+}
+
+func (s *Server) serverTime(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	writeJSON(w, map[string]int64{"serverTime": s.now()})
+}
+
+func (s *Server) getExchangeInfo(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	info := s.exchangeInfo
+	info.ServerTime = s.now()
+	writeJSON(w, info)
+}
+
+func (s *Server) ticker24hr(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if symbol := r.URL.Query().Get("symbol"); symbol != "" {
+		ticker, ok := s.tickers[symbol]
+		if !ok {
+			writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+			return
+		}
+		writeJSON(w, ticker)
+		return
+	}
+	writeJSON(w, s.sortedTickers())
+}
+
+func (s *Server) tickerPrice(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if symbol := r.URL.Query().Get("symbol"); symbol != "" {
+		ticker, ok := s.tickers[symbol]
+		if !ok {
+			writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+			return
+		}
+		writeJSON(w, futures.SymbolPrice{Symbol: symbol, Price: ticker.LastPrice})
+		return
+	}
+	prices := []futures.SymbolPrice{}
+	for _, ticker := range s.sortedTickers() {
+		prices = append(prices, futures.SymbolPrice{Symbol: ticker.Symbol, Price: ticker.LastPrice})
+	}
+	writeJSON(w, prices)
+}
+
+// klineIntervals are the durations of the kline intervals the server
+// supports.
+var klineIntervals = map[string]time.Duration{
+	"1m":  time.Minute,
+	"3m":  3 * time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"30m": 30 * time.Minute,
+	"1h":  time.Hour,
+	"2h":  2 * time.Hour,
+	"4h":  4 * time.Hour,
+	"1d":  24 * time.Hour,
+}
+
+// klines responds with the symbol's last klines up to the current one, whose
+// prices are all the symbol's last price.
+func (s *Server) klines(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	query := r.URL.Query()
+	symbol := query.Get("symbol")
+	if _, ok := s.tickers[symbol]; !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	interval, ok := klineIntervals[query.Get("interval")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, -1120, "Invalid interval.")
+		return
+	}
+	limit := 500
+	if value := query.Get("limit"); value != "" {
+		limit, _ = strconv.Atoi(value)
+	}
+	if limit < 1 || limit > 1500 {
+		writeError(w, http.StatusBadRequest, -1130, "Data sent for parameter 'limit' is not valid.")
+		return
+	}
+
+	ms := interval.Milliseconds()
+	current := s.now() / ms * ms
+	price := format(s.lastPrice(symbol))
+	klines := make([][]interface{}, 0, limit)
+	for i := limit - 1; i >= 0; i-- {
+		openTime := current - int64(i)*ms
+		klines = append(klines, []interface{}{
+			openTime, price, price, price, price, "0", openTime + ms - 1, "0", 0, "0", "0", "0",
+		})
+	}
+	writeJSON(w, klines)
+}
+
+// premiumIndex responds with the symbol's mark price and funding rate, or
+// every symbol's if there's no symbol.
+func (s *Server) premiumIndex(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	symbol := r.URL.Query().Get("symbol")
+	if symbol == "" {
+		writeJSON(w, s.premiumIndexes())
+		return
+	}
+	if _, ok := s.tickers[symbol]; !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	for _, premium := range s.premiumIndexes() {
+		if premium.Symbol == symbol {
+			writeJSON(w, premium)
+			return
+		}
+	}
+}
+
+// premiumIndexes returns every symbol's mark price, which is its last price,
+// and funding rate. Must be called with s.m held.
+func (s *Server) premiumIndexes() []*futures.PremiumIndex {
+	now := s.now()
+	interval := fundingInterval.Milliseconds()
+	premiums := make([]*futures.PremiumIndex, 0, len(s.tickers))
+	for symbol := range s.tickers {
+		premiums = append(premiums, &futures.PremiumIndex{
+			Symbol:          symbol,
+			MarkPrice:       format(s.lastPrice(symbol)),
+			LastFundingRate: s.fundingRate(symbol),
+			NextFundingTime: (now/interval + 1) * interval,
+			Time:            now,
+		})
+	}
+	return premiums
+}
+
+// fundingRateHistory responds with the symbol's funding rates settled every
+// fundingInterval between startTime and endTime, oldest first and up to
+// limit. Without a startTime the last ones before endTime are returned. Every
+// rate is the symbol's current funding rate.
+func (s *Server) fundingRateHistory(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	query := r.URL.Query()
+	symbol := query.Get("symbol")
+	if _, ok := s.tickers[symbol]; !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		limit, _ = strconv.Atoi(value)
+	}
+	if limit < 1 || limit > 1000 {
+		writeError(w, http.StatusBadRequest, -1130, "Data sent for parameter 'limit' is not valid.")
+		return
+	}
+
+	interval := fundingInterval.Milliseconds()
+	end := s.now()
+	if value := query.Get("endTime"); value != "" {
+		endTime, _ := strconv.ParseInt(value, 10, 64)
+		if endTime < end {
+			end = endTime
+		}
+	}
+	last := end / interval * interval
+	first := last - int64(limit-1)*interval
+	if value := query.Get("startTime"); value != "" {
+		startTime, _ := strconv.ParseInt(value, 10, 64)
+		first = (startTime + interval - 1) / interval * interval
+		if max := first + int64(limit-1)*interval; last > max {
+			last = max
+		}
+	}
+
+	rate := s.fundingRate(symbol)
+	rates := make([]*futures.FundingRate, 0, limit)
+	for fundingTime := first; fundingTime <= last; fundingTime += interval {
+		rates = append(rates, &futures.FundingRate{
+			Symbol:      symbol,
+			FundingRate: rate,
+			FundingTime: fundingTime,
+			Time:        fundingTime,
+		})
+	}
+	writeJSON(w, rates)
+}
+
+// depthLevels is how many levels each side of a generated order book has
+const depthLevels = 20
+
+// depth responds with the symbol's order book snapshot, or one generated
+// with depthLevels levels of 1 contract each side of the last price, 0.01%
+// apart.
+func (s *Server) depth(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	query := r.URL.Query()
+	symbol := query.Get("symbol")
+	if _, ok := s.tickers[symbol]; !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	limit := 500
+	if value := query.Get("limit"); value != "" {
+		limit, _ = strconv.Atoi(value)
+	}
+
+	depth, ok := s.depths[symbol]
+	if !ok {
+		price := s.lastPrice(symbol)
+		depth = &futures.DepthResponse{LastUpdateID: s.now()}
+		for i := 1; i <= depthLevels; i++ {
+			step := price * 0.0001 * float64(i)
+			depth.Bids = append(depth.Bids, futures.Bid{Price: format(price - step), Quantity: "1"})
+			depth.Asks = append(depth.Asks, futures.Ask{Price: format(price + step), Quantity: "1"})
+		}
+	}
+
+	levels := func(levels []common.PriceLevel) [][2]string {
+		res := make([][2]string, 0, len(levels))
+		for i, level := range levels {
+			if i == limit {
+				break
+			}
+			res = append(res, [2]string{level.Price, level.Quantity})
+		}
+		return res
+	}
+	writeJSON(w, map[string]interface{}{
+		"lastUpdateId": depth.LastUpdateID,
+		"E":            s.now(),
+		"T":            s.now(),
+		"bids":         levels(depth.Bids),
+		"asks":         levels(depth.Asks),
+	})
+}
+
+// sortedTickers returns the tickers sorted by symbol. Must be called with s.m
+// held.
+func (s *Server) sortedTickers() []*futures.PriceChangeStats {
+	tickers := make([]*futures.PriceChangeStats, 0, len(s.tickers))
+	for _, ticker := range s.tickers {
+		tickers = append(tickers, ticker)
+	}
+	sort.Slice(tickers, func(i, j int) bool { return tickers[i].Symbol < tickers[j].Symbol })
+	return tickers
+}
+
+func (s *Server) account(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var unrealized, initialMargin, maintMargin float64
+	positions := []*futures.AccountPosition{}
+	for _, symbol := range s.exchangeInfo.Symbols {
+		leverage := s.leverage[symbol.Symbol]
+		for _, side := range s.positionSides() {
+			p, ok := s.positions[positionKey{symbol.Symbol, side}]
+			if !ok {
+				p = &Position{Symbol: symbol.Symbol, PositionSide: side}
+			}
+			notional := s.notional(p)
+			profit := s.unrealizedProfit(p)
+			initial := math.Abs(notional) / float64(leverage)
+			maint := math.Abs(notional) * maintMarginRatio
+			unrealized += profit
+			initialMargin += initial
+			maintMargin += maint
+
+			positions = append(positions, &futures.AccountPosition{
+				Isolated:              s.isolated[symbol.Symbol],
+				Leverage:              strconv.Itoa(leverage),
+				InitialMargin:         format(initial),
+				MaintMargin:           format(maint),
+				PositionInitialMargin: format(initial),
+				Symbol:                symbol.Symbol,
+				UnrealizedProfit:      format(profit),
+				EntryPrice:            format(p.EntryPrice),
+				MaxNotional:           format(s.brackets[len(s.brackets)-1].NotionalCap),
+				PositionSide:          side,
+				PositionAmt:           format(p.Amount),
+				Notional:              format(notional),
+				IsolatedWallet:        "0",
+				UpdateTime:            s.now(),
+			})
+		}
+	}
+
+	wallet := s.wallet["USDT"]
+	marginBalance := wallet + unrealized
+	writeJSON(w, futures.Account{
+		Assets: []*futures.AccountAsset{{
+			Asset:                 "USDT",
+			InitialMargin:         format(initialMargin),
+			MaintMargin:           format(maintMargin),
+			MarginBalance:         format(marginBalance),
+			MaxWithdrawAmount:     format(marginBalance - initialMargin),
+			PositionInitialMargin: format(initialMargin),
+			UnrealizedProfit:      format(unrealized),
+			WalletBalance:         format(wallet),
+		}},
+		CanDeposit:                 true,
+		CanTrade:                   true,
+		CanWithdraw:                true,
+		MaxWithdrawAmount:          format(marginBalance - initialMargin),
+		Positions:                  positions,
+		TotalInitialMargin:         format(initialMargin),
+		TotalMaintMargin:           format(maintMargin),
+		TotalMarginBalance:         format(marginBalance),
+		TotalPositionInitialMargin: format(initialMargin),
+		TotalUnrealizedProfit:      format(unrealized),
+		TotalWalletBalance:         format(wallet),
+		UpdateTime:                 s.now(),
+	})
+}
+
+func (s *Server) balance(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	unrealized := 0.0
+	for _, p := range s.positions {
+		unrealized += s.unrealizedProfit(p)
+	}
+
+	assets := make([]string, 0, len(s.wallet))
+	for asset := range s.wallet {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+
+	balances := []*futures.Balance{}
+	for _, asset := range assets {
+		wallet := s.wallet[asset]
+		profit := 0.0
+		if asset == "USDT" {
+			profit = unrealized
+		}
+		balances = append(balances, &futures.Balance{
+			AccountAlias:       "fake",
+			Asset:              asset,
+			Balance:            format(wallet),
+			CrossWalletBalance: format(wallet),
+			CrossUnPnl:         format(profit),
+			AvailableBalance:   format(wallet + profit),
+			MaxWithdrawAmount:  format(wallet + profit),
+		})
+	}
+	writeJSON(w, balances)
+}
+
+func (s *Server) order(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.createOrder(w, r)
+	case http.MethodGet:
+		s.getOrder(w, r)
+	case http.MethodDelete:
+		s.cancelOrder(w, r)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	o := &futures.Order{
+		Symbol:        p.Get("symbol"),
+		ClientOrderID: p.Get("newClientOrderId"),
+		Price:         p.Get("price"),
+		ReduceOnly:    p.Get("reduceOnly") == "true",
+		OrigQuantity:  p.Get("quantity"),
+		Status:        futures.OrderStatusTypeNew,
+		TimeInForce:   futures.TimeInForceType(p.Get("timeInForce")),
+		Type:          futures.OrderType(p.Get("type")),
+		Side:          futures.SideType(p.Get("side")),
+		StopPrice:     p.Get("stopPrice"),
+		WorkingType:   futures.WorkingTypeContractPrice,
+		AvgPrice:      "0",
+		OrigType:      p.Get("type"),
+		PositionSide:  futures.PositionSideType(p.Get("positionSide")),
+		ClosePosition: p.Get("closePosition") == "true",
+	}
+	if o.Price == "" {
+		o.Price = "0"
+	}
+	if o.StopPrice == "" {
+		o.StopPrice = "0"
+	}
+	if o.OrigQuantity == "" {
+		o.OrigQuantity = "0"
+	}
+	if o.PositionSide == "" {
+		o.PositionSide = futures.PositionSideTypeBoth
+	}
+
+	if failures := s.orderFailures[o.Type]; len(failures) > 0 {
+		s.orderFailures[o.Type] = failures[1:]
+		writeFailure(w, &failures[0])
+		return
+	}
+
+	if status, code, msg := s.validateOrder(o); code != 0 {
+		writeError(w, status, code, msg)
+		return
+	}
+
+	if o.ClientOrderID == "" {
+		o.ClientOrderID = fmt.Sprintf("fake%d", s.nextOrderID)
+	}
+	o.OrderID = s.nextOrderID
+	s.nextOrderID++
+	o.Time = s.now()
+	o.UpdateTime = o.Time
+	o.ExecutedQuantity = "0"
+	o.CumQuantity = "0"
+	o.CumQuote = "0"
+	s.orders = append(s.orders, o)
+	s.publishOrder(o, futures.OrderExecutionTypeNew, 0)
+
+	last := s.lastPrice(o.Symbol)
+	switch {
+	case o.Type == futures.OrderTypeMarket || o.Type == futures.OrderTypeLimit && triggered(o, last):
+		s.fill(o, last)
+	case o.TimeInForce == futures.TimeInForceTypeIOC || o.TimeInForce == futures.TimeInForceTypeFOK:
+		// LIMIT orders that can't be filled immediately aren't kept
+		o.Status = futures.OrderStatusTypeExpired
+		s.publishOrder(o, futures.OrderExecutionTypeExpired, 0)
+	}
+
+	writeJSON(w, createOrderResponse(o))
+}
+
+// validateOrder returns the binance error of an invalid order, or a 0 code if
+// it's valid. Must be called with s.m held.
+func (s *Server) validateOrder(o *futures.Order) (int, int64, string) {
+	if _, ok := s.symbol(o.Symbol); !ok {
+		return http.StatusBadRequest, -1121, "Invalid symbol."
+	}
+
+	for _, other := range s.orders {
+		if o.ClientOrderID != "" && other.ClientOrderID == o.ClientOrderID {
+			return http.StatusBadRequest, -4116, "ClientOrderId is duplicated."
+		}
+	}
+
+	if s.dualSide {
+		if o.PositionSide == futures.PositionSideTypeBoth {
+			return http.StatusBadRequest, -4061, "Order's position side does not match user's setting."
+		}
+		if o.ReduceOnly {
+			return http.StatusBadRequest, -1106, "Parameter 'reduceonly' sent when not required."
+		}
+	} else if o.PositionSide != futures.PositionSideTypeBoth {
+		return http.StatusBadRequest, -4061, "Order's position side does not match user's setting."
+	}
+
+	if !o.ClosePosition && parse(o.OrigQuantity) <= 0 {
+		return http.StatusBadRequest, -1102, "Mandatory parameter 'quantity' was not sent, was empty/null, or malformed."
+	}
+
+	switch o.Type {
+	case futures.OrderTypeLimit:
+		if parse(o.Price) <= 0 || o.TimeInForce == "" {
+			return http.StatusBadRequest, -1102, "Mandatory parameter 'price' was not sent, was empty/null, or malformed."
+		}
+	case futures.OrderTypeStopMarket, futures.OrderTypeTakeProfitMarket:
+		if parse(o.StopPrice) <= 0 {
+			return http.StatusBadRequest, -1102, "Mandatory parameter 'stopPrice' was not sent, was empty/null, or malformed."
+		}
+		if triggered(o, s.lastPrice(o.Symbol)) {
+			return http.StatusBadRequest, -2021, "Order would immediately trigger."
+		}
+	case futures.OrderTypeMarket:
+	default:
+		return http.StatusBadRequest, -1116, "Invalid orderType."
+	}
+
+	if o.ReduceOnly {
+		position, ok := s.positions[positionKey{o.Symbol, o.PositionSide}]
+		if !ok || position.Amount > 0 == (o.Side == futures.SideTypeBuy) {
+			return http.StatusBadRequest, -2022, "ReduceOnly Order is rejected."
+		}
+	}
+	return 0, 0, ""
+}
+
+// createOrderResponse returns the create order response of the order.
+func createOrderResponse(o *futures.Order) *futures.CreateOrderResponse {
+	return &futures.CreateOrderResponse{
+		Symbol:           o.Symbol,
+		OrderID:          o.OrderID,
+		ClientOrderID:    o.ClientOrderID,
+		Price:            o.Price,
+		OrigQuantity:     o.OrigQuantity,
+		ExecutedQuantity: o.ExecutedQuantity,
+		CumQuote:         o.CumQuote,
+		ReduceOnly:       o.ReduceOnly,
+		Status:           o.Status,
+		StopPrice:        o.StopPrice,
+		TimeInForce:      o.TimeInForce,
+		Type:             o.Type,
+		Side:             o.Side,
+		UpdateTime:       o.UpdateTime,
+		WorkingType:      o.WorkingType,
+		AvgPrice:         o.AvgPrice,
+		PositionSide:     o.PositionSide,
+		ClosePosition:    o.ClosePosition,
+	}
+}
+
+// cancelOrderResponse returns the cancel order response of the order.
+func cancelOrderResponse(o *futures.Order) *futures.CancelOrderResponse {
+	return &futures.CancelOrderResponse{
+		ClientOrderID:    o.ClientOrderID,
+		CumQuantity:      o.CumQuantity,
+		CumQuote:         o.CumQuote,
+		ExecutedQuantity: o.ExecutedQuantity,
+		OrderID:          o.OrderID,
+		OrigQuantity:     o.OrigQuantity,
+		Price:            o.Price,
+		ReduceOnly:       o.ReduceOnly,
+		Side:             o.Side,
+		Status:           o.Status,
+		StopPrice:        o.StopPrice,
+		Symbol:           o.Symbol,
+		TimeInForce:      o.TimeInForce,
+		Type:             o.Type,
+		UpdateTime:       o.UpdateTime,
+		WorkingType:      o.WorkingType,
+		PositionSide:     o.PositionSide,
+	}
+}
+
+// findOrder returns the symbol's order by its orderId, or by its
+// clientOrderId if orderID is empty. Must be called with s.m held.
+func (s *Server) findOrder(symbol, orderID, clientOrderID string) (*futures.Order, bool) {
+	for _, o := range s.orders {
+		if o.Symbol != symbol {
+			continue
+		}
+		if orderID != "" && strconv.FormatInt(o.OrderID, 10) == orderID ||
+			orderID == "" && clientOrderID != "" && o.ClientOrderID == clientOrderID {
+			return o, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+	o, ok := s.findOrder(p.Get("symbol"), p.Get("orderId"), p.Get("origClientOrderId"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, -2013, "Order does not exist.")
+		return
+	}
+	writeJSON(w, o)
+}
+
+func (s *Server) cancelOrder(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+	o, ok := s.findOrder(p.Get("symbol"), p.Get("orderId"), p.Get("origClientOrderId"))
+	if !ok || !isOpen(o) {
+		writeError(w, http.StatusBadRequest, -2011, "Unknown order sent.")
+		return
+	}
+	s.cancel(o)
+	writeJSON(w, cancelOrderResponse(o))
+}
+
+// cancel cancels the open order. Must be called with s.m held.
+func (s *Server) cancel(o *futures.Order) {
+	o.Status = futures.OrderStatusTypeCanceled
+	o.UpdateTime = s.now()
+	s.publishOrder(o, futures.OrderExecutionTypeCanceled, 0)
+}
+
+func (s *Server) openOrders(w http.ResponseWriter, r *http.Request) {
+	symbol := params(r).Get("symbol")
+	s.m.Lock()
+	defer s.m.Unlock()
+	orders := []*futures.Order{}
+	for _, o := range s.orders {
+		if isOpen(o) && (symbol == "" || o.Symbol == symbol) {
+			orders = append(orders, o)
+		}
+	}
+	writeJSON(w, orders)
+}
+
+func (s *Server) allOrders(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+	orders := []*futures.Order{}
+	for _, o := range s.orders {
+		if o.Symbol == p.Get("symbol") {
+			orders = append(orders, o)
+		}
+	}
+	if limit, _ := strconv.Atoi(p.Get("limit")); limit > 0 && len(orders) > limit {
+		orders = orders[len(orders)-limit:]
+	}
+	writeJSON(w, orders)
+}
+
+func (s *Server) cancelAllOpenOrders(w http.ResponseWriter, r *http.Request) {
+	symbol := params(r).Get("symbol")
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, o := range s.orders {
+		if o.Symbol == symbol && isOpen(o) {
+			s.cancel(o)
+		}
+	}
+	writeJSON(w, common.APIError{Code: 200, Message: "The operation of cancel all open order is done."})
+}
+
+func (s *Server) batchOrders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w)
+		return
+	}
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// the lists are formatted as [1,2,3] and [a b c]
+	trim := func(list string) []string {
+		return strings.FieldsFunc(strings.Trim(list, "[]"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+
+	res := []interface{}{}
+	cancel := func(orderID, clientOrderID string) {
+		o, ok := s.findOrder(p.Get("symbol"), orderID, clientOrderID)
+		if !ok || !isOpen(o) {
+			res = append(res, common.APIError{Code: -2011, Message: "Unknown order sent."})
+			return
+		}
+		s.cancel(o)
+		res = append(res, cancelOrderResponse(o))
+	}
+	for _, id := range trim(p.Get("orderIdList")) {
+		cancel(id, "")
+	}
+	for _, id := range trim(p.Get("origClientOrderIdList")) {
+		cancel("", id)
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) changeLeverage(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	symbol := p.Get("symbol")
+	if _, ok := s.symbol(symbol); !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	leverage, err := strconv.Atoi(p.Get("leverage"))
+	if err != nil || leverage < 1 || leverage > s.brackets[0].InitialLeverage {
+		writeError(w, http.StatusBadRequest, -4028, "Leverage is not valid")
+		return
+	}
+	s.leverage[symbol] = leverage
+
+	maxNotional := 0.0
+	for _, bracket := range s.brackets {
+		if leverage <= bracket.InitialLeverage {
+			maxNotional = bracket.NotionalCap
+		}
+	}
+	writeJSON(w, futures.SymbolLeverage{
+		Leverage:         leverage,
+		MaxNotionalValue: format(maxNotional),
+		Symbol:           symbol,
+	})
+}
+
+func (s *Server) changeMarginType(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	symbol := p.Get("symbol")
+	if _, ok := s.symbol(symbol); !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	isolated := p.Get("marginType") == string(futures.MarginTypeIsolated)
+	if s.isolated[symbol] == isolated {
+		writeError(w, http.StatusBadRequest, -4046, "No need to change margin type.")
+		return
+	}
+	s.isolated[symbol] = isolated
+	writeJSON(w, common.APIError{Code: 200, Message: "success"})
+}
+
+func (s *Server) positionMode(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, futures.PositionMode{DualSidePosition: s.dualSide})
+		return
+	}
+
+	dualSide := p.Get("dualSidePosition") == "true"
+	if dualSide == s.dualSide {
+		writeError(w, http.StatusBadRequest, -4059, "No need to change position side.")
+		return
+	}
+	open := len(s.positions) > 0
+	for _, o := range s.orders {
+		open = open || isOpen(o)
+	}
+	if open {
+		writeError(w, http.StatusBadRequest, -4068, "Position side cannot be changed if there exists position.")
+		return
+	}
+	s.dualSide = dualSide
+	writeJSON(w, common.APIError{Code: 200, Message: "success"})
+}
+
+func (s *Server) leverageBracket(w http.ResponseWriter, r *http.Request) {
+	symbol := params(r).Get("symbol")
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	brackets := []futures.LeverageBracket{}
+	for _, info := range s.exchangeInfo.Symbols {
+		if symbol == "" || info.Symbol == symbol {
+			brackets = append(brackets, futures.LeverageBracket{
+				Symbol:   info.Symbol,
+				Brackets: s.brackets,
+			})
+		}
+	}
+	writeJSON(w, brackets)
+}
+
+func (s *Server) positionRisk(w http.ResponseWriter, r *http.Request) {
+	symbol := params(r).Get("symbol")
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	risks := []*futures.PositionRisk{}
+	for _, info := range s.exchangeInfo.Symbols {
+		if symbol != "" && info.Symbol != symbol {
+			continue
+		}
+		leverage := s.leverage[info.Symbol]
+		for _, side := range s.positionSides() {
+			p, ok := s.positions[positionKey{info.Symbol, side}]
+			if !ok {
+				p = &Position{Symbol: info.Symbol, PositionSide: side}
+			}
+
+			marginType := "cross"
+			isolatedMargin := "0"
+			if s.isolated[info.Symbol] {
+				marginType = "isolated"
+				isolatedMargin = format(math.Abs(s.notional(p))/float64(leverage) + s.unrealizedProfit(p))
+			}
+
+			risks = append(risks, &futures.PositionRisk{
+				EntryPrice:       format(p.EntryPrice),
+				MarginType:       marginType,
+				IsAutoAddMargin:  "false",
+				IsolatedMargin:   isolatedMargin,
+				Leverage:         strconv.Itoa(leverage),
+				LiquidationPrice: format(s.liquidationPrice(p)),
+				MarkPrice:        format(s.lastPrice(info.Symbol)),
+				MaxNotionalValue: format(s.brackets[len(s.brackets)-1].NotionalCap),
+				PositionAmt:      format(p.Amount),
+				Symbol:           info.Symbol,
+				UnRealizedProfit: format(s.unrealizedProfit(p)),
+				PositionSide:     string(side),
+				Notional:         format(s.notional(p)),
+				IsolatedWallet:   "0",
+			})
+		}
+	}
+	writeJSON(w, risks)
+}
+
+func (s *Server) listenKey(w http.ResponseWriter, r *http.Request) {
+	p := params(r)
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		// binance returns the active listen key if there is one
+		for key := range s.listenKeys {
+			writeJSON(w, map[string]string{"listenKey": key})
+			return
+		}
+		s.nextKey++
+		key := fmt.Sprintf("fakeListenKey%d", s.nextKey)
+		s.listenKeys[key] = true
+		writeJSON(w, map[string]string{"listenKey": key})
+	case http.MethodPut:
+		if !s.listenKeys[p.Get("listenKey")] {
+			writeError(w, http.StatusBadRequest, -1125, "This listenKey does not exist.")
+			return
+		}
+		writeJSON(w, struct{}{})
+	case http.MethodDelete:
+		delete(s.listenKeys, p.Get("listenKey"))
+		writeJSON(w, struct{}{})
+	default:
+		methodNotAllowed(w)
+	}
+}
@@ -0,0 +1,297 @@
+package fakebinance
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// conn is a websocket connection to a stream.
+type conn struct {
+	m sync.Mutex
+	c *websocket.Conn
+}
+
+// send writes the message as json to the connection.
+func (c *conn) send(message interface{}) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.c.WriteJSON(message)
+}
+
+// serveStream serves the /ws/<stream> websocket streams, either !ticker@arr,
+// !markPrice@arr (@1s) or a user data stream's listen key.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	stream := strings.TrimPrefix(r.URL.Path, "/ws/")
+
+	s.m.Lock()
+	_, isListenKey := s.listenKeys[stream]
+	s.m.Unlock()
+	isMarkPrice := stream == "!markPrice@arr" || stream == "!markPrice@arr@1s"
+	if stream != "!ticker@arr" && !isMarkPrice && !isListenKey {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{c: ws}
+
+	s.m.Lock()
+	switch {
+	case isListenKey:
+		s.userConns[stream] = append(s.userConns[stream], c)
+	case isMarkPrice:
+		s.markPriceConns = append(s.markPriceConns, c)
+	default:
+		s.tickerConns = append(s.tickerConns, c)
+	}
+	s.m.Unlock()
+
+	switch {
+	case isMarkPrice:
+		s.PublishMarkPrices()
+	case !isListenKey:
+		s.PublishTickers()
+	}
+
+	// The connection is dropped once the client disconnects
+	go func() {
+		for {
+			_, _, err := ws.ReadMessage()
+			if err != nil {
+				s.drop(c)
+				return
+			}
+		}
+	}()
+}
+
+// drop closes the connection and removes it from its stream.
+func (s *Server) drop(c *conn) {
+	c.c.Close()
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.tickerConns = remove(s.tickerConns, c)
+	s.markPriceConns = remove(s.markPriceConns, c)
+	for key, conns := range s.userConns {
+		s.userConns[key] = remove(conns, c)
+	}
+}
+
+// remove returns conns without c.
+func remove(conns []*conn, c *conn) []*conn {
+	kept := conns[:0]
+	for _, other := range conns {
+		if other != c {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// DisconnectStreams closes every websocket connection, e.g. to test
+// reconnects.
+func (s *Server) DisconnectStreams() {
+	s.m.Lock()
+	conns := append(s.tickerConns, s.markPriceConns...)
+	for _, userConns := range s.userConns {
+		conns = append(conns, userConns...)
+	}
+	s.tickerConns = nil
+	s.markPriceConns = nil
+	s.userConns = make(map[string][]*conn)
+	s.m.Unlock()
+
+	for _, c := range conns {
+		c.c.Close()
+	}
+}
+
+// PublishTickers pushes every symbol's ticker to the !ticker@arr streams.
+func (s *Server) PublishTickers() {
+	s.m.Lock()
+	now := s.now()
+	event := futures.WsAllMarketTickerEvent{}
+	for _, ticker := range s.tickers {
+		event = append(event, &futures.WsMarketTickerEvent{
+			Event:              "24hrTicker",
+			Time:               now,
+			Symbol:             ticker.Symbol,
+			PriceChange:        ticker.PriceChange,
+			PriceChangePercent: ticker.PriceChangePercent,
+			WeightedAvgPrice:   ticker.WeightedAvgPrice,
+			ClosePrice:         ticker.LastPrice,
+			CloseQty:           ticker.LastQuantity,
+			OpenPrice:          ticker.OpenPrice,
+			HighPrice:          ticker.HighPrice,
+			LowPrice:           ticker.LowPrice,
+			BaseVolume:         ticker.Volume,
+			QuoteVolume:        ticker.QuoteVolume,
+			OpenTime:           ticker.OpenTime,
+			CloseTime:          ticker.CloseTime,
+		})
+	}
+	conns := append([]*conn{}, s.tickerConns...)
+	s.m.Unlock()
+
+	for _, c := range conns {
+		if err := c.send(event); err != nil {
+			s.drop(c)
+		}
+	}
+}
+
+// PublishMarkPrices pushes every symbol's mark price and funding rate to the
+// !markPrice@arr streams. The mark and index prices are the last price.
+func (s *Server) PublishMarkPrices() {
+	s.m.Lock()
+	now := s.now()
+	event := futures.WsAllMarkPriceEvent{}
+	for _, premium := range s.premiumIndexes() {
+		event = append(event, &futures.WsMarkPriceEvent{
+			Event:                "markPriceUpdate",
+			Time:                 now,
+			Symbol:               premium.Symbol,
+			MarkPrice:            premium.MarkPrice,
+			IndexPrice:           premium.MarkPrice,
+			EstimatedSettlePrice: premium.MarkPrice,
+			FundingRate:          premium.LastFundingRate,
+			NextFundingTime:      premium.NextFundingTime,
+		})
+	}
+	conns := append([]*conn{}, s.markPriceConns...)
+	s.m.Unlock()
+
+	for _, c := range conns {
+		if err := c.send(event); err != nil {
+			s.drop(c)
+		}
+	}
+}
+
+// PublishUserEvent pushes the event to every user data stream.
+func (s *Server) PublishUserEvent(event *futures.WsUserDataEvent) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.publishUserEvent(event)
+}
+
+// ExpireListenKey expires the listen key and pushes a listenKeyExpired event
+// to its streams.
+func (s *Server) ExpireListenKey(listenKey string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.listenKeys, listenKey)
+	event := &futures.WsUserDataEvent{
+		Event: futures.UserDataEventTypeListenKeyExpired,
+		Time:  s.now(),
+	}
+	for _, c := range s.userConns[listenKey] {
+		_ = c.send(event)
+	}
+}
+
+// ListenKeys returns the active listen keys.
+func (s *Server) ListenKeys() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	keys := []string{}
+	for key := range s.listenKeys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// publishUserEvent pushes the event to every user data stream. Must be called
+// with s.m held.
+func (s *Server) publishUserEvent(event *futures.WsUserDataEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, conns := range s.userConns {
+		for _, c := range conns {
+			_ = c.send(json.RawMessage(data))
+		}
+	}
+}
+
+// publishOrder pushes an ORDER_TRADE_UPDATE for the order, lastFilled is the
+// quantity filled by a trade. Must be called with s.m held.
+func (s *Server) publishOrder(o *futures.Order, execution futures.OrderExecutionType, lastFilled float64) {
+	now := s.now()
+	s.publishUserEvent(&futures.WsUserDataEvent{
+		Event:           futures.UserDataEventTypeOrderTradeUpdate,
+		Time:            now,
+		TransactionTime: now,
+		OrderTradeUpdate: futures.WsOrderTradeUpdate{
+			Symbol:               o.Symbol,
+			ClientOrderID:        o.ClientOrderID,
+			Side:                 o.Side,
+			Type:                 o.Type,
+			TimeInForce:          o.TimeInForce,
+			OriginalQty:          o.OrigQuantity,
+			OriginalPrice:        o.Price,
+			AveragePrice:         o.AvgPrice,
+			StopPrice:            o.StopPrice,
+			ExecutionType:        execution,
+			Status:               o.Status,
+			ID:                   o.OrderID,
+			LastFilledQty:        format(lastFilled),
+			AccumulatedFilledQty: o.ExecutedQuantity,
+			LastFilledPrice:      o.AvgPrice,
+			TradeTime:            now,
+			IsReduceOnly:         o.ReduceOnly,
+			OriginalType:         futures.OrderType(o.OrigType),
+			PositionSide:         o.PositionSide,
+			IsClosingPosition:    o.ClosePosition,
+		},
+	})
+}
+
+// publishAccount pushes an ACCOUNT_UPDATE for the position and the USDT
+// balance. Must be called with s.m held.
+func (s *Server) publishAccount(p *Position) {
+	now := s.now()
+	s.publishUserEvent(&futures.WsUserDataEvent{
+		Event:           futures.UserDataEventTypeAccountUpdate,
+		Time:            now,
+		TransactionTime: now,
+		AccountUpdate: futures.WsAccountUpdate{
+			Reason: futures.UserDataEventReasonTypeOrder,
+			Balances: []futures.WsBalance{{
+				Asset:              "USDT",
+				Balance:            format(s.wallet["USDT"]),
+				CrossWalletBalance: format(s.wallet["USDT"]),
+			}},
+			Positions: []futures.WsPosition{{
+				Symbol:        p.Symbol,
+				Side:          p.PositionSide,
+				Amount:        format(p.Amount),
+				MarginType:    s.marginType(p.Symbol),
+				EntryPrice:    format(p.EntryPrice),
+				MarkPrice:     format(s.lastPrice(p.Symbol)),
+				UnrealizedPnL: format(s.unrealizedProfit(p)),
+			}},
+		},
+	})
+}
+
+// marginType returns the symbol's margin type. Must be called with s.m held.
+func (s *Server) marginType(symbol string) futures.MarginType {
+	if s.isolated[symbol] {
+		return futures.MarginTypeIsolated
+	}
+	return futures.MarginTypeCrossed
+}
@@ -1,19 +1,44 @@
 package test
 
 import (
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 )
 
-// InitializeBinanceTests configures the binance tests
+// fake is the fake binance server the tests run against without an .env.test
+// file
+var fake *fakebinance.Server
+
+var (
+	// fakePrices are the initial prices of the fake binance server's symbols
+	fakePrices = map[string]float64{
+		"BTCUSDT": 60000,
+		"ETHUSDT": 4000,
+		"TRXUSDT": 0.1,
+		"DOTUSDT": 30,
+		"XRPUSDT": 1,
+	}
+
+	// fakeTickInterval is how often the fake binance server's prices move
+	fakeTickInterval = 1 * time.Second
+)
+
+// InitializeBinanceTests configures the binance tests. Without an .env.test
+// file the tests run against the fake binance server instead of the testnet.
 func InitializeBinanceTests() {
 	gin.SetMode(gin.TestMode)
 
 	err := godotenv.Load(".env.test")
 	if err != nil {
-		log.Fatal("Error loading .env.test file")
+		log.Warn("No .env.test file, running the tests against the fake binance server")
+		startFakeBinance()
 	}
 
 	futures.UseTestnet = true
@@ -24,10 +49,16 @@ func InitializeBinanceTests() {
 	log.SetFormatter(&log.JSONFormatter{})
 }
 
-// InitializeStoreTests configures the store tests
+// InitializeStoreTests configures the store tests. Without an .env.test file
+// the tests run against the fake binance server instead of the testnet.
 func IntializeStoreTests() {
 	gin.SetMode(gin.TestMode)
 
+	if _, err := os.Stat(".env.test"); err != nil {
+		log.Warn("No .env.test file, running the tests against the fake binance server")
+		startFakeBinance()
+	}
+
 	futures.UseTestnet = true
 
 	// Report the caller method in the logs
@@ -37,3 +68,39 @@ func IntializeStoreTests() {
 	// log.SetLevel(log.DebugLevel)
 	log.SetFormatter(&log.JSONFormatter{})
 }
+
+// FakeBinance returns the fake binance server the tests run against, or nil
+// if they run against the testnet.
+func FakeBinance() *fakebinance.Server {
+	return fake
+}
+
+// startFakeBinance starts the fake binance server and redirects the binance
+// requests and streams to it.
+func startFakeBinance() {
+	if fake != nil {
+		return
+	}
+	fake = fakebinance.New()
+	fake.Install()
+	setFakePrices(0)
+	os.Setenv("FUTURES_API_KEY", "fake")
+	os.Setenv("FUTURES_API_SECRET", "fake")
+
+	// The prices move up by 0.01% each tick, like a live market
+	go func() {
+		for tick := 1; ; tick++ {
+			time.Sleep(fakeTickInterval)
+			setFakePrices(tick)
+		}
+	}()
+}
+
+// setFakePrices sets the fake binance server's prices to their initial price
+// moved up by 0.01% per tick.
+func setFakePrices(tick int) {
+	for symbol, price := range fakePrices {
+		price *= 1 + 0.0001*float64(tick)
+		fake.SetPrice(symbol, strconv.FormatFloat(price, 'f', -1, 64))
+	}
+}
@@ -0,0 +1,444 @@
+// Package userstream manages the binance futures user data streams and
+// publishes their events to subscribers in the process.
+//
+// A single user data stream is opened per user, no matter how many
+// subscribers the user has. The stream's listen key is kept alive every 30
+// minutes, and the stream is reconnected with a new listen key if it's
+// disconnected, the listen key expires or it can't be kept alive. Subscribers
+// are notified once the stream is reconnected, since the events sent while it
+// was down are missed. The stream is closed once its last subscriber
+// unsubscribes.
+package userstream
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	streams  = make(map[string]*stream)
+	streamsM sync.Mutex
+
+	// keepaliveInterval is how often a listen key is kept alive. Binance
+	// expires listen keys after 60 minutes.
+	keepaliveInterval = 30 * time.Minute
+
+	// reconnectDelay is how long to wait before reconnecting a dropped stream.
+	reconnectDelay = 5 * time.Second
+
+	// requestTimeout is the timeout of the listen key requests.
+	requestTimeout = 1 * time.Minute
+
+	// eventBuffer is how many events are buffered per subscription before the
+	// stream blocks on it.
+	eventBuffer = 100
+)
+
+// eventReconnected is published to the subscribers once the stream is
+// reconnected. It isn't a binance event.
+const eventReconnected futures.UserDataEventType = "reconnected"
+
+// OrderTradeUpdate is an ORDER_TRADE_UPDATE event, sent when an order is
+// created, filled, cancelled or expired.
+type OrderTradeUpdate struct {
+	Time            int64                      `json:"time"`
+	TransactionTime int64                      `json:"transactionTime"`
+	Order           futures.WsOrderTradeUpdate `json:"order"`
+}
+
+// AccountUpdate is an ACCOUNT_UPDATE event, sent when a balance or position
+// changes.
+type AccountUpdate struct {
+	Time            int64                   `json:"time"`
+	TransactionTime int64                   `json:"transactionTime"`
+	Update          futures.WsAccountUpdate `json:"update"`
+}
+
+// MarginCall is a MARGIN_CALL event, sent when the user's positions are at
+// risk of liquidation.
+type MarginCall struct {
+	Time               int64                `json:"time"`
+	CrossWalletBalance string               `json:"crossWalletBalance"`
+	Positions          []futures.WsPosition `json:"positions"`
+}
+
+// AccountConfigUpdate is an ACCOUNT_CONFIG_UPDATE event, sent when a symbol's
+// leverage changes.
+type AccountConfigUpdate struct {
+	Time            int64                         `json:"time"`
+	TransactionTime int64                         `json:"transactionTime"`
+	Config          futures.WsAccountConfigUpdate `json:"config"`
+}
+
+// Handlers are a subscriber's event handlers. Handlers that aren't set don't
+// receive their events. A subscription's handlers are called one at a time,
+// in the order the events were received.
+type Handlers struct {
+	OrderTradeUpdate    func(*OrderTradeUpdate)
+	AccountUpdate       func(*AccountUpdate)
+	MarginCall          func(*MarginCall)
+	AccountConfigUpdate func(*AccountConfigUpdate)
+
+	// Reconnected is called once the stream is reconnected after it was
+	// disconnected, so the subscriber can reconcile the state it tracks with
+	// the events it missed, e.g. by querying its orders.
+	Reconnected func()
+}
+
+// Subscription is a subscriber to a user's data stream.
+type Subscription struct {
+	s        *stream
+	handlers Handlers
+	events   chan *futures.WsUserDataEvent
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Subscribe subscribes the handlers to the user's data stream, opening the
+// stream if the user doesn't have one yet. The stream is connected by the
+// time Subscribe returns, so no events after it returns are missed.
+//
+// The stream is connected without holding up the other users' subscriptions,
+// the user's concurrent subscriptions wait for it to connect.
+func Subscribe(user *models.User, handlers Handlers) (*Subscription, error) {
+	streamsM.Lock()
+	s, ok := streams[user.APIKey]
+	if !ok {
+		s = newStream(ratelimit.NewClient(user.APIKey, user.APISecret))
+		streams[user.APIKey] = s
+	}
+	sub := &Subscription{
+		s:        s,
+		handlers: handlers,
+		events:   make(chan *futures.WsUserDataEvent, eventBuffer),
+		done:     make(chan struct{}),
+	}
+	s.add(sub)
+	streamsM.Unlock()
+
+	if !ok {
+		s.connect()
+	}
+	<-s.ready
+	if s.err != nil {
+		sub.Unsubscribe()
+		return nil, s.err
+	}
+
+	go sub.dispatch()
+	return sub, nil
+}
+
+// Unsubscribe stops the subscription's handlers from receiving events, and
+// closes the user's data stream if it was the last subscriber.
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		streamsM.Lock()
+		defer streamsM.Unlock()
+
+		s := sub.s
+		if s.remove(sub) == 0 {
+			s.stop()
+			if streams[s.client.APIKey] == s {
+				delete(streams, s.client.APIKey)
+			}
+		}
+		close(sub.done)
+	})
+}
+
+// dispatch calls the subscription's handlers for its events until it's
+// unsubscribed.
+func (sub *Subscription) dispatch() {
+	for {
+		select {
+		case event := <-sub.events:
+			sub.handle(event)
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// handle calls the subscription's handler for the event's type.
+func (sub *Subscription) handle(event *futures.WsUserDataEvent) {
+	h := sub.handlers
+	switch event.Event {
+	case futures.UserDataEventTypeOrderTradeUpdate:
+		if h.OrderTradeUpdate != nil {
+			h.OrderTradeUpdate(&OrderTradeUpdate{
+				Time:            event.Time,
+				TransactionTime: event.TransactionTime,
+				Order:           event.OrderTradeUpdate,
+			})
+		}
+	case futures.UserDataEventTypeAccountUpdate:
+		if h.AccountUpdate != nil {
+			h.AccountUpdate(&AccountUpdate{
+				Time:            event.Time,
+				TransactionTime: event.TransactionTime,
+				Update:          event.AccountUpdate,
+			})
+		}
+	case futures.UserDataEventTypeMarginCall:
+		if h.MarginCall != nil {
+			h.MarginCall(&MarginCall{
+				Time:               event.Time,
+				CrossWalletBalance: event.CrossWalletBalance,
+				Positions:          event.MarginCallPositions,
+			})
+		}
+	case futures.UserDataEventTypeAccountConfigUpdate:
+		if h.AccountConfigUpdate != nil {
+			h.AccountConfigUpdate(&AccountConfigUpdate{
+				Time:            event.Time,
+				TransactionTime: event.TransactionTime,
+				Config:          event.AccountConfigUpdate,
+			})
+		}
+	case eventReconnected:
+		if h.Reconnected != nil {
+			h.Reconnected()
+		}
+	}
+}
+
+// stream is a user's data stream and its subscribers.
+type stream struct {
+	m         sync.Mutex
+	client    *futures.Client
+	subs      map[*Subscription]struct{}
+	listenKey string
+	stopC     chan struct{}
+	stopped   bool
+
+	// ready is closed once the stream's first connection attempt is done, err
+	// is why it failed
+	ready chan struct{}
+	err   error
+}
+
+// newStream returns a stream for the client's user without connecting it.
+func newStream(client *futures.Client) *stream {
+	return &stream{
+		client: client,
+		subs:   make(map[*Subscription]struct{}),
+		ready:  make(chan struct{}),
+	}
+}
+
+// connect connects the stream for the first time and marks it ready. A stream
+// that fails to connect is stopped and removed, so the next subscription
+// opens a new one.
+func (s *stream) connect() {
+	err := s.start()
+	if err != nil {
+		streamsM.Lock()
+		if streams[s.client.APIKey] == s {
+			delete(streams, s.client.APIKey)
+		}
+		streamsM.Unlock()
+
+		s.m.Lock()
+		s.stopped = true
+		s.m.Unlock()
+	}
+	s.err = err
+	close(s.ready)
+}
+
+// add adds the subscriber to the stream.
+func (s *stream) add(sub *Subscription) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.subs[sub] = struct{}{}
+}
+
+// remove removes the subscriber from the stream and returns how many
+// subscribers are left.
+func (s *stream) remove(sub *Subscription) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.subs, sub)
+	return len(s.subs)
+}
+
+// start starts a listen key, connects the stream and keeps the listen key
+// alive.
+func (s *stream) start() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	listenKey, err := startListenKey(ctx, s.client)
+	if err != nil {
+		return err
+	}
+
+	doneC, stopC, err := futures.WsUserDataServe(listenKey, s.publish, s.handleErr)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.stopped {
+		close(stopC)
+		return nil
+	}
+	s.listenKey = listenKey
+	s.stopC = stopC
+
+	go s.keepalive(listenKey, doneC)
+
+	log.Info("Connected user data stream")
+	return nil
+}
+
+// stop disconnects the stream and closes its listen key.
+func (s *stream) stop() {
+	s.m.Lock()
+	if s.stopped {
+		s.m.Unlock()
+		return
+	}
+	s.stopped = true
+	if s.stopC != nil {
+		close(s.stopC)
+	}
+	listenKey := s.listenKey
+	s.m.Unlock()
+	if listenKey == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err := closeListenKey(ctx, s.client, listenKey)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// disconnect disconnects the stream so it's reconnected with a new listen
+// key, unless it's stopped.
+func (s *stream) disconnect() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.stopped || s.stopC == nil {
+		return
+	}
+	close(s.stopC)
+	s.stopC = nil
+}
+
+// keepalive keeps the listen key alive until the stream is disconnected,
+// then reconnects it. A listen key that can't be kept alive, e.g. because it
+// already expired, disconnects the stream so it's reconnected with a new one.
+func (s *stream) keepalive(listenKey string, doneC chan struct{}) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			err := keepaliveListenKey(ctx, s.client, listenKey)
+			cancel()
+			if err != nil {
+				log.WithError(err).Warn("User data stream listen key could not be kept alive")
+				s.disconnect()
+			}
+		case <-doneC:
+			s.reconnect()
+			return
+		}
+	}
+}
+
+// reconnect restarts the stream until it succeeds or the stream is stopped,
+// then notifies the subscribers.
+func (s *stream) reconnect() {
+	for {
+		s.m.Lock()
+		stopped := s.stopped
+		s.m.Unlock()
+		if stopped {
+			return
+		}
+
+		log.Warn("User data stream disconnected, reconnecting")
+		time.Sleep(reconnectDelay)
+		err := s.start()
+		if err == nil {
+			s.publish(&futures.WsUserDataEvent{Event: eventReconnected})
+			return
+		}
+		log.Error(err)
+	}
+}
+
+// publish sends the event to every subscriber. An expired listen key
+// disconnects the stream so it's reconnected with a new one.
+func (s *stream) publish(event *futures.WsUserDataEvent) {
+	if event.Event == futures.UserDataEventTypeListenKeyExpired {
+		log.Warn("User data stream listen key expired")
+		s.disconnect()
+		return
+	}
+
+	s.m.Lock()
+	subs := make([]*Subscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.m.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.events <- event:
+		case <-sub.done:
+		}
+	}
+}
+
+func (s *stream) handleErr(err error) {
+	log.Error(err)
+}
+
+// startListenKey starts a new user data stream and returns its listen key.
+// The listen key is valid for 60 minutes unless it is kept alive.
+func startListenKey(ctx context.Context, client *futures.Client) (string, error) {
+	svc := client.NewStartUserStreamService()
+	return retry.Do(ctx, client, "StartUserStream", func(opts ...futures.RequestOption) (string, error) {
+		return svc.Do(ctx, opts...)
+	})
+}
+
+// keepaliveListenKey extends the validity of the listen key by 60 minutes.
+func keepaliveListenKey(ctx context.Context, client *futures.Client, listenKey string) error {
+	svc := client.NewKeepaliveUserStreamService().ListenKey(listenKey)
+	err := retry.DoErr(ctx, client, "KeepaliveUserStream", func(opts ...futures.RequestOption) error {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// closeListenKey closes the user data stream of the listen key.
+func closeListenKey(ctx context.Context, client *futures.Client, listenKey string) error {
+	svc := client.NewCloseUserStreamService().ListenKey(listenKey)
+	err := retry.DoErr(ctx, client, "CloseUserStream", func(opts ...futures.RequestOption) error {
+		return svc.Do(ctx, opts...)
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package userstream
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/test"
+	"github.com/bosdhill/golang-binance-service/libs/test/fakebinance"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	test.IntializeStoreTests()
+	reconnectDelay = 10 * time.Millisecond
+	keepaliveInterval = 50 * time.Millisecond
+}
+
+// fakeServer returns the fake binance server, skipping the test against the
+// testnet since its user data events can't be scripted.
+func fakeServer(t *testing.T) *fakebinance.Server {
+	fake := test.FakeBinance()
+	if fake == nil {
+		t.Skip("the testnet user data events can't be scripted")
+	}
+	return fake
+}
+
+// connected returns whether the user has an open stream.
+func connected(user *models.User) bool {
+	streamsM.Lock()
+	defer streamsM.Unlock()
+	_, ok := streams[user.APIKey]
+	return ok
+}
+
+func TestSubscribe(t *testing.T) {
+	fake := fakeServer(t)
+	user := &models.User{APIKey: "subscribe", APISecret: "secret"}
+	listenKeyRequests := fake.Requests("/fapi/v1/listenKey")
+
+	orders := make(chan *OrderTradeUpdate, 10)
+	accounts := make(chan *AccountUpdate, 10)
+	marginCalls := make(chan *MarginCall, 10)
+	configs := make(chan *AccountConfigUpdate, 10)
+
+	sub1, err := Subscribe(user, Handlers{
+		OrderTradeUpdate: func(e *OrderTradeUpdate) { orders <- e },
+		AccountUpdate:    func(e *AccountUpdate) { accounts <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub2, err := Subscribe(user, Handlers{
+		OrderTradeUpdate:    func(e *OrderTradeUpdate) { orders <- e },
+		MarginCall:          func(e *MarginCall) { marginCalls <- e },
+		AccountConfigUpdate: func(e *AccountConfigUpdate) { configs <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, listenKeyRequests+1, fake.Requests("/fapi/v1/listenKey"), "one stream per user")
+
+	fake.PublishUserEvent(&futures.WsUserDataEvent{
+		Event:            futures.UserDataEventTypeOrderTradeUpdate,
+		OrderTradeUpdate: futures.WsOrderTradeUpdate{ClientOrderID: "abc"},
+	})
+	fake.PublishUserEvent(&futures.WsUserDataEvent{
+		Event:         futures.UserDataEventTypeAccountUpdate,
+		AccountUpdate: futures.WsAccountUpdate{Reason: futures.UserDataEventReasonTypeOrder},
+	})
+	fake.PublishUserEvent(&futures.WsUserDataEvent{
+		Event:              futures.UserDataEventTypeMarginCall,
+		CrossWalletBalance: "100",
+	})
+	fake.PublishUserEvent(&futures.WsUserDataEvent{
+		Event:               futures.UserDataEventTypeAccountConfigUpdate,
+		AccountConfigUpdate: futures.WsAccountConfigUpdate{Symbol: "BTCUSDT", Leverage: 20},
+	})
+
+	// Both subscribers receive the order update
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-orders:
+			assert.Equal(t, "abc", e.Order.ClientOrderID)
+		case <-time.After(time.Second):
+			t.Fatal("order trade update not received")
+		}
+	}
+
+	select {
+	case e := <-accounts:
+		assert.Equal(t, futures.UserDataEventReasonTypeOrder, e.Update.Reason)
+	case <-time.After(time.Second):
+		t.Fatal("account update not received")
+	}
+
+	select {
+	case e := <-marginCalls:
+		assert.Equal(t, "100", e.CrossWalletBalance)
+	case <-time.After(time.Second):
+		t.Fatal("margin call not received")
+	}
+
+	select {
+	case e := <-configs:
+		assert.Equal(t, "BTCUSDT", e.Config.Symbol)
+		assert.Equal(t, int64(20), e.Config.Leverage)
+	case <-time.After(time.Second):
+		t.Fatal("account config update not received")
+	}
+
+	assert.Empty(t, orders, "unexpected order trade update")
+	assert.Empty(t, accounts, "unexpected account update")
+
+	// The stream is closed with its last subscriber
+	sub1.Unsubscribe()
+	assert.True(t, connected(user))
+	sub2.Unsubscribe()
+	assert.False(t, connected(user))
+	assert.Empty(t, fake.ListenKeys(), "listen key closed")
+}
+
+func TestSubscribeConcurrently(t *testing.T) {
+	fake := fakeServer(t)
+	user := &models.User{APIKey: "concurrent", APISecret: "secret"}
+	listenKeyRequests := fake.Requests("/fapi/v1/listenKey")
+
+	// The subscriptions made while the stream connects wait for it
+	var wg sync.WaitGroup
+	subs := make([]*Subscription, 5)
+	for i := range subs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			subs[i], err = Subscribe(user, Handlers{})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, listenKeyRequests+1, fake.Requests("/fapi/v1/listenKey"), "one stream per user")
+
+	for _, sub := range subs {
+		if sub != nil {
+			sub.Unsubscribe()
+		}
+	}
+	assert.False(t, connected(user))
+}
+
+func TestSubscribeFailed(t *testing.T) {
+	fake := fakeServer(t)
+	user := &models.User{APIKey: "failed", APISecret: "secret"}
+
+	fake.Fail("/fapi/v1/listenKey", fakebinance.Failure{Status: 401, Code: -2015, Message: "Invalid API-key, IP, or permissions for action."})
+	_, err := Subscribe(user, Handlers{})
+	assert.Error(t, err)
+	assert.False(t, connected(user), "failed stream removed")
+
+	sub, err := Subscribe(user, Handlers{})
+	if assert.NoError(t, err, "new stream opened") {
+		sub.Unsubscribe()
+	}
+}
+
+// reconnects subscribes to the user's stream and returns a channel receiving
+// its reconnects and one receiving its order trade updates.
+func reconnects(t *testing.T, user *models.User) (*Subscription, chan struct{}, chan *OrderTradeUpdate) {
+	reconnected := make(chan struct{}, 10)
+	orders := make(chan *OrderTradeUpdate, 10)
+	sub, err := Subscribe(user, Handlers{
+		OrderTradeUpdate: func(e *OrderTradeUpdate) { orders <- e },
+		Reconnected:      func() { reconnected <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub, reconnected, orders
+}
+
+// assertReconnected asserts the stream reconnected and receives events again.
+func assertReconnected(t *testing.T, fake *fakebinance.Server, reconnected chan struct{}, orders chan *OrderTradeUpdate) {
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscriber not notified of the reconnect")
+	}
+
+	fake.PublishUserEvent(&futures.WsUserDataEvent{
+		Event:            futures.UserDataEventTypeOrderTradeUpdate,
+		OrderTradeUpdate: futures.WsOrderTradeUpdate{ClientOrderID: "after"},
+	})
+	select {
+	case e := <-orders:
+		assert.Equal(t, "after", e.Order.ClientOrderID)
+	case <-time.After(time.Second):
+		t.Fatal("order trade update not received after the reconnect")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	fake := fakeServer(t)
+	sub, reconnected, orders := reconnects(t, &models.User{APIKey: "reconnect", APISecret: "secret"})
+	defer sub.Unsubscribe()
+
+	fake.DisconnectStreams()
+
+	assertReconnected(t, fake, reconnected, orders)
+}
+
+func TestListenKeyExpired(t *testing.T) {
+	fake := fakeServer(t)
+	sub, reconnected, orders := reconnects(t, &models.User{APIKey: "expired", APISecret: "secret"})
+	defer sub.Unsubscribe()
+
+	for _, key := range fake.ListenKeys() {
+		fake.ExpireListenKey(key)
+	}
+
+	assertReconnected(t, fake, reconnected, orders)
+	assert.NotEmpty(t, fake.ListenKeys(), "new listen key")
+}
+
+func TestKeepaliveFailed(t *testing.T) {
+	fake := fakeServer(t)
+	sub, reconnected, orders := reconnects(t, &models.User{APIKey: "keepalive", APISecret: "secret"})
+	defer sub.Unsubscribe()
+
+	// The listen key expired without the stream being told
+	fake.Fail("/fapi/v1/listenKey", fakebinance.Failure{Status: 400, Code: -1125, Message: "This listenKey does not exist."})
+
+	assertReconnected(t, fake, reconnected, orders)
+}
@@ -0,0 +1,344 @@
+// vault stores the users' binance futures api credentials encrypted at rest,
+// so requests reference a stored user with a bearer token instead of sending
+// the credentials.
+//
+// The credentials are encrypted with AES-256-GCM using the master key, with the
+// user's ID as additional data so they can't be swapped between users. Only
+// the SHA-256 hash of each user's bearer token is stored.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+)
+
+var nowFunc = time.Now
+
+// Registration is a stored user's ID and bearer token. The token is only
+// returned when the user is registered.
+type Registration struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+// record is a stored user.
+type record struct {
+	ID        string `json:"id"`
+	TokenHash string `json:"tokenHash"`
+
+	// APIKey and APISecret are encrypted and base64 encoded, prefixed by
+	// their nonce
+	APIKey    string `json:"apiKey"`
+	APISecret string `json:"apiSecret"`
+
+	Leverage   int                `json:"leverage,omitempty"`
+	MarginType futures.MarginType `json:"marginType,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	RotatedAt time.Time `json:"rotatedAt,omitempty"`
+}
+
+// Vault stores the users' credentials in a local file.
+type Vault struct {
+	path string
+	aead cipher.AEAD
+
+	m     sync.RWMutex
+	users map[string]*record
+}
+
+// ParseMasterKey returns the base64 encoded 32 byte master key.
+func ParseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key must be base64 encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// New returns a vault storing the users in the file at path, encrypted with
+// the 32 byte master key. The users already stored in the file are loaded.
+func New(path string, masterKey []byte) (*Vault, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vault{
+		path:  path,
+		aead:  aead,
+		users: make(map[string]*record),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &v.users)
+	if err != nil {
+		return nil, fmt.Errorf("could not read vault %s: %w", path, err)
+	}
+
+	// The credentials are decrypted once so a wrong master key fails now
+	// instead of on the users' requests
+	for _, r := range v.users {
+		_, err = v.open(r.ID, r.APIKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt vault %s, wrong master key: %w", path, err)
+		}
+		break
+	}
+	return v, nil
+}
+
+// Register stores the user's credentials and returns the user's new ID and
+// bearer token.
+func (v *Vault) Register(user *models.User) (*Registration, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	token := id + "." + secret
+
+	r := &record{
+		ID:         id,
+		TokenHash:  hash(token),
+		Leverage:   user.Leverage,
+		MarginType: user.MarginType,
+		CreatedAt:  nowFunc().UTC(),
+	}
+	err = v.seal(r, user.APIKey, user.APISecret)
+	if err != nil {
+		return nil, err
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.users[id] = r
+	err = v.save()
+	if err != nil {
+		delete(v.users, id)
+		return nil, err
+	}
+	return &Registration{ID: id, Token: token}, nil
+}
+
+// Authenticate returns the ID and credentials of the user the bearer token
+// was issued to.
+func (v *Vault) Authenticate(token string) (string, *models.User, error) {
+	id := strings.SplitN(token, ".", 2)[0]
+
+	v.m.RLock()
+	r, ok := v.users[id]
+	v.m.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(hash(token)), []byte(r.TokenHash)) != 1 {
+		return "", nil, errors.NewInvalidToken()
+	}
+
+	user, err := v.user(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, user, nil
+}
+
+// Get returns the stored user's credentials.
+func (v *Vault) Get(id string) (*models.User, error) {
+	v.m.RLock()
+	r, ok := v.users[id]
+	v.m.RUnlock()
+	if !ok {
+		return nil, errors.NewUnknownUser(id)
+	}
+	return v.user(r)
+}
+
+// Users returns the credentials of every stored user by ID.
+func (v *Vault) Users() (map[string]*models.User, error) {
+	v.m.RLock()
+	defer v.m.RUnlock()
+	users := make(map[string]*models.User, len(v.users))
+	for id, r := range v.users {
+		user, err := v.user(r)
+		if err != nil {
+			return nil, err
+		}
+		users[id] = user
+	}
+	return users, nil
+}
+
+// Rotate replaces the stored user's api key and secret. The user's bearer
+// token stays valid.
+func (v *Vault) Rotate(id, apiKey, apiSecret string) error {
+	v.m.Lock()
+	defer v.m.Unlock()
+	r, ok := v.users[id]
+	if !ok {
+		return errors.NewUnknownUser(id)
+	}
+
+	rotated := *r
+	rotated.RotatedAt = nowFunc().UTC()
+	err := v.seal(&rotated, apiKey, apiSecret)
+	if err != nil {
+		return err
+	}
+
+	v.users[id] = &rotated
+	err = v.save()
+	if err != nil {
+		v.users[id] = r
+		return err
+	}
+	return nil
+}
+
+// Delete removes the stored user, revoking its bearer token.
+func (v *Vault) Delete(id string) error {
+	v.m.Lock()
+	defer v.m.Unlock()
+	r, ok := v.users[id]
+	if !ok {
+		return errors.NewUnknownUser(id)
+	}
+
+	delete(v.users, id)
+	err := v.save()
+	if err != nil {
+		v.users[id] = r
+		return err
+	}
+	return nil
+}
+
+// user returns the record's decrypted credentials.
+func (v *Vault) user(r *record) (*models.User, error) {
+	apiKey, err := v.open(r.ID, r.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	apiSecret, err := v.open(r.ID, r.APISecret)
+	if err != nil {
+		return nil, err
+	}
+	return &models.User{
+		APIKey:     apiKey,
+		APISecret:  apiSecret,
+		Leverage:   r.Leverage,
+		MarginType: r.MarginType,
+	}, nil
+}
+
+// seal sets the record's encrypted api key and secret.
+func (v *Vault) seal(r *record, apiKey, apiSecret string) error {
+	var err error
+	r.APIKey, err = v.encrypt(r.ID, apiKey)
+	if err != nil {
+		return err
+	}
+	r.APISecret, err = v.encrypt(r.ID, apiSecret)
+	return err
+}
+
+// encrypt returns the plaintext encrypted for the user, prefixed by its
+// random nonce and base64 encoded.
+func (v *Vault) encrypt(id, plaintext string) (string, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := v.aead.Seal(nonce, nonce, []byte(plaintext), []byte(id))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open returns the decrypted ciphertext of the user.
+func (v *Vault) open(id, ciphertext string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < v.aead.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := sealed[:v.aead.NonceSize()], sealed[v.aead.NonceSize():]
+	plaintext, err := v.aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// save writes the users to the vault's file, replacing it so it's never
+// partially written. Must be called with v.m held.
+func (v *Vault) save() error {
+	data, err := json.MarshalIndent(v.users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(v.path), filepath.Base(v.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.path)
+}
+
+// hash returns the hex encoded SHA-256 hash of the token.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, hex encoded.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
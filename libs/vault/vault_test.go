@@ -0,0 +1,149 @@
+package vault
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var masterKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestVault returns a vault stored in a temporary directory.
+func newTestVault(t *testing.T) (*Vault, string) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	v, err := New(path, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, path
+}
+
+func TestRegisterAndAuthenticate(t *testing.T) {
+	v, path := newTestVault(t)
+	user := &models.User{
+		APIKey:     "apikey",
+		APISecret:  "apisecret",
+		Leverage:   5,
+		MarginType: futures.MarginTypeIsolated,
+	}
+
+	reg, err := v.Register(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(reg.Token, reg.ID+"."))
+
+	id, got, err := v.Authenticate(reg.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, reg.ID, id)
+	assert.Equal(t, user, got)
+
+	// The credentials and token aren't stored in plaintext
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "apikey")
+	assert.NotContains(t, string(data), "apisecret")
+	assert.NotContains(t, string(data), reg.Token)
+
+	_, _, err = v.Authenticate(reg.ID + ".wrong")
+	_, ok := errors.AsAuthError(err)
+	assert.True(t, ok, "invalid token")
+}
+
+func TestReload(t *testing.T) {
+	v, path := newTestVault(t)
+	reg, err := v.Register(&models.User{APIKey: "apikey", APISecret: "apisecret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := New(path, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := reloaded.Get(reg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "apikey", user.APIKey)
+
+	_, err = New(path, []byte("fedcba9876543210fedcba9876543210"))
+	assert.Error(t, err, "wrong master key")
+}
+
+func TestRotateAndDelete(t *testing.T) {
+	v, _ := newTestVault(t)
+	reg, err := v.Register(&models.User{APIKey: "apikey", APISecret: "apisecret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = v.Rotate(reg.ID, "newkey", "newsecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, user, err := v.Authenticate(reg.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "newkey", user.APIKey)
+	assert.Equal(t, "newsecret", user.APISecret)
+
+	err = v.Delete(reg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = v.Authenticate(reg.Token)
+	assert.Error(t, err, "token revoked")
+
+	err = v.Delete(reg.ID)
+	_, ok := errors.AsNotFoundError(err)
+	assert.True(t, ok, "unknown user")
+}
+
+func TestUsers(t *testing.T) {
+	v, _ := newTestVault(t)
+	users, err := v.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, users)
+
+	first, err := v.Register(&models.User{APIKey: "firstkey", APISecret: "firstsecret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := v.Register(&models.User{APIKey: "secondkey", APISecret: "secondsecret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err = v.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, users, 2)
+	assert.Equal(t, "firstkey", users[first.ID].APIKey)
+	assert.Equal(t, "secondsecret", users[second.ID].APISecret)
+}
+
+func TestParseMasterKey(t *testing.T) {
+	_, err := ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	assert.NoError(t, err)
+
+	_, err = ParseMasterKey("c2hvcnQ=")
+	assert.Error(t, err, "short key")
+
+	_, err = ParseMasterKey("")
+	assert.Error(t, err, "missing key")
+}
@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	binance "github.com/adshao/go-binance/v2"
 	"github.com/adshao/go-binance/v2/delivery"
 	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	binancewrapper "github.com/bosdhill/golang-binance-service/libs/binancewrapper"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
 	"github.com/bosdhill/golang-binance-service/libs/store/info"
+	"github.com/bosdhill/golang-binance-service/libs/store/klines"
+	"github.com/bosdhill/golang-binance-service/libs/store/markprice"
+	"github.com/bosdhill/golang-binance-service/libs/store/orderbook"
 	"github.com/bosdhill/golang-binance-service/libs/store/stats"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/bosdhill/golang-binance-service/middleware/auth"
 	v1 "github.com/bosdhill/golang-binance-service/routers/v1"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -20,15 +34,31 @@ type ServerCtx struct {
 	Port       string
 	UseTestnet bool
 	Debug      bool
+
+	// VaultPath is the file the users' encrypted credentials are stored in
+	VaultPath string
+
+	// VaultMasterKey is the key the users' credentials are encrypted with
+	VaultMasterKey []byte
+
+	// APITokens are the clients authenticating with a static api token
+	APITokens []auth.Client
+
+	// HMACKeys are the clients authenticating with signed requests
+	HMACKeys []auth.Client
 }
 
 var (
-	router      = gin.Default()
-	defaultPort = "4200"
+	router           = gin.Default()
+	defaultPort      = "4200"
+	defaultVaultPath = "vault.json"
+
+	// restoreTimeout is the timeout of restoring a user's bracket orders
+	restoreTimeout = 2 * time.Minute
 )
 
 func loadServerCtx() *ServerCtx {
-	s := &ServerCtx{defaultPort, false, false}
+	s := &ServerCtx{Port: defaultPort, VaultPath: defaultVaultPath}
 
 	err := godotenv.Load()
 	if err != nil {
@@ -56,19 +86,37 @@ func loadServerCtx() *ServerCtx {
 	futures.UseTestnet = useTestnet
 	delivery.UseTestnet = useTestnet
 
+	vaultPath := os.Getenv("VAULT_PATH")
+	if vaultPath != "" {
+		s.VaultPath = vaultPath
+	}
+
+	s.VaultMasterKey, err = vault.ParseMasterKey(os.Getenv("VAULT_MASTER_KEY"))
+	if err != nil {
+		log.Fatal("Error loading VAULT_MASTER_KEY: ", err)
+	}
+
+	s.APITokens, err = auth.ParseClients(os.Getenv("API_TOKENS"))
+	if err != nil {
+		log.Fatal("Error loading API_TOKENS: ", err)
+	}
+
+	s.HMACKeys, err = auth.ParseClients(os.Getenv("HMAC_KEYS"))
+	if err != nil {
+		log.Fatal("Error loading HMAC_KEYS: ", err)
+	}
+
 	log.WithFields(log.Fields{
 		"Port":       s.Port,
 		"UseTestnet": s.UseTestnet,
 		"Debug":      s.Debug,
+		"VaultPath":  s.VaultPath,
 	}).Info("Server configuration loaded")
 
 	return s
 }
 
 func init() {
-	version1 := router.Group("/v1")
-	v1.InitRoutes(version1)
-
 	// Report the caller method in the logs
 	log.SetReportCaller(true)
 
@@ -91,10 +139,79 @@ func main() {
 	}
 
 	// Create in memory store to maintain price stats
-	stats.NewStore()
+	prices := stats.NewStore()
 
 	// Create in memory store for exchange info
-	info.NewStore()
+	symbols := info.NewStore()
+
+	// Create in memory store for the requested symbols' order books, kept in
+	// sync by their diff depth streams
+	books := orderbook.NewStore()
+
+	// Create in memory store to maintain mark prices and funding rates
+	markPrices := markprice.NewStore()
+
+	// Signed requests are timestamped with the binance server time, which is
+	// synced periodically
+	serverClock := clock.NewClock()
+
+	// The controllers make the users' requests through binance clients using
+	// the in memory stores and the server clock
+	exchange := binancewrapper.NewExchangeFactory(prices, symbols, books, markPrices, serverClock)
+
+	// The market streams are fanned out to the clients from one binance
+	// stream per channel
+	hub := marketstream.BinanceHub()
+
+	// Create in memory store for the requested symbols' klines, kept up to
+	// date by the hub's kline streams
+	candles := klines.NewStore(hub)
+
+	// Every binance request is made through the shared rate limiter
+	limiter := ratelimit.NewLimiter()
+
+	// The users' credentials are stored encrypted in the vault
+	credentials, err := vault.New(s.VaultPath, s.VaultMasterKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Brackets are only tracked in memory, so the vault users' brackets are
+	// restored from their orders
+	go restoreBrackets(exchange, credentials)
+
+	// Each route requires its clients to be authenticated with a scope
+	authenticator := auth.New(s.APITokens, s.HMACKeys)
+
+	// Every error response has the same body with the request's ID
+	router.Use(middleware.Errors())
+	router.NoRoute(func(c *gin.Context) {
+		middleware.Error(c, errors.NewUnknownRoute(c.Request.URL.Path))
+	})
+
+	version1 := router.Group("/v1")
+	// The service is ready while the stores' market data is fresh
+	stores := map[string]store.HealthSource{"stats": prices, "markprice": markPrices}
+
+	v1.InitRoutes(version1, authenticator, exchange, limiter, serverClock, credentials, prices, symbols, candles, markPrices, hub, stores)
 
 	router.Run(fmt.Sprintf(":%v", s.Port))
 }
+
+// restoreBrackets restores the bracket orders of every user stored in the
+// vault.
+func restoreBrackets(exchange binancewrapper.ExchangeFactory, credentials *vault.Vault) {
+	users, err := credentials.Users()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for id, user := range users {
+		ctx, cancel := context.WithTimeout(context.Background(), restoreTimeout)
+		err := exchange(user).RestoreBracketOrders(ctx)
+		cancel()
+		if err != nil {
+			log.WithField("User", id).Error(err)
+		}
+	}
+}
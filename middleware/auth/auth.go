@@ -0,0 +1,337 @@
+// auth authenticates the service's clients and authorizes their requests by
+// scope.
+//
+// Clients authenticate either with a static api token:
+//
+//	X-API-Token: <token>
+//
+// or by signing each request with their HMAC key:
+//
+//	X-API-Key: <key id>
+//	X-API-Timestamp: <unix time in ms>
+//	X-API-Nonce: <unique string>
+//	X-API-Signature: hex(HMAC-SHA256(secret, timestamp + "\n" + nonce + "\n" + method + "\n" + request URI + "\n" + body))
+//
+// Signed requests are rejected if their timestamp is more than the window
+// away from the local time, or their nonce was already used while their
+// timestamp is within the window, so they can't be replayed.
+package auth
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	nowFunc = time.Now
+
+	// defaultWindow is how far a signed request's timestamp can be from the
+	// local time
+	defaultWindow = 30 * time.Second
+)
+
+const (
+	tokenHeader     = "X-API-Token"
+	keyHeader       = "X-API-Key"
+	timestampHeader = "X-API-Timestamp"
+	nonceHeader     = "X-API-Nonce"
+	signatureHeader = "X-API-Signature"
+
+	// clientKey is the context key of the authenticated client's name
+	clientKey = "client"
+)
+
+// Scope is what a client is allowed to do. Each scope includes the scopes
+// below it: admin includes trade, which includes read.
+type Scope string
+
+const (
+	// ScopeRead allows reading balances, accounts, orders and positions
+	ScopeRead Scope = "read"
+
+	// ScopeTrade allows creating and cancelling orders, closing positions and
+	// changing the position mode
+	ScopeTrade Scope = "trade"
+
+	// ScopeAdmin allows managing the stored users and reading the metrics
+	ScopeAdmin Scope = "admin"
+)
+
+// level returns the scope's rank, 0 if it isn't a known scope.
+func (s Scope) level() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeTrade:
+		return 2
+	case ScopeAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Client is a client of the service with its token or HMAC secret and its
+// scopes.
+type Client struct {
+	Name   string
+	Secret string
+	Scopes []Scope
+}
+
+// allows returns whether the client's scopes include the scope.
+func (c *Client) allows(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s.level() >= scope.level() {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseClients parses a comma separated list of clients formatted as
+// name:secret:scope|scope, e.g. "bot:s3cr3t:read|trade,ops:0p5:admin".
+func ParseClients(s string) ([]Client, error) {
+	var clients []Client
+	for i, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid client %d, must be name:secret:scopes", i+1)
+		}
+
+		client := Client{Name: parts[0], Secret: parts[1]}
+		for _, scope := range strings.Split(parts[2], "|") {
+			if Scope(scope).level() == 0 {
+				return nil, fmt.Errorf("invalid scope %q of client %s, must be read, trade or admin", scope, parts[0])
+			}
+			client.Scopes = append(client.Scopes, Scope(scope))
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// Authenticator authenticates the requests of the clients with tokens and
+// HMAC keys.
+type Authenticator struct {
+	// tokens are the clients with api tokens by the SHA-256 hash of their
+	// token, so they're not looked up by the token itself
+	tokens map[string]*Client
+
+	// keys are the clients with HMAC keys by their key id, which is their name
+	keys map[string]*Client
+
+	// window is how far a signed request's timestamp can be from the local
+	// time. Its nonce is kept until its timestamp is outside of the window.
+	window time.Duration
+
+	// audit logs the denied requests
+	audit *log.Logger
+
+	m sync.Mutex
+
+	// nonces are the used nonces by their expiry, expiries orders them so the
+	// expired ones are forgotten without scanning all of them
+	nonces   map[string]time.Time
+	expiries nonceHeap
+}
+
+// usedNonce is a used nonce and when it expires.
+type usedNonce struct {
+	nonce  string
+	expiry time.Time
+}
+
+// nonceHeap is a min-heap of the used nonces by their expiry.
+type nonceHeap []usedNonce
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expiry.Before(h[j].expiry) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(usedNonce)) }
+
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// New returns an authenticator for the clients with api tokens and the
+// clients with HMAC keys. Requests are denied if there aren't any clients.
+func New(tokens []Client, keys []Client) *Authenticator {
+	a := &Authenticator{
+		tokens: make(map[string]*Client),
+		keys:   make(map[string]*Client),
+		window: defaultWindow,
+		audit:  log.StandardLogger(),
+		nonces: make(map[string]time.Time),
+	}
+	for i := range tokens {
+		a.tokens[hash(tokens[i].Secret)] = &tokens[i]
+	}
+	for i := range keys {
+		a.keys[keys[i].Name] = &keys[i]
+	}
+	if len(a.tokens) == 0 && len(a.keys) == 0 {
+		log.Warn("No api tokens or HMAC keys configured, every request requiring a scope is denied")
+	}
+	return a
+}
+
+// Require authenticates the request's client and aborts the request unless
+// the client is allowed the scope. Denied requests are audit logged.
+func (a *Authenticator) Require(scope Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := a.authenticate(c)
+		if err != nil {
+			// The key id of signed requests is logged, not their client since
+			// they aren't authenticated
+			a.deny(c, c.GetHeader(keyHeader), scope, &errors.AuthError{Reason: err.Error()})
+			return
+		}
+		if !client.allows(scope) {
+			a.deny(c, client.Name, scope, &errors.AuthError{Reason: "scope not allowed", Forbidden: true})
+			return
+		}
+
+		c.Set(clientKey, client.Name)
+		c.Next()
+	}
+}
+
+// ClientName returns the name of the client the request was authenticated
+// as, if any.
+func ClientName(c *gin.Context) string {
+	return c.GetString(clientKey)
+}
+
+// authenticate returns the client the request is authenticated as.
+func (a *Authenticator) authenticate(c *gin.Context) (*Client, error) {
+	if token := c.GetHeader(tokenHeader); token != "" {
+		client, ok := a.tokens[hash(token)]
+		if !ok {
+			return nil, fmt.Errorf("invalid api token")
+		}
+		return client, nil
+	}
+	if c.GetHeader(keyHeader) != "" {
+		return a.verify(c)
+	}
+	return nil, fmt.Errorf("api token or signature required")
+}
+
+// verify returns the client the request is signed by, checking its
+// timestamp, nonce and signature.
+func (a *Authenticator) verify(c *gin.Context) (*Client, error) {
+	client, ok := a.keys[c.GetHeader(keyHeader)]
+	if !ok {
+		return nil, fmt.Errorf("invalid api key")
+	}
+
+	timestamp := c.GetHeader(timestampHeader)
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+	now := nowFunc()
+	signedAt := time.UnixMilli(ms)
+	skew := now.Sub(signedAt)
+	if skew > a.window || skew < -a.window {
+		return nil, fmt.Errorf("timestamp outside of the %v window", a.window)
+	}
+
+	nonce := c.GetHeader(nonceHeader)
+	if nonce == "" {
+		return nil, fmt.Errorf("nonce required")
+	}
+
+	// The body is restored after it's read so the handlers can bind it
+	var body []byte
+	if c.Request.Body != nil {
+		body, err = ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := Sign(client.Secret, timestamp, nonce, c.Request.Method, c.Request.URL.RequestURI(), body)
+	signature, err := hex.DecodeString(c.GetHeader(signatureHeader))
+	if err != nil || !hmac.Equal(signature, expected) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	// The nonce is only used up by correctly signed requests, otherwise
+	// anyone could use up the client's nonces. It's kept for as long as the
+	// request's timestamp is accepted.
+	if !a.useNonce(client.Name+":"+nonce, signedAt.Add(a.window), now) {
+		return nil, fmt.Errorf("nonce already used")
+	}
+	return client, nil
+}
+
+// useNonce returns whether the nonce isn't already used, and records it until
+// its expiry. The expired nonces are forgotten.
+func (a *Authenticator) useNonce(nonce string, expiry, now time.Time) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	for len(a.expiries) > 0 && a.expiries[0].expiry.Before(now) {
+		expired := heap.Pop(&a.expiries).(usedNonce)
+		delete(a.nonces, expired.nonce)
+	}
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+	a.nonces[nonce] = expiry
+	heap.Push(&a.expiries, usedNonce{nonce: nonce, expiry: expiry})
+	return true
+}
+
+// deny aborts the request with the error and audit logs it.
+func (a *Authenticator) deny(c *gin.Context, client string, scope Scope, err *errors.AuthError) {
+	a.audit.WithFields(log.Fields{
+		"Audit":     true,
+		"Client":    client,
+		"Scope":     scope,
+		"Method":    c.Request.Method,
+		"Path":      c.Request.URL.Path,
+		"RemoteIP":  c.ClientIP(),
+		"Status":    err.Status(),
+		"Reason":    err.Reason,
+		"RequestID": middleware.RequestID(c),
+	}).Warn("Denied request")
+
+	middleware.Error(c, err)
+}
+
+// Sign returns the HMAC-SHA256 signature of the request with the secret.
+func Sign(secret, timestamp, nonce, method, requestURI string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + method + "\n" + requestURI + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// hash returns the hex encoded SHA-256 hash of the token.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRouter returns a router with a read and a trade route, and the buffer
+// the denied requests are audit logged to.
+func newTestRouter(t *testing.T) (*gin.Engine, *Authenticator, *bytes.Buffer) {
+	tokens, err := ParseClients("reader:readtoken:read,trader:tradetoken:trade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseClients("bot:botsecret:read|trade")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(tokens, keys)
+	var audit bytes.Buffer
+	a.audit = &log.Logger{Out: &audit, Formatter: &log.JSONFormatter{}, Level: log.InfoLevel}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.Errors())
+	ok := func(c *gin.Context) {
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = ioutil.ReadAll(c.Request.Body)
+		}
+		c.JSON(http.StatusOK, gin.H{"client": ClientName(c), "body": string(body)})
+	}
+	r.GET("/read", a.Require(ScopeRead), ok)
+	r.POST("/trade", a.Require(ScopeTrade), ok)
+	return r, a, &audit
+}
+
+// signedRequest returns a request signed with the HMAC key.
+func signedRequest(t *testing.T, method, uri, key, secret, nonce string, timestamp time.Time, body string) *http.Request {
+	req, err := http.NewRequest(method, uri, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := strconv.FormatInt(timestamp.UnixMilli(), 10)
+	req.Header.Set(keyHeader, key)
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(nonceHeader, nonce)
+	req.Header.Set(signatureHeader, hex.EncodeToString(Sign(secret, ts, nonce, method, uri, []byte(body))))
+	return req
+}
+
+func serve(r *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTokenScopes(t *testing.T) {
+	r, _, audit := newTestRouter(t)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		token        string
+		expectedCode int
+	}{
+		{name: "read with read token", method: "GET", path: "/read", token: "readtoken", expectedCode: http.StatusOK},
+		{name: "trade with read token", method: "POST", path: "/trade", token: "readtoken", expectedCode: http.StatusForbidden},
+		{name: "read with trade token", method: "GET", path: "/read", token: "tradetoken", expectedCode: http.StatusOK},
+		{name: "trade with trade token", method: "POST", path: "/trade", token: "tradetoken", expectedCode: http.StatusOK},
+		{name: "invalid token", method: "GET", path: "/read", token: "wrong", expectedCode: http.StatusUnauthorized},
+		{name: "no token", method: "GET", path: "/read", expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set(tokenHeader, tc.token)
+		}
+		w := serve(r, req)
+		assert.Equal(t, tc.expectedCode, w.Code, tc.name)
+	}
+
+	// Each denied request is audit logged
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var entry map[string]interface{}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "reader", entries[0]["Client"])
+	assert.Equal(t, "trade", entries[0]["Scope"])
+	assert.Equal(t, "/trade", entries[0]["Path"])
+	assert.Equal(t, true, entries[0]["Audit"])
+	assert.NotContains(t, audit.String(), "wrong", "token logged")
+}
+
+func TestSignedRequests(t *testing.T) {
+	r, a, _ := newTestRouter(t)
+	now := time.Now()
+
+	w := serve(r, signedRequest(t, "POST", "/trade?symbol=BTCUSDT", "bot", "botsecret", "n1", now, `{"side":"BUY"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "signed request")
+	assert.Contains(t, w.Body.String(), `"client":"bot"`)
+	assert.Contains(t, w.Body.String(), `\"side\":\"BUY\"`, "body restored")
+
+	w = serve(r, signedRequest(t, "POST", "/trade?symbol=BTCUSDT", "bot", "botsecret", "n1", now, `{"side":"BUY"}`))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "replayed nonce")
+
+	w = serve(r, signedRequest(t, "POST", "/trade", "bot", "botsecret", "n2", now.Add(-2*a.window), ""))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "stale timestamp")
+
+	w = serve(r, signedRequest(t, "POST", "/trade", "bot", "wrongsecret", "n3", now, ""))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "wrong secret")
+
+	// The body can't be changed without invalidating the signature
+	req := signedRequest(t, "POST", "/trade", "bot", "botsecret", "n4", now, `{"side":"BUY"}`)
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"side":"SELL"}`))
+	w = serve(r, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "tampered body")
+
+	// The nonce wasn't used up by the tampered request
+	w = serve(r, signedRequest(t, "POST", "/trade", "bot", "botsecret", "n4", now, `{"side":"BUY"}`))
+	assert.Equal(t, http.StatusOK, w.Code, "nonce of a rejected request")
+}
+
+func TestNonceReplay(t *testing.T) {
+	r, a, _ := newTestRouter(t)
+	now := time.Now()
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	// The request is signed ahead of the local time, so its timestamp is
+	// accepted for longer than the window after it's first used
+	signedAt := now.Add(a.window / 2)
+	w := serve(r, signedRequest(t, "POST", "/trade", "bot", "botsecret", "n1", signedAt, ""))
+	assert.Equal(t, http.StatusOK, w.Code, "signed request")
+
+	now = now.Add(a.window + time.Second)
+	w = serve(r, signedRequest(t, "POST", "/trade", "bot", "botsecret", "n1", signedAt, ""))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "replayed within the timestamp's window")
+	assert.Len(t, a.nonces, 1)
+
+	// The nonce is forgotten once its timestamp is outside of the window
+	now = signedAt.Add(a.window + time.Second)
+	w = serve(r, signedRequest(t, "POST", "/trade", "bot", "botsecret", "n2", now, ""))
+	assert.Equal(t, http.StatusOK, w.Code, "signed request")
+	assert.Len(t, a.nonces, 1, "expired nonce forgotten")
+	assert.Len(t, a.expiries, 1)
+
+	w = serve(r, signedRequest(t, "POST", "/trade", "bot", "botsecret", "n1", signedAt, ""))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "stale timestamp")
+}
+
+func TestParseClients(t *testing.T) {
+	clients, err := ParseClients("bot:s3cr3t:read|trade, ops:0p5:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Client{
+		{Name: "bot", Secret: "s3cr3t", Scopes: []Scope{ScopeRead, ScopeTrade}},
+		{Name: "ops", Secret: "0p5", Scopes: []Scope{ScopeAdmin}},
+	}, clients)
+
+	_, err = ParseClients("bot:s3cr3t:write")
+	assert.Error(t, err, "unknown scope")
+
+	_, err = ParseClients("s3cr3t")
+	assert.Error(t, err, "missing scopes")
+	assert.NotContains(t, err.Error(), "s3cr3t", "secret in error")
+
+	clients, err = ParseClients("")
+	assert.NoError(t, err)
+	assert.Empty(t, clients)
+}
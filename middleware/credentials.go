@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// userIDKey and userKey are the context keys of the stored user
+	// authenticated by the request's bearer token
+	userIDKey = "userID"
+	userKey   = "user"
+)
+
+// Credentials authenticates the requests with an Authorization: Bearer token
+// as a user stored in the vault, see StoredUser. Requests without a bearer
+// token aren't authenticated, their handlers read the credentials from the
+// body instead.
+func Credentials(v *vault.Vault) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		id, user, err := v.Authenticate(token)
+		if err != nil {
+			Error(c, err)
+			return
+		}
+
+		c.Set(userIDKey, id)
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// StoredUser returns the ID and credentials of the stored user the request is
+// authenticated as, if it has a bearer token.
+func StoredUser(c *gin.Context) (string, *models.User, bool) {
+	user, ok := c.Get(userKey)
+	if !ok {
+		return "", nil, false
+	}
+	return c.GetString(userIDKey), user.(*models.User), true
+}
+
+// RequireStoredUser returns the ID and credentials of the stored user the
+// request is authenticated as, or an error if it doesn't have a bearer token.
+func RequireStoredUser(c *gin.Context) (string, *models.User, error) {
+	id, user, ok := StoredUser(c)
+	if !ok {
+		return "", nil, errors.NewTokenRequired()
+	}
+	return id, user, nil
+}
+
+// bearerToken returns the token of the request's Authorization header.
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(header, "Bearer "), true
+}
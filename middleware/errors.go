@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"strconv"
+
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// requestIDKey is the context key of the request's ID
+	requestIDKey = "requestID"
+
+	// maxRequestIDLength is the longest request ID a client can set
+	maxRequestIDLength = 64
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	// Error is the error message
+	Error string `json:"error"`
+
+	// Code is the stable code of the kind of error
+	Code errors.Code `json:"code"`
+
+	// RequestID is the ID of the request, which is also in the X-Request-ID
+	// header and the logs
+	RequestID string `json:"requestId"`
+
+	// Details is the error itself, e.g. the invalid fields or the binance
+	// error code
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Errors sets the request's ID, from its X-Request-ID header if it has one,
+// and responds with the error recorded by the handlers with Error, if any.
+// The error's HTTP status and code are those of its errors.ServiceError.
+func Errors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength || !printable(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		render(c, c.Errors.Last().Err)
+	}
+}
+
+// Error records the error to be responded with by Errors and aborts the
+// request.
+func Error(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// RequestID returns the request's ID, set by Errors.
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// NewErrorResponse returns the error response of the request's error, e.g.
+// for an error sent over a stream instead of as the response.
+func NewErrorResponse(err error, requestID string) ErrorResponse {
+	serviceErr := errors.AsServiceError(err)
+	res := ErrorResponse{
+		Error:     serviceErr.Error(),
+		Code:      serviceErr.ErrorCode(),
+		RequestID: requestID,
+	}
+	switch serviceErr.(type) {
+	case *errors.TimeoutError, *errors.InternalError:
+		// These only wrap the error, which isn't exposed
+	default:
+		res.Details = serviceErr
+	}
+	return res
+}
+
+// render responds with the error and logs it.
+func render(c *gin.Context, err error) {
+	status := errors.AsServiceError(err).Status()
+	res := NewErrorResponse(err, RequestID(c))
+
+	if rateLimitErr, ok := errors.AsRateLimitError(err); ok {
+		retryAfter := math.Ceil(rateLimitErr.RetryAfter.Seconds())
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter)))
+	}
+
+	c.JSON(status, res)
+
+	entry := log.WithFields(log.Fields{
+		"RequestID": res.RequestID,
+		"Path":      c.FullPath(),
+		"Status":    status,
+		"Code":      res.Code,
+	})
+	if status >= 500 {
+		entry.Error(err)
+	} else {
+		entry.Warn(err)
+	}
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Error(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// printable returns whether s only has printable ASCII characters, so a
+// client's request ID can't inject anything into the logs.
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveError returns the response to a request whose handler fails with err.
+func serveError(t *testing.T, err error, requestID string) (*httptest.ResponseRecorder, ErrorResponse) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Errors())
+	r.GET("/fail", func(c *gin.Context) {
+		Error(c, err)
+	})
+
+	req, _ := http.NewRequest("GET", "/fail", nil)
+	if requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var res ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return w, res
+}
+
+func TestErrorStatusAndCode(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   errors.Code
+	}{
+		{
+			name:           "validation",
+			err:            errors.NewSymbolRequired(),
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   errors.CodeValidation,
+		},
+		{
+			name:           "filter",
+			err:            errors.NewFilterError("BTCUSDT", "MIN_NOTIONAL", "too small"),
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   errors.CodeFilter,
+		},
+		{
+			name:           "wrapped not found",
+			err:            fmt.Errorf("get user: %w", errors.NewUnknownUser("id")),
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   errors.CodeNotFound,
+		},
+		{
+			name:           "margin insufficient",
+			err:            &common.APIError{Code: -2019, Message: "Margin is insufficient."},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   errors.CodeInsufficientBalance,
+		},
+		{
+			name:           "unknown order",
+			err:            &common.APIError{Code: -2013, Message: "Order does not exist."},
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   errors.CodeNotFound,
+		},
+		{
+			name:           "invalid api key",
+			err:            &common.APIError{Code: -2015, Message: "Invalid API-key, IP, or permissions for action."},
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   errors.CodeExchangeUnauthorized,
+		},
+		{
+			name:           "unlisted bad parameter",
+			err:            &common.APIError{Code: -1111, Message: "Precision is over the maximum defined for this asset."},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   errors.CodeExchangeRejected,
+		},
+		{
+			name:           "unlisted order rejection",
+			err:            &common.APIError{Code: -4003, Message: "Quantity less than zero."},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   errors.CodeExchangeRejected,
+		},
+		{
+			name:           "binance timeout",
+			err:            &common.APIError{Code: -1007, Message: "Timeout waiting for response from backend server."},
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedCode:   errors.CodeUpstreamTimeout,
+		},
+		{
+			name:           "stale price",
+			err:            errors.NewStaleData("BTCUSDT", time.Minute),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   errors.CodeStaleData,
+		},
+		{
+			name:           "slippage exceeded",
+			err:            &errors.SlippageError{Symbol: "BTCUSDT", MaxSlippageBps: 10, ExpectedSlippageBps: 25, ReferencePrice: "60000", ExpectedAvgPrice: "60150"},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   errors.CodeSlippageExceeded,
+		},
+		{
+			name:           "internal",
+			err:            fmt.Errorf("open /var/lib/vault.json: permission denied"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   errors.CodeInternal,
+		},
+	}
+
+	for _, tc := range tests {
+		w, res := serveError(t, tc.err, "")
+		assert.Equal(t, tc.expectedStatus, w.Code, tc.name)
+		assert.Equal(t, tc.expectedCode, res.Code, tc.name)
+		assert.Equal(t, w.Header().Get(requestIDHeader), res.RequestID, tc.name)
+		assert.NotEmpty(t, res.RequestID, tc.name)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	w, res := serveError(t, &common.APIError{Code: -2019, Message: "Margin is insufficient."}, "req-1")
+	assert.Equal(t, "req-1", res.RequestID, "client's request ID")
+	assert.Equal(t, "binance error -2019: Margin is insufficient.", res.Error)
+	assert.Equal(t, map[string]interface{}{"code": float64(-2019), "msg": "Margin is insufficient."}, res.Details)
+
+	_, res = serveError(t, fmt.Errorf("open /var/lib/vault.json: permission denied"), "bad\nid")
+	assert.NotEqual(t, "bad\nid", res.RequestID, "invalid request ID")
+	assert.Equal(t, "internal server error", res.Error, "internal error not exposed")
+	assert.Nil(t, res.Details)
+
+	w, _ = serveError(t, errors.NewRateLimitError("REQUEST_WEIGHT", 1500*time.Millisecond), "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
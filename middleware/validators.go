@@ -1,35 +1,257 @@
 package middleware
 
 import (
-	"net/http"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
 
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/bosdhill/golang-binance-service/libs/store"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 )
 
-func Validator(c *gin.Context) {
-	obj := c.Request.Body
-	if err := c.ShouldBindJSON(&obj); err == nil {
-		validate := validator.New()
-		if err := validate.Struct(&obj); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			c.Abort()
+var userType = reflect.TypeOf(models.User{})
+
+// Validator validates the request bodies against the validate tags of the
+// models, before the handlers bind them.
+type Validator struct {
+	validate *validator.Validate
+	symbols  store.SymbolInfoSource
+}
+
+// NewValidator returns a validator checking that the order symbols exist in
+// symbols. The symbols aren't checked if it's nil.
+func NewValidator(symbols store.SymbolInfoSource) *Validator {
+	v := &Validator{validate: validator.New(), symbols: symbols}
+
+	// The fields are reported by their json name, which is what the client
+	// sent
+	v.validate.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	v.validate.RegisterValidation("side", validateSide)
+	v.validate.RegisterValidation("percentage", validatePercentage)
+	v.validate.RegisterValidation("symbol", v.validateSymbol)
+	v.validate.RegisterStructValidation(validateOrder, models.Order{})
+	return v
+}
+
+// Body validates the request body against the schema, the model the handler
+// binds the body to, and aborts the request with a bad request listing the
+// invalid fields, see Errors. The body is restored after it's read so the
+// handler can still bind it.
+//
+// If the request is authenticated as a stored user the credentials aren't
+// validated, since they're replaced by the stored user's, and the body can be
+// empty.
+func (v *Validator) Body(schema interface{}) gin.HandlerFunc {
+	typ := reflect.TypeOf(schema)
+	return func(c *gin.Context) {
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(c.Request.Body)
+			if err != nil {
+				Error(c, errors.NewInvalidBody(err))
+				return
+			}
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		_, _, stored := StoredUser(c)
+		if stored && typ == userType {
+			c.Next()
+			return
+		}
+
+		obj := reflect.New(typ)
+		if !stored || len(body) != 0 {
+			err := json.Unmarshal(body, obj.Interface())
+			if err != nil {
+				Error(c, decodeError(err))
+				return
+			}
+		}
+
+		var err error
+		if stored {
+			err = v.validate.StructExcept(obj.Interface(), userFields(typ)...)
+		} else {
+			err = v.validate.Struct(obj.Interface())
+		}
+		if err != nil {
+			fieldErrs, ok := err.(validator.ValidationErrors)
+			if !ok {
+				Error(c, err)
+				return
+			}
+			Error(c, validationErrors(typ, fieldErrs))
 			return
 		}
+
+		c.Next()
 	}
-	c.Next()
 }
 
-func OrderRequestValidator(c *gin.Context) {
-	// TODO
+// decodeError returns the field with the wrong type if the body couldn't be
+// decoded because of it, otherwise that the body is invalid.
+func decodeError(err error) error {
+	typeErr, ok := err.(*json.UnmarshalTypeError)
+	if !ok || typeErr.Field == "" {
+		return errors.NewInvalidBody(err)
+	}
+	return errors.ValidationErrors{{
+		Field:  typeErr.Field,
+		Reason: fmt.Sprintf("must be a %s", typeErr.Type.Kind()),
+	}}
 }
 
-func BalanceRequestValidator(c *gin.Context) {
-	// TODO
+// validationErrors returns the invalid fields of the schema.
+func validationErrors(typ reflect.Type, fieldErrs validator.ValidationErrors) errors.ValidationErrors {
+	var errs errors.ValidationErrors
+	for _, fieldErr := range fieldErrs {
+		errs = append(errs, &errors.ValidationError{
+			Field:  fieldPath(typ, fieldErr.StructNamespace()),
+			Reason: reason(fieldErr),
+		})
+	}
+	return errs
 }
 
-func AccountRequestValidator(c *gin.Context) {
-	// TODO
+// fieldPath returns the json path of the field from its namespace, e.g.
+// Bot.Order.Price is order.price. The schema's name and embedded structs are
+// left out since they aren't part of the json.
+func fieldPath(typ reflect.Type, namespace string) string {
+	var path []string
+	for _, name := range strings.Split(namespace, ".")[1:] {
+		if typ.Kind() != reflect.Struct {
+			path = append(path, name)
+			continue
+		}
+		index := ""
+		if i := strings.Index(name, "["); i != -1 {
+			name, index = name[:i], name[i:]
+		}
+		f, ok := typ.FieldByName(name)
+		if !ok {
+			path = append(path, name+index)
+			continue
+		}
+		typ = f.Type
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+			typ = typ.Elem()
+		}
+		if f.Anonymous {
+			continue
+		}
+		if jsonName := strings.Split(f.Tag.Get("json"), ",")[0]; jsonName != "" {
+			name = jsonName
+		}
+		path = append(path, name+index)
+	}
+	return strings.Join(path, ".")
+}
+
+// reason returns why the field is invalid.
+func reason(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "oneof":
+		return fmt.Sprintf("must be one of %s", strings.ReplaceAll(fieldErr.Param(), " ", ", "))
+	case "min":
+		return fmt.Sprintf("must be at least %s", fieldErr.Param())
+	case "max":
+		switch fieldErr.Kind() {
+		case reflect.Slice:
+			return fmt.Sprintf("must have at most %s items", fieldErr.Param())
+		case reflect.String:
+			return fmt.Sprintf("must be at most %s characters", fieldErr.Param())
+		}
+		return fmt.Sprintf("must be at most %s", fieldErr.Param())
+	case "side":
+		return "must be BUY or SELL"
+	case "percentage":
+		return "must be greater than 0 and at most 1"
+	case "symbol":
+		return "unknown symbol"
+	case "market":
+		return "is only allowed for MARKET orders"
+	}
+	return fmt.Sprintf("failed the %s validation", fieldErr.Tag())
+}
+
+// userFields returns the names of the schema's credentials fields.
+func userFields(typ reflect.Type) []string {
+	var fields []string
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).Type == userType {
+			fields = append(fields, typ.Field(i).Name)
+		}
+	}
+	return fields
+}
+
+// validateSide validates the order side is BUY or SELL.
+func validateSide(fl validator.FieldLevel) bool {
+	side := futures.SideType(fl.Field().String())
+	return side == futures.SideTypeBuy || side == futures.SideTypeSell
+}
+
+// validatePercentage validates the percentage of the balance is in (0, 1].
+func validatePercentage(fl validator.FieldLevel) bool {
+	p := fl.Field().Float()
+	return p > 0 && p <= 1
+}
+
+// validateSymbol validates the symbol exists in the exchange info.
+func (v *Validator) validateSymbol(fl validator.FieldLevel) bool {
+	if v.symbols == nil {
+		return true
+	}
+	_, ok := v.symbols.GetSymbol(fl.Field().String())
+	return ok
+}
+
+// validateOrder validates the fields required by the order's type: the
+// percentage for every type unless the order closes the position, the price
+// for LIMIT orders and the stop price for STOP_MARKET orders. The slippage
+// guard and sizing price are only allowed for MARKET orders.
+func validateOrder(sl validator.StructLevel) {
+	order := sl.Current().Interface().(models.Order)
+
+	if order.Percentage == 0 && !(order.Type == futures.OrderTypeStopMarket && order.ClosePosition) {
+		sl.ReportError(order.Percentage, "percentage", "Percentage", "required", "")
+	}
+	switch order.Type {
+	case futures.OrderTypeLimit:
+		if order.Price == "" {
+			sl.ReportError(order.Price, "price", "Price", "required", "")
+		}
+	case futures.OrderTypeStopMarket:
+		if order.StopPrice == "" {
+			sl.ReportError(order.StopPrice, "stopPrice", "StopPrice", "required", "")
+		}
+	}
+	if order.Type != futures.OrderTypeMarket {
+		if order.MaxSlippageBps != 0 {
+			sl.ReportError(order.MaxSlippageBps, "maxSlippageBps", "MaxSlippageBps", "market", "")
+		}
+		if order.SlippageAction != "" {
+			sl.ReportError(order.SlippageAction, "slippageAction", "SlippageAction", "market", "")
+		}
+		if order.SizingPrice != "" {
+			sl.ReportError(order.SizingPrice, "sizingPrice", "SizingPrice", "market", "")
+		}
+	}
 }
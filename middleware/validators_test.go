@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adshao/go-binance/v2/futures"
+	"github.com/bosdhill/golang-binance-service/core/errors"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSymbols is a symbol info source with only BTCUSDT.
+type fakeSymbols struct{}
+
+func (fakeSymbols) GetSymbol(symbol string) (futures.Symbol, bool) {
+	return futures.Symbol{Symbol: symbol}, symbol == "BTCUSDT"
+}
+
+// newTestRouter returns a router validating the order and bracket order
+// bodies, whose handlers respond with the body they bound.
+func newTestRouter(stored bool) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Errors())
+	v := NewValidator(fakeSymbols{})
+	if stored {
+		r.Use(func(c *gin.Context) {
+			c.Set(userIDKey, "id")
+			c.Set(userKey, &models.User{APIKey: "apikey", APISecret: "apisecret"})
+		})
+	}
+	echo := func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	}
+	r.GET("/balance", v.Body(models.User{}), echo)
+	r.POST("/order", v.Body(models.Bot{}), echo)
+	r.POST("/order/bracket", v.Body(models.BracketBot{}), echo)
+	return r
+}
+
+func serve(r *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// invalidFields returns the invalid fields of the bad request by field name.
+func invalidFields(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+	var res struct {
+		Details []*errors.ValidationError `json:"details"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]string)
+	for _, f := range res.Details {
+		fields[f.Field] = f.Reason
+	}
+	return fields
+}
+
+const user = `"user":{"api_key":"apikey","api_secret":"apisecret"}`
+
+func TestValidateOrder(t *testing.T) {
+	r := newTestRouter(false)
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedFields map[string]string
+	}{
+		{
+			name: "market order",
+			body: `{` + user + `,"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5}}`,
+		},
+		{
+			name: "close position stop market order",
+			body: `{` + user + `,"order":{"type":"STOP_MARKET","symbol":"BTCUSDT","side":"SELL","stopPrice":"100","closePosition":true}}`,
+		},
+		{
+			name:           "missing credentials",
+			body:           `{"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5}}`,
+			expectedFields: map[string]string{"user.api_key": "is required", "user.api_secret": "is required"},
+		},
+		{
+			name: "invalid side, percentage and symbol",
+			body: `{` + user + `,"order":{"type":"MARKET","symbol":"FOOUSDT","side":"HOLD","percentage":1.5}}`,
+			expectedFields: map[string]string{
+				"order.symbol":     "unknown symbol",
+				"order.side":       "must be BUY or SELL",
+				"order.percentage": "must be greater than 0 and at most 1",
+			},
+		},
+		{
+			name:           "limit order without price",
+			body:           `{` + user + `,"order":{"type":"LIMIT","symbol":"BTCUSDT","side":"BUY","percentage":0.5}}`,
+			expectedFields: map[string]string{"order.price": "is required"},
+		},
+		{
+			name: "market order with slippage guard",
+			body: `{` + user + `,"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5,"maxSlippageBps":50,"slippageAction":"LIMIT_IOC"}}`,
+		},
+		{
+			name: "limit order with slippage guard",
+			body: `{` + user + `,"order":{"type":"LIMIT","symbol":"BTCUSDT","side":"BUY","percentage":0.5,"price":"100","maxSlippageBps":50,"slippageAction":"REJECT"}}`,
+			expectedFields: map[string]string{
+				"order.maxSlippageBps": "is only allowed for MARKET orders",
+				"order.slippageAction": "is only allowed for MARKET orders",
+			},
+		},
+		{
+			name: "market order with invalid slippage guard",
+			body: `{` + user + `,"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5,"maxSlippageBps":5000,"slippageAction":"CANCEL"}}`,
+			expectedFields: map[string]string{
+				"order.maxSlippageBps": "must be at most 1000",
+				"order.slippageAction": "must be one of REJECT, LIMIT_IOC",
+			},
+		},
+		{
+			name: "market order sized at the mark price",
+			body: `{` + user + `,"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5,"sizingPrice":"MARK"}}`,
+		},
+		{
+			name: "invalid sizing price",
+			body: `{` + user + `,"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5,"sizingPrice":"INDEX"}}`,
+			expectedFields: map[string]string{
+				"order.sizingPrice": "must be one of LAST, MARK",
+			},
+		},
+		{
+			name: "limit order with sizing price",
+			body: `{` + user + `,"order":{"type":"LIMIT","symbol":"BTCUSDT","side":"BUY","percentage":0.5,"price":"100","sizingPrice":"MARK"}}`,
+			expectedFields: map[string]string{
+				"order.sizingPrice": "is only allowed for MARKET orders",
+			},
+		},
+		{
+			name:           "stop market order without stop price",
+			body:           `{` + user + `,"order":{"type":"STOP_MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5}}`,
+			expectedFields: map[string]string{"order.stopPrice": "is required"},
+		},
+		{
+			name:           "unsupported type",
+			body:           `{` + user + `,"order":{"type":"TRAILING_STOP_MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5}}`,
+			expectedFields: map[string]string{"order.type": "must be one of MARKET, LIMIT, STOP_MARKET"},
+		},
+		{
+			name:           "wrong type",
+			body:           `{` + user + `,"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":"half"}}`,
+			expectedFields: map[string]string{"order.percentage": "must be a float64"},
+		},
+	}
+
+	for _, tc := range tests {
+		w := serve(r, "POST", "/order", tc.body)
+		if tc.expectedFields == nil {
+			assert.Equal(t, http.StatusOK, w.Code, tc.name)
+			assert.Equal(t, tc.body, w.Body.String(), tc.name+": body restored")
+			continue
+		}
+		assert.Equal(t, http.StatusBadRequest, w.Code, tc.name)
+		assert.Equal(t, tc.expectedFields, invalidFields(t, w), tc.name)
+	}
+}
+
+func TestValidateBracketOrder(t *testing.T) {
+	r := newTestRouter(false)
+
+	w := serve(r, "POST", "/order/bracket", `{`+user+`,"order":{"type":"LIMIT","symbol":"BTCUSDT","side":"BUY","percentage":0.5,"takeProfitPrice":"110"}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{
+		"order.price":         "is required",
+		"order.stopLossPrice": "is required",
+	}, invalidFields(t, w), "embedded order fields")
+}
+
+func TestValidateStoredUser(t *testing.T) {
+	r := newTestRouter(true)
+
+	w := serve(r, "GET", "/balance", "")
+	assert.Equal(t, http.StatusOK, w.Code, "credentials not required")
+
+	w = serve(r, "POST", "/order", `{"order":{"type":"MARKET","symbol":"BTCUSDT","side":"BUY","percentage":0.5}}`)
+	assert.Equal(t, http.StatusOK, w.Code, "order without credentials")
+
+	w = serve(r, "POST", "/order", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "order required")
+	assert.Contains(t, invalidFields(t, w), "order.type")
+}
@@ -1,7 +1,33 @@
 package v1
 
-import "github.com/gin-gonic/gin"
+import (
+	binance "github.com/bosdhill/golang-binance-service/libs/binancewrapper"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
+	"github.com/bosdhill/golang-binance-service/middleware/auth"
+	"github.com/gin-gonic/gin"
+)
 
-func InitRoutes(g *gin.RouterGroup) {
-	SetUserRoutes(g)
+func InitRoutes(
+	g *gin.RouterGroup,
+	a *auth.Authenticator,
+	exchange binance.ExchangeFactory,
+	limiter *ratelimit.Limiter,
+	clock *clock.Clock,
+	v *vault.Vault,
+	tickers store.TickerSource,
+	symbols store.SymbolListSource,
+	klines store.KlineSource,
+	funding store.FundingSource,
+	hub *marketstream.Hub,
+	stores map[string]store.HealthSource,
+) {
+	SetUserRoutes(g, a, exchange, v, symbols)
+	SetUsersRoutes(g, a, v)
+	SetMarketRoutes(g, a, tickers, symbols, klines, funding)
+	SetStreamRoutes(g, a, hub, symbols)
+	SetMetricsRoutes(g, a, limiter, clock, stores)
 }
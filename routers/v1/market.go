@@ -0,0 +1,26 @@
+package v1
+
+import (
+	"github.com/bosdhill/golang-binance-service/controllers/v1/market"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/middleware/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func SetMarketRoutes(
+	rg *gin.RouterGroup,
+	a *auth.Authenticator,
+	tickers store.TickerSource,
+	symbols store.SymbolListSource,
+	klines store.KlineSource,
+	funding store.FundingSource,
+) {
+	m := market.NewController(tickers, symbols, klines, funding)
+
+	rg.GET("market/symbols", a.Require(auth.ScopeRead), m.GetSymbols, gin.Logger())
+	rg.GET("market/ticker/:symbol", a.Require(auth.ScopeRead), m.GetTicker, gin.Logger())
+	rg.GET("market/tickers", a.Require(auth.ScopeRead), m.GetTickers, gin.Logger())
+	rg.GET("market/klines", a.Require(auth.ScopeRead), m.GetKlines, gin.Logger())
+	rg.GET("market/funding", a.Require(auth.ScopeRead), m.GetFunding, gin.Logger())
+	rg.GET("market/funding/history", a.Require(auth.ScopeRead), m.GetFundingHistory, gin.Logger())
+}
@@ -0,0 +1,26 @@
+package v1
+
+import (
+	"github.com/bosdhill/golang-binance-service/controllers/v1/metrics"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/clock"
+	"github.com/bosdhill/golang-binance-service/libs/binancewrapper/ratelimit"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/middleware/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func SetMetricsRoutes(
+	rg *gin.RouterGroup,
+	a *auth.Authenticator,
+	limiter *ratelimit.Limiter,
+	clock *clock.Clock,
+	stores map[string]store.HealthSource,
+) {
+	m := metrics.NewController(limiter, clock, stores)
+
+	// The readiness check is public so it can be probed without credentials
+	rg.GET("ready", m.Ready)
+
+	rg.GET("metrics/ratelimit", a.Require(auth.ScopeAdmin), m.GetRateLimits, gin.Logger())
+	rg.GET("metrics/clock", a.Require(auth.ScopeAdmin), m.GetClock, gin.Logger())
+}
@@ -0,0 +1,20 @@
+package v1
+
+import (
+	"github.com/bosdhill/golang-binance-service/controllers/v1/stream"
+	"github.com/bosdhill/golang-binance-service/libs/marketstream"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/middleware/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func SetStreamRoutes(
+	rg *gin.RouterGroup,
+	a *auth.Authenticator,
+	hub *marketstream.Hub,
+	symbols store.SymbolInfoSource,
+) {
+	s := stream.NewController(hub, symbols)
+
+	rg.GET("stream/tickers", a.Require(auth.ScopeRead), s.StreamTickers, gin.Logger())
+}
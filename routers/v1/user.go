@@ -2,13 +2,43 @@ package v1
 
 import (
 	user "github.com/bosdhill/golang-binance-service/controllers/v1/user"
+	"github.com/bosdhill/golang-binance-service/core/models"
+	binance "github.com/bosdhill/golang-binance-service/libs/binancewrapper"
+	"github.com/bosdhill/golang-binance-service/libs/store"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
 	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/bosdhill/golang-binance-service/middleware/auth"
 	"github.com/gin-gonic/gin"
 )
 
-func SetUserRoutes(rg *gin.RouterGroup) {
+func SetUserRoutes(
+	rg *gin.RouterGroup,
+	a *auth.Authenticator,
+	exchange binance.ExchangeFactory,
+	v *vault.Vault,
+	symbols store.SymbolInfoSource,
+) {
+	u := user.NewController(exchange)
+
+	// Requests with a bearer token are made as the stored user, otherwise with
+	// the credentials in the body
+	credentials := middleware.Credentials(v)
+
+	// The bodies are validated after the credentials so the stored user's
+	// requests aren't required to have credentials in the body
+	validator := middleware.NewValidator(symbols)
+
 	rg.GET("user/ping", user.Ping, gin.Logger())
-	rg.GET("user/balance", user.GetBalance, gin.Logger(), middleware.Validator)
-	rg.GET("user/account", user.GetAccount, gin.Logger(), middleware.Validator)
-	rg.POST("user/order", user.CreateOrder, gin.Logger(), middleware.Validator)
+	rg.GET("user/balance", a.Require(auth.ScopeRead), credentials, validator.Body(models.User{}), u.GetBalance, gin.Logger())
+	rg.GET("user/account", a.Require(auth.ScopeRead), credentials, validator.Body(models.User{}), u.GetAccount, gin.Logger())
+	rg.POST("user/order", a.Require(auth.ScopeTrade), credentials, validator.Body(models.Bot{}), u.CreateOrder, gin.Logger())
+	rg.POST("user/order/bracket", a.Require(auth.ScopeTrade), credentials, validator.Body(models.BracketBot{}), u.CreateBracketOrder, gin.Logger())
+	rg.GET("user/order/:id", a.Require(auth.ScopeRead), credentials, validator.Body(models.User{}), u.GetOrder, gin.Logger())
+	rg.DELETE("user/order/:id", a.Require(auth.ScopeTrade), credentials, validator.Body(models.User{}), u.CancelOrder, gin.Logger())
+	rg.GET("user/orders", a.Require(auth.ScopeRead), credentials, validator.Body(models.User{}), u.ListOrders, gin.Logger())
+	rg.DELETE("user/orders", a.Require(auth.ScopeTrade), credentials, validator.Body(models.OrderCancellation{}), u.CancelOrders, gin.Logger())
+	rg.GET("user/positions", a.Require(auth.ScopeRead), credentials, validator.Body(models.User{}), u.ListPositions, gin.Logger())
+	rg.POST("user/positions/close", a.Require(auth.ScopeTrade), credentials, validator.Body(models.User{}), u.ClosePositions, gin.Logger())
+	rg.GET("user/position-mode", a.Require(auth.ScopeRead), credentials, validator.Body(models.User{}), u.GetPositionMode, gin.Logger())
+	rg.PUT("user/position-mode", a.Require(auth.ScopeTrade), credentials, validator.Body(models.PositionMode{}), u.ChangePositionMode, gin.Logger())
 }
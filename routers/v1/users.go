@@ -0,0 +1,18 @@
+package v1
+
+import (
+	"github.com/bosdhill/golang-binance-service/controllers/v1/users"
+	"github.com/bosdhill/golang-binance-service/libs/vault"
+	"github.com/bosdhill/golang-binance-service/middleware"
+	"github.com/bosdhill/golang-binance-service/middleware/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func SetUsersRoutes(rg *gin.RouterGroup, a *auth.Authenticator, v *vault.Vault) {
+	u := users.NewController(v)
+	credentials := middleware.Credentials(v)
+
+	rg.POST("users", a.Require(auth.ScopeAdmin), u.Register, gin.Logger())
+	rg.PUT("users/:id/keys", a.Require(auth.ScopeAdmin), credentials, u.RotateKeys, gin.Logger())
+	rg.DELETE("users/:id", a.Require(auth.ScopeAdmin), credentials, u.DeleteUser, gin.Logger())
+}